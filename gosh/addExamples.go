@@ -91,6 +91,21 @@ func addExamples(ps *param.PSet) error {
 			"\n\n"+
 			"-w-pln writes to the new, edited copy of the file")
 
+	ps.AddExample(
+		`gosh -csv -csv-header`+
+			` -b 'total := 0.0'`+
+			` -e 'v, _ := strconv.ParseFloat(_rec[_hdr["price"]], 64)'`+
+			` -e 'total += v'`+
+			` -a-pln 'total'`+
+			` -- prices.csv`,
+		"This reads the CSV file prices.csv and prints the total of"+
+			" the values in the 'price' column"+
+			"\n\n"+
+			"-csv sets up the loop reading CSV records into _rec"+
+			"\n\n"+
+			"-csv-header treats the first record as a header and sets"+
+			" up the _hdr map from column name to field index")
+
 	ps.AddExample(`gosh -http-handler 'http.FileServer(http.Dir("/tmp/xxx"))'`,
 		"This runs a web server that serves files from /tmp/xxx.")
 
@@ -15,10 +15,12 @@ const (
 	noteSnippets            = "Gosh - snippets"
 	noteSnippetsComments    = "Gosh - snippet comments"
 	noteSnippetsDirs        = "Gosh - snippet directories"
+	noteSnippetParams       = "Gosh - snippet parameters"
 	noteCodeSections        = "Gosh - code sections"
 	noteShebangScripts      = "Gosh - shebang scripts"
 	noteShebangScriptParams = "Gosh - shebang script parameters"
 	noteGoshExitStatus      = "Gosh - exit status values"
+	noteBuildCache          = "Gosh - build cache"
 )
 
 // alternativeSnippetPartNames returns a string describing alternative names
@@ -47,6 +49,20 @@ func addNotes(ps *param.PSet) error {
 			" there are no duplicate filenames. If any of these checks"+
 			" fails the program aborts with an error message."+
 			"\n\n"+
+			"The check for a pre-existing copy of the original file"+
+			" depends on the backup mode (see"+
+			" '-"+paramNameBackupMode+"'). With a different backup"+
+			" suffix it is that suffix which is checked, with a backup"+
+			" directory it is the copy in that directory and with"+
+			" numbered or timestamped backups, or no backups at all,"+
+			" there is no check."+
+			"\n\n"+
+			"If the edited contents of a file are the same as the"+
+			" original contents the file is left alone and no backup"+
+			" copy is made. To see what an edit would change without"+
+			" changing anything, use the"+
+			" '-"+paramNameIPEDryRun+"' parameter."+
+			"\n\n"+
 			"If '-"+paramNameInPlaceEdit+"' is given then some"+
 			" filenames must be supplied"+
 			" (after '"+ps.TerminalParam()+"')."+
@@ -54,7 +70,8 @@ func addNotes(ps *param.PSet) error {
 			" After you have run this edit program you could use the"+
 			" findCmpRm program to check that the changes were as"+
 			" expected",
-		param.NoteSeeParam(paramNameInPlaceEdit))
+		param.NoteSeeParam(paramNameInPlaceEdit, paramNameBackupMode,
+			paramNameIPEDryRun))
 
 	ps.AddNote(noteArgsToScript,
 		"Arguments can be supplied to the generated program. These can be"+
@@ -78,7 +95,8 @@ func addNotes(ps *param.PSet) error {
 			"- If the program is being generated to perform in-place"+
 			" editing (see the parameter '"+paramNameInPlaceEdit+"') then"+
 			" an error is reported if a file with the same name plus"+
-			" a '"+origExt+"' extension exists.")
+			" a '"+origExt+"' extension exists (but see the"+
+			" '"+paramNameBackupMode+"' parameter).")
 
 	ps.AddNote(noteVars,
 		"gosh will create some variables as it builds the program."+
@@ -181,8 +199,49 @@ func addNotes(ps *param.PSet) error {
 			"   'Env'      for an environment variable the snippet uses"+
 			"\n"+
 			"   'Declares' for a variable that it declares."+
+			"\n\n"+
+			"The '"+snippetParamTag+"' and '"+snippetExpectsVarTag+"'"+
+			" tags are the exceptions, they have meaning to gosh. The"+
+			" first declares a snippet parameter and the second"+
+			" declares a variable that the snippet uses but which the"+
+			" user must provide (this is used when the snippets are"+
+			" checked)."+
 			alternativeSnippetPartNames(snippet.TagPart),
-		param.NoteSeeNote(noteSnippets))
+		param.NoteSeeNote(noteSnippets, noteSnippetParams))
+
+	ps.AddNote(noteSnippetParams,
+		"A snippet can declare parameters which are replaced by values"+
+			" given when the snippet is used. This means that the"+
+			" snippet need not rely on the user's code having"+
+			" variables with particular names."+
+			"\n\n"+
+			"A parameter is declared with a snippet comment giving a"+
+			" '"+snippetParamTag+"' tag. The tag value is the parameter"+
+			" name, optionally followed by '=' and a default value, and"+
+			" then a description. For instance:"+
+			"\n\n"+
+			"// "+snippet.CommentStr+" "+snippet.TagStr+" "+
+			snippetParamTag+": num=a the value to show"+
+			"\n\n"+
+			"Every occurrence of the parameter name in double braces"+
+			" (for instance '{{num}}') in the snippet text is replaced"+
+			" by the value of the parameter."+
+			"\n\n"+
+			"Values are given after the snippet name, separated by"+
+			" commas. For instance:"+
+			"\n\n"+
+			"-exec-snippet perc"+snippetArgSep+"num=hits"+
+			snippetArgSep+"den=total"+
+			"\n\n"+
+			"A value can itself contain commas, only a comma which is"+
+			" followed by a parameter name and '=' starts the next"+
+			" value."+
+			"\n\n"+
+			"It is an error to give a value for a parameter that the"+
+			" snippet does not declare or to give no value for a"+
+			" parameter that has no default. The parameters are shown"+
+			" when the snippets are listed.",
+		param.NoteSeeNote(noteSnippets, noteSnippetsComments))
 
 	ps.AddNote(noteSnippetsDirs,
 		"By default snippets will be searched for in standard"+
@@ -200,19 +259,32 @@ func addNotes(ps *param.PSet) error {
 			" sections and you can add code to these sections."+
 			" The sections are:"+
 			"\n\n"+
-			globalSect+"       - code at global scope, outside of main\n"+
-			beforeSect+"       - code at the start of the program\n"+
-			beforeInnerSect+" - code before any inner loop\n"+
-			execSect+"         - code, maybe in a readloop/web handler\n"+
-			afterInnerSect+"  - code after any inner loop\n"+
-			afterSect+"        - code at the end of the program"+
+			globalSect+"         - code at global scope, outside of main\n"+
+			beforeSect+"         - code at the start of the program\n"+
+			beforeInnerSect+"   - code before any inner loop\n"+
+			execSect+"           - code, maybe in a readloop/web handler\n"+
+			afterInnerSect+"    - code after any inner loop\n"+
+			afterSect+"          - code at the end of the program\n"+
+			afterShutdownSect+" - code run after a webserver"+
+			" has shut down\n"+
+			middlewareSect+"     - middleware wrapping the webserver"+
+			" handler"+
 			"\n\n"+
 			"The ...inner sections are only useful if you have some inner"+
 			" loop - where you are looping over a list of files and"+
 			" reading each one. Otherwise they just appear immediately"+
 			" before or after their corresponding sections. "+
 			beforeInnerSect+" appears after "+beforeSect+
-			" and "+afterInnerSect+" appears before "+afterSect)
+			" and "+afterInnerSect+" appears before "+afterSect+
+			"\n\n"+
+			"The "+afterShutdownSect+" section is only used when"+
+			" running as a webserver. It is run once the webserver"+
+			" has shut down after being interrupted. The "+
+			middlewareSect+" section is also only used when running"+
+			" as a webserver. It is not a sequence of statements,"+
+			" each entry is a Go expression of type"+
+			" 'func(http.Handler) http.Handler' which wraps the"+
+			" webserver's handler.")
 
 	ps.AddNote(noteShebangScripts,
 		"You can use gosh in shebang scripts (executable files"+
@@ -238,12 +310,18 @@ func addNotes(ps *param.PSet) error {
 			" passed on the '#!' line which must only contain"+
 			" the gosh command and -"+paramNameExecFile+"."+
 			" The parameters must be given on lines immediately after"+
-			" the '#!' line and must start with '"+shebangGoshParam+"'.",
+			" the '#!' line and must start with '"+shebangGoshParam+"'."+
+			"\n\n"+
+			"The program built from a shebang script can be kept in"+
+			" the build cache so that it can be run without being"+
+			" rebuilt the next time the script is run. To do this"+
+			" give the '"+paramNameBuildCache+"' parameter on a"+
+			" '"+shebangGoshParam+"' line.",
 		param.NoteSeeParam(
 			paramNameBeforeFile, paramNameExecFile,
 			paramNameAfterFile, paramNameGlobalFile,
 			paramNameInnerBeforeFile, paramNameInnerAfterFile),
-		param.NoteSeeNote(noteShebangScriptParams),
+		param.NoteSeeNote(noteShebangScriptParams, noteBuildCache),
 	)
 
 	ps.AddNote(noteShebangScriptParams,
@@ -312,11 +390,56 @@ func addNotes(ps *param.PSet) error {
 		param.NoteSeeNote(noteShebangScripts),
 		param.NoteAttrs(param.DontShowNoteInStdUsage))
 
+	ps.AddNote(noteBuildCache,
+		"If the build cache is in use (see the"+
+			" '"+paramNameBuildCache+"' parameter) then each program"+
+			" that gosh builds is saved in the cache and the next time"+
+			" the same program is wanted the saved copy is run"+
+			" directly. This saves the time taken to populate the"+
+			" imports, tidy the module files and build the program."+
+			"\n\n"+
+			"The cached program is found using a hash of the generated"+
+			" code, any copied files, the local module and workspace"+
+			" settings, the build arguments, the importer settings,"+
+			" the version of Go and some environment variables which"+
+			" affect the build. Note that changes to the contents of"+
+			" any local modules or workspace directories are not"+
+			" detected. Nor are new releases of any modules the program"+
+			" uses. You can clear the cache"+
+			" (with '"+paramNameBuildCacheClear+"') to force these"+
+			" changes to be picked up."+
+			"\n\n"+
+			"For programs built from shebang scripts the cache is"+
+			" checked before the program is constructed, using a"+
+			" hash of the script pathnames and contents, the"+
+			" pathnames and contents of any embedded files, snippets,"+
+			" copied files and files giving code, the contents of any"+
+			" local module or workspace directories and of the gosh"+
+			" configuration files, the gosh arguments, the versions"+
+			" of gosh and of Go and the same environment variables."+
+			" These are checked again before the cached program is"+
+			" run. This means that a cached script starts almost as"+
+			" quickly as the program itself. When any of these files"+
+			" is changed, created or removed, or gosh or Go is"+
+			" updated, the old entry will never be used again. You"+
+			" can list these stale entries"+
+			" (with '"+paramNameBuildCacheStale+"') and remove them by"+
+			" also clearing the cache."+
+			"\n\n"+
+			"Each time a program is added to the cache any entries"+
+			" which have not been used for longer than the maximum age"+
+			" are removed. Then, if the cache is bigger than the"+
+			" maximum size, the least recently used entries are"+
+			" removed until it is not.",
+		param.NoteSeeParam(buildCacheParamNames...))
+
 	ps.AddNote(noteGoshExitStatus,
 		"if gosh has a problem when building the program it will exit"+
 			" with a non-zero exit status. Otherwise it will exit with"+
-			" the exit status of the generated program (unless it was"+
-			" ended by a signal). Also, if gosh is in a loop where"+
+			" the exit status of the generated program. If the program"+
+			" was ended by a signal gosh will exit with "+
+			strconv.Itoa(signalExitBase)+" plus the signal number, as"+
+			" the shell would. Also, if gosh is in a loop where"+
 			" it edits the program repeatedly it will not exit when the"+
 			" program exits and so the exit status will be lost. Various"+
 			" exit statuses indicate different problems."+
@@ -332,7 +455,16 @@ func addNotes(ps *param.PSet) error {
 			" that some other gosh stage has failed"+
 			"\n"+
 			"- "+strconv.Itoa(goshExitStatusRunFail)+": indicates"+
-			" that the built executable could not be run")
+			" that the built executable could not be run"+
+			"\n"+
+			"- "+strconv.Itoa(goshExitStatusRunLimit)+": indicates"+
+			" that the program was stopped because it reached the"+
+			" timeout or its CPU time limit"+
+			"\n"+
+			"- "+strconv.Itoa(goshExitStatusSnippetCheck)+": indicates"+
+			" that some snippets were found to be broken when the"+
+			" snippets were checked (using the"+
+			" '"+paramNameSnippetCheck+"' parameter)")
 
 	return nil
 }
@@ -6,8 +6,11 @@ import (
 	"go/token"
 	"math"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/nickwells/check.mod/v2/check"
 	"github.com/nickwells/filecheck.mod/filecheck"
@@ -62,6 +65,44 @@ const (
 	paramNameSplitLine    = "split-line"
 	paramNameSplitPattern = "split-pattern"
 
+	paramNameCSV           = "csv"
+	paramNameTSV           = "tsv"
+	paramNameCSVDelimiter  = "csv-delimiter"
+	paramNameCSVComment    = "csv-comment"
+	paramNameCSVLazyQuotes = "csv-lazy-quotes"
+	paramNameCSVHeader     = "csv-header"
+
+	paramNameJSONLines     = "json-lines"
+	paramNameJSONType      = "json-type"
+	paramNameJSONErrsFatal = "json-errors-fatal"
+
+	paramNameParallelFiles = "parallel-files"
+	paramNameDecompress    = "decompress"
+
+	paramNameWalkDirs       = "walk-dirs"
+	paramNameWalkInclude    = "walk-include"
+	paramNameWalkExclude    = "walk-exclude"
+	paramNameWalkSkipHidden = "walk-skip-hidden"
+
+	paramNameBackupMode   = "backup-mode"
+	paramNameBackupSuffix = "backup-suffix"
+	paramNameBackupDir    = "backup-dir"
+
+	paramNameIPEDryRun = "in-place-edit-dry-run"
+
+	paramNameHTTPPort              = "http-port"
+	paramNameHTTPUnixSocket        = "http-unix-socket"
+	paramNameHTTPAddrFile          = "http-addr-file"
+	paramNameHTTPTLSCert           = "http-tls-cert"
+	paramNameHTTPTLSKey            = "http-tls-key"
+	paramNameHTTPTLSSelfSigned     = "http-tls-self-signed"
+	paramNameHTTPReadTimeout       = "http-read-timeout"
+	paramNameHTTPReadHeaderTimeout = "http-read-header-timeout"
+	paramNameHTTPWriteTimeout      = "http-write-timeout"
+	paramNameHTTPIdleTimeout       = "http-idle-timeout"
+	paramNameHTTPShutdownGrace     = "http-shutdown-grace"
+	paramNameAfterShutdown         = "after-shutdown"
+
 	paramNamePreCheck = "pre-check"
 
 	paramNameShowFilename = "show-filename"
@@ -96,6 +137,54 @@ var readloopParamNames = []string{
 	paramNameSplitLine,
 	paramNameSplitPattern,
 	paramNameInPlaceEdit,
+	paramNameCSV,
+	paramNameJSONLines,
+	paramNameParallelFiles,
+	paramNameDecompress,
+	paramNameWalkDirs,
+}
+
+var walkParamNames = []string{
+	paramNameWalkDirs,
+	paramNameWalkInclude,
+	paramNameWalkExclude,
+	paramNameWalkSkipHidden,
+}
+
+var httpTLSParamNames = []string{
+	paramNameHTTPTLSCert,
+	paramNameHTTPTLSKey,
+	paramNameHTTPTLSSelfSigned,
+}
+
+var httpTimeoutParamNames = []string{
+	paramNameHTTPReadTimeout,
+	paramNameHTTPReadHeaderTimeout,
+	paramNameHTTPWriteTimeout,
+	paramNameHTTPIdleTimeout,
+	paramNameHTTPShutdownGrace,
+}
+
+var backupParamNames = []string{
+	paramNameInPlaceEdit,
+	paramNameBackupMode,
+	paramNameBackupSuffix,
+	paramNameBackupDir,
+}
+
+var jsonParamNames = []string{
+	paramNameJSONLines,
+	paramNameJSONType,
+	paramNameJSONErrsFatal,
+}
+
+var csvParamNames = []string{
+	paramNameCSV,
+	paramNameTSV,
+	paramNameCSVDelimiter,
+	paramNameCSVComment,
+	paramNameCSVLazyQuotes,
+	paramNameCSVHeader,
 }
 
 var fileParamNames = []string{
@@ -131,7 +220,9 @@ var formatterParamNames = []string{
 func makeSnippetHelpText(section string) string {
 	return "insert a snippet of code from the given" +
 		" filename (which must be in one of the snippets directories" +
-		" or a complete pathname) into the '" + section + "' section."
+		" or a complete pathname) into the '" + section + "' section." +
+		" Values for any snippet parameters can follow the filename" +
+		" as a comma-separated list of name=value pairs."
 }
 
 // makePrintHelpText makes the help text for the various print... parameters
@@ -184,12 +275,13 @@ func makeShebangFileHelpText(sect string) string {
 // given.
 func snippetPAF(g *gosh, sName *string, scriptName string) param.ActionFunc {
 	return func(_ location.L, _ *param.BaseParam, _ []string) error {
-		err := g.CacheSnippet(*sName)
+		name, err := g.cacheSnippetArg(*sName)
 		if err != nil {
 			return err
 		}
 
-		g.AddScriptEntry(scriptName, *sName, snippetExpand)
+		g.addScriptEntryFrom(scriptName, *sName, snippetExpand,
+			g.snippetOrigin(name))
 
 		return nil
 	}
@@ -203,8 +295,8 @@ func snippetPAF(g *gosh, sName *string, scriptName string) param.ActionFunc {
 // the PAF is being generated not at the point where the parameter value is
 // given.
 func scriptPAF(g *gosh, text *string, scriptName string) param.ActionFunc {
-	return func(_ location.L, _ *param.BaseParam, _ []string) error {
-		g.AddScriptEntry(scriptName, *text, verbatim)
+	return func(_ location.L, p *param.BaseParam, _ []string) error {
+		g.addScriptEntryFrom(scriptName, *text, verbatim, g.paramOrigin(p))
 		return nil
 	}
 }
@@ -212,8 +304,8 @@ func scriptPAF(g *gosh, text *string, scriptName string) param.ActionFunc {
 // stdinPAF generates the Post-Action func (PAF) that reads from os.Stdin and
 // adds the resulting text into the named script.
 func stdinPAF(g *gosh, scriptName string) param.ActionFunc {
-	return func(_ location.L, _ *param.BaseParam, _ []string) error {
-		g.AddScriptEntry(scriptName, "", readFromStdin)
+	return func(_ location.L, p *param.BaseParam, _ []string) error {
+		g.addScriptEntryFrom(scriptName, "", readFromStdin, g.paramOrigin(p))
 		return nil
 	}
 }
@@ -242,7 +334,9 @@ func parseShebangConfig(loc location.L, p *param.BaseParam, config []byte) error
 
 // shebangFilePAF generates the Post-Action func (PAF) that adds the contents
 // of the shebang file to the named script. If the first line starts with
-// '#!' it is removed before adding the rest of the contents.
+// '#!' it is removed before adding the rest of the contents and the file is
+// recorded as a shebang script so that the built program can be cached.
+// Otherwise it is recorded as a file that the program depends on.
 //
 // Note that we pass a pointer to the name of the file rather than the string
 // - this is necessary otherwise we are passing the text value at the point
@@ -250,12 +344,24 @@ func parseShebangConfig(loc location.L, p *param.BaseParam, config []byte) error
 // given.
 func shebangFilePAF(g *gosh, text *string, scriptName string) param.ActionFunc {
 	return func(loc location.L, p *param.BaseParam, _ []string) error {
-		script, config, err := shebangFileContents(*text)
+		script, config, content, err := shebangFileContents(*text)
 		if err != nil {
 			return err
 		}
 
-		g.AddScriptEntry(scriptName, string(script), verbatim)
+		if isShebangScript(content) {
+			s, err := newShebangScript(*text, content)
+			if err != nil {
+				return err
+			}
+
+			g.shebangScripts = append(g.shebangScripts, s)
+		} else {
+			g.addShebangDep(*text)
+		}
+
+		g.addScriptEntryFrom(scriptName, string(script), verbatim,
+			fileOrigin(*text, string(script)))
 
 		if len(config) != 0 {
 			return parseShebangConfig(loc, p, config)
@@ -267,7 +373,8 @@ func shebangFilePAF(g *gosh, text *string, scriptName string) param.ActionFunc {
 
 // packageFilePAF generates the Post-Action func (PAF) that adds the contents
 // of the package file to the named script. This will strip out any package
-// or import statements at the start of the file.
+// or import statements at the start of the file. The file is recorded as
+// one that the program depends on.
 //
 // Note that we pass a pointer to the name of the file rather than the string
 // - this is necessary otherwise we are passing the text value at the point
@@ -280,7 +387,10 @@ func packageFilePAF(g *gosh, text *string, scriptName string) param.ActionFunc {
 			return err
 		}
 
-		g.AddScriptEntry(scriptName, contents, verbatim)
+		g.addShebangDep(*text)
+
+		g.addScriptEntryFrom(scriptName, contents, verbatim,
+			fileOrigin(*text, contents))
 
 		return nil
 	}
@@ -468,24 +578,30 @@ func addWebParams(g *gosh) func(ps *param.PSet) error {
 			),
 		)
 
-		g.runAsWebserverSetters = append(g.runAsWebserverSetters,
-			ps.Add("http-port",
-				psetter.Int[int64]{
-					Value: &g.httpPort,
-					Checks: []check.Int64{
-						check.ValGT[int64](0),
-						check.ValLE[int64](math.MaxUint16),
-					},
+		httpPortParam := ps.Add(paramNameHTTPPort,
+			psetter.Int[int64]{
+				Value: &g.httpPort,
+				Checks: []check.Int64{
+					check.ValGE[int64](0),
+					check.ValLE[int64](math.MaxUint16),
 				},
-				"set the port number that the webserver will listen on."+
-					" Setting this will also force the script to be run"+
-					" within an http handler function."+
-					" Note that if you set this to a value less"+
-					" than 1024 you will need to have superuser privilege.",
-				param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
-				param.GroupName(paramGroupNameWeb),
-			),
+			},
+			"set the port number that the webserver will listen on."+
+				" Setting this will also force the script to be run"+
+				" within an http handler function."+
+				" Note that if you set this to a value less"+
+				" than 1024 you will need to have superuser privilege."+
+				"\n\n"+
+				"If this is set to 0 the webserver will listen on a"+
+				" port chosen by the system and the address it is"+
+				" listening on will be printed once it is ready to"+
+				" accept requests.",
+			param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(paramNameHTTPUnixSocket, paramNameHTTPAddrFile),
 		)
+		g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+			httpPortParam)
 
 		g.runAsWebserverSetters = append(g.runAsWebserverSetters,
 			ps.Add("http-path",
@@ -540,6 +656,13 @@ func addWebParams(g *gosh) func(ps *param.PSet) error {
 			),
 		)
 
+		addWebListenParams(g, ps, httpPortParam)
+		addWebRouteParams(g, ps)
+		addWebTLSParams(g, ps)
+		addWebTimeoutParams(g, ps)
+		addWebShutdownParams(g, ps)
+		addWebMiddlewareParams(g, ps)
+
 		ps.AddFinalCheck(func() error {
 			if len(g.scripts[execSect]) > 0 &&
 				g.httpHandler != dfltHTTPHandlerName {
@@ -556,6 +679,261 @@ func addWebParams(g *gosh) func(ps *param.PSet) error {
 	}
 }
 
+// addWebListenParams adds the parameters which control where the webserver
+// listens for requests. These are all in the "web" parameter group.
+func addWebListenParams(g *gosh, ps *param.PSet, httpPortParam *param.ByName) {
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPUnixSocket,
+			psetter.Pathname{
+				Value:         &g.httpUnixSocket,
+				ForceAbsolute: true,
+			},
+			"set the pathname of a Unix domain socket that the"+
+				" webserver will listen on instead of a TCP port. Any"+
+				" socket left behind at this pathname by an earlier"+
+				" run will be removed. Setting this will also force"+
+				" the program to be run as a web server.",
+			param.AltNames("unix-socket"),
+			param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(paramNameHTTPPort, paramNameHTTPAddrFile),
+		),
+	)
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPAddrFile,
+			psetter.Pathname{
+				Value:         &g.httpAddrFile,
+				ForceAbsolute: true,
+			},
+			"set the name of a file that the address the webserver"+
+				" is listening on will be written to once it is ready"+
+				" to accept requests. The file is written in one step"+
+				" so a program waiting for it to appear will never see"+
+				" it partly written. This is most useful when the port"+
+				" is chosen by the system (see '"+paramNameHTTPPort+"')."+
+				" Setting this will also force the program to be run"+
+				" as a web server.",
+			param.AltNames("addr-file"),
+			param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(paramNameHTTPPort, paramNameHTTPUnixSocket),
+		),
+	)
+
+	ps.AddFinalCheck(func() error {
+		if g.httpUnixSocket != "" && httpPortParam.HasBeenSet() {
+			return fmt.Errorf(
+				"you cannot give both a port (through the %q parameter)"+
+					" and a Unix domain socket (through the %q"+
+					" parameter) for the webserver to listen on",
+				"-"+paramNameHTTPPort, "-"+paramNameHTTPUnixSocket)
+		}
+
+		return nil
+	})
+}
+
+// addWebTLSParams adds the parameters which make the webserver serve HTTPS
+// rather than HTTP. These are all in the "web" parameter group.
+func addWebTLSParams(g *gosh, ps *param.PSet) {
+	tlsOpts := []param.ByNameOptFunc{
+		param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+		param.GroupName(paramGroupNameWeb),
+		param.SeeAlso(httpTLSParamNames...),
+	}
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPTLSCert,
+			psetter.Pathname{
+				Value:         &g.httpTLSCert,
+				Expectation:   filecheck.FileNonEmpty(),
+				ForceAbsolute: true,
+			},
+			"set the file holding the certificate that the webserver"+
+				" will use to serve HTTPS. The key file must also be"+
+				" given. Setting this will also force the program to"+
+				" be run as a web server.",
+			append(tlsOpts,
+				param.AltNames("tls-cert"))...,
+		),
+	)
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPTLSKey,
+			psetter.Pathname{
+				Value:         &g.httpTLSKey,
+				Expectation:   filecheck.FileNonEmpty(),
+				ForceAbsolute: true,
+			},
+			"set the file holding the private key that the webserver"+
+				" will use to serve HTTPS. The certificate file must"+
+				" also be given. Setting this will also force the"+
+				" program to be run as a web server.",
+			append(tlsOpts,
+				param.AltNames("tls-key"))...,
+		),
+	)
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPTLSSelfSigned,
+			psetter.Bool{Value: &g.httpTLSSelfSigned},
+			"serve HTTPS using a self-signed certificate generated when"+
+				" the webserver starts. The certificate is valid for"+
+				" 'localhost' and the loopback addresses for one day."+
+				" This is only suitable for local testing; clients"+
+				" will need to be told not to verify the certificate."+
+				" Setting this will also force the program to be run"+
+				" as a web server.",
+			append(tlsOpts,
+				param.AltNames("https", "tls-self-signed"))...,
+		),
+	)
+
+	ps.AddFinalCheck(func() error {
+		if (g.httpTLSCert == "") != (g.httpTLSKey == "") {
+			return fmt.Errorf(
+				"to serve HTTPS you must give both the certificate"+
+					" (through the %q parameter) and the key"+
+					" (through the %q parameter)",
+				"-"+paramNameHTTPTLSCert, "-"+paramNameHTTPTLSKey)
+		}
+
+		if g.httpTLSCert != "" && g.httpTLSSelfSigned {
+			return fmt.Errorf(
+				"you cannot give a certificate (through the %q"+
+					" parameter) and also ask for a self-signed"+
+					" certificate (through the %q parameter)",
+				"-"+paramNameHTTPTLSCert, "-"+paramNameHTTPTLSSelfSigned)
+		}
+
+		return nil
+	})
+}
+
+// addWebTimeoutParams adds the parameters which set the timeouts of the
+// webserver. These are all in the "web" parameter group.
+func addWebTimeoutParams(g *gosh, ps *param.PSet) {
+	timeoutParams := []struct {
+		name    string
+		altName string
+		value   *time.Duration
+		desc    string
+	}{
+		{
+			name:    paramNameHTTPReadTimeout,
+			altName: "read-timeout",
+			value:   &g.httpReadTimeout,
+			desc:    "for reading the entire request, including the body",
+		},
+		{
+			name:    paramNameHTTPReadHeaderTimeout,
+			altName: "read-header-timeout",
+			value:   &g.httpReadHeaderTimeout,
+			desc:    "for reading the request headers",
+		},
+		{
+			name:    paramNameHTTPWriteTimeout,
+			altName: "write-timeout",
+			value:   &g.httpWriteTimeout,
+			desc:    "for writing the response",
+		},
+		{
+			name:    paramNameHTTPIdleTimeout,
+			altName: "idle-timeout",
+			value:   &g.httpIdleTimeout,
+			desc:    "to wait for the next request on a kept-alive connection",
+		},
+	}
+
+	for _, tp := range timeoutParams {
+		g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+			ps.Add(tp.name,
+				psetter.Duration{
+					Value: tp.value,
+					Checks: []check.Duration{
+						check.ValGT[time.Duration](0),
+					},
+				},
+				"set the maximum time that the webserver will allow "+
+					tp.desc+". If this is not set there is no limit."+
+					" Setting this will also force the program to be"+
+					" run as a web server.",
+				param.AltNames(tp.altName),
+				param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+				param.GroupName(paramGroupNameWeb),
+				param.SeeAlso(httpTimeoutParamNames...),
+			),
+		)
+	}
+}
+
+// addWebShutdownParams adds the parameters which control what happens when
+// the webserver is shut down. These are all in the "web" parameter group.
+func addWebShutdownParams(g *gosh, ps *param.PSet) {
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPShutdownGrace,
+			psetter.Duration{
+				Value: &g.httpShutdownGrace,
+				Checks: []check.Duration{
+					check.ValGT[time.Duration](0),
+				},
+			},
+			"set the time that the webserver will wait for any requests"+
+				" in progress to complete after it has been sent an"+
+				" interrupt (SIGINT) or terminate (SIGTERM) signal."+
+				" Once all the requests have completed, or this time"+
+				" has passed, the code in the"+
+				" '"+afterShutdownSect+"' section is run and the"+
+				" program exits. Setting this will also force the"+
+				" program to be run as a web server.",
+			param.AltNames("shutdown-grace"),
+			param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(paramNameAfterShutdown),
+		),
+	)
+
+	var codeVal, snippetName string
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameAfterShutdown, psetter.String[string]{Value: &codeVal},
+			"follow this with Go code to be run after the webserver"+
+				" has shut down. This is the place for any cleaning up"+
+				" that the program needs to do before it exits."+
+				makeCodeSectionHelpText("", afterShutdownSect)+
+				" Setting this will also force the program to be run"+
+				" as a web server.",
+			param.AltNames("a-sd"),
+			param.PostAction(scriptPAF(g, &codeVal, afterShutdownSect)),
+			param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+			param.ValueName("Go-code"),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(paramNameHTTPShutdownGrace),
+		),
+	)
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameAfterShutdown+"-snippet",
+			psetter.String[string]{
+				Value: &snippetName,
+				Checks: []check.String{
+					check.StringLength[string](check.ValGT(0)),
+				},
+			},
+			makeSnippetHelpText(afterShutdownSect)+
+				" Setting this will also force the program to be run"+
+				" as a web server.",
+			param.AltNames("a-sd-s"),
+			param.ValueName("filename"),
+			param.PostAction(snippetPAF(g, &snippetName, afterShutdownSect)),
+			param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(paramNameAfterShutdown),
+		),
+	)
+}
+
 // addReadloopParams will add the parameters in the "readloop" parameter
 // group
 func addReadloopParams(g *gosh) func(ps *param.PSet) error {
@@ -614,19 +992,107 @@ func addReadloopParams(g *gosh) func(ps *param.PSet) error {
 			),
 		)
 
+		addCSVParams(g, ps)
+		addJSONParams(g, ps)
+		addWalkParams(g, ps)
+
 		g.runInReadloopSetters = append(g.runInReadloopSetters,
 			ps.Add(paramNameInPlaceEdit, psetter.Bool{Value: &g.inPlaceEdit},
 				"read each file given as a residual parameter"+
 					" (after "+ps.TerminalParam()+") and replace its"+
 					" contents with whatever is printed to the '_w' file."+
-					" The original file will be kept in a copy with the"+
-					" original name and a '"+origExt+"' extension. If any"+
-					" of the supplied files already has a '"+origExt+"'"+
-					" copy this is an error.",
+					" By default, the original file will be kept in a copy"+
+					" with the original name and a '"+origExt+"'"+
+					" extension. If any of the supplied files already has"+
+					" a '"+origExt+"' copy this is an error. The way the"+
+					" original file is kept can be changed with the"+
+					" '"+paramNameBackupMode+"' parameter.",
 				param.AltNames("i"),
 				param.PostAction(paction.SetVal(&g.runInReadLoop, true)),
 				param.GroupName(paramGroupNameReadloop),
-				param.SeeAlso(paramNameWPrint),
+				param.SeeAlso(paramNameWPrint, paramNameBackupMode,
+					paramNameIPEDryRun),
+			),
+		)
+
+		addBackupParams(g, ps)
+
+		g.runInReadloopSetters = append(g.runInReadloopSetters,
+			ps.Add(paramNameIPEDryRun, psetter.Bool{Value: &g.ipeDryRun},
+				"edit each file as if in-place (see"+
+					" '"+paramNameInPlaceEdit+"') but, rather than"+
+					" replacing the original file, show a unified diff"+
+					" between the original and the new contents. The"+
+					" original files are left unchanged and no backup"+
+					" copies are made. A summary of the number of files"+
+					" changed and unchanged is written to standard error"+
+					" at the end. Setting this will also force in-place"+
+					" editing.",
+				param.AltNames("dry-run", "diff"),
+				param.PostAction(paction.SetVal(&g.runInReadLoop, true)),
+				param.PostAction(paction.SetVal(&g.inPlaceEdit, true)),
+				param.GroupName(paramGroupNameReadloop),
+				param.SeeAlso(paramNameInPlaceEdit),
+			),
+		)
+
+		parallelFiles := ps.Add(paramNameParallelFiles,
+			psetter.Int[int64]{
+				Value:  &g.parallelFiles,
+				Checks: []check.Int64{check.ValGT[int64](0)},
+			},
+			"process each of the files given as residual parameters"+
+				" (after "+ps.TerminalParam()+") in its own goroutine,"+
+				" running at most this many at the same time. The"+
+				" '"+beforeSect+"' and '"+afterSect+"' sections are"+
+				" still run just once but the code in the"+
+				" '"+beforeInnerSect+"', '"+execSect+"' and"+
+				" '"+afterInnerSect+"' sections will be run"+
+				" concurrently and so must not change any shared"+
+				" variables without synchronisation."+
+				"\n\n"+
+				"Each file has its own output buffer (available as"+
+				" '_o'). The buffered output for each file is written"+
+				" to standard output, in the order the files were"+
+				" given, as soon as that file and all the files before"+
+				" it have been processed. Anything written directly to"+
+				" the standard output or standard error, for instance"+
+				" by fmt.Println or the log package, is not buffered"+
+				" and may be interleaved with the output for other"+
+				" files so you should write to '_o' instead. The"+
+				" filename and line number variables ('_fn' and '_fl')"+
+				" are only set in the sections run for each file."+
+				" A file being edited in-place is still only"+
+				" replaced once its new contents are complete."+
+				" Setting this will also force the script to be run in"+
+				" a loop reading from the list of files.",
+			param.AltNames("parallel", "workers"),
+			param.PostAction(paction.SetVal(&g.runInReadLoop, true)),
+			param.GroupName(paramGroupNameReadloop),
+			param.SeeAlso(readloopParamNames...),
+		)
+		g.runInReadloopSetters = append(g.runInReadloopSetters, parallelFiles)
+
+		g.runInReadloopSetters = append(g.runInReadloopSetters,
+			ps.Add(paramNameDecompress, psetter.Bool{Value: &g.decompress},
+				"decompress any of the files given as residual parameters"+
+					" (after "+ps.TerminalParam()+") which are compressed."+
+					" A file is taken to be compressed if it has a '.gz'"+
+					" or '.bz2' extension or if its first few bytes show"+
+					" that it has been compressed with gzip or bzip2."+
+					" The file is then read through a reader (available"+
+					" as '_r') which decompresses its contents."+
+					"\n\n"+
+					"If you are editing the files in-place then any"+
+					" gzip-compressed file will be compressed again once"+
+					" it has been edited. Files compressed with bzip2"+
+					" cannot be edited in-place."+
+					" Setting this will also force the script to be run"+
+					" in a loop reading from the list of files.",
+				param.AltNames("gunzip", "z"),
+				param.PostAction(paction.SetVal(&g.runInReadLoop, true)),
+				param.GroupName(paramGroupNameReadloop),
+				param.SeeAlso(readloopParamNames...),
 			),
 		)
 
@@ -657,6 +1123,22 @@ func addReadloopParams(g *gosh) func(ps *param.PSet) error {
 					"-"+paramNameInPlaceEdit, ps.TerminalParam())
 			}
 
+			if len(ps.TrailingParams()) == 0 && parallelFiles.HasBeenSet() {
+				return fmt.Errorf(
+					"you have given the %q parameter but no filenames have"+
+						" been given (they should be supplied following %q)",
+					"-"+paramNameParallelFiles, ps.TerminalParam())
+			}
+
+			if parallelFiles.HasBeenSet() && g.jsonErrsFatal {
+				return fmt.Errorf(
+					"you cannot process files in parallel (through the %q"+
+						" parameter) and make JSON errors fatal (through"+
+						" the %q parameter) as the program would exit while"+
+						" other files are still being processed",
+					"-"+paramNameParallelFiles, "-"+paramNameJSONErrsFatal)
+			}
+
 			if writeToIPEFile.HasBeenSet() && !g.inPlaceEdit {
 				return fmt.Errorf(
 					"you are writing to the file used when in-place editing"+
@@ -676,6 +1158,400 @@ func addReadloopParams(g *gosh) func(ps *param.PSet) error {
 	}
 }
 
+// checkCSVRune returns an error if the string is not a single character
+// which can be used as a CSV delimiter or comment character.
+func checkCSVRune(s string) error {
+	if utf8.RuneCountInString(s) != 1 {
+		return fmt.Errorf("%q should be a single character", s)
+	}
+
+	r, _ := utf8.DecodeRuneInString(s)
+	if r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return fmt.Errorf("%q cannot be used as a CSV field separator"+
+			" or comment character", s)
+	}
+
+	return nil
+}
+
+// addCSVParams adds the parameters which control the reading of CSV
+// records in the read-loop. These are all in the "readloop" parameter group.
+func addCSVParams(g *gosh, ps *param.PSet) {
+	csvOpts := []param.ByNameOptFunc{
+		param.PostAction(paction.SetVal(&g.runInReadLoop, true)),
+		param.GroupName(paramGroupNameReadloop),
+		param.SeeAlso(csvParamNames...),
+	}
+	csvSetterOpts := []param.ByNameOptFunc{
+		param.PostAction(paction.SetVal(&g.runInReadLoop, true)),
+		param.PostAction(paction.SetVal(&g.csvRecords, true)),
+		param.GroupName(paramGroupNameReadloop),
+		param.SeeAlso(csvParamNames...),
+	}
+
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameCSV, psetter.Bool{Value: &g.csvRecords},
+			"read the input as CSV (comma-separated values) records"+
+				" rather than as lines. Each record is available as a"+
+				" slice of strings in '_rec' (see the Note '"+noteVars+"')"+
+				" and the line number of the start of the record is in"+
+				" '_fl'. Records need not all have the same number of"+
+				" fields. Any badly formed records are reported and"+
+				" skipped."+
+				"\n\n"+
+				"If you are editing the files in-place a CSV writer on"+
+				" the '_w' file is available as '_cw'; records"+
+				" written to it will use the same field separator as"+
+				" the input. Setting this will also force the script"+
+				" to be run in a loop reading from stdin or from a"+
+				" list of files.",
+			append(csvOpts,
+				param.AltNames("csv-records"))...,
+		),
+	)
+
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameTSV, psetter.Nil{},
+			"read the input as TSV (tab-separated values) records."+
+				" This is the same as giving the '"+paramNameCSV+"'"+
+				" parameter with the field separator set to a tab.",
+			append(csvSetterOpts,
+				param.PostAction(paction.SetVal(&g.csvDelimiter, "\t")))...,
+		),
+	)
+
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameCSVDelimiter,
+			psetter.String[string]{
+				Value:  &g.csvDelimiter,
+				Checks: []check.String{checkCSVRune},
+			},
+			"set the character which separates the fields of the CSV"+
+				" records.",
+			append(csvSetterOpts,
+				param.AltNames("csv-sep", "csv-separator"))...,
+		),
+	)
+
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameCSVComment,
+			psetter.String[string]{
+				Value:  &g.csvComment,
+				Checks: []check.String{checkCSVRune},
+			},
+			"set the character which introduces a comment line in the"+
+				" CSV input. Lines starting with this character are"+
+				" ignored and are not copied when editing in-place."+
+				" By default there are no comment lines.",
+			csvSetterOpts...,
+		),
+	)
+
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameCSVLazyQuotes, psetter.Bool{Value: &g.csvLazyQuotes},
+			"allow quotes to appear in unquoted fields and unescaped"+
+				" quotes to appear in quoted fields of the CSV records.",
+			csvSetterOpts...,
+		),
+	)
+
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameCSVHeader, psetter.Bool{Value: &g.csvHeader},
+			"treat the first CSV record of each file as a header."+
+				" The header record is not passed to the 'exec'"+
+				" section, instead a map from each header field to its"+
+				" index is made available in '_hdr'. If you are"+
+				" editing the files in-place the header record is"+
+				" written to '_cw' for you.",
+			csvSetterOpts...,
+		),
+	)
+
+	ps.AddFinalCheck(func() error {
+		if !g.csvRecords {
+			return nil
+		}
+
+		if g.splitLine {
+			return fmt.Errorf(
+				"you cannot split the lines (through the %q parameter)"+
+					" and read CSV records (through the %q parameter)"+
+					" at the same time",
+				"-"+paramNameSplitLine, "-"+paramNameCSV)
+		}
+
+		if g.csvComment == g.csvDelimiter {
+			return fmt.Errorf(
+				"the CSV comment character (%q) must be different from"+
+					" the field separator",
+				g.csvComment)
+		}
+
+		return nil
+	})
+}
+
+// addJSONParams adds the parameters which control the decoding of
+// JSON-lines input in the read-loop. These are all in the "readloop"
+// parameter group.
+func addJSONParams(g *gosh, ps *param.PSet) {
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameJSONLines, psetter.Bool{Value: &g.jsonLines},
+			"treat each line of the input as a JSON value and decode"+
+				" it before the 'exec' section is run. The decoded"+
+				" value is available in '_jv' (see the Note '"+
+				noteVars+"'); by default this is a map[string]any but"+
+				" you can give your own type."+
+				"\n\n"+
+				"Lines which cannot be decoded are reported (with the"+
+				" file name and line number) and skipped; they are not"+
+				" passed to the 'exec' section and so are not copied"+
+				" if you are editing the files in-place. Setting this"+
+				" will also force the script to be run in a loop"+
+				" reading from stdin or from a list of files.",
+			param.AltNames("jsonl", "json"),
+			param.PostAction(paction.SetVal(&g.runInReadLoop, true)),
+			param.GroupName(paramGroupNameReadloop),
+			param.SeeAlso(jsonParamNames...),
+		),
+	)
+
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameJSONType,
+			psetter.String[string]{
+				Value: &g.jsonType,
+				Checks: []check.String{
+					check.StringLength[string](check.ValGT(0)),
+				},
+			},
+			"set the type of the value into which each line of JSON"+
+				" will be decoded. This can be any type which"+
+				" json.Unmarshal can decode into; you can declare"+
+				" your own type in the '"+globalSect+"' section (for"+
+				" instance, through a snippet). Setting this will also"+
+				" force each line to be decoded as JSON.",
+			param.AltNames("jsonl-type"),
+			param.PostAction(paction.SetVal(&g.runInReadLoop, true)),
+			param.PostAction(paction.SetVal(&g.jsonLines, true)),
+			param.GroupName(paramGroupNameReadloop),
+			param.SeeAlso(jsonParamNames...),
+		),
+	)
+
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameJSONErrsFatal, psetter.Bool{Value: &g.jsonErrsFatal},
+			"make any line which cannot be decoded as JSON a fatal"+
+				" error. The program will report the error and exit"+
+				" immediately. The file being edited in-place at the"+
+				" time is left unchanged. Setting this will also force"+
+				" each line to be decoded as JSON.",
+			param.AltNames("jsonl-errors-fatal"),
+			param.PostAction(paction.SetVal(&g.runInReadLoop, true)),
+			param.PostAction(paction.SetVal(&g.jsonLines, true)),
+			param.GroupName(paramGroupNameReadloop),
+			param.SeeAlso(jsonParamNames...),
+		),
+	)
+
+	ps.AddFinalCheck(func() error {
+		if g.jsonLines && g.csvRecords {
+			return fmt.Errorf(
+				"you cannot decode JSON lines (through the %q parameter)"+
+					" and read CSV records (through the %q parameter)"+
+					" at the same time",
+				"-"+paramNameJSONLines, "-"+paramNameCSV)
+		}
+
+		return nil
+	})
+}
+
+// checkGlob returns an error if the pattern is not a valid glob pattern.
+func checkGlob(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("bad pattern: %q: %w", pattern, err)
+	}
+
+	return nil
+}
+
+// addWalkParams adds the parameters which control the walking of
+// directories given as residual parameters to the read-loop. These are all
+// in the "readloop" parameter group.
+func addWalkParams(g *gosh, ps *param.PSet) {
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameWalkDirs, psetter.Bool{Value: &g.walkDirs},
+			"allow directories to be given as residual parameters"+
+				" (after "+ps.TerminalParam()+"). Each directory is"+
+				" walked and every regular file found within it is"+
+				" read in turn, with '_fn' set to the file's"+
+				" pathname. Any files given as residual parameters"+
+				" are always read, the patterns given to choose the"+
+				" files only apply to the files found in directories."+
+				" If you are editing the files in-place then the"+
+				" copies of the original files kept by earlier edits"+
+				" (according to the backup mode) and any temporary"+
+				" files left by an edit are not read."+
+				" Setting this will also force the script to be run"+
+				" in a loop reading from the list of files.",
+			param.AltNames("recursive", "walk"),
+			param.PostAction(paction.SetVal(&g.runInReadLoop, true)),
+			param.GroupName(paramGroupNameReadloop),
+			param.SeeAlso(walkParamNames...),
+		),
+	)
+
+	walkOpts := []param.ByNameOptFunc{
+		param.PostAction(paction.SetVal(&g.runInReadLoop, true)),
+		param.PostAction(paction.SetVal(&g.walkDirs, true)),
+		param.GroupName(paramGroupNameReadloop),
+		param.SeeAlso(walkParamNames...),
+	}
+
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameWalkInclude,
+			psetter.StrListAppender[string]{
+				Value:  &g.walkInclude,
+				Checks: []check.String{checkGlob},
+			},
+			"add a glob pattern to the list of patterns that the name"+
+				" of a file found in a directory must match if it is"+
+				" to be read. If no patterns are given, all the files"+
+				" will be read. Setting this will also allow"+
+				" directories to be given.",
+			append(walkOpts,
+				param.AltNames("include"))...,
+		),
+	)
+
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameWalkExclude,
+			psetter.StrListAppender[string]{
+				Value:  &g.walkExclude,
+				Checks: []check.String{checkGlob},
+			},
+			"add a glob pattern to the list of patterns that the name"+
+				" of a file or directory found in a directory must not"+
+				" match if it is to be read (or walked). Setting this"+
+				" will also allow directories to be given.",
+			append(walkOpts,
+				param.AltNames("exclude"))...,
+		),
+	)
+
+	g.runInReadloopSetters = append(g.runInReadloopSetters,
+		ps.Add(paramNameWalkSkipHidden,
+			psetter.Bool{Value: &g.walkSkipHidden},
+			"do not walk any hidden directories (those with names"+
+				" starting with a '.') or any 'testdata' directories."+
+				" Setting this will also allow directories to be given.",
+			append(walkOpts,
+				param.AltNames("skip-hidden"))...,
+		),
+	)
+}
+
+// addBackupParams adds the parameters which control how the original file
+// is kept when editing in-place. These are all in the "readloop" parameter
+// group.
+func addBackupParams(g *gosh, ps *param.PSet) {
+	ps.Add(paramNameBackupMode,
+		psetter.Enum[string]{
+			Value: &g.backupMode,
+			AllowedVals: psetter.AllowedVals[string]{
+				backupModeSuffix: "rename the original file to" +
+					" its name plus the backup suffix. It is an" +
+					" error if this file already exists.",
+				backupModeNumbered: "rename the original file to" +
+					" its name plus the backup suffix and the first" +
+					" number (from 1) that gives a file that does" +
+					" not already exist. So, with the default suffix," +
+					" the first edit will leave a copy in 'x" +
+					origExt + ".1', the next in 'x" + origExt + ".2'" +
+					" and so on.",
+				backupModeTimestamp: "rename the original file to" +
+					" its name plus the backup suffix and the time" +
+					" the file was edited (in the form" +
+					" '" + backupTimeFormat + "').",
+				backupModeDir: "move the original file into the" +
+					" backup directory (see" +
+					" '" + paramNameBackupDir + "'). It will be" +
+					" saved under its full pathname so the backup" +
+					" directory will mirror the directory tree of" +
+					" the edited files. It is an error if this file" +
+					" already exists.",
+				backupModeNone: "do not keep a copy of the original" +
+					" file.",
+			},
+		},
+		"set the way that the original file is kept when it is edited"+
+			" in-place. The default of '"+backupModeSuffix+"' with the"+
+			" default suffix of '"+origExt+"' gives copies that can be"+
+			" checked using the findCmpRm program.",
+		param.AltNames("backup"),
+		param.GroupName(paramGroupNameReadloop),
+		param.SeeAlso(backupParamNames...),
+		param.SeeNote(noteInPlaceEdit),
+	)
+
+	ps.Add(paramNameBackupSuffix,
+		psetter.String[string]{
+			Value: &g.backupSuffix,
+			Checks: []check.String{
+				check.StringLength[string](check.ValGT(0)),
+			},
+		},
+		"set the suffix added to the name of the original file when"+
+			" it is kept after editing in-place. Note that the"+
+			" findCmpRm program will only find copies with the"+
+			" default suffix.",
+		param.GroupName(paramGroupNameReadloop),
+		param.SeeAlso(backupParamNames...),
+	)
+
+	ps.Add(paramNameBackupDir,
+		psetter.Pathname{
+			Value:         &g.backupDir,
+			ForceAbsolute: true,
+		},
+		"set the directory where the original files are kept when"+
+			" they are edited in-place. The directory will be created"+
+			" if it does not exist. Setting this will also set the"+
+			" backup mode to '"+backupModeDir+"'.",
+		param.PostAction(paction.SetVal(&g.backupMode, backupModeDir)),
+		param.GroupName(paramGroupNameReadloop),
+		param.SeeAlso(backupParamNames...),
+	)
+
+	ps.AddFinalCheck(func() error {
+		if g.backupMode == backupModeDir && g.backupDir == "" {
+			return fmt.Errorf(
+				"the backup mode is %q but no backup directory has been"+
+					" given (through the %q parameter)",
+				backupModeDir, "-"+paramNameBackupDir)
+		}
+
+		if !g.inPlaceEdit {
+			for _, n := range backupParamNames {
+				if n == paramNameInPlaceEdit {
+					continue
+				}
+
+				if p, err := ps.GetParamByName(n); err == nil &&
+					p.HasBeenSet() {
+					return fmt.Errorf(
+						"you have given the %q parameter but you are"+
+							" not editing any files in-place (through"+
+							" the %q parameter)",
+						"-"+n, "-"+paramNameInPlaceEdit)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
 // addStdinParams returns a func that will add parameters to the passed
 // ParamSet for specifying reading the code from stdin.
 func addStdinParams(g *gosh) func(ps *param.PSet) error {
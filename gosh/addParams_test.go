@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/nickwells/errutil.mod/errutil"
 	"github.com/nickwells/filecheck.mod/filecheck"
@@ -26,6 +27,10 @@ const (
 
 	testNoSuchFile = "testdata/nonesuch"
 
+	testPackageFilesDir = "testdata/packageFiles"
+
+	testBzip2File = "testdata/compressed.bz2"
+
 	snippetsDir = "snippets"
 	snippet0    = "s0"
 	snippet1    = "s1"
@@ -49,6 +54,9 @@ func cmpGoshStruct(iVal, iExpVal any) error {
 		[]string{"snippetDirs"},          // ... and the snippet dir list
 		[]string{"runInReadloopSetters"}, // ... and the lists of ByName param
 		[]string{"runAsWebserverSetters"},
+		[]string{"scripts", "origin"}, // ... and the script entry origins
+		[]string{"paramUses"},
+		[]string{"asserts", "origin"}, // ... and the assertion origins
 	)
 }
 
@@ -124,6 +132,24 @@ func populateFileScriptEntries(t *testing.T) ([]string, []scriptEntry) {
 	return files, fileSE
 }
 
+// absPaths returns the absolute pathnames of the named files
+func absPaths(t *testing.T, names ...string) []string {
+	t.Helper()
+
+	paths := []string{}
+
+	for _, name := range names {
+		path, err := filepath.Abs(name)
+		if err != nil {
+			t.Fatalf("Could not make the pathname absolute: %q: %v", name, err)
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
 // populateSnippetScriptEntries generates the slice of snippets. This slice
 // is used to check that the -...-snippet parameters are working correctly
 func populateSnippetScriptEntries() ([]string, []scriptEntry) {
@@ -467,6 +493,123 @@ func TestParseParamsCmdReadloop(t *testing.T) {
 				p, "--", testDataFile1, testDataFile2))
 	}
 
+	for _, mode := range []string{
+		backupModeNumbered,
+		backupModeTimestamp,
+		backupModeNone,
+	} {
+		testCases = append(testCases,
+			mkTestParser(nil,
+				testhelper.MkID("in-place edit, has orig file, mode: "+mode),
+				func(g *gosh) {
+					g.runInReadLoop = true
+					g.inPlaceEdit = true
+					g.backupMode = mode
+					g.filesToRead = true
+					g.args = []string{testHasOrigFile}
+				},
+				"-i", "-backup", mode, "--", testHasOrigFile))
+	}
+
+	for _, p := range []string{
+		"-" + paramNameIPEDryRun,
+		"-dry-run",
+		"-diff",
+	} {
+		testCases = append(testCases,
+			mkTestParser(nil,
+				testhelper.MkID("in-place edit dry-run, has orig file: "+p),
+				func(g *gosh) {
+					g.runInReadLoop = true
+					g.inPlaceEdit = true
+					g.ipeDryRun = true
+					g.filesToRead = true
+					g.args = []string{testHasOrigFile}
+				},
+				p, "--", testHasOrigFile))
+	}
+
+	testCases = append(testCases,
+		mkTestParser(nil,
+			testhelper.MkID("in-place edit, has orig file, other suffix"),
+			func(g *gosh) {
+				g.runInReadLoop = true
+				g.inPlaceEdit = true
+				g.backupSuffix = ".bak"
+				g.filesToRead = true
+				g.args = []string{testHasOrigFile}
+			},
+			"-i", "-"+paramNameBackupSuffix, ".bak", "--", testHasOrigFile))
+
+	{
+		backupDir, err := filepath.Abs("testdata")
+		if err != nil {
+			t.Fatal("Cannot find the backup directory name:", err)
+		}
+
+		testCases = append(testCases,
+			mkTestParser(nil,
+				testhelper.MkID("in-place edit, backup dir"),
+				func(g *gosh) {
+					g.runInReadLoop = true
+					g.inPlaceEdit = true
+					g.backupMode = backupModeDir
+					g.backupDir = backupDir
+					g.filesToRead = true
+					g.args = []string{testDataFile1}
+				},
+				"-i", "-"+paramNameBackupDir, "testdata",
+				"--", testDataFile1))
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(`the backup mode is "dir"`+
+				` but no backup directory has been given`+
+				` (through the "-backup-dir" parameter)`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("backup mode dir, no backup dir"),
+				func(g *gosh) {
+					g.backupMode = backupModeDir
+				},
+				"-"+paramNameBackupMode, backupModeDir))
+	}
+
+	for _, tc := range []struct {
+		pName string
+		val   string
+		gs    func(g *gosh)
+	}{
+		{
+			pName: paramNameBackupMode,
+			val:   backupModeNumbered,
+			gs:    func(g *gosh) { g.backupMode = backupModeNumbered },
+		},
+		{
+			pName: paramNameBackupSuffix,
+			val:   ".bak",
+			gs:    func(g *gosh) { g.backupSuffix = ".bak" },
+		},
+	} {
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(`you have given the "-`+tc.pName+`" parameter`+
+				` but you are not editing any files in-place`+
+				` (through the "-in-place-edit" parameter)`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("backup param without in-place edit: "+
+					tc.pName),
+				tc.gs,
+				"-"+tc.pName, tc.val))
+	}
+
 	for _, p := range []string{
 		"-" + paramNameReadloop,
 		"-n",
@@ -533,6 +676,277 @@ func TestParseParamsCmdReadloop(t *testing.T) {
 				p, "[,.;:]"))
 	}
 
+	for _, p := range []string{
+		"-" + paramNameCSV,
+		"-csv-records",
+	} {
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("csv: "+p),
+				func(g *gosh) {
+					g.csvRecords = true
+					g.runInReadLoop = true
+				},
+				p))
+	}
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("tsv"),
+			func(g *gosh) {
+				g.csvRecords = true
+				g.csvDelimiter = "\t"
+				g.runInReadLoop = true
+			},
+			"-"+paramNameTSV))
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("csv: all settings"),
+			func(g *gosh) {
+				g.csvRecords = true
+				g.csvDelimiter = ";"
+				g.csvComment = "#"
+				g.csvLazyQuotes = true
+				g.csvHeader = true
+				g.runInReadLoop = true
+			},
+			"-"+paramNameCSVDelimiter, ";",
+			"-"+paramNameCSVComment, "#",
+			"-"+paramNameCSVLazyQuotes,
+			"-"+paramNameCSVHeader))
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"csv-delimiter",
+			errors.New(`"ab" should be a single character`+
+				"\nAt: [command line]: Supplied Parameter:2:"+
+				` "-csv-delimiter" "ab"`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("csv: bad delimiter"),
+				func(g *gosh) {},
+				"-"+paramNameCSVDelimiter, "ab"))
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(
+				`the CSV comment character (";") must be different`+
+					` from the field separator`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("csv: comment is the delimiter"),
+				func(g *gosh) {
+					g.csvRecords = true
+					g.csvDelimiter = ";"
+					g.csvComment = ";"
+					g.runInReadLoop = true
+				},
+				"-"+paramNameCSVDelimiter, ";",
+				"-"+paramNameCSVComment, ";"))
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(
+				`you cannot split the lines (through the "-split-line"`+
+					` parameter) and read CSV records (through the "-csv"`+
+					` parameter) at the same time`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("csv and split-line"),
+				func(g *gosh) {
+					g.csvRecords = true
+					g.splitLine = true
+					g.runInReadLoop = true
+				},
+				"-"+paramNameCSV, "-"+paramNameSplitLine))
+	}
+
+	for _, p := range []string{
+		"-" + paramNameParallelFiles,
+		"-parallel",
+		"-workers",
+	} {
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(
+				`you have given the "-parallel-files"`+
+					` parameter but no filenames have been given`+
+					` (they should be supplied following "--")`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("parallel files, no files: "+p),
+				func(g *gosh) {
+					g.runInReadLoop = true
+					g.parallelFiles = 4
+				},
+				p, "4"))
+
+		testCases = append(testCases,
+			mkTestParser(nil,
+				testhelper.MkID("parallel files, good args: "+p),
+				func(g *gosh) {
+					g.runInReadLoop = true
+					g.parallelFiles = 4
+					g.filesToRead = true
+					g.args = []string{testDataFile1, testDataFile2}
+				},
+				p, "4", "--", testDataFile1, testDataFile2))
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(
+				`you cannot process files in parallel`+
+					` (through the "-parallel-files" parameter)`+
+					` and make JSON errors fatal`+
+					` (through the "-json-errors-fatal" parameter)`+
+					` as the program would exit while`+
+					` other files are still being processed`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("parallel files and JSON errors fatal"),
+				func(g *gosh) {
+					g.runInReadLoop = true
+					g.parallelFiles = 4
+					g.jsonLines = true
+					g.jsonErrsFatal = true
+					g.filesToRead = true
+					g.args = []string{testDataFile1}
+				},
+				"-"+paramNameParallelFiles, "4",
+				"-"+paramNameJSONErrsFatal,
+				"--", testDataFile1))
+	}
+
+	for _, p := range []string{
+		"-" + paramNameDecompress,
+		"-gunzip",
+		"-z",
+	} {
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("decompress: "+p),
+				func(g *gosh) {
+					g.runInReadLoop = true
+					g.decompress = true
+					g.filesToRead = true
+					g.args = []string{testDataFile1}
+				},
+				p, "--", testDataFile1))
+	}
+
+	for _, p := range []string{
+		"-" + paramNameWalkDirs,
+		"-recursive",
+		"-walk",
+	} {
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("walk dirs: "+p),
+				func(g *gosh) {
+					g.runInReadLoop = true
+					g.walkDirs = true
+					g.filesToRead = true
+					g.args = []string{testPackageFilesDir, testDataFile1}
+				},
+				p, "--", testPackageFilesDir, testDataFile1))
+	}
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("walk dirs: include and exclude"),
+			func(g *gosh) {
+				g.runInReadLoop = true
+				g.walkDirs = true
+				g.walkInclude = []string{"*.go", "*.txt"}
+				g.walkExclude = []string{"vendor"}
+				g.walkSkipHidden = true
+			},
+			"-include", "*.go",
+			"-"+paramNameWalkInclude, "*.txt",
+			"-exclude", "vendor",
+			"-skip-hidden"))
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"walk-include",
+			errors.New(`bad pattern: "[": syntax error in pattern`+
+				"\nAt: [command line]: Supplied Parameter:2:"+
+				` "-walk-include" "["`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("walk dirs: bad include pattern"),
+				func(g *gosh) {},
+				"-"+paramNameWalkInclude, "["))
+	}
+
+	testCases = append(testCases,
+		mkTestParser(nil,
+			testhelper.MkID("directory without walk dirs"),
+			func(g *gosh) {
+				g.runInReadLoop = true
+				g.errMap.AddError("file check",
+					errors.New(`"packageFiles" should be a regular file`))
+			},
+			"-n", "--", testPackageFilesDir))
+
+	for _, p := range []string{
+		"-" + paramNameJSONLines,
+		"-jsonl",
+		"-json",
+	} {
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("json lines: "+p),
+				func(g *gosh) {
+					g.jsonLines = true
+					g.runInReadLoop = true
+				},
+				p))
+	}
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("json lines: all settings"),
+			func(g *gosh) {
+				g.jsonLines = true
+				g.jsonType = "logRec"
+				g.jsonErrsFatal = true
+				g.runInReadLoop = true
+			},
+			"-"+paramNameJSONType, "logRec",
+			"-"+paramNameJSONErrsFatal))
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(
+				`you cannot decode JSON lines (through the "-json-lines"`+
+					` parameter) and read CSV records (through the "-csv"`+
+					` parameter) at the same time`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("json lines and csv"),
+				func(g *gosh) {
+					g.jsonLines = true
+					g.csvRecords = true
+					g.runInReadLoop = true
+				},
+				"-"+paramNameJSONLines, "-"+paramNameCSV))
+	}
+
 	for _, p := range []struct {
 		param string
 		idx   int
@@ -647,8 +1061,147 @@ func TestParseParamsCmdWeb(t *testing.T) {
 					g.runAsWebserver = true
 					g.httpPort = httpPortNum
 				}, "-http-port", fmt.Sprintf("%d", httpPortNum)))
+
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("http port: system chosen"),
+				func(g *gosh) {
+					g.runAsWebserver = true
+					g.httpPort = 0
+				}, "-"+paramNameHTTPPort, "0"))
+	}
+
+	{
+		const (
+			sockName = "/tmp/gosh.sock"
+			addrName = "/tmp/gosh.addr"
+		)
+
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("http unix socket"),
+				func(g *gosh) {
+					g.runAsWebserver = true
+					g.httpUnixSocket = sockName
+					g.httpAddrFile = addrName
+				},
+				"-unix-socket", sockName,
+				"-"+paramNameHTTPAddrFile, addrName))
+
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(`you cannot give both a port (through the`+
+				` "-http-port" parameter) and a Unix domain socket`+
+				` (through the "-http-unix-socket" parameter) for the`+
+				` webserver to listen on`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("http unix socket and port"),
+				func(g *gosh) {
+					g.runAsWebserver = true
+					g.httpUnixSocket = sockName
+					g.httpPort = 8001
+				},
+				"-"+paramNameHTTPUnixSocket, sockName,
+				"-http-port", "8001"))
+	}
+
+	{
+		cert, err := filepath.Abs(testDataFile1)
+		if err != nil {
+			t.Fatal("Cannot find the certificate file name:", err)
+		}
+
+		key, err := filepath.Abs(testDataFile2)
+		if err != nil {
+			t.Fatal("Cannot find the key file name:", err)
+		}
+
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("http tls cert and key"),
+				func(g *gosh) {
+					g.runAsWebserver = true
+					g.httpTLSCert = cert
+					g.httpTLSKey = key
+				},
+				"-"+paramNameHTTPTLSCert, testDataFile1,
+				"-tls-key", testDataFile2))
+
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(`to serve HTTPS you must give both the certificate`+
+				` (through the "-http-tls-cert" parameter) and the key`+
+				` (through the "-http-tls-key" parameter)`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs, testhelper.MkID("http tls cert, no key"),
+				func(g *gosh) {
+					g.runAsWebserver = true
+					g.httpTLSCert = cert
+				},
+				"-tls-cert", testDataFile1))
+
+		parseErrs = errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(`you cannot give a certificate (through the`+
+				` "-http-tls-cert" parameter) and also ask for a`+
+				` self-signed certificate (through the`+
+				` "-http-tls-self-signed" parameter)`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("http tls cert and self-signed"),
+				func(g *gosh) {
+					g.runAsWebserver = true
+					g.httpTLSCert = cert
+					g.httpTLSKey = key
+					g.httpTLSSelfSigned = true
+				},
+				"-tls-cert", testDataFile1,
+				"-tls-key", testDataFile2,
+				"-https"))
 	}
 
+	for _, p := range []string{
+		"-" + paramNameHTTPTLSSelfSigned,
+		"-https",
+		"-tls-self-signed",
+	} {
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("http tls self-signed: "+p),
+				func(g *gosh) {
+					g.runAsWebserver = true
+					g.httpTLSSelfSigned = true
+				},
+				p))
+	}
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("http timeouts"),
+			func(g *gosh) {
+				g.runAsWebserver = true
+				g.httpReadTimeout = time.Second
+				g.httpReadHeaderTimeout = 2 * time.Second
+				g.httpWriteTimeout = 3 * time.Second
+				g.httpIdleTimeout = time.Minute
+				g.httpShutdownGrace = 10 * time.Second
+			},
+			"-read-timeout", "1s",
+			"-read-header-timeout", "2s",
+			"-"+paramNameHTTPWriteTimeout, "3s",
+			"-idle-timeout", "1m",
+			"-shutdown-grace", "10s"))
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("after shutdown"),
+			func(g *gosh) {
+				g.runAsWebserver = true
+				g.AddScriptEntry(afterShutdownSect, "cleanup()", verbatim)
+			},
+			"-"+paramNameAfterShutdown, "cleanup()"))
+
 	for _, p := range []string{
 		"-http-server",
 		"-http",
@@ -815,6 +1368,9 @@ func TestParseParamsSnippets(t *testing.T) {
 						snippetsSE[1],
 					}
 					g.snippetDirs = append([]string{sdPath}, g.snippetDirs...)
+					g.shebangDeps = absPaths(t,
+						filepath.Join(sdPath, snippets[0]),
+						filepath.Join(sdPath, snippets[1]))
 				},
 				"-snippet-dir", filepath.Join("testdata", snippetsDir),
 				p.param, snippets[0],
@@ -843,6 +1399,7 @@ func TestParseParamsCmd(t *testing.T) {
 	testCases = append(testCases,
 		mkTestParser(nil, testhelper.MkID(""), func(g *gosh) {
 			g.scripts[afterSect] = []scriptEntry{fileSE[0], fileSE[1]}
+			g.shebangDeps = absPaths(t, file[0], file[1])
 		}, "-after-file", file[0], "-a-f", file[1]))
 
 	testCases = append(testCases,
@@ -858,6 +1415,7 @@ func TestParseParamsCmd(t *testing.T) {
 	testCases = append(testCases,
 		mkTestParser(nil, testhelper.MkID(""), func(g *gosh) {
 			g.scripts[beforeSect] = []scriptEntry{fileSE[0], fileSE[1]}
+			g.shebangDeps = absPaths(t, file[0], file[1])
 		}, "-before-file", file[0], "-b-f", file[1]))
 
 	testCases = append(testCases,
@@ -873,6 +1431,7 @@ func TestParseParamsCmd(t *testing.T) {
 	testCases = append(testCases,
 		mkTestParser(nil, testhelper.MkID(""), func(g *gosh) {
 			g.scripts[execSect] = []scriptEntry{fileSE[0], fileSE[1], fileSE[2]}
+			g.shebangDeps = absPaths(t, file[0], file[1], file[2])
 		}, "-exec-file", file[0],
 			"-e-f", file[1],
 			"-shebang", file[2]))
@@ -885,6 +1444,7 @@ func TestParseParamsCmd(t *testing.T) {
 	testCases = append(testCases,
 		mkTestParser(nil, testhelper.MkID(""), func(g *gosh) {
 			g.scripts[globalSect] = []scriptEntry{fileSE[0], fileSE[1]}
+			g.shebangDeps = absPaths(t, file[0], file[1])
 		}, "-global-file", file[0], "-g-f", file[1]))
 
 	testCases = append(testCases,
@@ -7,6 +7,7 @@ func addReferences(ps *param.PSet) error {
 		"This program can be used to verify any changes made when"+
 			" in-place editing (see '-"+paramNameInPlaceEdit+"'). It"+
 			" will find all the files with a '"+origExt+"' extension"+
+			" (the default backup suffix, see '-"+paramNameBackupMode+"')"+
 			" and give you the chance to compare them with the"+
 			" updated version and then to delete the saved copy or to"+
 			" revert the file to the original content"+
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/parser"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nickwells/location.mod/location"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/psetter"
+	"github.com/nickwells/verbose.mod/verbose"
+)
+
+const (
+	paramGroupNameAssert = "cmd-assert"
+
+	paramNameAssert      = "assert"
+	paramNameAssertEqual = "assert-equal"
+
+	assertTag = "assert"
+
+	// assertEqualSep separates the got and want expressions given to the
+	// assert-equal parameter. It is not a Go operator and so cannot appear
+	// in an expression other than in a literal or a comment.
+	assertEqualSep = "=>"
+
+	// assertTestName is the name of the test func which runs the assertions
+	assertTestName = "TestGosh"
+)
+
+var assertParamNames = []string{
+	paramNameAssert,
+	paramNameAssertEqual,
+}
+
+// assertion records the details of an assertion to be tested. For an
+// equality assertion the want expression is set and the expr is the value
+// that the code has got. The text is the value given to the parameter and
+// is used to name the test and to report any failure.
+type assertion struct {
+	text   string
+	expr   string
+	want   string
+	origin srcOrigin
+}
+
+// isEqual returns true if this is an equality assertion
+func (a assertion) isEqual() bool {
+	return a.want != ""
+}
+
+// parseAssertExpr checks that the value is a valid Go expression
+func parseAssertExpr(v string) (string, error) {
+	v = strings.TrimSpace(v)
+
+	if _, err := parser.ParseExpr(v); err != nil {
+		return "", fmt.Errorf("bad assertion: %q is not a Go expression: %w",
+			v, err)
+	}
+
+	return v, nil
+}
+
+// splitAssertEqual splits the value given to the assert-equal parameter
+// into the got and want expressions. The separator is taken to be the
+// first one where the text either side of it are both valid Go expressions.
+func splitAssertEqual(v string) (string, string, error) {
+	if !strings.Contains(v, assertEqualSep) {
+		return "", "", fmt.Errorf("bad assertion: %q"+
+			" (it should be of the form got"+assertEqualSep+"want)", v)
+	}
+
+	for i := 0; i < len(v); i++ {
+		n := strings.Index(v[i:], assertEqualSep)
+		if n < 0 {
+			break
+		}
+
+		i += n
+
+		got := strings.TrimSpace(v[:i])
+		want := strings.TrimSpace(v[i+len(assertEqualSep):])
+
+		_, errGot := parser.ParseExpr(got)
+		_, errWant := parser.ParseExpr(want)
+
+		if errGot == nil && errWant == nil {
+			return got, want, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("bad assertion: %q"+
+		" (there is no '"+assertEqualSep+"' between two Go expressions)", v)
+}
+
+// assertPAF generates the Post-Action func (PAF) that adds the boolean
+// expression to the assertions to be tested.
+//
+// Note that we pass a pointer to the parameter value rather than the string
+// - this is necessary otherwise we are passing the text value at the point
+// the PAF is being generated not at the point where the parameter value is
+// given.
+func assertPAF(g *gosh, v *string) param.ActionFunc {
+	return func(_ location.L, p *param.BaseParam, _ []string) error {
+		expr, err := parseAssertExpr(*v)
+		if err != nil {
+			return err
+		}
+
+		g.asserts = append(g.asserts, assertion{
+			text:   expr,
+			expr:   expr,
+			origin: g.paramOrigin(p),
+		})
+
+		return nil
+	}
+}
+
+// assertEqualPAF generates the Post-Action func (PAF) that adds the pair of
+// got and want expressions to the assertions to be tested.
+//
+// Note that we pass a pointer to the parameter value rather than the string
+// - this is necessary otherwise we are passing the text value at the point
+// the PAF is being generated not at the point where the parameter value is
+// given.
+func assertEqualPAF(g *gosh, v *string) param.ActionFunc {
+	return func(_ location.L, p *param.BaseParam, _ []string) error {
+		got, want, err := splitAssertEqual(*v)
+		if err != nil {
+			return err
+		}
+
+		g.asserts = append(g.asserts, assertion{
+			text:   got + " " + assertEqualSep + " " + want,
+			expr:   got,
+			want:   want,
+			origin: g.paramOrigin(p),
+		})
+
+		return nil
+	}
+}
+
+// addAssertParams returns a func that will add parameters concerned with
+// testing the code with assertions to the passed param.PSet.
+func addAssertParams(g *gosh) func(ps *param.PSet) error {
+	return func(ps *param.PSet) error {
+		ps.AddGroup(paramGroupNameAssert,
+			"parameters relating to testing the code with assertions.")
+
+		const assertModeHelpText = "\n\n" +
+			"Giving this turns the program into a test. The code in" +
+			" the '" + beforeSect + "' and '" + execSect + "' sections" +
+			" is run first, then each assertion is run as a separate" +
+			" subtest and finally the code in the '" + afterSect + "'" +
+			" section is run. The test is written into a test file" +
+			" and built using 'go test -c'. The test binary is run," +
+			" with the '-test.v' flag, from the directory that gosh" +
+			" was run from. The global section and any" +
+			" copied Go files are available to the test so that the" +
+			" code of a package can be tested without writing a test" +
+			" file in the package." +
+			"\n\n" +
+			"The *testing.T is available to your code as '_t'."
+
+		var assertVal string
+
+		ps.Add(paramNameAssert, psetter.String[string]{Value: &assertVal},
+			"follow this with a Go expression which must be true. If"+
+				" it is false the test fails and the expression is"+
+				" reported."+
+				assertModeHelpText,
+			param.AltNames("assert-true"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.PostAction(assertPAF(g, &assertVal)),
+			param.GroupName(paramGroupNameAssert),
+			param.SeeAlso(assertParamNames...),
+			param.SeeAlso(paramNameCopyGoFile),
+		)
+
+		var assertEqualVal string
+
+		ps.Add(paramNameAssertEqual,
+			psetter.String[string]{Value: &assertEqualVal},
+			"follow this with a pair of Go expressions separated by"+
+				" '"+assertEqualSep+"'. The first is the value that the"+
+				" code has got and the second is the value it should"+
+				" have. The want value is converted to the type of the"+
+				" got value and they are compared using"+
+				" reflect.DeepEqual. If they differ the test fails and"+
+				" both the expressions and their values are reported."+
+				assertModeHelpText,
+			param.AltNames("assert-eq"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.PostAction(assertEqualPAF(g, &assertEqualVal)),
+			param.GroupName(paramGroupNameAssert),
+			param.SeeAlso(assertParamNames...),
+			param.SeeAlso(paramNameCopyGoFile),
+		)
+
+		ps.AddFinalCheck(func() error {
+			if !g.hasAsserts() {
+				return nil
+			}
+
+			if g.benchmark {
+				return errors.New(
+					"gosh cannot both benchmark the code and test assertions")
+			}
+
+			if g.runInReadLoop || g.runAsWebserver || g.repl {
+				return errors.New(
+					"gosh cannot test assertions in a read-loop," +
+						" as a webserver or interactively")
+			}
+
+			if len(ps.TrailingParams()) > 0 {
+				return errors.New(
+					"gosh cannot pass arguments to the assertion tests")
+			}
+
+			if g.hasRlimits() {
+				return errors.New(
+					"the resource limits cannot be applied to the" +
+						" assertion tests")
+			}
+
+			return nil
+		})
+
+		return nil
+	}
+}
+
+// hasAsserts returns true if there are assertions to be tested
+func (g *gosh) hasAsserts() bool {
+	return len(g.asserts) > 0
+}
+
+// hasAssertEqual returns true if any of the assertions compare a pair of
+// values
+func (g *gosh) hasAssertEqual() bool {
+	return slices.ContainsFunc(g.asserts, assertion.isEqual)
+}
+
+// printAssertExpr prints the expression on a line of its own, recording
+// that the line comes from the assertion so that any build errors can be
+// reported against it. The part describes which of the expressions in the
+// assertion this is.
+func (g *gosh) printAssertExpr(a assertion, expr, part string) {
+	o := a.origin
+	if part != "" && o.desc != "" {
+		o.desc += " (" + part + ")"
+	}
+
+	g.in()
+	g.printEntry(scriptEntry{value: expr, origin: o}, []string{expr})
+	g.out()
+}
+
+// writeAssertFuncs writes the func which runs the assertions. The program
+// is built by 'go test' and so the main func is empty. The Test func itself is
+// written into a separate test file (see writeAssertTestFile) so that the
+// importer, the formatter and the mapping of build errors, which all work
+// on the gosh file, still apply to the assertions.
+//
+// Each expression is written on a line of its own so that any build errors
+// in it can be mapped back to the parameter that gave it.
+func (g *gosh) writeAssertFuncs() {
+	tag := assertTag
+
+	g.gPrint("", tag)
+	g.gPrint("// main is not used, the assertions are run by 'go test'", tag)
+	g.gPrint("func main() {}", tag)
+	g.gPrint("", tag)
+	g.gPrint("// _testAsserts runs the code and then tests the assertions",
+		tag)
+	g.gPrint("func _testAsserts(_t *testing.T) {", tag)
+	g.in()
+	g.writeScript(beforeSect)
+	g.writeScript(beforeInnerSect)
+	g.writeScript(execSect)
+	g.writeScript(afterInnerSect)
+
+	for _, a := range g.asserts {
+		name := strconv.Quote(a.text)
+
+		g.gPrint("", tag)
+		g.gPrint("_t.Run("+name+", func(_t *testing.T) {", tag)
+		g.in()
+
+		if a.isEqual() {
+			g.gPrint("_got :=", tag)
+			g.printAssertExpr(a, a.expr, "got")
+			g.gPrint("_want := _got", tag)
+			g.gPrint("_want =", tag)
+			g.printAssertExpr(a, a.want, "want")
+			g.gPrint("if !reflect.DeepEqual(_got, _want) {", tag)
+			g.in()
+			g.gPrint(`_t.Errorf("%s\n\t got: %#v\n\twant: %#v", `+
+				name+", _got, _want)", tag)
+			g.out()
+			g.gPrint("}", tag)
+		} else {
+			g.gPrint("var _ok bool =", tag)
+			g.printAssertExpr(a, a.expr, "")
+			g.gPrint("if !_ok {", tag)
+			g.in()
+			g.gPrint(`_t.Errorf("false: %s", `+name+")", tag)
+			g.out()
+			g.gPrint("}", tag)
+		}
+
+		g.out()
+		g.gPrint("})", tag)
+	}
+
+	g.writeScript(afterSect)
+	g.out()
+	g.gPrint("}", tag)
+}
+
+// writeAssertTestFile writes the test file holding the Test func which
+// calls the func in the gosh file that runs the assertions.
+func (g *gosh) writeAssertTestFile() {
+	if !g.hasAsserts() {
+		return
+	}
+
+	const testFilePerms = 0o600 // Owner: Read/Write, the rest, none
+
+	var content bytes.Buffer
+
+	content.WriteString("package main\n\nimport \"testing\"\n")
+	fmt.Fprintf(&content,
+		"\nfunc %s(t *testing.T) { _testAsserts(t) }\n", assertTestName)
+
+	err := os.WriteFile(goshTestFilename, content.Bytes(), testFilePerms)
+	g.reportFatalError("write the test file", goshTestFilename, err)
+}
+
+// assertRunArgs returns the arguments to the test binary which will run
+// the assertion tests
+func (g *gosh) assertRunArgs() []string {
+	args := []string{"-test.v", "-test.run=^" + assertTestName + "$"}
+
+	if g.profile {
+		args = append(args,
+			"-test.cpuprofile="+g.profilePath(profileCPUFilename),
+			"-test.memprofile="+g.profilePath(profileHeapFilename))
+	}
+
+	return args
+}
+
+// runAsserts builds the assertion tests as a test binary and runs it from
+// the directory where gosh was run. It is called from within the gosh
+// directory.
+func (g *gosh) runAsserts(stdout io.Writer) {
+	defer g.dbgStack.Start("runAsserts", "Testing the assertions")()
+
+	intro := g.dbgStack.Tag()
+
+	if !g.makeExecutable() {
+		return
+	}
+
+	if g.dontRun {
+		verbose.Println(intro, " Skipping execution")
+		return
+	}
+
+	g.chdirInto(g.runDir)
+
+	g.executeProgram(g.assertRunArgs(), stdout)
+}
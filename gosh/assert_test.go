@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nickwells/errutil.mod/errutil"
+	"github.com/nickwells/gogen.mod/gogen"
+	"github.com/nickwells/param.mod/v7/paramtest"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// TestParseParamsAssert will use the paramtest.Parser to make sure the
+// behaviour of the parameter setting is as expected. This tests just the
+// parameters in the 'cmd-assert' group.
+func TestParseParamsAssert(t *testing.T) {
+	testCases := []paramtest.Parser{
+		mkTestParser(nil, testhelper.MkID("assertions"),
+			func(g *gosh) {
+				g.asserts = []assertion{
+					{text: "x > 1", expr: "x > 1"},
+					{
+						text: `f(a, "=>") => "b"`,
+						expr: `f(a, "=>")`,
+						want: `"b"`,
+					},
+				}
+			},
+			"-"+paramNameAssert, " x > 1 ",
+			"-assert-eq", `f(a, "=>")=>"b"`),
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New("gosh cannot both benchmark the code"+
+				" and test assertions"))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("assertions and benchmark"),
+				func(g *gosh) {
+					g.benchmark = true
+					g.asserts = []assertion{{text: "true", expr: "true"}}
+				},
+				"-"+paramNameAssert, "true", "-"+paramNameBenchmark))
+	}
+
+	for _, tc := range testCases {
+		_ = tc.Test(t)
+	}
+}
+
+func TestSplitAssertEqual(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		v       string
+		expGot  string
+		expWant string
+	}{
+		{
+			ID:      testhelper.MkID("simple"),
+			v:       "len(s) => 3",
+			expGot:  "len(s)",
+			expWant: "3",
+		},
+		{
+			ID:      testhelper.MkID("separator in a literal"),
+			v:       `strings.Repeat("=>", 2) => "=>=>"`,
+			expGot:  `strings.Repeat("=>", 2)`,
+			expWant: `"=>=>"`,
+		},
+		{
+			ID: testhelper.MkID("no separator"),
+			v:  "len(s) == 3",
+			ExpErr: testhelper.MkExpErr(`bad assertion: "len(s) == 3"`,
+				"(it should be of the form got=>want)"),
+		},
+		{
+			ID: testhelper.MkID("not expressions"),
+			v:  "len(s => 3",
+			ExpErr: testhelper.MkExpErr(`bad assertion: "len(s => 3"`,
+				"(there is no '=>' between two Go expressions)"),
+		},
+	}
+
+	for _, tc := range testCases {
+		got, want, err := splitAssertEqual(tc.v)
+		if testhelper.CheckExpErr(t, err, tc) && err == nil {
+			testhelper.DiffString(t, tc.IDStr(), "got", got, tc.expGot)
+			testhelper.DiffString(t, tc.IDStr(), "want", want, tc.expWant)
+		}
+	}
+}
+
+// writeAssertTestProg writes the assertion test program into the current
+// directory
+func writeAssertTestProg(t *testing.T, g *gosh) {
+	t.Helper()
+
+	g.writeGoFile()
+	g.writeAssertTestFile()
+
+	err := os.WriteFile("go.mod", []byte("module gosh\n\ngo 1.24\n"), 0o600)
+	if err != nil {
+		t.Fatal("Cannot write the go.mod file:", err)
+	}
+}
+
+func TestRunAsserts(t *testing.T) {
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is not available")
+	}
+
+	origGoCmd := gogen.GetGoCmdName()
+	if err := gogen.SetGoCmdName(goCmd); err != nil {
+		t.Fatal("Cannot set the go command:", err)
+	}
+
+	t.Cleanup(func() { _ = gogen.SetGoCmdName(origGoCmd) })
+	t.Setenv("GOFLAGS", "")
+	t.Setenv("GOWORK", "off")
+
+	// the test data is read relative to the directory gosh was run from
+	runDir := t.TempDir()
+
+	if err := os.Mkdir(filepath.Join(runDir, "testdata"), 0o700); err != nil {
+		t.Fatal("Cannot make the testdata directory:", err)
+	}
+
+	err = os.WriteFile(filepath.Join(runDir, "testdata", "data.txt"),
+		[]byte("ab"), 0o600)
+	if err != nil {
+		t.Fatal("Cannot write the test data:", err)
+	}
+
+	goshDir := t.TempDir()
+	t.Chdir(goshDir)
+
+	g := mkTestGosh(func(g *gosh) {
+		g.goshDir = goshDir
+		g.runDir = runDir
+		g.imports = []string{"os", "strings"}
+		g.AddScriptEntry(globalSect, "var n int64", verbatim)
+		g.AddScriptEntry(beforeSect,
+			`b, err := os.ReadFile("testdata/data.txt")`, verbatim)
+		g.AddScriptEntry(beforeSect, `if err != nil { _t.Fatal(err) }`,
+			verbatim)
+		g.AddScriptEntry(beforeSect, `s := strings.Repeat(string(b), 2)`,
+			verbatim)
+		g.AddScriptEntry(execSect, "n = int64(len(s))", verbatim)
+		g.asserts = []assertion{
+			{text: "n == 4", expr: "n == 4"},
+			{text: "n > 4", expr: "n > 4"},
+			{text: "n => 4", expr: "n", want: "4"},
+			{text: `s => "abba"`, expr: "s", want: `"abba"`},
+		}
+	})
+
+	writeAssertTestProg(t, g)
+
+	var stdout bytes.Buffer
+
+	g.runAsserts(&stdout)
+
+	testhelper.DiffInt(t, "failed assertions", "exit status", g.exitStatus, 1)
+
+	out := stdout.String()
+	for _, s := range []string{
+		"--- PASS: TestGosh/n_==_4",
+		"--- FAIL: TestGosh/n_>_4",
+		"false: n > 4",
+		"--- PASS: TestGosh/n_=>_4",
+		"--- FAIL: TestGosh/s_=>_\"abba\"",
+		"s => \"abba\"\n" +
+			"        \t got: \"abab\"\n" +
+			"        \twant: \"abba\"\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("the test output should contain %q", s)
+		}
+	}
+
+	if t.Failed() {
+		t.Log("test output:\n" + out)
+	}
+
+	t.Chdir(t.TempDir())
+
+	g = mkTestGosh(func(g *gosh) {
+		g.AddScriptEntry(execSect, "undefinedFunc()", verbatim)
+		g.asserts = []assertion{{text: "true", expr: "true"}}
+	})
+
+	writeAssertTestProg(t, g)
+
+	g.runAsserts(&stdout)
+
+	testhelper.DiffInt(t, "build failure", "exit status",
+		g.exitStatus, goshExitStatusBuildFail)
+}
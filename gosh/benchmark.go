@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nickwells/check.mod/v2/check"
+	"github.com/nickwells/location.mod/location"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/psetter"
+	"github.com/nickwells/verbose.mod/verbose"
+)
+
+const (
+	paramGroupNameBenchmark = "cmd-benchmark"
+
+	paramNameBenchmark  = "benchmark"
+	paramNameBenchAlt   = "bench-alt"
+	paramNameBenchCount = "bench-count"
+	paramNameProfile    = "profile"
+
+	benchTag   = "benchmark"
+	profileTag = "profile"
+
+	benchExecName = "Exec"
+	benchAltName  = "Alt"
+
+	profileCPUFilename  = "gosh-cpu.pprof"
+	profileHeapFilename = "gosh-heap.pprof"
+)
+
+var benchmarkParamNames = []string{
+	paramNameBenchmark,
+	paramNameBenchAlt,
+	paramNameBenchCount,
+	paramNameProfile,
+}
+
+// benchAltSect returns the name of the script section holding the code for
+// the n'th alternative benchmark
+func benchAltSect(n int) string {
+	return "bench-alt-" + strconv.Itoa(n)
+}
+
+// benchAltPAF generates the Post-Action func (PAF) that adds the code as a
+// new alternative benchmark. Each alternative is benchmarked separately
+// with the same setup code.
+//
+// Note that we pass a pointer to the text of the code rather than the string
+// - this is necessary otherwise we are passing the text value at the point
+// the PAF is being generated not at the point where the parameter value is
+// given.
+func benchAltPAF(g *gosh, text *string) param.ActionFunc {
+	return func(_ location.L, p *param.BaseParam, _ []string) error {
+		sName := benchAltSect(len(g.benchAlts) + 1)
+
+		g.scripts[sName] = []scriptEntry{}
+		g.benchAlts = append(g.benchAlts, sName)
+		g.benchmark = true
+
+		g.addScriptEntryFrom(sName, *text, verbatim, g.paramOrigin(p))
+
+		return nil
+	}
+}
+
+// addBenchmarkParams returns a func that will add parameters concerned with
+// benchmarking and profiling the program to the passed param.PSet.
+func addBenchmarkParams(g *gosh) func(ps *param.PSet) error {
+	return func(ps *param.PSet) error {
+		ps.AddGroup(paramGroupNameBenchmark,
+			"parameters relating to benchmarking and profiling the program.")
+
+		ps.Add(paramNameBenchmark, psetter.Bool{Value: &g.benchmark},
+			"benchmark the code rather than running it. The code in"+
+				" the '"+execSect+"' section is run repeatedly in a"+
+				" benchmark loop with the '"+beforeSect+"' section"+
+				" as setup code which is not timed. The '"+afterSect+"'"+
+				" section is run after the loop. The benchmarks are"+
+				" written into a test file and built using 'go test -c'."+
+				" The test binary is run from the directory that gosh"+
+				" was run from with the '-test.bench' and"+
+				" '-test.benchmem' flags."+
+				"\n\n"+
+				"The *testing.B is available to your code as '_b'.",
+			param.AltNames("bench"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameBenchmark),
+			param.SeeAlso(benchmarkParamNames...),
+		)
+
+		var altCode string
+
+		ps.Add(paramNameBenchAlt, psetter.String[string]{Value: &altCode},
+			"follow this with Go code to be benchmarked as an"+
+				" alternative to the code in the '"+execSect+"'"+
+				" section. Each time this is given it adds a separate"+
+				" benchmark, using the same setup code, and the results"+
+				" of all the benchmarks are reported side by side so"+
+				" that they can be compared."+
+				"\n\n"+
+				"Giving this turns on benchmarking.",
+			param.AltNames("bench-alternative"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.PostAction(benchAltPAF(g, &altCode)),
+			param.GroupName(paramGroupNameBenchmark),
+			param.SeeAlso(benchmarkParamNames...),
+		)
+
+		ps.Add(paramNameBenchCount,
+			psetter.Int[int64]{
+				Value: &g.benchCount,
+				Checks: []check.Int64{
+					check.ValGT[int64](0),
+				},
+			},
+			"run each benchmark this many times. This is passed to"+
+				" the test binary as the '-test.count' flag. Where a"+
+				" benchmark is run several times the side by side"+
+				" comparison shows the average of the results.",
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameBenchmark),
+			param.SeeAlso(benchmarkParamNames...),
+		)
+
+		ps.Add(paramNameProfile, psetter.Bool{Value: &g.profile},
+			"write a CPU profile and a heap profile of the program"+
+				" into the directory that gosh was run from. The"+
+				" profiles are written to '"+profileCPUFilename+"'"+
+				" and '"+profileHeapFilename+"' and can be examined"+
+				" with 'go tool pprof'."+
+				"\n\n"+
+				"The profiles are written when the main func returns"+
+				" so they will not be written if the program calls"+
+				" os.Exit. When benchmarking, the profiles are made"+
+				" by the test binary and cover all the benchmarks.",
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameBenchmark),
+			param.SeeAlso(benchmarkParamNames...),
+		)
+
+		ps.AddFinalCheck(func() error {
+			if !g.benchmark {
+				if p, err := ps.GetParamByName(paramNameBenchCount); err == nil &&
+					p.HasBeenSet() {
+					return fmt.Errorf(
+						"the %q parameter is only used when benchmarking"+
+							" (using the %q parameter)",
+						"-"+paramNameBenchCount, "-"+paramNameBenchmark)
+				}
+
+				return nil
+			}
+
+			if g.runInReadLoop || g.runAsWebserver || g.repl {
+				return errors.New(
+					"gosh cannot benchmark the code in a read-loop," +
+						" as a webserver or interactively")
+			}
+
+			if len(ps.TrailingParams()) > 0 {
+				return errors.New(
+					"gosh cannot pass arguments to the benchmarks")
+			}
+
+			if g.hasRlimits() {
+				return errors.New(
+					"the resource limits cannot be applied to the benchmarks")
+			}
+
+			return nil
+		})
+
+		return nil
+	}
+}
+
+// benchFuncs returns the names of the benchmarks and the sections holding
+// the code to be benchmarked. The exec section is only benchmarked if it
+// has some code in it.
+func (g *gosh) benchFuncs() ([]string, []string) {
+	names := []string{}
+	sects := []string{}
+
+	if len(g.scripts[execSect]) > 0 {
+		names = append(names, benchExecName)
+		sects = append(sects, execSect)
+	}
+
+	for i, sName := range g.benchAlts {
+		names = append(names, benchAltName+strconv.Itoa(i+1))
+		sects = append(sects, sName)
+	}
+
+	return names, sects
+}
+
+// writeBenchFuncs writes the funcs which run the benchmarks. The program is
+// built by 'go test' and so the main func is empty. The Benchmark funcs
+// themselves are written into a separate test file (see
+// writeBenchTestFile) so that the importer, the formatter and the mapping
+// of build errors, which all work on the gosh file, still apply to the
+// code being benchmarked.
+func (g *gosh) writeBenchFuncs() {
+	tag := benchTag
+
+	g.gPrint("", tag)
+	g.gPrint("// main is not used, the benchmarks are run by 'go test'", tag)
+	g.gPrint("func main() {}", tag)
+
+	names, sects := g.benchFuncs()
+
+	for i, name := range names {
+		g.gPrint("", tag)
+		g.gPrint("// _bench"+name+" runs the benchmark loop", tag)
+		g.gPrint("func _bench"+name+"(_b *testing.B) {", tag)
+		g.in()
+		g.writeScript(beforeSect)
+		g.gPrint("for _b.Loop() {", tag)
+		g.in()
+		g.writeScript(beforeInnerSect)
+		g.writeScript(sects[i])
+		g.writeScript(afterInnerSect)
+		g.out()
+		g.gPrint("}", tag)
+		g.writeScript(afterSect)
+		g.out()
+		g.gPrint("}", tag)
+	}
+}
+
+// writeBenchTestFile writes the test file holding the Benchmark funcs. Each
+// one calls the corresponding func in the gosh file.
+func (g *gosh) writeBenchTestFile() {
+	if !g.benchmark {
+		return
+	}
+
+	const benchFilePerms = 0o600 // Owner: Read/Write, the rest, none
+
+	var content bytes.Buffer
+
+	content.WriteString("package main\n\nimport \"testing\"\n")
+
+	names, _ := g.benchFuncs()
+	for _, name := range names {
+		fmt.Fprintf(&content,
+			"\nfunc Benchmark%s(b *testing.B) { _bench%s(b) }\n", name, name)
+	}
+
+	err := os.WriteFile(goshTestFilename, content.Bytes(), benchFilePerms)
+	g.reportFatalError("write the benchmark file", goshTestFilename, err)
+}
+
+// profilePath returns the full pathname of the named profile file
+func (g *gosh) profilePath(name string) string {
+	return filepath.Join(g.runDir, name)
+}
+
+// writeProfileStart writes the statements which start profiling the
+// program and arrange for the profiles to be written when main returns
+func (g *gosh) writeProfileStart() {
+	if !g.profile {
+		return
+	}
+
+	tag := profileTag
+
+	g.gPrint("_stopProfiles := _startProfiles()", tag)
+	g.gPrint("defer _stopProfiles()", tag)
+}
+
+// writeProfileFunc writes the function which starts the CPU profile and
+// returns a function which stops it and writes the heap profile.
+func (g *gosh) writeProfileFunc() {
+	if !g.profile {
+		return
+	}
+
+	tag := profileTag
+
+	g.gPrint("", tag)
+	g.gPrint("// _startProfiles starts the CPU profile and returns a func"+
+		" which stops it and writes the heap profile", tag)
+	g.gPrint("func _startProfiles() func() {", tag)
+	g.in()
+	g.gPrint("_cpuF, _err := os.Create("+
+		strconv.Quote(g.profilePath(profileCPUFilename))+")", tag)
+	g.gPrint("if _err == nil {", tag)
+	{
+		g.in()
+		g.gPrint("_err = pprof.StartCPUProfile(_cpuF)", tag)
+		g.out()
+	}
+	g.gPrint("}", tag)
+	g.gPrint("if _err != nil {", tag)
+	{
+		g.in()
+		g.gPrintErr(`"Couldn't start the CPU profile: %v\n", _err`, tag)
+		g.out()
+	}
+	g.gPrint("}", tag)
+	g.gPrint("", tag)
+	g.gPrint("return func() {", tag)
+	g.in()
+	g.gPrint("pprof.StopCPUProfile()", tag)
+	g.gPrint("if _cpuF != nil {", tag)
+	{
+		g.in()
+		g.gPrint("_ = _cpuF.Close()", tag)
+		g.out()
+	}
+	g.gPrint("}", tag)
+	g.gPrint("", tag)
+	g.gPrint("_heapF, _err := os.Create("+
+		strconv.Quote(g.profilePath(profileHeapFilename))+")", tag)
+	g.gPrint("if _err == nil {", tag)
+	{
+		g.in()
+		g.gPrint("runtime.GC()", tag)
+		g.gPrint("_err = pprof.WriteHeapProfile(_heapF)", tag)
+		g.gPrint("if _closeErr := _heapF.Close(); _err == nil {", tag)
+		{
+			g.in()
+			g.gPrint("_err = _closeErr", tag)
+			g.out()
+		}
+		g.gPrint("}", tag)
+		g.out()
+	}
+	g.gPrint("}", tag)
+	g.gPrint("if _err != nil {", tag)
+	{
+		g.in()
+		g.gPrintErr(`"Couldn't write the heap profile: %v\n", _err`, tag)
+		g.out()
+	}
+	g.gPrint("}", tag)
+	g.out()
+	g.gPrint("}", tag)
+	g.out()
+	g.gPrint("}", tag)
+}
+
+// benchRunArgs returns the arguments to the test binary which will run the
+// benchmarks
+func (g *gosh) benchRunArgs() []string {
+	args := []string{"-test.run=^$", "-test.bench=.", "-test.benchmem"}
+
+	if g.benchCount > 0 {
+		args = append(args,
+			"-test.count="+strconv.FormatInt(g.benchCount, 10))
+	}
+
+	if g.profile {
+		args = append(args,
+			"-test.cpuprofile="+g.profilePath(profileCPUFilename),
+			"-test.memprofile="+g.profilePath(profileHeapFilename))
+	}
+
+	return args
+}
+
+// runBenchmarks builds the benchmarks as a test binary and runs it from the
+// directory where gosh was run and, if there is more than one benchmark,
+// reports the results side by side. It is called from within the gosh
+// directory.
+func (g *gosh) runBenchmarks() {
+	defer g.dbgStack.Start("runBenchmarks", "Running the benchmarks")()
+
+	intro := g.dbgStack.Tag()
+
+	if !g.makeExecutable() {
+		return
+	}
+
+	if g.dontRun {
+		verbose.Println(intro, " Skipping execution")
+		return
+	}
+
+	g.chdirInto(g.runDir)
+
+	var stdout bytes.Buffer
+
+	g.executeProgram(g.benchRunArgs(), io.MultiWriter(os.Stdout, &stdout))
+
+	if g.exitStatus != 0 {
+		return
+	}
+
+	if results := parseBenchResults(&stdout); len(results) > 1 {
+		fmt.Println()
+		reportBenchResults(os.Stdout, results)
+	}
+}
+
+// benchLineRE matches a line of benchmark results from 'go test'. The
+// submatches are the benchmark name and the results following the count of
+// iterations.
+var benchLineRE = regexp.MustCompile(`^Benchmark(\S+?)(?:-\d+)?\s+\d+\s+(.*)$`)
+
+// benchResult holds the average of the results for one benchmark
+type benchResult struct {
+	name    string
+	runs    int
+	units   []string
+	metrics map[string]float64
+}
+
+// parseBenchResults reads the output from 'go test' and returns the
+// results for each benchmark, in the order they first appear. Where a
+// benchmark has been run several times the results are averaged.
+func parseBenchResults(r io.Reader) []*benchResult {
+	results := []*benchResult{}
+	byName := map[string]*benchResult{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m := benchLineRE.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+
+		br, ok := byName[m[1]]
+		if !ok {
+			br = &benchResult{name: m[1], metrics: map[string]float64{}}
+			byName[m[1]] = br
+			results = append(results, br)
+		}
+
+		br.runs++
+
+		fields := strings.Fields(m[2])
+		for i := 0; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				continue
+			}
+
+			unit := fields[i+1]
+			if _, ok := br.metrics[unit]; !ok {
+				br.units = append(br.units, unit)
+			}
+
+			br.metrics[unit] += v
+		}
+	}
+
+	for _, br := range results {
+		for unit := range br.metrics {
+			br.metrics[unit] /= float64(br.runs)
+		}
+	}
+
+	return results
+}
+
+// reportBenchResults writes the benchmark results side by side. The time
+// taken by each benchmark is also shown relative to the first one.
+func reportBenchResults(w io.Writer, results []*benchResult) {
+	const nsPerOp = "ns/op"
+
+	units := []string{}
+
+	for _, br := range results {
+		for _, u := range br.units {
+			if !slices.Contains(units, u) {
+				units = append(units, u)
+			}
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprint(tw, "benchmark\t")
+
+	for _, u := range units {
+		fmt.Fprint(tw, u+"\t")
+	}
+
+	fmt.Fprintln(tw, "vs "+results[0].name+"\t")
+
+	base := results[0].metrics[nsPerOp]
+
+	for _, br := range results {
+		fmt.Fprint(tw, br.name+"\t")
+
+		for _, u := range units {
+			v, ok := br.metrics[u]
+			if !ok {
+				fmt.Fprint(tw, "-\t")
+				continue
+			}
+
+			fmt.Fprint(tw, formatBenchVal(v)+"\t")
+		}
+
+		if ns, ok := br.metrics[nsPerOp]; ok && base > 0 {
+			fmt.Fprintf(tw, "%.2fx\t", ns/base)
+		} else {
+			fmt.Fprint(tw, "-\t")
+		}
+
+		fmt.Fprintln(tw)
+	}
+
+	tw.Flush() //nolint:errcheck
+}
+
+// formatBenchVal formats the benchmark value. Large values and whole
+// numbers are shown without a fractional part, other values are shown to
+// three significant figures.
+func formatBenchVal(v float64) string {
+	const bigVal = 100
+
+	if v >= bigVal || v == math.Trunc(v) {
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+
+	return strconv.FormatFloat(v, 'g', 3, 64)
+}
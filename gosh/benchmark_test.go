@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nickwells/errutil.mod/errutil"
+	"github.com/nickwells/gogen.mod/gogen"
+	"github.com/nickwells/param.mod/v7/paramtest"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// TestParseParamsBenchmark will use the paramtest.Parser to make sure the
+// behaviour of the parameter setting is as expected. This tests just the
+// parameters in the 'cmd-benchmark' group.
+func TestParseParamsBenchmark(t *testing.T) {
+	testCases := []paramtest.Parser{
+		mkTestParser(nil, testhelper.MkID("benchmark"),
+			func(g *gosh) {
+				g.benchmark = true
+				g.benchCount = 3
+			},
+			"-bench", "-"+paramNameBenchCount, "3"),
+		mkTestParser(nil, testhelper.MkID("profile"),
+			func(g *gosh) { g.profile = true },
+			"-"+paramNameProfile),
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(`the "-bench-count" parameter is only used when`+
+				` benchmarking (using the "-benchmark" parameter)`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("bench count without benchmarking"),
+				func(g *gosh) { g.benchCount = 3 },
+				"-"+paramNameBenchCount, "3"))
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New("gosh cannot benchmark the code in a read-loop,"+
+				" as a webserver or interactively"))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("benchmark in a read-loop"),
+				func(g *gosh) {
+					g.benchmark = true
+					g.runInReadLoop = true
+				},
+				"-"+paramNameBenchmark, "-"+paramNameReadloop))
+	}
+
+	for _, tc := range testCases {
+		_ = tc.Test(t)
+	}
+}
+
+func TestBenchRunArgs(t *testing.T) {
+	runDir := t.TempDir()
+
+	testCases := []struct {
+		testhelper.ID
+		gs      func(g *gosh)
+		expArgs []string
+	}{
+		{
+			ID: testhelper.MkID("default"),
+			expArgs: []string{
+				"-test.run=^$", "-test.bench=.", "-test.benchmem",
+			},
+		},
+		{
+			ID: testhelper.MkID("count"),
+			gs: func(g *gosh) { g.benchCount = 5 },
+			expArgs: []string{
+				"-test.run=^$", "-test.bench=.", "-test.benchmem",
+				"-test.count=5",
+			},
+		},
+		{
+			ID: testhelper.MkID("profile"),
+			gs: func(g *gosh) { g.profile = true },
+			expArgs: []string{
+				"-test.run=^$", "-test.bench=.", "-test.benchmem",
+				"-test.cpuprofile=" +
+					filepath.Join(runDir, profileCPUFilename),
+				"-test.memprofile=" +
+					filepath.Join(runDir, profileHeapFilename),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(func(g *gosh) {
+			g.benchmark = true
+			g.runDir = runDir
+		})
+
+		if tc.gs != nil {
+			tc.gs(g)
+		}
+
+		testhelper.DiffStringSlice(t, tc.IDStr(), "args",
+			g.benchRunArgs(), tc.expArgs)
+	}
+}
+
+func TestBenchBuildCmdArgs(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		gs      func(g *gosh)
+		expArgs []string
+	}{
+		{
+			ID:      testhelper.MkID("default"),
+			expArgs: []string{"test", "-c", "-o", dfltExecName},
+		},
+		{
+			ID:      testhelper.MkID("build args"),
+			gs:      func(g *gosh) { g.buildArgs = []string{"-race"} },
+			expArgs: []string{"test", "-race", "-c", "-o", dfltExecName},
+		},
+		{
+			ID:      testhelper.MkID("not a benchmark"),
+			gs:      func(g *gosh) { g.benchmark = false },
+			expArgs: []string{"build"},
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(func(g *gosh) { g.benchmark = true })
+
+		if tc.gs != nil {
+			tc.gs(g)
+		}
+
+		testhelper.DiffStringSlice(t, tc.IDStr(), "args",
+			g.buildCmdArgs(), tc.expArgs)
+	}
+}
+
+func TestBenchResults(t *testing.T) {
+	const goTestOutput = `goos: linux
+goarch: amd64
+pkg: G
+BenchmarkExec-8   	1000000	       100.0 ns/op	     208 B/op	       1 allocs/op
+BenchmarkExec-8   	1000000	       110.0 ns/op	     208 B/op	       1 allocs/op
+BenchmarkAlt1-8   	 500000	       210.5 ns/op	     336 B/op	       2 allocs/op
+BenchmarkAlt2     	 500000	         0.5 ns/op
+PASS
+ok  	G	4.929s
+`
+
+	results := parseBenchResults(strings.NewReader(goTestOutput))
+
+	var out bytes.Buffer
+
+	reportBenchResults(&out, results)
+
+	testhelper.DiffString(t, "benchmark results", "report", out.String(),
+		"  benchmark  ns/op  B/op  allocs/op  vs Exec\n"+
+			"       Exec    105   208          1    1.00x\n"+
+			"       Alt1    210   336          2    2.00x\n"+
+			"       Alt2    0.5     -          -    0.00x\n")
+}
+
+func TestRunBenchFuncs(t *testing.T) {
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is not available")
+	}
+
+	t.Chdir(t.TempDir())
+
+	g := mkTestGosh(func(g *gosh) {
+		g.benchmark = true
+		g.imports = []string{"strings"}
+		g.AddScriptEntry(beforeSect, `s := strings.Repeat("x", 10)`, verbatim)
+		g.AddScriptEntry(execSect, `_ = s + s`, verbatim)
+	})
+
+	altSect := benchAltSect(1)
+	g.scripts[altSect] = []scriptEntry{}
+	g.benchAlts = []string{altSect}
+	g.AddScriptEntry(altSect, `_ = strings.ToUpper(s)`, verbatim)
+
+	g.writeGoFile()
+	g.writeBenchTestFile()
+
+	if g.errMap.HasErrors() {
+		var errs bytes.Buffer
+
+		g.errMap.Report(&errs, "gosh")
+		t.Fatal("Cannot write the program:", errs.String())
+	}
+
+	err = os.WriteFile("go.mod", []byte("module gosh\n\ngo 1.24\n"), 0o600)
+	if err != nil {
+		t.Fatal("Cannot write the go.mod file:", err)
+	}
+
+	cmd := exec.Command(goCmd,
+		"test", "-run=^$", "-bench=.", "-benchtime=1x")
+	cmd.Env = append(os.Environ(), "GOFLAGS=", "GOWORK=off")
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		prog, _ := os.ReadFile(goshFilename)
+		t.Log("Program:\n" + string(prog))
+		t.Fatal("Cannot run the benchmarks:", err, "\n"+string(out))
+	}
+
+	var names []string
+	for _, br := range parseBenchResults(bytes.NewReader(out)) {
+		names = append(names, br.name)
+	}
+
+	testhelper.DiffStringSlice(t, "benchmarks", "names", names,
+		[]string{benchExecName, benchAltName + "1"})
+}
+
+func TestRunBenchmarks(t *testing.T) {
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is not available")
+	}
+
+	origGoCmd := gogen.GetGoCmdName()
+	if err := gogen.SetGoCmdName(goCmd); err != nil {
+		t.Fatal("Cannot set the go command:", err)
+	}
+
+	t.Cleanup(func() { _ = gogen.SetGoCmdName(origGoCmd) })
+	t.Setenv("GOFLAGS", "")
+	t.Setenv("GOWORK", "off")
+
+	runDir := t.TempDir()
+
+	err = os.WriteFile(filepath.Join(runDir, "data.txt"), []byte("x"), 0o600)
+	if err != nil {
+		t.Fatal("Cannot write the data file:", err)
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		code      string
+		gs        func(g *gosh)
+		expStatus int
+	}{
+		{
+			// the file is read relative to the directory gosh was run
+			// from
+			ID: testhelper.MkID("good"),
+			code: `if _, err := os.ReadFile("data.txt"); err != nil {` +
+				` _b.Fatal(err) }`,
+		},
+		{
+			ID:        testhelper.MkID("build failure"),
+			code:      `undefinedFunc()`,
+			expStatus: goshExitStatusBuildFail,
+		},
+		{
+			ID:   testhelper.MkID("timeout"),
+			code: `time.Sleep(time.Hour)`,
+			gs: func(g *gosh) {
+				g.runTimeout = time.Second
+				g.runTimeoutGrace = time.Second
+			},
+			expStatus: goshExitStatusRunLimit,
+		},
+	}
+
+	for _, tc := range testCases {
+		goshDir := t.TempDir()
+		t.Chdir(goshDir)
+
+		g := mkTestGosh(func(g *gosh) {
+			g.benchmark = true
+			g.goshDir = goshDir
+			g.runDir = runDir
+			g.imports = []string{"os", "time"}
+			g.AddScriptEntry(execSect, "_ = os.Args", verbatim)
+			g.AddScriptEntry(execSect, "_ = time.Now", verbatim)
+			g.AddScriptEntry(execSect, tc.code, verbatim)
+		})
+
+		if tc.gs != nil {
+			tc.gs(g)
+		}
+
+		g.writeGoFile()
+		g.writeBenchTestFile()
+
+		err := os.WriteFile("go.mod", []byte("module gosh\n\ngo 1.24\n"),
+			0o600)
+		if err != nil {
+			t.Fatal("Cannot write the go.mod file:", err)
+		}
+
+		g.runBenchmarks()
+
+		testhelper.DiffInt(t, tc.IDStr(), "exit status",
+			g.exitStatus, tc.expStatus)
+	}
+}
+
+func TestWriteProfile(t *testing.T) {
+	runDir := t.TempDir()
+
+	g := mkTestGosh(func(g *gosh) {
+		g.profile = true
+		g.runDir = runDir
+		g.AddScriptEntry(execSect, `fmt.Println("profiled")`, verbatim)
+	})
+
+	execPath := buildTestProg(t, g)
+
+	stdout, stderr, status := runTestProg(t, execPath, "")
+
+	testhelper.DiffString(t, "profile", "stderr", stderr, "")
+	testhelper.DiffInt(t, "profile", "exit status", status, 0)
+	testhelper.DiffString(t, "profile", "stdout", stdout, "profiled\n")
+
+	for _, name := range []string{profileCPUFilename, profileHeapFilename} {
+		info, err := os.Stat(filepath.Join(runDir, name))
+		if err != nil {
+			t.Errorf("the profile was not written: %v", err)
+			continue
+		}
+
+		if info.Size() == 0 {
+			t.Errorf("the profile is empty: %s", name)
+		}
+	}
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/nickwells/check.mod/v2/check"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/psetter"
+	"github.com/nickwells/verbose.mod/verbose"
+	"github.com/nickwells/xdg.mod/xdg"
+)
+
+const (
+	paramGroupNameBuildCache = "cmd-build-cache"
+
+	paramNameBuildCache       = "build-cache"
+	paramNameBuildCacheDir    = "build-cache-dir"
+	paramNameBuildCacheMaxAge = "build-cache-max-age"
+	paramNameBuildCacheMaxMB  = "build-cache-max-size"
+	paramNameBuildCacheList   = "build-cache-list"
+	paramNameBuildCacheClear  = "build-cache-clear"
+	paramNameBuildCacheStale  = "build-cache-list-stale"
+	paramNameBuildCacheBuild  = "build-cache-rebuild"
+
+	// buildCacheVersion is included in every cache key. Changing it will
+	// invalidate all existing entries in the build cache.
+	buildCacheVersion = "1"
+
+	dfltBuildCacheMaxAge = 30 * 24 * time.Hour
+	dfltBuildCacheMaxMB  = 500
+
+	bytesPerMB = 1024 * 1024
+)
+
+var buildCacheParamNames = []string{
+	paramNameBuildCache,
+	paramNameBuildCacheDir,
+	paramNameBuildCacheMaxAge,
+	paramNameBuildCacheMaxMB,
+	paramNameBuildCacheList,
+	paramNameBuildCacheClear,
+	paramNameBuildCacheStale,
+	paramNameBuildCacheBuild,
+}
+
+// buildCacheRebuildAltNames are the alternative names for the parameter
+// forcing the program to be rebuilt
+var buildCacheRebuildAltNames = []string{"cache-rebuild", "rebuild"}
+
+// buildCacheEnvVars lists the environment variables which can change the
+// program that 'go build' generates from the same source
+var buildCacheEnvVars = []string{
+	"CGO_ENABLED",
+	"GOARCH",
+	"GOEXPERIMENT",
+	"GOFLAGS",
+	"GOOS",
+}
+
+// buildCacheEntry records the details of an entry in the build cache
+type buildCacheEntry struct {
+	key      string
+	path     string
+	lastUsed time.Time
+	size     int64
+}
+
+// dfltBuildCacheDir returns the default directory where built programs are
+// cached
+func dfltBuildCacheDir() string {
+	return filepath.Join(xdg.CacheHome(),
+		"github.com",
+		"nickwells",
+		"utilities",
+		"gosh",
+		"build")
+}
+
+// addBuildCacheParams returns a func that will add parameters concerned
+// with caching the built programs to the passed param.PSet.
+func addBuildCacheParams(g *gosh) func(ps *param.PSet) error {
+	return func(ps *param.PSet) error {
+		ps.AddGroup(paramGroupNameBuildCache,
+			"parameters relating to the cache of built programs.")
+
+		ps.Add(paramNameBuildCache,
+			psetter.Bool{Value: &g.useBuildCache},
+			"keep a copy of the built program in a cache and, if an"+
+				" identical program is requested again, run the cached"+
+				" copy rather than building it again."+
+				"\n\n"+
+				"The cache is not used if the program is being edited or"+
+				" if it is not being run."+
+				"\n\n"+
+				"For programs built from shebang scripts the cache is"+
+				" checked before the program is constructed, give this"+
+				" on a '"+shebangGoshParam+"' line in the script to"+
+				" use it.",
+			param.AltNames("cache"),
+			param.GroupName(paramGroupNameBuildCache),
+			param.SeeAlso(buildCacheParamNames...),
+			param.SeeNote(noteBuildCache),
+		)
+
+		ps.Add(paramNameBuildCacheDir,
+			psetter.Pathname{
+				Value:         &g.buildCacheDir,
+				ForceAbsolute: true,
+			},
+			"set the directory where built programs are cached. The"+
+				" directory will be created if it does not exist.",
+			param.AltNames("cache-dir"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameBuildCache),
+			param.SeeAlso(buildCacheParamNames...),
+		)
+
+		ps.Add(paramNameBuildCacheMaxAge,
+			psetter.Duration{
+				Value: &g.buildCacheMaxAge,
+				Checks: []check.Duration{
+					check.ValGT[time.Duration](0),
+				},
+			},
+			"set the maximum time that a program can stay in the"+
+				" build cache without being used. Older entries are"+
+				" removed whenever a new program is added to the cache.",
+			param.AltNames("cache-max-age"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameBuildCache),
+			param.SeeAlso(buildCacheParamNames...),
+		)
+
+		ps.Add(paramNameBuildCacheMaxMB,
+			psetter.Int[int64]{
+				Value: &g.buildCacheMaxMB,
+				Checks: []check.Int64{
+					check.ValGT[int64](0),
+				},
+			},
+			"set the maximum size of the build cache in megabytes."+
+				" If the cache is bigger than this after a new program"+
+				" is added then the least recently used entries are"+
+				" removed until it is no longer too big.",
+			param.AltNames("cache-max-size", "build-cache-max-mb"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameBuildCache),
+			param.SeeAlso(buildCacheParamNames...),
+		)
+
+		ps.Add(paramNameBuildCacheList,
+			psetter.Bool{Value: &g.buildCacheList},
+			"list the entries in the build cache and exit, no"+
+				" program is run.",
+			param.AltNames("cache-list"),
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameBuildCache),
+			param.SeeAlso(buildCacheParamNames...),
+		)
+
+		ps.Add(paramNameBuildCacheClear,
+			psetter.Bool{Value: &g.buildCacheClear},
+			"remove all the entries from the build cache and exit, no"+
+				" program is run. If the cache is also being listed"+
+				" the entries are shown before they are removed.",
+			param.AltNames("cache-clear"),
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameBuildCache),
+			param.SeeAlso(buildCacheParamNames...),
+		)
+
+		ps.Add(paramNameBuildCacheStale,
+			psetter.Bool{Value: &g.buildCacheListStale},
+			"list the entries in the build cache which were built from"+
+				" shebang scripts and which will never be used again,"+
+				" and exit, no program is run. An entry is stale if"+
+				" any of its scripts, or of the files or directories it"+
+				" depends on, has been changed or removed or if"+
+				" gosh or Go has changed since it was built. If the"+
+				" cache is also being cleared then only the stale"+
+				" entries are removed.",
+			param.AltNames("cache-list-stale"),
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameBuildCache),
+			param.SeeAlso(buildCacheParamNames...),
+			param.SeeNote(noteBuildCache),
+		)
+
+		ps.Add(paramNameBuildCacheBuild,
+			psetter.Bool{Value: &g.buildCacheRebuild},
+			"build the program even if it is in the build cache. The"+
+				" newly built program replaces the cached copy."+
+				"\n\n"+
+				"This can be used to pick up changes which the build"+
+				" cache does not detect.",
+			param.AltNames(buildCacheRebuildAltNames...),
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameBuildCache),
+			param.SeeAlso(buildCacheParamNames...),
+			param.SeeNote(noteBuildCache),
+		)
+
+		return nil
+	}
+}
+
+// manageBuildCache checks the build cache parameters and lists or clears
+// the cache accordingly. If either is done then the program will exit
+// after it is complete.
+func manageBuildCache(g *gosh) {
+	if !g.buildCacheList && !g.buildCacheClear && !g.buildCacheListStale {
+		return
+	}
+
+	entries, err := g.buildCacheEntries()
+	g.reportFatalError("read the build cache", g.buildCacheDir, err)
+
+	switch {
+	case g.buildCacheListStale:
+		stale, err := staleBuildCacheEntries(entries)
+		g.reportFatalError("find the stale build cache entries",
+			g.buildCacheDir, err)
+
+		listStaleBuildCache(stale)
+
+		entries = entries[:0]
+		for _, e := range stale {
+			entries = append(entries, e.buildCacheEntry)
+		}
+	case g.buildCacheList:
+		listBuildCache(entries)
+	}
+
+	if g.buildCacheClear {
+		for _, e := range entries {
+			err := os.RemoveAll(e.path)
+			g.reportFatalError("remove the build cache entry", e.path, err)
+		}
+	}
+
+	os.Exit(0)
+}
+
+// listBuildCache prints the build cache entries, most recently used first
+func listBuildCache(entries []buildCacheEntry) {
+	var total int64
+
+	slices.SortFunc(entries, func(a, b buildCacheEntry) int {
+		return b.lastUsed.Compare(a.lastUsed)
+	})
+
+	for _, e := range entries {
+		fmt.Printf("%s %8.1fMB %s\n",
+			e.lastUsed.Format(time.DateTime),
+			float64(e.size)/bytesPerMB,
+			e.path)
+
+		total += e.size
+	}
+
+	fmt.Printf("%d entries, %.1fMB in total\n",
+		len(entries), float64(total)/bytesPerMB)
+}
+
+// buildCacheUsable returns true if the build cache should be used
+func (g *gosh) buildCacheUsable() bool {
+	return g.useBuildCache && !g.edit && !g.dontRun && !g.benchmark &&
+		!g.hasAsserts()
+}
+
+// buildCacheEntryDir returns the name of the directory holding the cache
+// entry for the current program
+func (g *gosh) buildCacheEntryDir() string {
+	return filepath.Join(g.buildCacheDir, g.buildCacheKey)
+}
+
+// execPath returns the pathname of the program to be run. This is the
+// program in the gosh directory unless a copy has been found in the build
+// cache.
+func (g *gosh) execPath() string {
+	if g.cachedExec != "" {
+		return g.cachedExec
+	}
+
+	return filepath.Join(g.goshDir, g.execName)
+}
+
+// runFromBuildCache looks for a previously built copy of the program in the
+// build cache and, if one is found, runs it. It returns true if the cached
+// program was run, false otherwise. It is run from within the gosh
+// directory after the program has been constructed but before the imports
+// have been populated. If the cache key has already been made from the
+// shebang scripts then the cache has already been checked.
+func (g *gosh) runFromBuildCache() bool {
+	if !g.buildCacheUsable() || g.buildCacheKey != "" {
+		return false
+	}
+
+	defer g.dbgStack.Start("runFromBuildCache",
+		"Checking the build cache")()
+
+	intro := g.dbgStack.Tag()
+
+	key, err := g.makeBuildCacheKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr,
+			"gosh couldn't make the build cache key:", err)
+
+		return false
+	}
+
+	g.buildCacheKey = key
+	verbose.Println(intro, " Cache key: ", key)
+
+	if !g.findInBuildCache(intro) {
+		return false
+	}
+
+	g.chdirInto(g.runDir)
+	g.executeProgram(g.args, os.Stdout)
+
+	return true
+}
+
+// findInBuildCache looks in the build cache for the program with the
+// current cache key. If it is found the cached program is recorded as the
+// program to be run and it returns true. The cache is not checked if the
+// program is to be rebuilt.
+func (g *gosh) findInBuildCache(intro string) bool {
+	if g.buildCacheRebuild {
+		verbose.Println(intro, " Rebuilding, the build cache is not checked")
+		return false
+	}
+
+	entryDir := g.buildCacheEntryDir()
+	execPath := filepath.Join(entryDir, g.execName)
+
+	if _, err := os.Stat(execPath); err != nil {
+		verbose.Println(intro, " Not found in the build cache")
+		return false
+	}
+
+	verbose.Println(intro, " Found in the build cache: ", execPath)
+
+	now := time.Now()
+	if err := os.Chtimes(entryDir, now, now); err != nil {
+		verbose.Println(intro, " Couldn't record the cache use: ", err.Error())
+	}
+
+	g.cachedExec = execPath
+
+	return true
+}
+
+// makeBuildCacheKey returns a hash of everything which determines the
+// program that will be built. It is run from within the gosh directory.
+func (g *gosh) makeBuildCacheKey() (string, error) {
+	h := sha256.New()
+
+	goVer, err := goVersion()
+	if err != nil {
+		return "", err
+	}
+
+	addToHash(h, "version", buildCacheVersion)
+	addToHash(h, "go-version", goVer)
+	addToHash(h, "exec-name", g.execName)
+	addToHash(h, "importer", g.importPopulator)
+	addToHash(h, "importer-args", g.importPopulatorArgs...)
+	addToHash(h, "build-args", g.buildArgs...)
+	addToHash(h, "workspace", g.workspace...)
+
+	for _, k := range slices.Sorted(maps.Keys(g.localModules)) {
+		addToHash(h, "local-module", k, g.localModules[k])
+	}
+
+	for _, ev := range buildCacheEnvVars {
+		addToHash(h, "env", ev, os.Getenv(ev))
+	}
+
+	dirEntries, err := os.ReadDir(".")
+	if err != nil {
+		return "", err
+	}
+
+	for _, de := range dirEntries {
+		if de.IsDir() || filepath.Ext(de.Name()) != ".go" {
+			continue
+		}
+
+		content, err := os.ReadFile(de.Name())
+		if err != nil {
+			return "", err
+		}
+
+		addToHash(h, "file", de.Name(), string(content))
+	}
+
+	for _, name := range g.embedFileNames() {
+		content, err := os.ReadFile(name) //nolint:gosec
+		if err != nil {
+			return "", err
+		}
+
+		addToHash(h, "embed-file", name, string(content))
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// addToHash adds the tag and the values to the hash. The lengths are added
+// as well so that different sets of values cannot give the same hash.
+func addToHash(h hash.Hash, tag string, vals ...string) {
+	fmt.Fprintf(h, "%s:%d\n", tag, len(vals))
+
+	for _, v := range vals {
+		fmt.Fprintf(h, "%d:%s\n", len(v), v)
+	}
+}
+
+// addToBuildCache copies the newly built program and its source into the
+// build cache and then prunes the cache. It is run from within the gosh
+// directory. Any problems are reported but are not fatal.
+func (g *gosh) addToBuildCache() {
+	if !g.buildCacheUsable() || g.buildCacheKey == "" {
+		return
+	}
+
+	defer g.dbgStack.Start("addToBuildCache",
+		"Adding the program to the build cache")()
+
+	intro := g.dbgStack.Tag()
+
+	const (
+		cacheDirPerms    = 0o700 // Owner: Read/Write/Exec, the rest, none
+		shebangInfoPerms = 0o600 // Owner: Read/Write, the rest, none
+	)
+
+	entryDir := g.buildCacheEntryDir()
+
+	verbose.Println(intro, " Cache entry: ", entryDir)
+
+	err := os.MkdirAll(entryDir, cacheDirPerms)
+	if err == nil {
+		err = copyFile(goshFilename, filepath.Join(entryDir, goshFilename))
+	}
+
+	if err == nil {
+		err = copyFile(g.execName, filepath.Join(entryDir, g.execName))
+	}
+
+	if err == nil && g.shebangCacheInfo != "" {
+		err = os.WriteFile(filepath.Join(entryDir, shebangCacheInfoFile),
+			[]byte(g.shebangCacheInfo), shebangInfoPerms)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr,
+			"gosh couldn't add the program to the build cache:", err)
+
+		return
+	}
+
+	g.pruneBuildCache()
+}
+
+// copyFile copies the contents and permissions of the from file to the to
+// file. The copy is written to a temporary file which is then renamed so
+// that a partial copy is never seen.
+func copyFile(from, to string) error {
+	src, err := os.Open(from) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.CreateTemp(filepath.Dir(to), filepath.Base(to)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name()) //nolint:errcheck
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Chmod(info.Mode())
+	}
+
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(dst.Name(), to)
+}
+
+// pruneBuildCache removes the entries from the build cache which have not
+// been used for longer than the maximum age. Then, if the cache is still
+// bigger than the maximum size, it removes the least recently used entries
+// until it is not.
+func (g *gosh) pruneBuildCache() {
+	defer g.dbgStack.Start("pruneBuildCache", "Pruning the build cache")()
+
+	intro := g.dbgStack.Tag()
+
+	entries, err := g.buildCacheEntries()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gosh couldn't prune the build cache:", err)
+		return
+	}
+
+	slices.SortFunc(entries, func(a, b buildCacheEntry) int {
+		return a.lastUsed.Compare(b.lastUsed)
+	})
+
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+
+	oldest := time.Now().Add(-g.buildCacheMaxAge)
+	maxSize := g.buildCacheMaxMB * bytesPerMB
+
+	for _, e := range entries {
+		if e.key == g.buildCacheKey {
+			continue
+		}
+
+		if !e.lastUsed.Before(oldest) && total <= maxSize {
+			continue
+		}
+
+		verbose.Println(intro, " Removing: ", e.path)
+
+		if err := os.RemoveAll(e.path); err != nil {
+			fmt.Fprintln(os.Stderr,
+				"gosh couldn't remove the build cache entry:", err)
+
+			continue
+		}
+
+		total -= e.size
+	}
+}
+
+// buildCacheEntries returns the entries in the build cache. A missing cache
+// directory is not an error, it is treated as an empty cache.
+func (g *gosh) buildCacheEntries() ([]buildCacheEntry, error) {
+	dirEntries, err := os.ReadDir(g.buildCacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	entries := make([]buildCacheEntry, 0, len(dirEntries))
+
+	for _, de := range dirEntries {
+		if !de.IsDir() || !isBuildCacheKey(de.Name()) {
+			continue
+		}
+
+		info, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		e := buildCacheEntry{
+			key:      de.Name(),
+			path:     filepath.Join(g.buildCacheDir, de.Name()),
+			lastUsed: info.ModTime(),
+		}
+
+		files, err := os.ReadDir(e.path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			if fi, err := f.Info(); err == nil {
+				e.size += fi.Size()
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// isBuildCacheKey returns true if the name could be a build cache key
+func isBuildCacheKey(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(name)
+
+	return err == nil
+}
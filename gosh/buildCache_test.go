@@ -0,0 +1,232 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nickwells/param.mod/v7/paramtest"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// TestParseParamsBuildCache will use the paramtest.Parser to make sure the
+// behaviour of the parameter setting is as expected. This tests just the
+// parameters in the 'cmd-build-cache' group.
+func TestParseParamsBuildCache(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal("Cannot find the current working directory:", err)
+	}
+
+	testCases := []paramtest.Parser{}
+
+	for _, p := range []string{"-build-cache", "-cache"} {
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("use the build cache: "+p),
+				func(g *gosh) { g.useBuildCache = true },
+				p))
+	}
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("build cache dir"),
+			func(g *gosh) {
+				g.buildCacheDir = filepath.Join(cwd, "testdata", "cache")
+			},
+			"-build-cache-dir", "testdata/cache"))
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("build cache max age"),
+			func(g *gosh) { g.buildCacheMaxAge = 2 * time.Hour },
+			"-build-cache-max-age", "2h"))
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("build cache max size"),
+			func(g *gosh) { g.buildCacheMaxMB = 42 },
+			"-build-cache-max-size", "42"))
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("build cache list and clear"),
+			func(g *gosh) {
+				g.buildCacheList = true
+				g.buildCacheClear = true
+			},
+			"-build-cache-list", "-build-cache-clear"))
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("build cache list stale"),
+			func(g *gosh) { g.buildCacheListStale = true },
+			"-build-cache-list-stale"))
+
+	for _, p := range []string{"-build-cache-rebuild", "-rebuild"} {
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("rebuild: "+p),
+				func(g *gosh) { g.buildCacheRebuild = true },
+				p))
+	}
+
+	for _, tc := range testCases {
+		_ = tc.Test(t)
+	}
+}
+
+func TestMakeBuildCacheKey(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	writeFile := func(name, content string) {
+		t.Helper()
+
+		if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+			t.Fatal("Cannot write the test file:", err)
+		}
+	}
+
+	makeKey := func(g *gosh) string {
+		t.Helper()
+
+		key, err := g.makeBuildCacheKey()
+		if err != nil {
+			t.Fatal("Cannot make the build cache key:", err)
+		}
+
+		if !isBuildCacheKey(key) {
+			t.Errorf("bad build cache key: %q", key)
+		}
+
+		return key
+	}
+
+	writeFile(goshFilename, "package main\n")
+
+	baseKey := makeKey(mkTestGosh())
+
+	testhelper.DiffString(t, "same program", "key",
+		makeKey(mkTestGosh()), baseKey)
+
+	testCases := []struct {
+		testhelper.ID
+		g       *gosh
+		setFile func()
+	}{
+		{
+			ID: testhelper.MkID("build args"),
+			g: mkTestGosh(func(g *gosh) {
+				g.buildArgs = []string{"-race"}
+			}),
+		},
+		{
+			ID: testhelper.MkID("local modules"),
+			g: mkTestGosh(func(g *gosh) {
+				g.localModules = map[string]string{"a": "/b"}
+			}),
+		},
+		{
+			ID: testhelper.MkID("workspace"),
+			g: mkTestGosh(func(g *gosh) {
+				g.workspace = []string{"/a"}
+			}),
+		},
+		{
+			ID: testhelper.MkID("executable name"),
+			g: mkTestGosh(func(g *gosh) {
+				g.execName = "X"
+			}),
+		},
+		{
+			ID: testhelper.MkID("program changed"),
+			g:  mkTestGosh(),
+			setFile: func() {
+				writeFile(goshFilename, "package main\n\nfunc main() {}\n")
+			},
+		},
+		{
+			ID: testhelper.MkID("copied file added"),
+			g:  mkTestGosh(),
+			setFile: func() {
+				writeFile("goshCopy00x.go", "package main\n")
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		writeFile(goshFilename, "package main\n")
+		os.Remove("goshCopy00x.go") //nolint:errcheck
+
+		if tc.setFile != nil {
+			tc.setFile()
+		}
+
+		if key := makeKey(tc.g); key == baseKey {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: the build cache key should have changed")
+		}
+	}
+}
+
+func TestPruneBuildCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	now := time.Now()
+
+	entries := []struct {
+		key      string
+		age      time.Duration
+		size     int
+		expGone  bool
+		isLatest bool
+	}{
+		{key: strings.Repeat("a", 64), age: time.Minute, size: bytesPerMB},
+		{
+			key: strings.Repeat("b", 64), age: 2 * time.Minute,
+			size: bytesPerMB, expGone: true,
+		},
+		{
+			key: strings.Repeat("c", 64), age: 48 * time.Hour,
+			size: 1, expGone: true,
+		},
+		{
+			key: strings.Repeat("d", 64), age: 72 * time.Hour,
+			size: bytesPerMB, isLatest: true,
+		},
+	}
+
+	g := mkTestGosh(func(g *gosh) {
+		g.buildCacheDir = cacheDir
+		g.buildCacheMaxAge = 24 * time.Hour
+		g.buildCacheMaxMB = 2
+	})
+
+	for _, e := range entries {
+		dir := filepath.Join(cacheDir, e.key)
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			t.Fatal("Cannot make the cache entry:", err)
+		}
+
+		err := os.WriteFile(filepath.Join(dir, g.execName),
+			make([]byte, e.size), 0o600)
+		if err != nil {
+			t.Fatal("Cannot write the cache entry:", err)
+		}
+
+		then := now.Add(-e.age)
+		if err := os.Chtimes(dir, then, then); err != nil {
+			t.Fatal("Cannot set the cache entry times:", err)
+		}
+
+		if e.isLatest {
+			g.buildCacheKey = e.key
+		}
+	}
+
+	g.pruneBuildCache()
+
+	for _, e := range entries {
+		_, err := os.Stat(filepath.Join(cacheDir, e.key))
+		gone := os.IsNotExist(err)
+
+		if gone != e.expGone {
+			t.Errorf("cache entry %q: gone: %t, expected: %t",
+				e.key[:1], gone, e.expGone)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/nickwells/check.mod/v2/check"
+	"github.com/nickwells/filecheck.mod/filecheck"
+	"github.com/nickwells/param.mod/v7/paction"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/psetter"
+)
+
+const (
+	paramNameBuildOutput = "build-output"
+	paramNameBuildGOOS   = "build-goos"
+	paramNameBuildGOARCH = "build-goarch"
+)
+
+var buildOutputParamNames = []string{
+	paramNameBuildOutput,
+	paramNameBuildGOOS,
+	paramNameBuildGOARCH,
+}
+
+// addBuildOutputParams returns a func that will add parameters concerned
+// with building the program for use elsewhere to the passed param.PSet.
+func addBuildOutputParams(g *gosh) func(ps *param.PSet) error {
+	return func(ps *param.PSet) error {
+		ps.Add(paramNameBuildOutput,
+			psetter.Pathname{
+				Value: &g.buildOutput,
+				Expectation: filecheck.Provisos{
+					Existence: filecheck.Optional,
+				},
+				ForceAbsolute: true,
+			},
+			"write the built program to the given pathname. If this is"+
+				" an existing directory the program is written into it"+
+				" using the name of the program (see the"+
+				" '"+paramNameSetExecName+"' parameter)."+
+				"\n\n"+
+				"The program is built but is not run and the gosh"+
+				" directory is removed afterwards as usual. This, with"+
+				" the '"+paramNameBuildGOOS+"' and"+
+				" '"+paramNameBuildGOARCH+"' parameters, lets you build"+
+				" small tools for other machines without making a"+
+				" module.",
+			param.AltNames("output"),
+			param.ValueName("pathname"),
+			param.PostAction(paction.SetVal(&g.dontRun, true)),
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameGosh),
+			param.SeeAlso(buildOutputParamNames...),
+		)
+
+		targetRE := regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+		targetChecks := []check.String{
+			check.StringMatchesPattern[string](targetRE,
+				"The value must be a lower-case letter followed by"+
+					" zero or more lower-case letters or digits"),
+		}
+
+		ps.Add(paramNameBuildGOOS,
+			psetter.String[string]{
+				Value:  &g.buildGOOS,
+				Checks: targetChecks,
+			},
+			"build the program for the given operating system. This"+
+				" is passed to 'go build' as the GOOS environment"+
+				" variable. Run 'go tool dist list' to see the"+
+				" operating systems and architectures that Go"+
+				" supports."+
+				"\n\n"+
+				"When building for another platform CGO_ENABLED is"+
+				" set to 0 so that the program does not need a C"+
+				" compiler for the target.",
+			param.AltNames("goos"),
+			param.ValueName("os"),
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameGosh),
+			param.SeeAlso(buildOutputParamNames...),
+		)
+
+		ps.Add(paramNameBuildGOARCH,
+			psetter.String[string]{
+				Value:  &g.buildGOARCH,
+				Checks: targetChecks,
+			},
+			"build the program for the given architecture. This is"+
+				" passed to 'go build' as the GOARCH environment"+
+				" variable. Run 'go tool dist list' to see the"+
+				" operating systems and architectures that Go"+
+				" supports."+
+				"\n\n"+
+				"When building for another platform CGO_ENABLED is"+
+				" set to 0 so that the program does not need a C"+
+				" compiler for the target.",
+			param.AltNames("goarch"),
+			param.ValueName("arch"),
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameGosh),
+			param.SeeAlso(buildOutputParamNames...),
+		)
+
+		ps.AddFinalCheck(func() error {
+			if g.buildOutput == "" {
+				if g.buildGOOS != "" || g.buildGOARCH != "" {
+					return fmt.Errorf(
+						"a program built for another platform cannot be"+
+							" run, give the pathname to write it to"+
+							" (using the %q parameter)",
+						"-"+paramNameBuildOutput)
+				}
+
+				return nil
+			}
+
+			if g.repl {
+				return errors.New(
+					"gosh cannot write the program when running" +
+						" interactively")
+			}
+
+			return nil
+		})
+
+		return nil
+	}
+}
+
+// isCrossBuild returns true if the program is being built for another
+// platform
+func (g *gosh) isCrossBuild() bool {
+	return g.buildGOOS != "" || g.buildGOARCH != ""
+}
+
+// buildEnv returns the environment in which 'go build' is run. This sets
+// the target platform if the program is being built for another platform.
+func (g *gosh) buildEnv() []string {
+	env := os.Environ()
+
+	if !g.isCrossBuild() {
+		return env
+	}
+
+	env = append(env, "CGO_ENABLED=0")
+
+	if g.buildGOOS != "" {
+		env = append(env, "GOOS="+g.buildGOOS)
+	}
+
+	if g.buildGOARCH != "" {
+		env = append(env, "GOARCH="+g.buildGOARCH)
+	}
+
+	return env
+}
+
+// buildOutputArgs returns the arguments to 'go build' which set the
+// pathname of the built program. If no output pathname has been given the
+// program is left in the gosh directory and no arguments are needed.
+func (g *gosh) buildOutputArgs() []string {
+	if g.buildOutput == "" {
+		return []string{}
+	}
+
+	return []string{"-o", g.buildOutputPath()}
+}
+
+// buildOutputPath returns the pathname where the built program is
+// written. If the output is an existing directory the program is written
+// into it.
+func (g *gosh) buildOutputPath() string {
+	if g.buildOutput == "" {
+		return g.execName
+	}
+
+	if info, err := os.Stat(g.buildOutput); err == nil && info.IsDir() {
+		return g.buildOutput + string(os.PathSeparator)
+	}
+
+	return g.buildOutput
+}
+
+// testOutputPath returns the pathname where the test binary built for
+// benchmarks or assertions is written. Unlike 'go build', 'go test -c'
+// names a binary written into a directory after the package rather than
+// the program so if the output is an existing directory the program name
+// is given explicitly.
+func (g *gosh) testOutputPath() string {
+	path := g.buildOutputPath()
+	if !strings.HasSuffix(path, string(os.PathSeparator)) {
+		return path
+	}
+
+	path = filepath.Join(path, g.execName)
+
+	goos := g.buildGOOS
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+
+	if goos == "windows" {
+		path += ".exe"
+	}
+
+	return path
+}
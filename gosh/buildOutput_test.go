@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nickwells/errutil.mod/errutil"
+	"github.com/nickwells/param.mod/v7/paramtest"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// TestParseParamsBuildOutput will use the paramtest.Parser to make sure the
+// behaviour of the build output parameters is as expected.
+func TestParseParamsBuildOutput(t *testing.T) {
+	testCases := []paramtest.Parser{
+		mkTestParser(nil, testhelper.MkID("output"),
+			func(g *gosh) {
+				g.buildOutput = "/a/prog"
+				g.buildGOOS = "windows"
+				g.buildGOARCH = "arm64"
+				g.dontRun = true
+			},
+			"-"+paramNameBuildOutput, "/a/prog",
+			"-goos", "windows", "-goarch", "arm64"),
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(`a program built for another platform cannot be`+
+				` run, give the pathname to write it to`+
+				` (using the "-build-output" parameter)`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("target without output"),
+				func(g *gosh) { g.buildGOOS = "plan9" },
+				"-"+paramNameBuildGOOS, "plan9"))
+	}
+
+	for _, tc := range testCases {
+		_ = tc.Test(t)
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	t.Setenv("GOOS", "linux")
+	t.Setenv("GOARCH", "")
+	t.Setenv("CGO_ENABLED", "")
+
+	testCases := []struct {
+		testhelper.ID
+		goos    string
+		goarch  string
+		expVals map[string]string
+	}{
+		{
+			ID: testhelper.MkID("host"),
+			expVals: map[string]string{
+				"GOOS": "linux", "GOARCH": "", "CGO_ENABLED": "",
+			},
+		},
+		{
+			ID:   testhelper.MkID("os"),
+			goos: "windows",
+			expVals: map[string]string{
+				"GOOS": "windows", "GOARCH": "", "CGO_ENABLED": "0",
+			},
+		},
+		{
+			ID:     testhelper.MkID("arch"),
+			goarch: "arm64",
+			expVals: map[string]string{
+				"GOOS": "linux", "GOARCH": "arm64", "CGO_ENABLED": "0",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(func(g *gosh) {
+			g.buildGOOS = tc.goos
+			g.buildGOARCH = tc.goarch
+		})
+
+		// the last setting of a variable is the one that is used
+		vals := map[string]string{}
+
+		for _, ev := range g.buildEnv() {
+			k, v, _ := strings.Cut(ev, "=")
+			vals[k] = v
+		}
+
+		for k, expV := range tc.expVals {
+			testhelper.DiffString(t, tc.IDStr(), k, vals[k], expV)
+		}
+	}
+}
+
+func TestBuildOutputPath(t *testing.T) {
+	dir := t.TempDir()
+
+	testCases := []struct {
+		testhelper.ID
+		output      string
+		goos        string
+		expPath     string
+		expArgs     []string
+		expTestPath string
+	}{
+		{
+			ID:          testhelper.MkID("no output"),
+			expPath:     dfltExecName,
+			expArgs:     []string{},
+			expTestPath: dfltExecName,
+		},
+		{
+			ID:          testhelper.MkID("file"),
+			output:      filepath.Join(dir, "prog"),
+			expPath:     filepath.Join(dir, "prog"),
+			expArgs:     []string{"-o", filepath.Join(dir, "prog")},
+			expTestPath: filepath.Join(dir, "prog"),
+		},
+		{
+			ID:          testhelper.MkID("directory"),
+			output:      dir,
+			goos:        "linux",
+			expPath:     dir + string(os.PathSeparator),
+			expArgs:     []string{"-o", dir + string(os.PathSeparator)},
+			expTestPath: filepath.Join(dir, dfltExecName),
+		},
+		{
+			ID:          testhelper.MkID("directory, windows"),
+			output:      dir,
+			goos:        "windows",
+			expPath:     dir + string(os.PathSeparator),
+			expArgs:     []string{"-o", dir + string(os.PathSeparator)},
+			expTestPath: filepath.Join(dir, dfltExecName+".exe"),
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(func(g *gosh) {
+			g.buildOutput = tc.output
+			g.buildGOOS = tc.goos
+		})
+
+		testhelper.DiffString(t, tc.IDStr(), "output path",
+			g.buildOutputPath(), tc.expPath)
+		testhelper.DiffStringSlice(t, tc.IDStr(), "build args",
+			g.buildOutputArgs(), tc.expArgs)
+		testhelper.DiffString(t, tc.IDStr(), "test output path",
+			g.testOutputPath(), tc.expTestPath)
+	}
+}
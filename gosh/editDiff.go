@@ -0,0 +1,35 @@
+package main
+
+import (
+	_ "embed"
+	"os"
+)
+
+// editDiffSrcName is the name of the source file, relative to the gosh
+// source directory, holding the code which shows the differences made by a
+// dry-run of an in-place edit
+const editDiffSrcName = "editdiff/diff.go"
+
+// editDiffSrc holds the code which shows the differences made by a dry-run
+// of an in-place edit. The code is kept in a package of its own so that it
+// can be tested and is copied into the gosh directory when it is needed.
+//
+//go:embed editdiff/diff.go
+var editDiffSrc []byte
+
+// copyDiffFile writes the code which shows the differences made by a
+// dry-run of an in-place edit into the gosh directory. The package is
+// renamed to 'main'.
+func (g *gosh) copyDiffFile() {
+	if !g.ipeDryRun || !g.filesToRead {
+		return
+	}
+
+	const copyFilePerms = 0o600 // Owner: Read/Write, the rest, no permissions
+
+	content, err := packageRenameContent(editDiffSrcName, editDiffSrc)
+	g.reportFatalError("rename the package of", editDiffSrcName, err)
+
+	err = os.WriteFile(goshDiffFilename, content, copyFilePerms)
+	g.reportFatalError("write the file to be copied", goshDiffFilename, err)
+}
@@ -0,0 +1,196 @@
+// Package editdiff holds the code which finds the differences between the
+// original and edited contents of a file. It is not imported, gosh copies
+// it into the generated program when files are being edited in-place as a
+// dry-run. The package clause is changed to 'main' when the file is copied
+// and so the package-level names all start with an underscore to avoid
+// clashing with any names in the program.
+package editdiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// _diffContext is the number of unchanged lines shown around each
+	// change
+	_diffContext = 3
+
+	// _diffMaxCells is the largest table of common subsequence lengths
+	// that will be built. If the changed part of the file is bigger than
+	// this it is shown as entirely replaced.
+	_diffMaxCells = 1 << 24
+)
+
+// _diffEdit records a line of the original or edited contents and where it
+// comes in each. The op is ' ' for a line in both, '-' for a line only in
+// the original and '+' for a line only in the edited contents.
+type _diffEdit struct {
+	op     byte
+	line   string
+	oldIdx int
+	newIdx int
+}
+
+// _diffEdits returns the edits which turn the old lines into the new
+// lines. Any common lines at the start and end are found first and the
+// longest common subsequence of the remaining lines is then used to find
+// the smallest set of changes.
+func _diffEdits(a, b []string) []_diffEdit {
+	var edits []_diffEdit
+
+	ai, bi := 0, 0
+	add := func(op byte, l string) {
+		edits = append(edits, _diffEdit{op, l, ai, bi})
+
+		if op != '+' {
+			ai++
+		}
+
+		if op != '-' {
+			bi++
+		}
+	}
+
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		add(' ', a[pre])
+		pre++
+	}
+
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre &&
+		a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	n, m := len(ma), len(mb)
+
+	if n*m > _diffMaxCells {
+		for _, l := range ma {
+			add('-', l)
+		}
+
+		for _, l := range mb {
+			add('+', l)
+		}
+	} else {
+		lcs := make([][]int32, n+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, m+1)
+		}
+
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < n || j < m {
+			switch {
+			case i < n && j < m && ma[i] == mb[j]:
+				add(' ', ma[i])
+				i++
+				j++
+			case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+				add('-', ma[i])
+				i++
+			default:
+				add('+', mb[j])
+				j++
+			}
+		}
+	}
+
+	for _, l := range a[len(a)-suf:] {
+		add(' ', l)
+	}
+
+	return edits
+}
+
+// _diffLines splits the contents into lines, each keeping its newline
+func _diffLines(c []byte) []string {
+	lines := strings.SplitAfter(string(c), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// _diff returns the differences between the old and new contents of the
+// named file as a unified diff
+func _diff(fn string, oldC, newC []byte) string {
+	edits := _diffEdits(_diffLines(oldC), _diffLines(newC))
+
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fn, fn)
+
+	for start := 0; start < len(edits); {
+		for start < len(edits) && edits[start].op == ' ' {
+			start++
+		}
+
+		if start == len(edits) {
+			break
+		}
+
+		// changes separated by no more than twice the context are shown
+		// in the same hunk
+		end := start + 1
+		for k := end; k < len(edits) && k-end <= 2*_diffContext; k++ {
+			if edits[k].op != ' ' {
+				end = k + 1
+			}
+		}
+
+		hunkStart := max(start-_diffContext, 0)
+		hunkEnd := min(end+_diffContext, len(edits))
+
+		oldN, newN := 0, 0
+
+		for _, e := range edits[hunkStart:hunkEnd] {
+			if e.op != '+' {
+				oldN++
+			}
+
+			if e.op != '-' {
+				newN++
+			}
+		}
+
+		oldStart := edits[hunkStart].oldIdx
+		if oldN > 0 {
+			oldStart++
+		}
+
+		newStart := edits[hunkStart].newIdx
+		if newN > 0 {
+			newStart++
+		}
+
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n",
+			oldStart, oldN, newStart, newN)
+
+		for _, e := range edits[hunkStart:hunkEnd] {
+			sb.WriteByte(e.op)
+			sb.WriteString(e.line)
+
+			if !strings.HasSuffix(e.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		start = end
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,114 @@
+package editdiff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestDiff(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		oldC   string
+		newC   string
+		expVal string
+	}{
+		{
+			ID:     testhelper.MkID("no change"),
+			oldC:   "a\nb\n",
+			newC:   "a\nb\n",
+			expVal: "--- f\n+++ f\n",
+		},
+		{
+			ID:   testhelper.MkID("line changed"),
+			oldC: "a\nb\nc\n",
+			newC: "a\nB\nc\n",
+			expVal: "--- f\n+++ f\n" +
+				"@@ -1,3 +1,3 @@\n" +
+				" a\n-b\n+B\n c\n",
+		},
+		{
+			ID:   testhelper.MkID("separate hunks"),
+			oldC: "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n",
+			newC: "A\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\n",
+			expVal: "--- f\n+++ f\n" +
+				"@@ -1,4 +1,4 @@\n" +
+				"-a\n+A\n b\n c\n d\n" +
+				"@@ -9,4 +9,3 @@\n" +
+				" i\n j\n k\n-l\n",
+		},
+		{
+			ID:   testhelper.MkID("close changes share a hunk"),
+			oldC: "a\nb\nc\nd\ne\nf\ng\nh\n",
+			newC: "A\nb\nc\nd\ne\nf\nG\nh\n",
+			expVal: "--- f\n+++ f\n" +
+				"@@ -1,8 +1,8 @@\n" +
+				"-a\n+A\n b\n c\n d\n e\n f\n-g\n+G\n h\n",
+		},
+		{
+			ID:   testhelper.MkID("lines added to an empty file"),
+			oldC: "",
+			newC: "a\nb\n",
+			expVal: "--- f\n+++ f\n" +
+				"@@ -0,0 +1,2 @@\n" +
+				"+a\n+b\n",
+		},
+		{
+			ID:   testhelper.MkID("all lines removed"),
+			oldC: "a\nb\n",
+			newC: "",
+			expVal: "--- f\n+++ f\n" +
+				"@@ -1,2 +0,0 @@\n" +
+				"-a\n-b\n",
+		},
+		{
+			ID:   testhelper.MkID("no newline at end"),
+			oldC: "a\nb",
+			newC: "A\nb",
+			expVal: "--- f\n+++ f\n" +
+				"@@ -1,2 +1,2 @@\n" +
+				"-a\n+A\n b\n\\ No newline at end of file\n",
+		},
+		{
+			ID:   testhelper.MkID("newline added at end"),
+			oldC: "a",
+			newC: "a\n",
+			expVal: "--- f\n+++ f\n" +
+				"@@ -1,1 +1,1 @@\n" +
+				"-a\n\\ No newline at end of file\n+a\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		testhelper.DiffString(t, tc.IDStr(), "diff",
+			_diff("f", []byte(tc.oldC), []byte(tc.newC)), tc.expVal)
+	}
+}
+
+func TestDiffEditsTooBig(t *testing.T) {
+	const n = 5000 // n*n is bigger than _diffMaxCells
+
+	oldLines := make([]string, 0, n+2)
+	newLines := make([]string, 0, n+2)
+
+	oldLines = append(oldLines, "first\n")
+	newLines = append(newLines, "first\n")
+
+	for i := range n {
+		oldLines = append(oldLines, strings.Repeat("o", i%7+1)+"\n")
+		newLines = append(newLines, strings.Repeat("n", i%7+1)+"\n")
+	}
+
+	oldLines = append(oldLines, "last\n")
+	newLines = append(newLines, "last\n")
+
+	counts := map[byte]int{}
+	for _, e := range _diffEdits(oldLines, newLines) {
+		counts[e.op]++
+	}
+
+	testhelper.DiffInt(t, "too big", "common lines", counts[' '], 2)
+	testhelper.DiffInt(t, "too big", "deleted lines", counts['-'], n)
+	testhelper.DiffInt(t, "too big", "added lines", counts['+'], n)
+}
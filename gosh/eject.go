@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nickwells/check.mod/v2/check"
+	"github.com/nickwells/filecheck.mod/filecheck"
+	"github.com/nickwells/gogen.mod/gogen"
+	"github.com/nickwells/param.mod/v7/paction"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/psetter"
+	"github.com/nickwells/verbose.mod/verbose"
+)
+
+const (
+	paramNameEject             = "eject"
+	paramNameEjectModule       = "eject-module"
+	paramNameEjectKeepComments = "eject-keep-comments"
+
+	ejectParamsetFilename = "paramset.go"
+
+	ejectDirPerms  = 0o755 // Owner: Read/Write/Exec, the rest: Read/Exec
+	ejectFilePerms = 0o644 // Owner: Read/Write, the rest: Read
+)
+
+var ejectParamNames = []string{
+	paramNameEject,
+	paramNameEjectModule,
+	paramNameEjectKeepComments,
+}
+
+// ejectParamsetSkeleton is the content of the paramset file written into
+// the ejected module. The program description is filled in when the file
+// is written. The names start with an underscore, as do the names gosh
+// declares, so that they cannot clash with the user's code.
+const ejectParamsetSkeleton = `package main
+
+import (
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/paramset"
+)
+
+// _makeParamSet creates the parameter set ready for argument parsing. To
+// use it, call _makeParamSet().Parse() at the start of main and add the
+// program's parameters in _addParams.
+func _makeParamSet() *param.PSet {
+	return paramset.New(
+		_addParams,
+		param.SetProgramDescription(%s),
+	)
+}
+
+// _addParams adds the program's parameters to the parameter set
+func _addParams(_ *param.PSet) error {
+	return nil
+}
+`
+
+// ejectParamset returns the content of the paramset file. The program
+// description gives the gosh command which generated the program.
+func ejectParamset(goshArgs []string) string {
+	words := []string{"gosh"}
+	for _, a := range goshArgs {
+		words = append(words, shellQuote(a))
+	}
+
+	desc := "This program was generated by gosh using the command:" +
+		"\n\n" + strings.Join(words, " ")
+
+	return fmt.Sprintf(ejectParamsetSkeleton, strconv.Quote(desc))
+}
+
+// addEjectParams returns a func that will add parameters concerned with
+// ejecting the generated program to the passed param.PSet.
+func addEjectParams(g *gosh) func(ps *param.PSet) error {
+	return func(ps *param.PSet) error {
+		ps.Add(paramNameEject,
+			psetter.Pathname{
+				Value: &g.ejectDir,
+				Expectation: filecheck.Provisos{
+					Existence: filecheck.Optional,
+					Checks:    []check.FileInfo{check.FileInfoIsDir},
+				},
+				ForceAbsolute: true,
+			},
+			"write the generated program into the given directory as a"+
+				" standalone module. This will contain the generated"+
+				" code, any copied Go files, the 'go.mod' and 'go.sum'"+
+				" files and a skeleton '"+ejectParamsetFilename+"'"+
+				" file which you can use to add parameters to the"+
+				" program. Any local-module replace directives are"+
+				" kept in the 'go.mod' file but any workspace is not."+
+				"\n\n"+
+				"The directory will be created if it does not exist"+
+				" but gosh will not overwrite any files already in it."+
+				" The program is built but is not run and it is not"+
+				" ejected if it cannot be built.",
+			param.ValueName("dir"),
+			param.PostAction(paction.SetVal(&g.dontRun, true)),
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameGosh),
+			param.SeeAlso(ejectParamNames...),
+		)
+
+		ps.Add(paramNameEjectModule,
+			psetter.String[string]{
+				Value: &g.ejectModule,
+				Checks: []check.String{
+					check.StringLength[string](check.ValGT(0)),
+				},
+			},
+			"set the module path of the ejected program. If this is"+
+				" not given the last part of the directory name given"+
+				" through the '"+paramNameEject+"' parameter is used.",
+			param.ValueName("module-path"),
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameGosh),
+			param.SeeAlso(ejectParamNames...),
+		)
+
+		ps.Add(paramNameEjectKeepComments,
+			psetter.Bool{Value: &g.ejectKeepComments},
+			"keep the comments that gosh adds to the generated code"+
+				" when the program is ejected. By default they are"+
+				" removed.",
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameGosh),
+			param.SeeAlso(ejectParamNames...),
+		)
+
+		ps.AddFinalCheck(func() error {
+			if g.ejectDir == "" {
+				for _, pName := range []string{
+					paramNameEjectModule,
+					paramNameEjectKeepComments,
+				} {
+					if p, err := ps.GetParamByName(pName); err == nil &&
+						p.HasBeenSet() {
+						return fmt.Errorf(
+							"the %q parameter is only used when the"+
+								" program is ejected (using the %q"+
+								" parameter)",
+							"-"+pName, "-"+paramNameEject)
+					}
+				}
+
+				return nil
+			}
+
+			if g.repl {
+				return errors.New(
+					"gosh cannot eject the program when running" +
+						" interactively")
+			}
+
+			return nil
+		})
+
+		return nil
+	}
+}
+
+// stripGoshComments removes the comments that gosh adds to the generated
+// code. Lines holding only a gosh comment are removed and any gosh comment
+// at the end of a line is removed. The result is reformatted.
+func stripGoshComments(content []byte) ([]byte, error) {
+	const goshComment = "//" + goshCommentIntro
+
+	var buf bytes.Buffer
+
+	content = bytes.Replace(content, []byte(goshCommentExplanation+"\n"),
+		nil, 1)
+
+	for line := range strings.Lines(string(content)) {
+		if strings.HasPrefix(strings.TrimSpace(line), goshComment) {
+			continue
+		}
+
+		if code, _, found := strings.Cut(line, goshComment); found {
+			line = strings.TrimRight(code, " \t") + "\n"
+		}
+
+		buf.WriteString(line)
+	}
+
+	return format.Source(buf.Bytes())
+}
+
+// ejectFileNames returns the names of the files in the gosh directory which
+// are to be copied into the ejected module. It is run from within the gosh
+// directory.
+func ejectFileNames() ([]string, error) {
+	names := []string{goshFilename, "go.mod"}
+
+	for _, name := range []string{
+		"go.sum",
+		goshTestFilename,
+		goshDiffFilename,
+	} {
+		if _, err := os.Stat(name); err == nil {
+			names = append(names, name)
+		}
+	}
+
+	copies, err := filepath.Glob("goshCopy*.go")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(names, copies...), nil
+}
+
+// ejectFiles writes the files making up the ejected module into the eject
+// directory. It is run from within the gosh directory.
+func (g *gosh) ejectFiles() error {
+	names, err := ejectFileNames()
+	if err != nil {
+		return err
+	}
+
+	names = append(names, g.embedFileNames()...)
+	names = append(names, ejectParamsetFilename)
+
+	for _, name := range names {
+		to := filepath.Join(g.ejectDir, name)
+		if _, err := os.Lstat(to); err == nil {
+			return fmt.Errorf("%q already exists", to)
+		}
+	}
+
+	for _, name := range names {
+		to := filepath.Join(g.ejectDir, name)
+
+		switch name {
+		case ejectParamsetFilename:
+			err = os.WriteFile(to, []byte(ejectParamset(g.goshArgs)),
+				ejectFilePerms)
+		case goshFilename:
+			err = g.ejectGoshFile(to)
+		default:
+			err = copyFile(name, to)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ejectGoshFile writes the generated program into the named file, removing
+// the gosh comments unless they are to be kept.
+func (g *gosh) ejectGoshFile(to string) error {
+	content, err := os.ReadFile(goshFilename)
+	if err != nil {
+		return err
+	}
+
+	if !g.ejectKeepComments {
+		content, err = stripGoshComments(content)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.WriteFile(to, content, ejectFilePerms)
+}
+
+// ejectProgram writes the generated program into the eject directory as a
+// standalone module with the requested module path. The program is not
+// ejected if it could not be built.
+func (g *gosh) ejectProgram() {
+	if g.ejectDir == "" {
+		return
+	}
+
+	if g.exitStatus != 0 {
+		fmt.Fprintln(os.Stderr,
+			"gosh did not eject the program, it could not be built")
+
+		return
+	}
+
+	defer g.dbgStack.Start("ejectProgram", "Ejecting the program")()
+
+	intro := g.dbgStack.Tag()
+
+	g.chdirInto(g.goshDir)
+
+	verbose.Println(intro, " Creating the directory: ", g.ejectDir)
+
+	err := os.MkdirAll(g.ejectDir, ejectDirPerms)
+	g.reportFatalError("create the eject directory", g.ejectDir, err)
+
+	err = g.ejectFiles()
+	g.reportFatalError("eject the program into", g.ejectDir, err)
+
+	modPath := g.ejectModule
+	if modPath == "" {
+		modPath = filepath.Base(g.ejectDir)
+	}
+
+	g.chdirInto(g.ejectDir)
+
+	verbose.Println(intro, " Command: go mod edit -module="+modPath)
+	gogen.ExecGoCmd(gogen.NoCmdIO, "mod", "edit", "-module="+modPath)
+
+	if !g.dontRunGoModTidy {
+		verbose.Println(intro, " Command: go mod tidy")
+
+		if !gogen.ExecGoCmdNoExit(gogen.NoCmdFailIO, "mod", "tidy") {
+			fmt.Fprintln(os.Stderr,
+				"gosh couldn't tidy the ejected module,"+
+					" run 'go mod tidy' in "+g.ejectDir)
+		}
+	}
+
+	g.chdirInto(g.goshDir)
+
+	fmt.Println("gosh program ejected into " + g.ejectDir)
+}
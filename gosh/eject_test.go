@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nickwells/errutil.mod/errutil"
+	"github.com/nickwells/param.mod/v7/paramtest"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// TestParseParamsEject will use the paramtest.Parser to make sure the
+// behaviour of the eject parameters is as expected.
+func TestParseParamsEject(t *testing.T) {
+	dir := t.TempDir()
+	ejectDir := filepath.Join(dir, "prog")
+
+	testCases := []paramtest.Parser{}
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("eject"),
+			func(g *gosh) {
+				g.ejectDir = ejectDir
+				g.ejectModule = "example.com/prog"
+				g.ejectKeepComments = true
+				g.dontRun = true
+			},
+			"-"+paramNameEject, ejectDir,
+			"-"+paramNameEjectModule, "example.com/prog",
+			"-"+paramNameEjectKeepComments))
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(`the "-eject-module" parameter is only used when`+
+				` the program is ejected (using the "-eject" parameter)`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs, testhelper.MkID("module but no eject"),
+				func(g *gosh) { g.ejectModule = "example.com/prog" },
+				"-"+paramNameEjectModule, "example.com/prog"))
+	}
+
+	for _, tc := range testCases {
+		_ = tc.Test(t)
+	}
+}
+
+func TestStripGoshComments(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		content string
+		expVal  string
+	}{
+		{
+			ID:      testhelper.MkID("no comments"),
+			content: "package main\n\nfunc main() {\n\tx := 1\n\t_ = x\n}\n",
+			expVal:  "package main\n\nfunc main() {\n\tx := 1\n\t_ = x\n}\n",
+		},
+		{
+			ID: testhelper.MkID("gosh comments"),
+			content: "package main\n\n" +
+				"// ====\n" +
+				"// generated by gosh\n" +
+				goshCommentExplanation + "\n" +
+				"// ====\n\n" +
+				"func main() {\n" +
+				"\tvar x int //" + goshCommentIntro + "frame\n" +
+				"\t//" + goshCommentIntro + "Section start: exec\n" +
+				"\tx++ // user comment\n" +
+				"\t_ = x\n" +
+				"}\n",
+			expVal: "package main\n\n" +
+				"// ====\n" +
+				"// generated by gosh\n" +
+				"// ====\n\n" +
+				"func main() {\n" +
+				"\tvar x int\n" +
+				"\tx++ // user comment\n" +
+				"\t_ = x\n" +
+				"}\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		val, err := stripGoshComments([]byte(tc.content))
+		if err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: unexpected error: %v", err)
+
+			continue
+		}
+
+		testhelper.DiffString(t, tc.IDStr(), "stripped", string(val), tc.expVal)
+	}
+}
+
+func TestEjectFiles(t *testing.T) {
+	goshDir := t.TempDir()
+	ejectDir := t.TempDir()
+
+	t.Chdir(goshDir)
+
+	const (
+		prog   = "package main\n\nfunc main() {} //" + goshCommentIntro + "x\n"
+		gomod  = "module G\n\ngo 1.22\n"
+		copied = "package main\n\nfunc f() {} //" + goshCommentIntro + "x\n"
+	)
+
+	for name, content := range map[string]string{
+		goshFilename:        prog,
+		"go.mod":            gomod,
+		"goshCopy00util.go": copied,
+	} {
+		if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+			t.Fatal("Cannot write the gosh directory file:", err)
+		}
+	}
+
+	g := mkTestGosh(func(g *gosh) {
+		g.ejectDir = ejectDir
+		g.goshArgs = []string{"-e", "fmt.Println(\"Hi\")"}
+	})
+
+	if err := g.ejectFiles(); err != nil {
+		t.Fatal("Cannot eject the files:", err)
+	}
+
+	var (
+		expProg   = "package main\n\nfunc main() {}\n"
+		expMod    = gomod
+		expCopied = copied
+		expSkel   = strings.Replace(ejectParamsetSkeleton, "%s",
+			`"This program was generated by gosh using the command:`+
+				`\n\ngosh -e 'fmt.Println(\"Hi\")'"`, 1)
+	)
+
+	checkTestFile(t, "ejected program",
+		filepath.Join(ejectDir, goshFilename), &expProg)
+	checkTestFile(t, "module file",
+		filepath.Join(ejectDir, "go.mod"), &expMod)
+	checkTestFile(t, "copied file",
+		filepath.Join(ejectDir, "goshCopy00util.go"), &expCopied)
+	checkTestFile(t, "paramset skeleton",
+		filepath.Join(ejectDir, ejectParamsetFilename), &expSkel)
+	checkTestFile(t, "no sum file",
+		filepath.Join(ejectDir, "go.sum"), nil)
+
+	err := g.ejectFiles()
+	if err == nil {
+		t.Error("ejecting again should fail, the files already exist")
+	} else {
+		testhelper.DiffString(t, "eject again", "error", err.Error(),
+			`"`+filepath.Join(ejectDir, goshFilename)+`" already exists`)
+	}
+}
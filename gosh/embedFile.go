@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nickwells/location.mod/location"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/psetter"
+)
+
+const (
+	paramNameEmbedFile = "embed-file"
+
+	embedTypeString = "string"
+	embedTypeBytes  = "bytes"
+	embedTypeFS     = "fs"
+
+	embedTag = "embed"
+
+	embedErrCategory = "embedded files"
+)
+
+// embedGoTypes maps the types that can be given for an embedded file to the
+// Go type of the variable holding it
+var embedGoTypes = map[string]string{
+	embedTypeString: "string",
+	embedTypeBytes:  "[]byte",
+	embedTypeFS:     "embed.FS",
+}
+
+// embedFile records the details of a file to be embedded in the program
+type embedFile struct {
+	varName string
+	varType string
+	path    string
+}
+
+// baseName returns the name of the embedded file in the gosh directory
+func (ef embedFile) baseName() string {
+	return filepath.Base(ef.path)
+}
+
+// embedVar records the details of a variable holding embedded files
+type embedVar struct {
+	name      string
+	varType   string
+	fileNames []string
+}
+
+// parseEmbedFile parses the value given to the embed-file parameter. This
+// has the form: name[:type]=pathname. The type defaults to string.
+func parseEmbedFile(v string) (embedFile, error) {
+	nameType, path, ok := strings.Cut(v, "=")
+	if !ok || path == "" {
+		return embedFile{}, fmt.Errorf("bad embedded file: %q"+
+			" (it should be of the form name[:type]=pathname)", v)
+	}
+
+	ef := embedFile{varType: embedTypeString}
+
+	name, varType, hasType := strings.Cut(nameType, ":")
+	if hasType {
+		if _, ok := embedGoTypes[varType]; !ok {
+			return embedFile{}, fmt.Errorf(
+				"bad embedded file type: %q (it should be %s, %s or %s)",
+				varType, embedTypeString, embedTypeBytes, embedTypeFS)
+		}
+
+		ef.varType = varType
+	}
+
+	if !token.IsIdentifier(name) || name == "_" {
+		return embedFile{}, fmt.Errorf(
+			"bad embedded file variable name: %q", name)
+	}
+
+	ef.varName = name
+
+	var err error
+
+	ef.path, err = filepath.Abs(path)
+	if err != nil {
+		return embedFile{}, err
+	}
+
+	return ef, nil
+}
+
+// embedFilePAF generates the Post-Action func (PAF) that adds the embedded
+// file to the list of files to be embedded in the program.
+//
+// Note that we pass a pointer to the parameter value rather than the string
+// - this is necessary otherwise we are passing the text value at the point
+// the PAF is being generated not at the point where the parameter value is
+// given.
+func embedFilePAF(g *gosh, v *string) param.ActionFunc {
+	return func(_ location.L, _ *param.BaseParam, _ []string) error {
+		ef, err := parseEmbedFile(*v)
+		if err != nil {
+			return err
+		}
+
+		g.embedFiles = append(g.embedFiles, ef)
+
+		return nil
+	}
+}
+
+// addEmbedParams returns a func that will add parameters concerned with
+// embedding files in the program to the passed param.PSet.
+func addEmbedParams(g *gosh) func(ps *param.PSet) error {
+	return func(ps *param.PSet) error {
+		var embedVal string
+
+		ps.Add(paramNameEmbedFile, psetter.String[string]{Value: &embedVal},
+			"embed a file in the program. The value has the form"+
+				" name[:type]=pathname. The file is copied into the gosh"+
+				" directory and a variable with the given name is"+
+				" declared in the global section with a '//go:embed'"+
+				" directive so that the file's contents are built into"+
+				" the program. This means that the program does not"+
+				" need to find the file when it runs and so an ejected"+
+				" or cached program is self-contained."+
+				"\n\n"+
+				"The type of the variable can be "+
+				embedTypeString+" (the default), "+
+				embedTypeBytes+" (a []byte) or "+
+				embedTypeFS+" (an embed.FS). Several files can be"+
+				" embedded in the same "+embedTypeFS+" variable by"+
+				" giving the same name each time; each file appears in"+
+				" the embed.FS under the last part of its pathname."+
+				"\n\n"+
+				"The files cannot be Go files and must have different"+
+				" names from each other and from the files that gosh"+
+				" creates. The variable name cannot start with '_' (these"+
+				" names are reserved for gosh) or be the name of an"+
+				" imported package.",
+			param.Attrs(param.DontShowInStdUsage),
+			param.AltNames("embed"),
+			param.PostAction(embedFilePAF(g, &embedVal)),
+			param.SeeAlso(paramNameCopyGoFile),
+		)
+
+		return nil
+	}
+}
+
+// embedVars returns the variables holding the embedded files in the order
+// in which they were first given. The file names are the names of the files
+// in the gosh directory.
+func (g *gosh) embedVars() []embedVar {
+	vars := []embedVar{}
+
+	for _, ef := range g.embedFiles {
+		i := slices.IndexFunc(vars,
+			func(ev embedVar) bool { return ev.name == ef.varName })
+		if i < 0 {
+			vars = append(vars, embedVar{name: ef.varName, varType: ef.varType})
+			i = len(vars) - 1
+		}
+
+		if !slices.Contains(vars[i].fileNames, ef.baseName()) {
+			vars[i].fileNames = append(vars[i].fileNames, ef.baseName())
+		}
+	}
+
+	return vars
+}
+
+// embedFileNames returns the names of the embedded files in the gosh
+// directory
+func (g *gosh) embedFileNames() []string {
+	names := []string{}
+
+	for _, ef := range g.embedFiles {
+		if !slices.Contains(names, ef.baseName()) {
+			names = append(names, ef.baseName())
+		}
+	}
+
+	return names
+}
+
+// isGoshFileName returns true if the name is one that gosh could create in
+// the gosh directory
+func (g *gosh) isGoshFileName(name string) bool {
+	switch name {
+	case goshFilename, g.execName, "go.mod", "go.sum", "go.work", "go.work.sum":
+		return true
+	}
+
+	return strings.HasPrefix(name, "goshCopy")
+}
+
+// checkEmbedFiles checks that the files to be embedded can be read and that
+// neither the variable names nor the file names clash. The variable names
+// must not clash with each other, with the variables that gosh declares or
+// with the names of the imported packages. Any problems are added to the
+// error map.
+func (g *gosh) checkEmbedFiles() {
+	vars := map[string]embedFile{}
+	paths := map[string]string{}
+	pkgs := importNames(append([]string{g.embedImport()}, g.imports...))
+
+	for _, ef := range g.embedFiles {
+		if err := checkEmbedFileReadable(ef.path); err != nil {
+			g.addError(embedErrCategory, err)
+		}
+
+		if prev, ok := vars[ef.varName]; ok {
+			switch {
+			case prev.varType != ef.varType:
+				g.addError(embedErrCategory,
+					fmt.Errorf("variable %q is given as both %s and %s",
+						ef.varName, prev.varType, ef.varType))
+			case ef.varType != embedTypeFS:
+				g.addError(embedErrCategory,
+					fmt.Errorf("variable %q is given more than once"+
+						" (only an %s variable can hold several files)",
+						ef.varName, embedTypeFS))
+			}
+		} else {
+			vars[ef.varName] = ef
+			g.checkEmbedVarName(ef.varName, pkgs)
+		}
+
+		name := ef.baseName()
+
+		if prevPath, ok := paths[name]; ok && prevPath != ef.path {
+			g.addError(embedErrCategory,
+				fmt.Errorf("%q and %q have the same name", prevPath, ef.path))
+		}
+
+		paths[name] = ef.path
+
+		switch {
+		case filepath.Ext(name) == ".go":
+			g.addError(embedErrCategory,
+				fmt.Errorf("%q is a Go file, it would be built into"+
+					" the program (use '%s' instead)",
+					ef.path, paramNameCopyGoFile))
+		case g.isGoshFileName(name):
+			g.addError(embedErrCategory,
+				fmt.Errorf("%q has the same name as a file made by gosh",
+					ef.path))
+		case strings.ContainsAny(name, `*?[\`):
+			g.addError(embedErrCategory,
+				fmt.Errorf("%q cannot be embedded, the name contains"+
+					" one of the pattern characters: *?[\\", ef.path))
+		}
+	}
+}
+
+// checkEmbedVarName checks that the name of the variable holding embedded
+// files does not clash with a variable declared by gosh or hide an imported
+// package. Any problems are added to the error map.
+func (g *gosh) checkEmbedVarName(name string, pkgs map[string]string) {
+	var err error
+
+	switch {
+	case knownVarMap[name].typeName != "":
+		err = fmt.Errorf("variable %q clashes with the gosh variable"+
+			" of the same name (%s)",
+			name, knownVarMap[name].desc)
+	case strings.HasPrefix(name, "_"):
+		err = fmt.Errorf("variable %q cannot be used,"+
+			" names starting with '_' are reserved for gosh",
+			name)
+	case pkgs[name] != "":
+		err = fmt.Errorf("variable %q cannot be used,"+
+			" it would hide the imported package %q",
+			name, pkgs[name])
+	}
+
+	if err != nil {
+		g.addError(embedErrCategory, err)
+	}
+}
+
+// checkEmbedFileReadable returns a non-nil error if the named file is not a
+// regular file which can be read
+func checkEmbedFileReadable(path string) error {
+	f, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%q is not a regular file", path)
+	}
+
+	return nil
+}
+
+// copyEmbedFiles copies the files to be embedded into the gosh directory
+func (g *gosh) copyEmbedFiles() {
+	copied := map[string]bool{}
+
+	for _, ef := range g.embedFiles {
+		if copied[ef.path] {
+			continue
+		}
+
+		copied[ef.path] = true
+
+		err := copyFile(ef.path, ef.baseName())
+		g.reportFatalError("copy the file to be embedded", ef.path, err)
+	}
+}
+
+// embedImport returns the import needed by the embedded file variables
+func (g *gosh) embedImport() string {
+	if len(g.embedFiles) == 0 {
+		return ""
+	}
+
+	if slices.ContainsFunc(g.embedFiles,
+		func(ef embedFile) bool { return ef.varType == embedTypeFS }) {
+		return "embed"
+	}
+
+	return "_=embed"
+}
+
+// writeEmbeds writes the declarations of the variables holding the embedded
+// files. Note that the '//go:embed' directive must not have a gosh comment
+// at the end of the line as it would be taken as part of the directive.
+func (g *gosh) writeEmbeds() {
+	vars := g.embedVars()
+	if len(vars) == 0 {
+		return
+	}
+
+	g.gPrint("", embedTag)
+
+	for _, ev := range vars {
+		patterns := make([]string, 0, len(ev.fileNames))
+		for _, name := range ev.fileNames {
+			patterns = append(patterns, strconv.Quote(name))
+		}
+
+		g.print("//go:embed " + strings.Join(patterns, " "))
+		g.gPrint("var "+ev.name+" "+embedGoTypes[ev.varType], embedTag)
+	}
+}
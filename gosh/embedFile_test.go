@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nickwells/errutil.mod/errutil"
+	"github.com/nickwells/param.mod/v7/paramtest"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// TestParseParamsEmbedFile will use the paramtest.Parser to make sure the
+// behaviour of the embed-file parameter is as expected.
+func TestParseParamsEmbedFile(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal("Cannot find the current working directory:", err)
+	}
+
+	testCases := []paramtest.Parser{
+		mkTestParser(nil, testhelper.MkID("embed files"),
+			func(g *gosh) {
+				g.embedFiles = []embedFile{
+					{
+						varName: "tbl",
+						varType: embedTypeString,
+						path:    filepath.Join(cwd, "testdata", "file1"),
+					},
+					{
+						varName: "fsys",
+						varType: embedTypeFS,
+						path:    "/a/b",
+					},
+				}
+			},
+			"-"+paramNameEmbedFile, "tbl=testdata/file1",
+			"-embed", "fsys:fs=/a/b"),
+	}
+
+	for _, tc := range testCases {
+		_ = tc.Test(t)
+	}
+}
+
+func TestParseEmbedFile(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		v      string
+		expVal embedFile
+	}{
+		{
+			ID: testhelper.MkID("default type"),
+			v:  "tbl=/a/tbl.csv",
+			expVal: embedFile{
+				varName: "tbl", varType: embedTypeString, path: "/a/tbl.csv",
+			},
+		},
+		{
+			ID: testhelper.MkID("bytes"),
+			v:  "img:bytes=/a/img.png",
+			expVal: embedFile{
+				varName: "img", varType: embedTypeBytes, path: "/a/img.png",
+			},
+		},
+		{
+			ID: testhelper.MkID("fs"),
+			v:  "files:fs=/a/b/../page.html",
+			expVal: embedFile{
+				varName: "files", varType: embedTypeFS, path: "/a/page.html",
+			},
+		},
+		{
+			ID: testhelper.MkID("no pathname"),
+			v:  "tbl",
+			ExpErr: testhelper.MkExpErr(`bad embedded file: "tbl"`,
+				"it should be of the form name[:type]=pathname"),
+		},
+		{
+			ID:     testhelper.MkID("bad type"),
+			v:      "tbl:int=/a/tbl.csv",
+			ExpErr: testhelper.MkExpErr(`bad embedded file type: "int"`),
+		},
+		{
+			ID: testhelper.MkID("bad name"),
+			v:  "1tbl=/a/tbl.csv",
+			ExpErr: testhelper.MkExpErr(
+				`bad embedded file variable name: "1tbl"`),
+		},
+		{
+			ID: testhelper.MkID("blank name"),
+			v:  "_=/a/tbl.csv",
+			ExpErr: testhelper.MkExpErr(
+				`bad embedded file variable name: "_"`),
+		},
+	}
+
+	for _, tc := range testCases {
+		ef, err := parseEmbedFile(tc.v)
+		if testhelper.CheckExpErr(t, err, tc) && err == nil {
+			if err := testhelper.DiffVals(ef, tc.expVal); err != nil {
+				t.Log(tc.IDStr())
+				t.Errorf("\t: %s", err)
+			}
+		}
+	}
+}
+
+func TestCheckEmbedFiles(t *testing.T) {
+	dir := mkTestTree(t, t.TempDir(),
+		"a.txt", "b.txt", "sub/a.txt", "prog.go", "go.mod")
+	missing := filepath.Join(dir, "missing.txt")
+
+	mkEF := func(name, varType, fName string) embedFile {
+		return embedFile{
+			varName: name,
+			varType: varType,
+			path:    filepath.Join(dir, fName),
+		}
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		embedFiles []embedFile
+		imports    []string
+		expErrs    []string
+	}{
+		{
+			ID: testhelper.MkID("good"),
+			embedFiles: []embedFile{
+				mkEF("a", embedTypeString, "a.txt"),
+				mkEF("fsys", embedTypeFS, "a.txt"),
+				mkEF("fsys", embedTypeFS, "b.txt"),
+			},
+		},
+		{
+			ID: testhelper.MkID("missing file"),
+			embedFiles: []embedFile{
+				mkEF("a", embedTypeString, "missing.txt"),
+			},
+			expErrs: []string{
+				"open " + missing + ": no such file or directory",
+			},
+		},
+		{
+			ID: testhelper.MkID("directory"),
+			embedFiles: []embedFile{
+				mkEF("a", embedTypeString, "sub"),
+			},
+			expErrs: []string{
+				`"` + filepath.Join(dir, "sub") + `" is not a regular file`,
+			},
+		},
+		{
+			ID: testhelper.MkID("variable clashes"),
+			embedFiles: []embedFile{
+				mkEF("a", embedTypeString, "a.txt"),
+				mkEF("a", embedTypeBytes, "a.txt"),
+				mkEF("b", embedTypeBytes, "b.txt"),
+				mkEF("b", embedTypeBytes, "b.txt"),
+			},
+			expErrs: []string{
+				`variable "a" is given as both string and bytes`,
+				`variable "b" is given more than once` +
+					` (only an fs variable can hold several files)`,
+			},
+		},
+		{
+			ID: testhelper.MkID("file name clashes"),
+			embedFiles: []embedFile{
+				mkEF("a", embedTypeString, "a.txt"),
+				mkEF("b", embedTypeString, "sub/a.txt"),
+				mkEF("c", embedTypeString, "prog.go"),
+				mkEF("d", embedTypeString, "go.mod"),
+			},
+			expErrs: []string{
+				`"` + filepath.Join(dir, "a.txt") + `" and "` +
+					filepath.Join(dir, "sub", "a.txt") + `" have the same name`,
+				`"` + filepath.Join(dir, "prog.go") + `" is a Go file,` +
+					` it would be built into the program` +
+					` (use '` + paramNameCopyGoFile + `' instead)`,
+				`"` + filepath.Join(dir, "go.mod") + `" has the same name` +
+					` as a file made by gosh`,
+			},
+		},
+		{
+			ID: testhelper.MkID("gosh and package name clashes"),
+			embedFiles: []embedFile{
+				mkEF("_l", embedTypeString, "a.txt"),
+				mkEF("_x", embedTypeString, "a.txt"),
+				mkEF("fmt", embedTypeString, "a.txt"),
+				mkEF("embed", embedTypeFS, "b.txt"),
+			},
+			imports: []string{"fmt"},
+			expErrs: []string{
+				`variable "_l" clashes with the gosh variable` +
+					` of the same name (` + knownVarMap["_l"].desc + `)`,
+				`variable "_x" cannot be used,` +
+					` names starting with '_' are reserved for gosh`,
+				`variable "fmt" cannot be used,` +
+					` it would hide the imported package "fmt"`,
+				`variable "embed" cannot be used,` +
+					` it would hide the imported package "embed"`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(func(g *gosh) {
+			g.embedFiles = tc.embedFiles
+			g.imports = tc.imports
+		})
+
+		g.checkEmbedFiles()
+
+		expErrs := errutil.ErrMap{}
+		for _, e := range tc.expErrs {
+			expErrs.AddError(embedErrCategory, errors.New(e))
+		}
+
+		if err := g.errMap.Matches(expErrs); err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: unexpected errors: %v", err)
+		}
+	}
+}
+
+func TestWriteEmbeds(t *testing.T) {
+	dir := t.TempDir()
+
+	for fName, content := range map[string]string{
+		"greeting.txt": "Hello",
+		"data.bin":     "\x01\x02\x03",
+		"page.html":    "<p>",
+	} {
+		err := os.WriteFile(filepath.Join(dir, fName), []byte(content), 0o600)
+		if err != nil {
+			t.Fatal("Cannot write the file to embed:", err)
+		}
+	}
+
+	g := mkTestGosh(func(g *gosh) {
+		g.imports = []string{"fmt"}
+		g.embedFiles = []embedFile{
+			{
+				varName: "greeting",
+				varType: embedTypeString,
+				path:    filepath.Join(dir, "greeting.txt"),
+			},
+			{
+				varName: "data",
+				varType: embedTypeBytes,
+				path:    filepath.Join(dir, "data.bin"),
+			},
+			{
+				varName: "fsys",
+				varType: embedTypeFS,
+				path:    filepath.Join(dir, "page.html"),
+			},
+			{
+				varName: "fsys",
+				varType: embedTypeFS,
+				path:    filepath.Join(dir, "greeting.txt"),
+			},
+		}
+		g.AddScriptEntry(execSect, `fmt.Println(greeting, len(data))`,
+			verbatim)
+		g.AddScriptEntry(execSect, `p, _ := fsys.ReadFile("page.html")`,
+			verbatim)
+		g.AddScriptEntry(execSect, `fmt.Println(string(p))`, verbatim)
+	})
+
+	execPath := buildTestProg(t, g)
+
+	t.Chdir(t.TempDir())
+
+	stdout, stderr, status := runTestProg(t, execPath, "")
+
+	testhelper.DiffString(t, "embedded files", "stderr", stderr, "")
+	testhelper.DiffInt(t, "embedded files", "exit status", status, 0)
+	testhelper.DiffString(t, "embedded files", "stdout", stdout,
+		"Hello 3\n<p>\n")
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"path/filepath"
 	"strings"
 )
 
@@ -10,7 +9,7 @@ func (g *gosh) populateEnv(env []string) []string {
 	newEnv := []string{}
 
 	replace := map[string]string{
-		"_": filepath.Join(g.goshDir, g.execName),
+		"_": g.execPath(),
 	}
 
 	for _, ev := range g.env {
@@ -1,18 +1,56 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/nickwells/filecheck.mod/filecheck"
 )
 
 const origExt = ".orig"
 
+// These are the ways in which the original file can be kept when editing
+// in-place
+const (
+	backupModeSuffix    = "suffix"
+	backupModeNumbered  = "numbered"
+	backupModeTimestamp = "timestamp"
+	backupModeDir       = "dir"
+	backupModeNone      = "none"
+)
+
+// backupTimeFormat is the format of the timestamp added to the name of the
+// copy of the original file when the backup mode is 'timestamp'
+const backupTimeFormat = "20060102-150405"
+
+// These are the patterns matching the names of the temporary files used
+// while editing a file in-place. The first is the file holding the edited
+// contents and the second is used while compressing those contents.
+const (
+	editTempPattern       = "*.[0-9]*.new"
+	recompressTempPattern = "*.new.[0-9]*.gz"
+)
+
+const (
+	compressionGzip  = "gzip"
+	compressionBzip2 = "bzip2"
+)
+
 // fileProvisos records the checks to be carried out on the files
 var fileProvisos = filecheck.FileExists()
 
-// origFileProvisos records the checks to be carried out on the files with
-// extension '.orig'
+// dirProvisos records the checks to be carried out on any directories to be
+// walked
+var dirProvisos = filecheck.DirExists()
+
+// origFileProvisos records the checks to be carried out on the copies of
+// the original files (by default, the files with extension '.orig')
 var origFileProvisos = filecheck.IsNew()
 
 // HandleRemainder processes the trailing parameters. If gosh has the
@@ -31,17 +69,22 @@ func (g *gosh) HandleRemainder(rem []string) {
 // in the Gosh struct and record any errors found.
 //
 // It will first check that there are no duplicate files, that they all
-// exist, that they are all files, that, if in-line editing is being done,
-// there are no existing files with the same name plus the '.orig'
-// extension. If any of these conditions is not met it will report the error,
-// add it to the ErrMap and return.
+// exist, that they are all files (or directories to be walked, in which
+// case the remaining checks apply to the files found), that, if in-line
+// editing is being done, there are no existing backup copies that would be
+// overwritten and that any compressed files can be compressed again once
+// they have been edited. If any of these conditions is not met it
+// will report the error, add it to the ErrMap and return.
 
 func (g *gosh) populateFilesToRead(names []string) {
 	goodNames := make([]string, 0, len(names))
 	dupMap := make(map[string]int)
+	walked := make(map[string]string)
 
 	for i, name := range names {
-		if firstIdx, exists := dupMap[name]; exists {
+		cleanName := filepath.Clean(name)
+
+		if firstIdx, exists := dupMap[cleanName]; exists {
 			g.addError("duplicate filename",
 				fmt.Errorf(
 					"filename %q has been given more than once,"+
@@ -51,18 +94,34 @@ func (g *gosh) populateFilesToRead(names []string) {
 			continue
 		}
 
-		dupMap[name] = i
+		dupMap[cleanName] = i
+
+		if g.walkDirs && dirProvisos.StatusCheck(name) == nil {
+			if g.checkDirToRead(name, walked) {
+				goodNames = append(goodNames, name)
+			}
+
+			continue
+		}
 
 		if err := fileProvisos.StatusCheck(name); err != nil {
 			g.addError("file check", err)
 			continue
 		}
 
-		if g.inPlaceEdit {
-			if err := origFileProvisos.StatusCheck(name + origExt); err != nil {
-				g.addError("original file check", err)
-				continue
-			}
+		if prev, exists := walked[cleanName]; exists {
+			g.addError("duplicate filename",
+				fmt.Errorf("file %q would be read more than once,"+
+					" through %q and again directly",
+					name, prev))
+
+			continue
+		}
+
+		walked[cleanName] = name
+
+		if !g.checkFileToEdit(name) {
+			continue
 		}
 
 		goodNames = append(goodNames, name)
@@ -74,3 +133,273 @@ func (g *gosh) populateFilesToRead(names []string) {
 
 	g.args = goodNames
 }
+
+// checkFileToEdit checks that, if the file is to be edited in-place, there
+// is no existing backup copy of the file that would be overwritten and
+// that, if it is compressed, it can be compressed again once it has been
+// edited. It records any errors found and returns false if there are any.
+//
+// No checks are needed if the edit is a dry-run as the file will not be
+// replaced.
+func (g *gosh) checkFileToEdit(name string) bool {
+	if !g.replacesFiles() {
+		return true
+	}
+
+	backupName, err := g.backupName(name)
+	if err != nil {
+		g.addError("original file check", err)
+		return false
+	}
+
+	if backupName != "" {
+		if err := origFileProvisos.StatusCheck(backupName); err != nil {
+			g.addError("original file check", err)
+			return false
+		}
+	}
+
+	if g.decompress {
+		if err := checkCanRecompress(name); err != nil {
+			g.addError("compressed file check", err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// replacesFiles returns true if the files being read are to be replaced
+// with their edited contents.
+func (g *gosh) replacesFiles() bool {
+	return g.inPlaceEdit && !g.ipeDryRun
+}
+
+// backupName returns the name of the file that the original file will be
+// saved in when it is edited. This is only known in advance for the
+// 'suffix' and 'dir' backup modes; for the other modes the name will be
+// chosen when the file is edited so that no existing file is overwritten
+// and an empty string is returned.
+func (g *gosh) backupName(name string) (string, error) {
+	switch g.backupMode {
+	case backupModeSuffix:
+		return name + g.backupSuffix, nil
+	case backupModeDir:
+		absName, err := filepath.Abs(name)
+		if err != nil {
+			return "", fmt.Errorf("cannot find the backup name for %q: %w",
+				name, err)
+		}
+
+		return filepath.Join(g.backupDir, absName), nil
+	}
+
+	return "", nil
+}
+
+// checkDirToRead walks the directory and checks each of the files that the
+// generated program will read. The walked map records the files already
+// found and where they were given; any file found again is reported. It
+// records any errors found and returns false if there are any.
+func (g *gosh) checkDirToRead(dir string, walked map[string]string) bool {
+	files, err := g.walkDir(dir)
+	if err != nil {
+		g.addError("directory check", err)
+		return false
+	}
+
+	ok := true
+
+	for _, name := range files {
+		name = filepath.Clean(name)
+
+		if prev, exists := walked[name]; exists {
+			g.addError("duplicate filename",
+				fmt.Errorf("file %q would be read more than once,"+
+					" through %q and again through %q",
+					name, prev, dir))
+
+			ok = false
+
+			continue
+		}
+
+		walked[name] = dir
+
+		if !g.checkFileToEdit(name) {
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// walkDir returns the regular files found under the directory which the
+// generated program will read. This should match the files found by the
+// _walkFiles func in the generated code.
+func (g *gosh) walkDir(dir string) ([]string, error) {
+	var files []string
+
+	err := filepath.WalkDir(dir,
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if path == dir {
+				return nil
+			}
+
+			if d.IsDir() {
+				if g.skipWalkDir(d.Name()) || g.isBackupDir(path) {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
+			if d.Type().IsRegular() &&
+				!matchesAny(g.walkExclude, d.Name()) &&
+				!matchesAny(g.walkSkipPatterns(), d.Name()) &&
+				(len(g.walkInclude) == 0 ||
+					matchesAny(g.walkInclude, d.Name())) {
+				files = append(files, path)
+			}
+
+			return nil
+		})
+
+	return files, err
+}
+
+// skipWalkDir returns true if the named directory should not be walked.
+func (g *gosh) skipWalkDir(name string) bool {
+	if g.walkSkipHidden &&
+		(strings.HasPrefix(name, ".") || name == "testdata") {
+		return true
+	}
+
+	return matchesAny(g.walkExclude, name)
+}
+
+// isBackupDir returns true if the directory is where the original files are
+// kept when editing in-place. It should not be walked as the copies of the
+// files edited earlier would be edited again.
+func (g *gosh) isBackupDir(dir string) bool {
+	if !g.inPlaceEdit || g.backupMode != backupModeDir {
+		return false
+	}
+
+	absDir, err := filepath.Abs(dir)
+
+	return err == nil && absDir == filepath.Clean(g.backupDir)
+}
+
+// walkSkipPatterns returns the glob patterns matching the names of files
+// which are never read when walking directories to edit the files found
+// in-place. These are the copies of the original files kept by earlier
+// edits and the temporary files used while editing.
+func (g *gosh) walkSkipPatterns() []string {
+	if !g.inPlaceEdit {
+		return nil
+	}
+
+	pats := []string{editTempPattern, recompressTempPattern}
+
+	suffix := escapeGlob(g.backupSuffix)
+
+	switch g.backupMode {
+	case backupModeSuffix:
+		pats = append(pats, "*"+suffix)
+	case backupModeNumbered:
+		pats = append(pats, "*"+suffix+".[0-9]*")
+	case backupModeTimestamp:
+		pats = append(pats, "*"+suffix+".[0-9]*-[0-9]*")
+	}
+
+	return pats
+}
+
+// escapeGlob returns the string with any characters which have a special
+// meaning in a glob pattern escaped so that the pattern matches them
+// literally.
+func escapeGlob(s string) string {
+	var b strings.Builder
+
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteRune('\\')
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// matchesAny returns true if the name matches any of the glob patterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if m, _ := filepath.Match(p, name); m {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compression returns the type of compression used by the named file (or
+// the empty string if it is not compressed). This is found from the
+// filename extension or, failing that, from the first few bytes of the
+// file. This should match the test made in the generated code.
+func compression(name string) (string, error) {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return compressionGzip, nil
+	case strings.HasSuffix(name, ".bz2"):
+		return compressionBzip2, nil
+	}
+
+	f, err := os.Open(name) //nolint:gosec
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 3)
+
+	n, err := io.ReadFull(f, magic)
+	if err != nil &&
+		!errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		return compressionGzip, nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return compressionBzip2, nil
+	}
+
+	return "", nil
+}
+
+// checkCanRecompress returns an error if the named file is compressed in a
+// way that the generated program cannot reproduce after editing it.
+func checkCanRecompress(name string) error {
+	z, err := compression(name)
+	if err != nil {
+		return err
+	}
+
+	if z == compressionBzip2 {
+		return fmt.Errorf(
+			"%q is compressed with %s and cannot be edited in-place"+
+				" (only %s-compressed files can be compressed again)",
+			name, z, compressionGzip)
+	}
+
+	return nil
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/nickwells/filecheck.mod/filecheck"
@@ -119,6 +121,38 @@ func TestPopulateFilesToRead(t *testing.T) {
 		})
 	}
 
+	{
+		var g *gosh
+
+		var eg *gosh
+
+		remainder := []string{testDataFile1, testBzip2File}
+
+		g = mkTestGosh(func(g *gosh) {
+			g.runInReadLoop = true
+			g.inPlaceEdit = true
+			g.decompress = true
+		})
+		eg = mkTestGosh(func(g *gosh) {
+			g.runInReadLoop = true
+			g.inPlaceEdit = true
+			g.decompress = true
+			g.filesToRead = true
+			g.args = []string{testDataFile1}
+			g.addError("compressed file check",
+				errors.New(`"`+testBzip2File+`" is compressed with bzip2`+
+					` and cannot be edited in-place`+
+					` (only gzip-compressed files can be compressed again)`))
+		})
+
+		testCases = append(testCases, tcs{
+			ID:      testhelper.MkID("bzip2 file, in-place-edit"),
+			files:   remainder,
+			g:       g,
+			expGosh: eg,
+		})
+	}
+
 	for _, tc := range testCases {
 		tc.g.populateFilesToRead(tc.files)
 
@@ -128,3 +162,387 @@ func TestPopulateFilesToRead(t *testing.T) {
 		}
 	}
 }
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+
+	testCases := []struct {
+		testhelper.ID
+		name    string
+		content string
+		expZ    string
+	}{
+		{
+			ID:      testhelper.MkID("plain"),
+			name:    "plain.txt",
+			content: "hello\n",
+		},
+		{
+			ID:   testhelper.MkID("empty"),
+			name: "empty.txt",
+		},
+		{
+			ID:      testhelper.MkID("gzip by extension"),
+			name:    "x.gz",
+			content: "not really",
+			expZ:    compressionGzip,
+		},
+		{
+			ID:      testhelper.MkID("bzip2 by extension"),
+			name:    "x.bz2",
+			content: "not really",
+			expZ:    compressionBzip2,
+		},
+		{
+			ID:      testhelper.MkID("gzip by content"),
+			name:    "gzipped",
+			content: "\x1f\x8b\x08",
+			expZ:    compressionGzip,
+		},
+		{
+			ID:      testhelper.MkID("bzip2 by content"),
+			name:    "bzipped",
+			content: "BZh91AY",
+			expZ:    compressionBzip2,
+		},
+	}
+
+	for _, tc := range testCases {
+		fName := mkTestFile(t, dir, tc.name, tc.content)
+
+		z, err := compression(fName)
+		if err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: unexpected error: %v", err)
+
+			continue
+		}
+
+		testhelper.DiffString(t, tc.IDStr(), "compression", z, tc.expZ)
+	}
+}
+
+// mkTestTree creates a directory tree under the given directory holding
+// the named files (each containing its own name) and returns the directory.
+func mkTestTree(t *testing.T, dir string, files ...string) string {
+	t.Helper()
+
+	for _, f := range files {
+		fName := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(fName), 0o700); err != nil {
+			t.Fatal("Cannot create the test directory:", err)
+		}
+
+		if err := os.WriteFile(fName, []byte(f+"\n"), 0o600); err != nil {
+			t.Fatal("Cannot create the test file:", err)
+		}
+	}
+
+	return dir
+}
+
+// testTreeFiles is the list of files in the test directory tree
+var testTreeFiles = []string{
+	"a.go",
+	"a.txt",
+	".hidden/h.go",
+	"testdata/t.go",
+	"sub/b.go",
+	"sub/b_test.go",
+	"sub/vendor/v.go",
+}
+
+func TestWalkDir(t *testing.T) {
+	dir := mkTestTree(t, t.TempDir(), testTreeFiles...)
+
+	testCases := []struct {
+		testhelper.ID
+		setGosh  func(g *gosh)
+		expFiles []string
+	}{
+		{
+			ID:      testhelper.MkID("all files"),
+			setGosh: func(_ *gosh) {},
+			expFiles: []string{
+				".hidden/h.go",
+				"a.go",
+				"a.txt",
+				"sub/b.go",
+				"sub/b_test.go",
+				"sub/vendor/v.go",
+				"testdata/t.go",
+			},
+		},
+		{
+			ID: testhelper.MkID("skip hidden"),
+			setGosh: func(g *gosh) {
+				g.walkSkipHidden = true
+			},
+			expFiles: []string{
+				"a.go",
+				"a.txt",
+				"sub/b.go",
+				"sub/b_test.go",
+				"sub/vendor/v.go",
+			},
+		},
+		{
+			ID: testhelper.MkID("include and exclude"),
+			setGosh: func(g *gosh) {
+				g.walkSkipHidden = true
+				g.walkInclude = []string{"*.go"}
+				g.walkExclude = []string{"*_test.go", "vendor"}
+			},
+			expFiles: []string{
+				"a.go",
+				"sub/b.go",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(tc.setGosh)
+
+		files, err := g.walkDir(dir)
+		if err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: unexpected error: %v", err)
+
+			continue
+		}
+
+		expFiles := make([]string, 0, len(tc.expFiles))
+		for _, f := range tc.expFiles {
+			expFiles = append(expFiles, filepath.Join(dir, f))
+		}
+
+		if err := testhelper.DiffVals(files, expFiles); err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: %s", err)
+		}
+	}
+}
+
+func TestWalkDirSkipsBackups(t *testing.T) {
+	dir := mkTestTree(t, t.TempDir(),
+		"a.go",
+		"a.go.orig",
+		"a.go.orig.1",
+		"a.go.orig.20240102-150405",
+		"a.go.bak",
+		"a.go.123456.new",
+		"a.go.123456.new.789.gz",
+		"a.new",
+		"bak/b.go",
+	)
+
+	testCases := []struct {
+		testhelper.ID
+		setGosh  func(g *gosh)
+		expFiles []string
+	}{
+		{
+			ID: testhelper.MkID("not editing"),
+			setGosh: func(g *gosh) {
+				g.inPlaceEdit = false
+			},
+			expFiles: []string{
+				"a.go",
+				"a.go.123456.new",
+				"a.go.123456.new.789.gz",
+				"a.go.bak",
+				"a.go.orig",
+				"a.go.orig.1",
+				"a.go.orig.20240102-150405",
+				"a.new",
+				"bak/b.go",
+			},
+		},
+		{
+			ID:      testhelper.MkID("suffix"),
+			setGosh: func(_ *gosh) {},
+			expFiles: []string{
+				"a.go",
+				"a.go.bak",
+				"a.go.orig.1",
+				"a.go.orig.20240102-150405",
+				"a.new",
+				"bak/b.go",
+			},
+		},
+		{
+			ID: testhelper.MkID("suffix, user suffix"),
+			setGosh: func(g *gosh) {
+				g.backupSuffix = ".bak"
+			},
+			expFiles: []string{
+				"a.go",
+				"a.go.orig",
+				"a.go.orig.1",
+				"a.go.orig.20240102-150405",
+				"a.new",
+				"bak/b.go",
+			},
+		},
+		{
+			ID: testhelper.MkID("numbered"),
+			setGosh: func(g *gosh) {
+				g.backupMode = backupModeNumbered
+			},
+			expFiles: []string{
+				"a.go",
+				"a.go.bak",
+				"a.go.orig",
+				"a.new",
+				"bak/b.go",
+			},
+		},
+		{
+			ID: testhelper.MkID("timestamp"),
+			setGosh: func(g *gosh) {
+				g.backupMode = backupModeTimestamp
+			},
+			expFiles: []string{
+				"a.go",
+				"a.go.bak",
+				"a.go.orig",
+				"a.go.orig.1",
+				"a.new",
+				"bak/b.go",
+			},
+		},
+		{
+			ID: testhelper.MkID("dir"),
+			setGosh: func(g *gosh) {
+				g.backupMode = backupModeDir
+				g.backupDir = filepath.Join(dir, "bak")
+			},
+			expFiles: []string{
+				"a.go",
+				"a.go.bak",
+				"a.go.orig",
+				"a.go.orig.1",
+				"a.go.orig.20240102-150405",
+				"a.new",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(func(g *gosh) { g.inPlaceEdit = true }, tc.setGosh)
+
+		files, err := g.walkDir(dir)
+		if err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: unexpected error: %v", err)
+
+			continue
+		}
+
+		expFiles := make([]string, 0, len(tc.expFiles))
+		for _, f := range tc.expFiles {
+			expFiles = append(expFiles, filepath.Join(dir, f))
+		}
+
+		if err := testhelper.DiffVals(files, expFiles); err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: %s", err)
+		}
+	}
+}
+
+func TestPopulateFilesToReadWalkDirs(t *testing.T) {
+	dir := mkTestTree(t, t.TempDir(),
+		append(testTreeFiles, "sub/b.go"+origExt)...)
+
+	testCases := []struct {
+		testhelper.ID
+		files   []string
+		setGosh func(g *gosh)
+		expErrs func(g *gosh)
+		expArgs []string
+	}{
+		{
+			ID:      testhelper.MkID("read a directory"),
+			files:   []string{dir},
+			expArgs: []string{dir},
+		},
+		{
+			ID:    testhelper.MkID("edit a directory with an orig file"),
+			files: []string{dir},
+			setGosh: func(g *gosh) {
+				g.inPlaceEdit = true
+				g.walkInclude = []string{"*.go"}
+			},
+			expErrs: func(g *gosh) {
+				g.addError("original file check",
+					fmt.Errorf("path: %q: %w",
+						filepath.Join(dir, "sub", "b.go")+origExt,
+						filecheck.ErrShouldNotExistButDoes))
+			},
+		},
+		{
+			ID:    testhelper.MkID("a file read twice"),
+			files: []string{filepath.Join(dir, "a.go"), dir},
+			setGosh: func(g *gosh) {
+				g.walkInclude = []string{"a.go"}
+			},
+			expErrs: func(g *gosh) {
+				g.addError("duplicate filename",
+					fmt.Errorf("file %q would be read more than once,"+
+						" through %q and again through %q",
+						filepath.Join(dir, "a.go"),
+						filepath.Join(dir, "a.go"), dir))
+			},
+			expArgs: []string{filepath.Join(dir, "a.go")},
+		},
+		{
+			ID: testhelper.MkID("the same file named differently"),
+			files: []string{
+				filepath.Join(dir, "a.go"),
+				dir + string(filepath.Separator) + "." +
+					string(filepath.Separator) + "a.go",
+			},
+			expErrs: func(g *gosh) {
+				g.addError("duplicate filename",
+					fmt.Errorf("filename %q has been given more than once,"+
+						" first at 0 and again at 1",
+						dir+string(filepath.Separator)+"."+
+							string(filepath.Separator)+"a.go"))
+			},
+			expArgs: []string{filepath.Join(dir, "a.go")},
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(func(g *gosh) {
+			g.runInReadLoop = true
+			g.walkDirs = true
+		})
+		eg := mkTestGosh(func(g *gosh) {
+			g.runInReadLoop = true
+			g.walkDirs = true
+		})
+
+		if tc.setGosh != nil {
+			tc.setGosh(g)
+			tc.setGosh(eg)
+		}
+
+		if tc.expErrs != nil {
+			tc.expErrs(eg)
+		}
+
+		if len(tc.expArgs) > 0 {
+			eg.filesToRead = true
+			eg.args = tc.expArgs
+		}
+
+		g.populateFilesToRead(tc.files)
+
+		if err := testhelper.DiffVals(*g, *eg); err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: Failed: %s\n", err)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/nickwells/errutil.mod/errutil"
 	"github.com/nickwells/param.mod/v7/param"
@@ -20,12 +23,25 @@ const (
 	dfltHTTPPath        = "/"
 	dfltHTTPHandlerName = "goshHandler"
 
+	dfltHTTPShutdownGrace = 5 * time.Second
+
 	dfltExecName = "G"
 
 	dfltSplitPattern = `\s+`
 
+	dfltCSVDelimiter = ","
+
+	dfltJSONType = "map[string]any"
+
 	goshCommentIntro = " gosh : "
 
+	// goshCommentExplanation is added to the introductory comment when
+	// gosh comments are being added to the generated code
+	goshCommentExplanation = `//
+// All lines of code generated by gosh (apart from these) end
+// with a comment like this: '//` + goshCommentIntro + `...'.
+// User provided code has no automatic end-of-line comment.`
+
 	globalSect      = "global"
 	beforeSect      = "before"
 	beforeInnerSect = "before-inner"
@@ -33,7 +49,18 @@ const (
 	afterInnerSect  = "after-inner"
 	afterSect       = "after"
 
+	afterShutdownSect = "after-shutdown"
+	middlewareSect    = "middleware"
+
 	goshFilename = "gosh.go"
+
+	// goshTestFilename is the name of the test file used when the code is
+	// run by 'go test' rather than being built and run as a program
+	goshTestFilename = "gosh_test.go"
+
+	// goshDiffFilename is the name of the file holding the code which shows
+	// the differences made by a dry-run of an in-place edit
+	goshDiffFilename = "goshDiff.go"
 )
 
 const (
@@ -41,6 +68,8 @@ const (
 	goshExitStatusBuildFail
 	goshExitStatusMisc
 	goshExitStatusRunFail
+	goshExitStatusRunLimit
+	goshExitStatusSnippetCheck
 )
 
 type expandFunc func(*gosh, string) ([]string, error)
@@ -48,35 +77,89 @@ type expandFunc func(*gosh, string) ([]string, error)
 // scriptEntry holds the values describing what should be added to the
 // script. The value can be either a snippet filename or else text to be
 // added verbatim; the expand func is set to handle these two cases
-// appropriately.
+// appropriately. The origin records where the entry came from so that
+// compiler errors can be reported against it.
 type scriptEntry struct {
 	expand expandFunc
 	value  string
+	origin srcOrigin
 }
 
 // gosh records all the details needed to build a gosh program
 type gosh struct {
 	preCheck bool
 
-	w           *os.File
+	w           *progWriter
 	indent      int
 	addComments bool
 
+	srcLocs   map[int]srcLoc
+	paramUses map[string]int
+
 	imports []string
 
 	scripts     map[string][]scriptEntry
 	copyGoFiles []string
+	embedFiles  []embedFile
+
+	benchmark  bool
+	benchAlts  []string
+	benchCount int64
+	profile    bool
+
+	asserts []assertion
 
 	runInReadLoop bool
 	inPlaceEdit   bool
 	splitLine     bool
 	splitPattern  string
 
+	backupMode   string
+	backupSuffix string
+	backupDir    string
+	ipeDryRun    bool
+
+	csvRecords    bool
+	csvDelimiter  string
+	csvComment    string
+	csvLazyQuotes bool
+	csvHeader     bool
+
+	jsonLines     bool
+	jsonType      string
+	jsonErrsFatal bool
+
+	parallelFiles int64
+	decompress    bool
+
+	walkDirs       bool
+	walkInclude    []string
+	walkExclude    []string
+	walkSkipHidden bool
+
 	runAsWebserver bool
 	httpHandler    string
 	httpPort       int64
 	httpPath       string
 
+	httpRoutes []httpRoute
+
+	httpUnixSocket string
+	httpAddrFile   string
+
+	httpAccessLog     string
+	httpAccessLogFile string
+
+	httpTLSCert       string
+	httpTLSKey        string
+	httpTLSSelfSigned bool
+
+	httpReadTimeout       time.Duration
+	httpReadHeaderTimeout time.Duration
+	httpWriteTimeout      time.Duration
+	httpIdleTimeout       time.Duration
+	httpShutdownGrace     time.Duration
+
 	runInReadloopSetters  []*param.ByName
 	runAsWebserverSetters []*param.ByName
 
@@ -104,6 +187,10 @@ type gosh struct {
 	ignoreGoModTidyErrs bool
 	dontRunGoModTidy    bool
 
+	ejectDir          string
+	ejectModule       string
+	ejectKeepComments bool
+
 	importPopulator     string
 	importPopulatorSet  bool
 	importPopulatorArgs []string
@@ -120,16 +207,58 @@ type gosh struct {
 	editor      string
 	editorArgs  []string
 
-	buildArgs []string
+	buildArgs   []string
+	buildOutput string
+	buildGOOS   string
+	buildGOARCH string
+
+	useBuildCache    bool
+	buildCacheDir    string
+	buildCacheMaxAge time.Duration
+	buildCacheMaxMB  int64
+	buildCacheList   bool
+	buildCacheClear  bool
+	buildCacheKey    string
+	cachedExec       string
+
+	buildCacheListStale bool
+	buildCacheRebuild   bool
+	shebangScripts      []shebangScript
+	shebangDeps         []string
+	configFiles         []string
+	shebangCacheInfo    string
+	goshArgs            []string
+
+	history       bool
+	historyFile   string
+	historyMaxMB  int64
+	historyTag    string
+	historyList   bool
+	historySearch *regexp.Regexp
+	historyShow   string
+	historyReplay string
 
 	env      []string
 	clearEnv bool
 
+	runTimeout      time.Duration
+	runTimeoutGrace time.Duration
+	runCPULimit     time.Duration
+	runMemLimitMB   int64
+	runFilesLimit   int64
+
+	repl        bool
+	replBase    int
+	replStdout  *bytes.Buffer
+	replStderr  *bytes.Buffer
+	replOutputs []replOutput
+
 	exitStatus int
 }
 
 // CacheSnippet will cache the named snippet and copy any imports it requires
-// into the set of imports for the gosh script
+// into the set of imports for the gosh script. The snippet file is recorded
+// as one that the program depends on.
 func (g *gosh) CacheSnippet(sName string) error {
 	s, err := g.snippets.Add(g.snippetDirs, sName)
 	if err != nil {
@@ -137,13 +266,20 @@ func (g *gosh) CacheSnippet(sName string) error {
 	}
 
 	g.imports = append(g.imports, s.Imports()...)
+	g.addShebangDep(s.Path())
 
 	return nil
 }
 
-// snippetExpand will return the snippet text. It also checks that the
-// snippet is being used in the correct order and returns an error if not.
-func snippetExpand(g *gosh, sName string) ([]string, error) {
+// snippetExpand will return the snippet text with any snippet parameters
+// replaced by their values. It also checks that the snippet is being used
+// in the correct order and returns an error if not.
+func snippetExpand(g *gosh, v string) ([]string, error) {
+	sName, vals, err := splitSnippetArg(v)
+	if err != nil {
+		return nil, err
+	}
+
 	s, err := g.snippets.Get(sName)
 	if err != nil {
 		return nil, err
@@ -159,15 +295,29 @@ func snippetExpand(g *gosh, sName string) ([]string, error) {
 		}
 	}
 
-	if len(s.Text()) == 0 {
+	var text []string
+
+	params, err := snippetParams(s)
+	if err == nil {
+		text, err = substSnippetParams(s.Text(), params, vals)
+	}
+
+	if err != nil {
+		g.addError("Snippet parameters",
+			fmt.Errorf("snippet %q: %w", sName, err))
+
+		return nil, nil
+	}
+
+	if len(text) == 0 {
 		return nil, nil
 	}
 
 	var content []string
 
-	addSnippetComment(&content, "BEGIN "+sName)
+	addSnippetComment(&content, "BEGIN "+v)
 	content = append(content, "// "+s.Path())
-	content = append(content, s.Text()...)
+	content = append(content, text...)
 	addSnippetComment(&content, "END")
 
 	return content, nil
@@ -195,9 +345,17 @@ func newGosh() *gosh {
 			execSect:        {},
 			afterInnerSect:  {},
 			afterSect:       {},
+
+			afterShutdownSect: {},
+			middlewareSect:    {},
 		},
 
-		splitPattern: dfltSplitPattern,
+		splitPattern:  dfltSplitPattern,
+		backupMode:    backupModeSuffix,
+		backupSuffix:  origExt,
+		httpAccessLog: accessLogNone,
+		csvDelimiter:  dfltCSVDelimiter,
+		jsonType:      dfltJSONType,
 
 		errMap: errutil.NewErrMap(),
 
@@ -205,11 +363,23 @@ func newGosh() *gosh {
 		httpPath:    dfltHTTPPath,
 		httpHandler: dfltHTTPHandlerName,
 
+		httpShutdownGrace: dfltHTTPShutdownGrace,
+
+		runTimeoutGrace: dfltRunTimeoutGrace,
+
 		execName: dfltExecName,
 
+		buildCacheDir:    dfltBuildCacheDir(),
+		buildCacheMaxAge: dfltBuildCacheMaxAge,
+		buildCacheMaxMB:  dfltBuildCacheMaxMB,
+
+		historyFile:  dfltHistoryFile(),
+		historyMaxMB: dfltHistoryMaxMB,
+
 		runDir: cwd,
 
 		snippetUsed: map[string]bool{},
+		paramUses:   map[string]int{},
 		snippets:    &snippet.Cache{},
 
 		dbgStack: &verbose.Stack{},
@@ -267,15 +437,20 @@ func (g *gosh) addError(name string, err error) {
 	g.errMap.AddError(name, err)
 }
 
-// checkScripts checks that not all the scripts are empty
+// checkScripts checks that not all the scripts are empty. When running
+// interactively the code is given later and so this check is skipped.
 func (g *gosh) checkScripts() {
+	if g.repl {
+		return
+	}
+
 	for _, s := range g.scripts {
 		if len(s) > 0 {
 			return
 		}
 	}
 
-	if g.httpHandler != dfltHTTPHandlerName {
+	if g.httpHandler != dfltHTTPHandlerName || g.hasAsserts() {
 		return
 	}
 
@@ -370,6 +545,39 @@ var knownVarMap = varMap{
 		typeName: "[]string",
 		desc:     "the parts of the line (when split)",
 	},
+	"_jv": {
+		typeName: dfltJSONType,
+		desc: "the decoded JSON value of the line" +
+			" (the type can be changed)",
+	},
+	"_r": {
+		typeName: "io.Reader",
+		desc:     "the reader for the file, decompressing it if needed",
+	},
+	"_z": {
+		typeName: "string",
+		desc:     "the compression used by the file being edited",
+	},
+	"_o": {
+		typeName: "*bytes.Buffer",
+		desc:     "the output for the file (when processing files in parallel)",
+	},
+	"_cr": {
+		typeName: "*csv.Reader",
+		desc:     "a CSV reader used to read the files",
+	},
+	"_rec": {
+		typeName: "[]string",
+		desc:     "the current record (when reading CSV records)",
+	},
+	"_hdr": {
+		typeName: "map[string]int",
+		desc:     "the index of each field in the CSV header record",
+	},
+	"_cw": {
+		typeName: "*csv.Writer",
+		desc:     "a CSV writer on the _w file (when editing CSV records)",
+	},
 }
 
 // nameType looks up the name in knownVarMap and if it is found it will
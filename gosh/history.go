@@ -0,0 +1,610 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nickwells/check.mod/v2/check"
+	"github.com/nickwells/param.mod/v7/paction"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/psetter"
+	"github.com/nickwells/verbose.mod/verbose"
+)
+
+const (
+	paramGroupNameHistory = "cmd-history"
+
+	paramNameHistory       = "history"
+	paramNameHistoryFile   = "history-file"
+	paramNameHistoryMaxMB  = "history-max-size"
+	paramNameHistoryTag    = "history-tag"
+	paramNameHistoryList   = "history-list"
+	paramNameHistorySearch = "history-search"
+	paramNameHistoryShow   = "history-show"
+	paramNameHistoryReplay = "history-replay"
+
+	// xdgStateHomeEnvVar is not provided by the xdg package
+	xdgStateHomeEnvVar     = "XDG_STATE_HOME"
+	xdgStateHomeEnvVarDflt = "$HOME/.local/state"
+
+	dfltHistoryMaxMB = 1
+
+	// historyRotations is the number of old history files that are kept
+	// when the history file is rotated
+	historyRotations = 3
+
+	historyDirPerms  = 0o700 // Owner: all, the rest, none
+	historyFilePerms = 0o600 // Owner: Read/Write, the rest, none
+
+	// historyLockSuffix is added to the name of the history file to give
+	// the name of the file which is locked while an entry is added
+	historyLockSuffix = ".lock"
+)
+
+var historyParamNames = []string{
+	paramNameHistory,
+	paramNameHistoryFile,
+	paramNameHistoryMaxMB,
+	paramNameHistoryTag,
+	paramNameHistoryList,
+	paramNameHistorySearch,
+	paramNameHistoryShow,
+	paramNameHistoryReplay,
+}
+
+// historyEntry records the details of a gosh invocation. The args are the
+// command line arguments which are used to replay the entry, the params
+// describe every parameter that was set, including those from config files
+// and from '#gosh.param:' lines, and where it was set.
+type historyEntry struct {
+	ID      int       `json:"id"`
+	Time    time.Time `json:"time"`
+	Dir     string    `json:"dir"`
+	Tag     string    `json:"tag,omitempty"`
+	Args    []string  `json:"args"`
+	Params  []string  `json:"params"`
+	Program string    `json:"program,omitempty"`
+}
+
+// xdgStateHome returns the value of the XDG_STATE_HOME environment variable
+// or the default value
+func xdgStateHome() string {
+	rval := os.ExpandEnv("$" + xdgStateHomeEnvVar)
+	if rval == "" {
+		rval = os.ExpandEnv(xdgStateHomeEnvVarDflt)
+	}
+
+	return rval
+}
+
+// dfltHistoryFile returns the default name of the file where the history
+// of gosh invocations is recorded
+func dfltHistoryFile() string {
+	return filepath.Join(xdgStateHome(),
+		"github.com",
+		"nickwells",
+		"utilities",
+		"gosh",
+		"history")
+}
+
+// addHistoryParams returns a func that will add parameters concerned with
+// the history of gosh invocations to the passed param.PSet.
+func addHistoryParams(g *gosh) func(ps *param.PSet) error {
+	return func(ps *param.PSet) error {
+		ps.AddGroup(paramGroupNameHistory,
+			"parameters relating to the history of gosh invocations.")
+
+		ps.Add(paramNameHistory, psetter.Bool{Value: &g.history},
+			"record this invocation in the history file if it"+
+				" succeeds. The entry records the command line, the"+
+				" directory gosh was run from, every parameter that"+
+				" was set, including those from config files and from"+
+				" '"+shebangGoshParam+"' lines, and the generated"+
+				" program. The entry can be replayed later without"+
+				" having to find it in the shell history."+
+				"\n\n"+
+				"Set this in the config file to record every"+
+				" invocation.",
+			param.AltNames("hist"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameHistory),
+			param.SeeAlso(historyParamNames...),
+		)
+
+		ps.Add(paramNameHistoryFile,
+			psetter.Pathname{
+				Value:         &g.historyFile,
+				ForceAbsolute: true,
+			},
+			"set the file where the history is recorded. The"+
+				" directory will be created if it does not exist.",
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameHistory),
+			param.SeeAlso(historyParamNames...),
+		)
+
+		ps.Add(paramNameHistoryMaxMB,
+			psetter.Int[int64]{
+				Value: &g.historyMaxMB,
+				Checks: []check.Int64{
+					check.ValGT[int64](0),
+				},
+			},
+			"set the maximum size of the history file in megabytes."+
+				" If adding an entry would make the file bigger than"+
+				" this then it is rotated; the file is renamed with a"+
+				" numeric suffix and a new file is started. Only the"+
+				" "+strconv.Itoa(historyRotations)+" most recent old"+
+				" files are kept.",
+			param.AltNames("history-max-mb"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameHistory),
+			param.SeeAlso(historyParamNames...),
+		)
+
+		ps.Add(paramNameHistoryTag,
+			psetter.String[string]{Value: &g.historyTag},
+			"give a tag to the history entry for this invocation. The"+
+				" entry can then be shown or replayed using the tag"+
+				" rather than its number. If several entries have the"+
+				" same tag the most recent one is used."+
+				"\n\n"+
+				"Giving this turns on the recording of the history.",
+			param.Attrs(param.DontShowInStdUsage),
+			param.PostAction(paction.SetVal(&g.history, true)),
+			param.GroupName(paramGroupNameHistory),
+			param.SeeAlso(historyParamNames...),
+		)
+
+		ps.Add(paramNameHistoryList, psetter.Bool{Value: &g.historyList},
+			"list the entries in the history and exit, no program"+
+				" is run.",
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameHistory),
+			param.SeeAlso(historyParamNames...),
+		)
+
+		ps.Add(paramNameHistorySearch,
+			psetter.Regexp{Value: &g.historySearch},
+			"list the entries in the history whose command line,"+
+				" parameters, directory or tag match this regular"+
+				" expression and exit, no program is run.",
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameHistory),
+			param.SeeAlso(historyParamNames...),
+		)
+
+		ps.Add(paramNameHistoryShow,
+			psetter.String[string]{Value: &g.historyShow},
+			"show the details of the history entry with this number"+
+				" or tag, including the generated program, and exit,"+
+				" no program is run.",
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameHistory),
+			param.SeeAlso(historyParamNames...),
+		)
+
+		ps.Add(paramNameHistoryReplay,
+			psetter.String[string]{Value: &g.historyReplay},
+			"run gosh again with the command line recorded in the"+
+				" history entry with this number or tag, from the"+
+				" directory it was run in. Config files and any"+
+				" scripts are read again so the program may differ"+
+				" from the one that was recorded.",
+			param.AltNames("replay"),
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameHistory),
+			param.SeeAlso(historyParamNames...),
+		)
+
+		ps.AddFinalCheck(func() error {
+			count := 0
+
+			for _, n := range []string{
+				paramNameHistoryShow,
+				paramNameHistoryReplay,
+			} {
+				if p, err := ps.GetParamByName(n); err == nil &&
+					p.HasBeenSet() {
+					count++
+				}
+			}
+
+			if g.historyList || g.historySearch != nil {
+				count++
+			}
+
+			if count > 1 {
+				return fmt.Errorf(
+					"only one of listing, showing or replaying the"+
+						" history can be done (see the %q group)",
+					paramGroupNameHistory)
+			}
+
+			return nil
+		})
+
+		return nil
+	}
+}
+
+// historyFiles returns the names of the history files, oldest first
+func (g *gosh) historyFiles() []string {
+	files := []string{}
+
+	for i := historyRotations; i > 0; i-- {
+		files = append(files, g.historyFile+"."+strconv.Itoa(i))
+	}
+
+	return append(files, g.historyFile)
+}
+
+// readHistoryFile reads the entries from the named history file. A
+// missing file is not an error.
+func readHistoryFile(fileName string) ([]historyEntry, error) {
+	f, err := os.Open(fileName) //nolint:gosec
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+
+	dec := json.NewDecoder(f)
+
+	for {
+		var e historyEntry
+
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return entries, nil
+		}
+
+		if err != nil {
+			return entries, fmt.Errorf("bad history file %q: %w",
+				fileName, err)
+		}
+
+		entries = append(entries, e)
+	}
+}
+
+// historyEntries returns all the entries in the history, oldest first
+func (g *gosh) historyEntries() ([]historyEntry, error) {
+	var entries []historyEntry
+
+	for _, fName := range g.historyFiles() {
+		e, err := readHistoryFile(fName)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e...)
+	}
+
+	return entries, nil
+}
+
+// nextHistoryID returns the number to be given to the next history
+// entry. This is one more than the number of the most recent entry.
+func (g *gosh) nextHistoryID() (int, error) {
+	files := g.historyFiles()
+
+	for _, fName := range slices.Backward(files) {
+		entries, err := readHistoryFile(fName)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(entries) > 0 {
+			return entries[len(entries)-1].ID + 1, nil
+		}
+	}
+
+	return 1, nil
+}
+
+// rotateHistory renames the history file, and any old history files,
+// giving them the next numeric suffix. The oldest file is removed.
+func (g *gosh) rotateHistory() error {
+	files := g.historyFiles()
+
+	err := os.Remove(files[0])
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for i := 1; i < len(files); i++ {
+		err := os.Rename(files[i], files[i-1])
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addHistoryEntry gives the entry its number and appends it to the history
+// file, rotating the file first if it would become too big. The history is
+// locked while this is done so that several gosh invocations running at
+// the same time (in a pipeline, say) do not give their entries the same
+// number or rotate the files over each other.
+func (g *gosh) addHistoryEntry(e historyEntry) error {
+	err := os.MkdirAll(filepath.Dir(g.historyFile), historyDirPerms)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockHistory(g.historyFile)
+	if err != nil {
+		return fmt.Errorf("cannot lock the history: %w", err)
+	}
+	defer unlock()
+
+	e.ID, err = g.nextHistoryID()
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	if info, err := os.Stat(g.historyFile); err == nil &&
+		info.Size() > 0 &&
+		info.Size()+int64(len(line)) > g.historyMaxMB*bytesPerMB {
+		if err := g.rotateHistory(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(g.historyFile,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, historyFilePerms)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// historyParams returns a description of every parameter that has been
+// set and where it was set
+func historyParams(ps *param.PSet) []string {
+	params := []string{}
+
+	for _, grp := range ps.GetGroups() {
+		for _, p := range grp.Params() {
+			params = append(params, p.WhereSet()...)
+		}
+	}
+
+	return params
+}
+
+// recordHistory adds an entry for this invocation to the history if it has
+// been requested and the invocation has succeeded. The program is read from
+// the gosh directory and so this must be called before it is cleaned up.
+// A failure to record the history is reported but does not change the
+// exit status.
+func (g *gosh) recordHistory(ps *param.PSet) {
+	if !g.history || g.exitStatus != 0 {
+		return
+	}
+
+	defer g.dbgStack.Start("recordHistory", "Recording the history")()
+
+	intro := g.dbgStack.Tag()
+
+	e := historyEntry{
+		Time:   time.Now(),
+		Dir:    g.runDir,
+		Tag:    g.historyTag,
+		Args:   os.Args[1:],
+		Params: historyParams(ps),
+	}
+
+	if g.goshDir != "" {
+		prog, err := os.ReadFile(filepath.Join(g.goshDir, goshFilename))
+		if err == nil {
+			e.Program = string(prog)
+		}
+	}
+
+	verbose.Println(intro, " History file: ", g.historyFile)
+
+	if err := g.addHistoryEntry(e); err != nil {
+		fmt.Fprintln(os.Stderr, "gosh couldn't record the history:", err)
+	}
+}
+
+// findHistoryEntry returns the entry with the given number or, if the
+// value is not a number, the most recent entry with the given tag.
+func findHistoryEntry(entries []historyEntry, v string) (historyEntry, error) {
+	if id, err := strconv.Atoi(v); err == nil {
+		for _, e := range entries {
+			if e.ID == id {
+				return e, nil
+			}
+		}
+
+		return historyEntry{}, fmt.Errorf("there is no history entry %d", id)
+	}
+
+	for _, e := range slices.Backward(entries) {
+		if e.Tag == v {
+			return e, nil
+		}
+	}
+
+	return historyEntry{},
+		fmt.Errorf("there is no history entry with the tag %q", v)
+}
+
+// searchHistory returns the entries where the command line, parameters,
+// directory or tag match the regular expression
+func searchHistory(entries []historyEntry, re *regexp.Regexp) []historyEntry {
+	return slices.DeleteFunc(slices.Clone(entries), func(e historyEntry) bool {
+		if re.MatchString(e.cmdLine()) ||
+			re.MatchString(e.Dir) ||
+			re.MatchString(e.Tag) {
+			return false
+		}
+
+		return !slices.ContainsFunc(e.Params, re.MatchString)
+	})
+}
+
+// shellQuote returns the string quoted so that it can be given to the
+// shell as a single word
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s,
+		"abcdefghijklmnopqrstuvwxyz"+
+			"ABCDEFGHIJKLMNOPQRSTUVWXYZ"+
+			"0123456789"+
+			"-_=+.,:/@%") == "" {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// cmdLine returns the command line of the history entry, quoted so that
+// it can be given to the shell
+func (e historyEntry) cmdLine() string {
+	words := []string{"gosh"}
+	for _, a := range e.Args {
+		words = append(words, shellQuote(a))
+	}
+
+	return strings.Join(words, " ")
+}
+
+// listHistory prints the history entries, oldest first
+func listHistory(w io.Writer, entries []historyEntry) {
+	for _, e := range entries {
+		tag := ""
+		if e.Tag != "" {
+			tag = " [" + e.Tag + "]"
+		}
+
+		fmt.Fprintf(w, "%5d %s%s %s\n",
+			e.ID, e.Time.Format(time.DateTime), tag, e.Dir)
+		fmt.Fprintf(w, "      %s\n", e.cmdLine())
+	}
+}
+
+// showHistory prints the details of the history entry
+func showHistory(w io.Writer, e historyEntry) {
+	fmt.Fprintf(w, "entry:     %d\n", e.ID)
+	fmt.Fprintf(w, "time:      %s\n", e.Time.Format(time.DateTime))
+
+	if e.Tag != "" {
+		fmt.Fprintf(w, "tag:       %s\n", e.Tag)
+	}
+
+	fmt.Fprintf(w, "directory: %s\n", e.Dir)
+	fmt.Fprintf(w, "command:   %s\n", e.cmdLine())
+	fmt.Fprintln(w, "parameters:")
+
+	for _, p := range e.Params {
+		fmt.Fprintf(w, "    %s\n", p)
+	}
+
+	if e.Program == "" {
+		fmt.Fprintln(w, "no program was recorded")
+		return
+	}
+
+	fmt.Fprintln(w, "program:")
+	fmt.Fprint(w, e.Program)
+}
+
+// replayHistory runs gosh again with the arguments from the history entry
+// in the directory where it was first run. It returns the exit status of
+// the replayed gosh.
+func (g *gosh) replayHistory(e historyEntry) int {
+	goshPath, err := os.Executable()
+	g.reportFatalError("find the gosh program", "", err)
+
+	verbose.Println("replayHistory: Command: ", e.cmdLine())
+	verbose.Println("replayHistory: Directory: ", e.Dir)
+
+	cmd := exec.Command(goshPath, e.Args...) //nolint:gosec
+	cmd.Dir = e.Dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err == nil {
+		return 0
+	}
+
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() > 0 {
+		return ee.ExitCode()
+	}
+
+	g.reportFatalError("replay the history entry", e.cmdLine(), err)
+
+	return goshExitStatusMisc
+}
+
+// manageHistory checks the history parameters and lists, shows or replays
+// the history accordingly. If any of these is done then the program will
+// exit after it is complete.
+func manageHistory(g *gosh) {
+	if !g.historyList && g.historySearch == nil &&
+		g.historyShow == "" && g.historyReplay == "" {
+		return
+	}
+
+	entries, err := g.historyEntries()
+	g.reportFatalError("read the history", g.historyFile, err)
+
+	switch {
+	case g.historyShow != "" || g.historyReplay != "":
+		v := g.historyShow
+		if v == "" {
+			v = g.historyReplay
+		}
+
+		e, err := findHistoryEntry(entries, v)
+		g.reportFatalError("find the history entry", v, err)
+
+		if g.historyShow != "" {
+			showHistory(os.Stdout, e)
+			break
+		}
+
+		os.Exit(g.replayHistory(e))
+	case g.historySearch != nil:
+		listHistory(os.Stdout, searchHistory(entries, g.historySearch))
+	default:
+		listHistory(os.Stdout, entries)
+	}
+
+	os.Exit(0)
+}
@@ -0,0 +1,33 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// historyLockAvailable records whether the history can be locked
+const historyLockAvailable = true
+
+// lockHistory takes an exclusive lock on the lock file for the history
+// file, waiting until any other gosh holding it has finished. The returned
+// func releases the lock.
+func lockHistory(historyFile string) (func(), error) {
+	f, err := os.OpenFile(historyFile+historyLockSuffix,
+		os.O_CREATE|os.O_RDWR, historyFilePerms)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package main
+
+// historyLockAvailable records whether the history can be locked
+const historyLockAvailable = false
+
+// lockHistory does nothing, file locks are not supported. The returned
+// func does nothing.
+func lockHistory(_ string) (func(), error) {
+	return func() {}, nil
+}
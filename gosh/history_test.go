@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nickwells/errutil.mod/errutil"
+	"github.com/nickwells/param.mod/v7/paramtest"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// TestParseParamsHistory will use the paramtest.Parser to make sure the
+// behaviour of the parameter setting is as expected. This tests just the
+// parameters in the 'cmd-history' group.
+func TestParseParamsHistory(t *testing.T) {
+	testCases := []paramtest.Parser{
+		mkTestParser(nil, testhelper.MkID("tag"),
+			func(g *gosh) {
+				g.history = true
+				g.historyTag = "t1"
+			},
+			"-"+paramNameHistoryTag, "t1"),
+		mkTestParser(nil, testhelper.MkID("replay"),
+			func(g *gosh) { g.historyReplay = "t1" },
+			"-replay", "t1"),
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(`only one of listing, showing or replaying the`+
+				` history can be done (see the "cmd-history" group)`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs,
+				testhelper.MkID("show and replay"),
+				func(g *gosh) {
+					g.historyShow = "1"
+					g.historyReplay = "2"
+				},
+				"-"+paramNameHistoryShow, "1",
+				"-"+paramNameHistoryReplay, "2"))
+	}
+
+	for _, tc := range testCases {
+		_ = tc.Test(t)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		s      string
+		expVal string
+	}{
+		{ID: testhelper.MkID("plain"), s: "-exec", expVal: "-exec"},
+		{ID: testhelper.MkID("path"), s: "/a/b.go", expVal: "/a/b.go"},
+		{ID: testhelper.MkID("empty"), s: "", expVal: "''"},
+		{ID: testhelper.MkID("space"), s: "a b", expVal: "'a b'"},
+		{
+			ID:     testhelper.MkID("quotes"),
+			s:      `fmt.Println("it's")`,
+			expVal: `'fmt.Println("it'\''s")'`,
+		},
+	}
+
+	for _, tc := range testCases {
+		testhelper.DiffString(t, tc.IDStr(), "quoted",
+			shellQuote(tc.s), tc.expVal)
+	}
+}
+
+func TestHistoryRotation(t *testing.T) {
+	g := mkTestGosh(func(g *gosh) {
+		g.historyFile = filepath.Join(t.TempDir(), "hist", "history")
+		g.historyMaxMB = 1
+	})
+
+	// each entry is more than half the maximum size so the file is rotated
+	// every time an entry is added
+	prog := strings.Repeat("x", bytesPerMB/2+1)
+
+	const entryCount = historyRotations + 2
+
+	for range entryCount {
+		if err := g.addHistoryEntry(historyEntry{Program: prog}); err != nil {
+			t.Fatal("Cannot add the history entry:", err)
+		}
+	}
+
+	entries, err := g.historyEntries()
+	if err != nil {
+		t.Fatal("Cannot read the history:", err)
+	}
+
+	ids := []int{}
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+
+	if err := testhelper.DiffVals(ids, []int{2, 3, 4, 5}); err != nil {
+		t.Errorf("unexpected history entries: %s", err)
+	}
+
+	id, err := g.nextHistoryID()
+	if err != nil {
+		t.Fatal("Cannot find the next history ID:", err)
+	}
+
+	testhelper.DiffInt(t, "next history ID", "ID", id, entryCount+1)
+}
+
+// addTestHistoryEntry adds an entry to the history file given by the
+// envTestAddHistory environment variable. It is run by the test binary
+// standing in for gosh (see TestMain).
+func addTestHistoryEntry(historyFile string) {
+	g := mkTestGosh(func(g *gosh) { g.historyFile = historyFile })
+
+	if err := g.addHistoryEntry(historyEntry{Program: "x"}); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot add the history entry:", err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+func TestHistoryConcurrentAppend(t *testing.T) {
+	if !historyLockAvailable {
+		t.Skip("the history cannot be locked")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal("Cannot find the test executable:", err)
+	}
+
+	historyFile := filepath.Join(t.TempDir(), "hist", "history")
+
+	// the history is filled so that reading it, to find the next ID,
+	// takes long enough for the appends to overlap
+	const (
+		oldEntryCount = 2000
+		entryCount    = 20
+	)
+
+	var hist bytes.Buffer
+
+	for i := range oldEntryCount {
+		line, err := json.Marshal(
+			historyEntry{ID: i + 1, Program: strings.Repeat("x", 200)})
+		if err != nil {
+			t.Fatal("Cannot make the history entry:", err)
+		}
+
+		hist.Write(append(line, '\n'))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(historyFile), 0o700); err != nil {
+		t.Fatal("Cannot make the history directory:", err)
+	}
+
+	if err := os.WriteFile(historyFile, hist.Bytes(), 0o600); err != nil {
+		t.Fatal("Cannot write the history file:", err)
+	}
+
+	cmds := []*exec.Cmd{}
+
+	for range entryCount {
+		cmd := exec.Command(self)
+		cmd.Env = append(os.Environ(), envTestAddHistory+"="+historyFile)
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Start(); err != nil {
+			t.Fatal("Cannot start the test process:", err)
+		}
+
+		cmds = append(cmds, cmd)
+	}
+
+	for _, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Error("The history entry was not added:", err)
+		}
+	}
+
+	g := mkTestGosh(func(g *gosh) { g.historyFile = historyFile })
+
+	entries, err := g.historyEntries()
+	if err != nil {
+		t.Fatal("Cannot read the history:", err)
+	}
+
+	ids := []int{}
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+
+	slices.Sort(ids)
+
+	expIDs := []int{}
+	for i := range oldEntryCount + entryCount {
+		expIDs = append(expIDs, i+1)
+	}
+
+	if err := testhelper.DiffVals(ids, expIDs); err != nil {
+		t.Errorf("the history entries should have unique IDs: %s", err)
+	}
+}
+
+func TestFindHistoryEntry(t *testing.T) {
+	entries := []historyEntry{
+		{ID: 7, Tag: "a"},
+		{ID: 8, Tag: "b"},
+		{ID: 9, Tag: "a"},
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		v     string
+		expID int
+	}{
+		{ID: testhelper.MkID("by number"), v: "8", expID: 8},
+		{ID: testhelper.MkID("by tag, most recent"), v: "a", expID: 9},
+		{
+			ID:     testhelper.MkID("no such number"),
+			v:      "1",
+			ExpErr: testhelper.MkExpErr("there is no history entry 1"),
+		},
+		{
+			ID: testhelper.MkID("no such tag"),
+			v:  "c",
+			ExpErr: testhelper.MkExpErr(
+				`there is no history entry with the tag "c"`),
+		},
+	}
+
+	for _, tc := range testCases {
+		e, err := findHistoryEntry(entries, tc.v)
+		if testhelper.CheckExpErr(t, err, tc) && err == nil {
+			testhelper.DiffInt(t, tc.IDStr(), "entry", e.ID, tc.expID)
+		}
+	}
+}
+
+func TestSearchHistory(t *testing.T) {
+	entries := []historyEntry{
+		{ID: 1, Dir: "/a", Args: []string{"-e", "fmt.Println(1)"}},
+		{ID: 2, Dir: "/b", Tag: "csv", Args: []string{"-e", "x++"}},
+		{
+			ID:     3,
+			Dir:    "/c",
+			Args:   []string{"-e", "y++"},
+			Params: []string{`common.cfg:1: import=strings`},
+		},
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		re     string
+		expIDs []int
+	}{
+		{ID: testhelper.MkID("args"), re: `Println`, expIDs: []int{1}},
+		{ID: testhelper.MkID("dir"), re: `^/b$`, expIDs: []int{2}},
+		{ID: testhelper.MkID("tag"), re: `csv`, expIDs: []int{2}},
+		{ID: testhelper.MkID("params"), re: `strings`, expIDs: []int{3}},
+		{ID: testhelper.MkID("several"), re: `\+\+`, expIDs: []int{2, 3}},
+		{ID: testhelper.MkID("none"), re: `nonesuch`, expIDs: []int{}},
+	}
+
+	for _, tc := range testCases {
+		ids := []int{}
+		for _, e := range searchHistory(entries, regexp.MustCompile(tc.re)) {
+			ids = append(ids, e.ID)
+		}
+
+		if err := testhelper.DiffVals(ids, tc.expIDs); err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: unexpected entries: %s", err)
+		}
+	}
+
+	testhelper.DiffInt(t, "search", "unchanged entries", len(entries), 3)
+}
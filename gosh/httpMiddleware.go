@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nickwells/check.mod/v2/check"
+	"github.com/nickwells/location.mod/location"
+	"github.com/nickwells/param.mod/v7/paction"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/psetter"
+)
+
+const (
+	paramNameHTTPAccessLog         = "http-access-log"
+	paramNameHTTPAccessLogFile     = "http-access-log-file"
+	paramNameHTTPMiddleware        = "http-middleware"
+	paramNameHTTPMiddlewareSnippet = "http-middleware-snippet"
+
+	accessLogNone   = "none"
+	accessLogCommon = "common"
+	accessLogJSON   = "json"
+
+	// accessLogTimeFormat is the format of the time in the Common Log
+	// Format
+	accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+	mwSfx = " - middleware"
+)
+
+var httpMiddlewareParamNames = []string{
+	paramNameHTTPAccessLog,
+	paramNameHTTPAccessLogFile,
+	paramNameHTTPMiddleware,
+	paramNameHTTPMiddlewareSnippet,
+}
+
+// needsHandlerWrapper returns true if the webserver's handler is to be
+// wrapped, either by the access logger or by some middleware.
+func (g *gosh) needsHandlerWrapper() bool {
+	return g.httpAccessLog != accessLogNone || len(g.scripts[middlewareSect]) > 0
+}
+
+// accessLogFilePAF generates the Post-Action func (PAF) that sets the format
+// of the access log if it has not already been set. This means that giving
+// just the file is enough to turn on access logging.
+func accessLogFilePAF(g *gosh) param.ActionFunc {
+	return func(_ location.L, _ *param.BaseParam, _ []string) error {
+		if g.httpAccessLog == accessLogNone {
+			g.httpAccessLog = accessLogCommon
+		}
+
+		return nil
+	}
+}
+
+// addWebMiddlewareParams adds the parameters which wrap the webserver's
+// handler in middleware, including the access logger. These are all in the
+// "web" parameter group.
+func addWebMiddlewareParams(g *gosh, ps *param.PSet) {
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPAccessLog,
+			psetter.Enum[string]{
+				Value: &g.httpAccessLog,
+				AllowedVals: psetter.AllowedVals[string]{
+					accessLogNone: "do not log requests",
+					accessLogCommon: "log each request in the Common Log" +
+						" Format followed by the time taken to" +
+						" handle it",
+					accessLogJSON: "log each request as a JSON object," +
+						" one per line",
+				},
+			},
+			"log every request that the webserver handles, giving the"+
+				" method, path, status, the number of bytes written"+
+				" and the time taken. The requests are logged to"+
+				" standard error unless a file is given with the"+
+				" '"+paramNameHTTPAccessLogFile+"' parameter."+
+				" Setting this will also force the program to be run"+
+				" as a web server.",
+			param.AltNames("access-log"),
+			param.ValueName("format"),
+			param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(httpMiddlewareParamNames...),
+		),
+	)
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPAccessLogFile,
+			psetter.Pathname{
+				Value:         &g.httpAccessLogFile,
+				ForceAbsolute: true,
+			},
+			"set the name of the file that requests are logged to. The"+
+				" file is created if it does not exist and is appended"+
+				" to if it does. If no format has been given through"+
+				" the '"+paramNameHTTPAccessLog+"' parameter the"+
+				" requests are logged in the '"+accessLogCommon+"'"+
+				" format. Setting this will also force the program to"+
+				" be run as a web server.",
+			param.AltNames("access-log-file"),
+			param.PostAction(accessLogFilePAF(g)),
+			param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(httpMiddlewareParamNames...),
+		),
+	)
+
+	var codeVal, snippetName string
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPMiddleware,
+			psetter.String[string]{Value: &codeVal},
+			"follow this with a Go expression of type"+
+				" 'func(http.Handler) http.Handler'. This will be used"+
+				" to wrap the handler for every request that the"+
+				" webserver receives, whichever route it matches."+
+				" This can be the name of a function given in the"+
+				" '"+globalSect+"' section or a function literal."+
+				"\n\n"+
+				"If more than one is given, the first one given is"+
+				" the outermost and so sees the request first. The"+
+				" access logger, if any, wraps all of them. These"+
+				" expressions are held in the '"+middlewareSect+"'"+
+				" section."+
+				" Setting this will also force the program to be run"+
+				" as a web server.",
+			param.AltNames("middleware", "mw"),
+			param.ValueName("Go-expr"),
+			param.PostAction(scriptPAF(g, &codeVal, middlewareSect)),
+			param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(httpMiddlewareParamNames...),
+		),
+	)
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPMiddlewareSnippet,
+			psetter.String[string]{
+				Value: &snippetName,
+				Checks: []check.String{
+					check.StringLength[string](check.ValGT(0)),
+				},
+			},
+			makeSnippetHelpText(middlewareSect)+
+				" The snippet must hold a single Go expression of type"+
+				" 'func(http.Handler) http.Handler'."+
+				" Setting this will also force the program to be run"+
+				" as a web server.",
+			param.AltNames("middleware-snippet", "mw-s"),
+			param.ValueName("filename"),
+			param.PostAction(snippetPAF(g, &snippetName, middlewareSect)),
+			param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(httpMiddlewareParamNames...),
+		),
+	)
+}
+
+// writeHandlerWrapperInit writes the code that wraps the webserver's handler
+// in the access logger and any middleware. The access log file, if any, is
+// opened here.
+func (g *gosh) writeHandlerWrapperInit(tag string) {
+	if !g.needsHandlerWrapper() {
+		return
+	}
+
+	tag += mwSfx
+
+	if g.httpAccessLog == accessLogNone {
+		g.gPrint("_srv.Handler = _wrapHandler(http.DefaultServeMux)", tag)
+		return
+	}
+
+	if g.httpAccessLogFile == "" {
+		g.gPrint("_srv.Handler = _wrapHandler(http.DefaultServeMux, os.Stderr)",
+			tag)
+
+		return
+	}
+
+	g.gPrint(fmt.Sprintf("_alf, _err := os.OpenFile(%q,",
+		g.httpAccessLogFile), tag)
+	g.gPrint("	os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)", tag)
+	g.gPrint("if _err != nil {", tag)
+	{
+		g.in()
+		g.gPrint("log.Fatal(_err)", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("defer _alf.Close()", tag)
+	g.gPrint("_srv.Handler = _wrapHandler(http.DefaultServeMux, _alf)", tag)
+}
+
+// writeHandlerWrapperFuncs writes the function which wraps the webserver's
+// handler and, if requests are to be logged, the access logger.
+func (g *gosh) writeHandlerWrapperFuncs() {
+	if !g.needsHandlerWrapper() {
+		return
+	}
+
+	tag := webTag + mwSfx
+
+	params := "_h http.Handler"
+	if g.httpAccessLog != accessLogNone {
+		params += ", _alw io.Writer"
+	}
+
+	g.gPrint("", tag)
+	g.gPrint("// _wrapHandler wraps the handler in the middleware", tag)
+	g.gPrint("func _wrapHandler("+params+") http.Handler {", tag)
+	g.in()
+
+	// The entries are expanded in the order given, so that any snippet
+	// ordering is checked correctly, but they are applied in reverse order
+	// so that the first one given is the outermost
+	type expandedEntry struct {
+		se    scriptEntry
+		lines []string
+	}
+
+	var mws []expandedEntry
+
+	for _, se := range g.scripts[middlewareSect] {
+		lines, err := se.expand(g, se.value)
+		if err != nil {
+			g.addError("script: "+middlewareSect, err)
+			continue
+		}
+
+		mws = append(mws, expandedEntry{se: se, lines: lines})
+	}
+
+	for i := len(mws) - 1; i >= 0; i-- {
+		g.gPrint("{", tag)
+		g.in()
+		g.gPrint("var _mw func(http.Handler) http.Handler =", tag)
+		g.printEntry(mws[i].se, mws[i].lines)
+
+		g.gPrint("_h = _mw(_h)", tag)
+		g.out()
+		g.gPrint("}", tag)
+	}
+
+	if g.httpAccessLog != accessLogNone {
+		g.gPrint("_h = _accessLog(_h, _alw)", tag)
+	}
+
+	g.gPrint("return _h", tag)
+	g.out()
+	g.gPrint("}", tag)
+
+	g.writeAccessLogFuncs()
+}
+
+// writeAccessLogFuncs writes the access logger and the ResponseWriter it
+// uses to record the status and the number of bytes written.
+func (g *gosh) writeAccessLogFuncs() {
+	if g.httpAccessLog == accessLogNone {
+		return
+	}
+
+	tag := webTag + mwSfx
+
+	g.gPrint("", tag)
+	g.gPrint("// _accessLogRW records the status and size of the response", tag)
+	g.gPrint("type _accessLogRW struct {", tag)
+	g.in()
+	g.gPrint("http.ResponseWriter", tag)
+	g.gPrint("status int", tag)
+	g.gPrint("size   int64", tag)
+	g.out()
+	g.gPrint("}", tag)
+
+	g.gPrint("", tag)
+	g.gPrint("func (_rw *_accessLogRW) WriteHeader(_status int) {", tag)
+	g.in()
+	g.gPrint("if _rw.status == 0 {", tag)
+	{
+		g.in()
+		g.gPrint("_rw.status = _status", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("_rw.ResponseWriter.WriteHeader(_status)", tag)
+	g.out()
+	g.gPrint("}", tag)
+
+	g.gPrint("", tag)
+	g.gPrint("func (_rw *_accessLogRW) Write(_b []byte) (int, error) {", tag)
+	g.in()
+	g.gPrint("if _rw.status == 0 {", tag)
+	{
+		g.in()
+		g.gPrint("_rw.status = http.StatusOK", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("_n, _err := _rw.ResponseWriter.Write(_b)", tag)
+	g.gPrint("_rw.size += int64(_n)", tag)
+	g.gPrint("return _n, _err", tag)
+	g.out()
+	g.gPrint("}", tag)
+
+	g.gPrint("", tag)
+	g.gPrint("func (_rw *_accessLogRW) Unwrap() http.ResponseWriter {", tag)
+	g.in()
+	g.gPrint("return _rw.ResponseWriter", tag)
+	g.out()
+	g.gPrint("}", tag)
+
+	g.gPrint("", tag)
+	g.gPrint("// _accessLog logs each request handled by _h to _w", tag)
+	g.gPrint("func _accessLog(_h http.Handler, _w io.Writer) http.Handler {",
+		tag)
+	g.in()
+	g.gPrint("var _mu sync.Mutex", tag)
+	g.gPrint("return http.HandlerFunc("+
+		"func(_rw http.ResponseWriter, _req *http.Request) {", tag)
+	g.in()
+	g.gPrint("_start := time.Now()", tag)
+	g.gPrint("_alrw := &_accessLogRW{ResponseWriter: _rw}", tag)
+	g.gPrint("_h.ServeHTTP(_alrw, _req)", tag)
+	g.gPrint("_latency := time.Since(_start)", tag)
+	g.gPrint("if _alrw.status == 0 {", tag)
+	{
+		g.in()
+		g.gPrint("_alrw.status = http.StatusOK", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("_host, _, _err := net.SplitHostPort(_req.RemoteAddr)", tag)
+	g.gPrint("if _err != nil {", tag)
+	{
+		g.in()
+		g.gPrint("_host = _req.RemoteAddr", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("_mu.Lock()", tag)
+	g.gPrint("defer _mu.Unlock()", tag)
+
+	if g.httpAccessLog == accessLogJSON {
+		g.writeAccessLogJSON(tag)
+	} else {
+		g.writeAccessLogCommon(tag)
+	}
+
+	g.out()
+	g.gPrint("})", tag)
+	g.out()
+	g.gPrint("}", tag)
+}
+
+// writeAccessLogCommon writes the code to log the request in the Common Log
+// Format. Missing values are shown as '-' and the latency is added at the
+// end of the line.
+func (g *gosh) writeAccessLogCommon(tag string) {
+	g.gPrint("if _host == \"\" {", tag)
+	{
+		g.in()
+		g.gPrint("_host = \"-\"", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint(`_size := "-"`, tag)
+	g.gPrint("if _alrw.size > 0 {", tag)
+	{
+		g.in()
+		g.gPrint("_size = fmt.Sprint(_alrw.size)", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint(`fmt.Fprintf(_w, "%s - - [%s] %q %d %s %s\n",`, tag)
+	g.gPrint("	_host,", tag)
+	g.gPrint(fmt.Sprintf("	_start.Format(%q),", accessLogTimeFormat), tag)
+	g.gPrint(`	_req.Method+" "+_req.RequestURI+" "+_req.Proto,`, tag)
+	g.gPrint("	_alrw.status, _size, _latency)", tag)
+}
+
+// writeAccessLogJSON writes the code to log the request as a JSON object
+func (g *gosh) writeAccessLogJSON(tag string) {
+	g.gPrint("json.NewEncoder(_w).Encode(struct {", tag)
+	g.in()
+	g.gPrint("Time    time.Time `json:\"time\"`", tag)
+	g.gPrint("Remote  string    `json:\"remote\"`", tag)
+	g.gPrint("Method  string    `json:\"method\"`", tag)
+	g.gPrint("Path    string    `json:\"path\"`", tag)
+	g.gPrint("Proto   string    `json:\"proto\"`", tag)
+	g.gPrint("Status  int       `json:\"status\"`", tag)
+	g.gPrint("Bytes   int64     `json:\"bytes\"`", tag)
+	g.gPrint("Latency string    `json:\"latency\"`", tag)
+	g.out()
+	g.gPrint("}{", tag)
+	g.in()
+	g.gPrint("Time:    _start,", tag)
+	g.gPrint("Remote:  _host,", tag)
+	g.gPrint("Method:  _req.Method,", tag)
+	g.gPrint("Path:    _req.RequestURI,", tag)
+	g.gPrint("Proto:   _req.Proto,", tag)
+	g.gPrint("Status:  _alrw.status,", tag)
+	g.gPrint("Bytes:   _alrw.size,", tag)
+	g.gPrint("Latency: _latency.String(),", tag)
+	g.out()
+	g.gPrint("})", tag)
+}
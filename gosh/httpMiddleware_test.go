@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/nickwells/param.mod/v7/paramtest"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// TestParseParamsHTTPMiddleware will use the paramtest.Parser to make sure
+// the behaviour of the middleware parameters is as expected.
+func TestParseParamsHTTPMiddleware(t *testing.T) {
+	const logName = "/tmp/gosh-access.log"
+
+	testCases := []paramtest.Parser{}
+
+	for _, p := range []string{"-" + paramNameHTTPAccessLog, "-access-log"} {
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("access log: "+p),
+				func(g *gosh) {
+					g.runAsWebserver = true
+					g.httpAccessLog = accessLogJSON
+				},
+				p, accessLogJSON))
+	}
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("access log file, no format"),
+			func(g *gosh) {
+				g.runAsWebserver = true
+				g.httpAccessLog = accessLogCommon
+				g.httpAccessLogFile = logName
+			},
+			"-access-log-file", logName))
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("access log format, then file"),
+			func(g *gosh) {
+				g.runAsWebserver = true
+				g.httpAccessLog = accessLogJSON
+				g.httpAccessLogFile = logName
+			},
+			"-access-log", accessLogJSON,
+			"-"+paramNameHTTPAccessLogFile, logName))
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("middleware"),
+			func(g *gosh) {
+				g.runAsWebserver = true
+				g.AddScriptEntry(middlewareSect, "mw1", verbatim)
+				g.AddScriptEntry(middlewareSect, "mw2", verbatim)
+			},
+			"-"+paramNameHTTPMiddleware, "mw1",
+			"-mw", "mw2"))
+
+	for _, tc := range testCases {
+		_ = tc.Test(t)
+	}
+}
+
+func TestWriteHandlerWrapper(t *testing.T) {
+	port := freeTestPort(t)
+	logName := filepath.Join(t.TempDir(), "access.log")
+
+	g := mkTestGosh(func(g *gosh) {
+		g.runAsWebserver = true
+		g.httpPort = port
+		g.httpAccessLog = accessLogCommon
+		g.httpAccessLogFile = logName
+		g.imports = []string{"fmt"}
+		g.AddScriptEntry(globalSect,
+			"func addHdr(v string) func(http.Handler) http.Handler {\n"+
+				"return func(h http.Handler) http.Handler {\n"+
+				"return http.HandlerFunc("+
+				"func(w http.ResponseWriter, r *http.Request) {\n"+
+				`w.Header().Add("X-Gosh", v)`+"\n"+
+				"h.ServeHTTP(w, r)\n"+
+				"})\n"+
+				"}\n"+
+				"}",
+			verbatim)
+		g.AddScriptEntry(middlewareSect, `addHdr("first")`, verbatim)
+		g.AddScriptEntry(middlewareSect, `addHdr("second")`, verbatim)
+		g.AddScriptEntry(execSect,
+			`http.Error(_rw, "teapot", http.StatusTeapot)`, verbatim)
+	})
+
+	execPath := buildTestProg(t, g)
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(execPath)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal("Cannot start the webserver:", err)
+	}
+
+	client := &http.Client{Timeout: time.Second}
+	url := fmt.Sprintf("http://localhost:%d/some/path?q=1", port)
+
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	for range 100 {
+		resp, err = client.Get(url)
+		if err == nil {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err != nil {
+		t.Error("the request failed:", err)
+	} else {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		testhelper.DiffInt(t, "wrapped handler", "status",
+			resp.StatusCode, http.StatusTeapot)
+
+		testhelper.DiffStringSlice(t, "wrapped handler", "middleware headers",
+			resp.Header.Values("X-Gosh"), []string{"first", "second"})
+	}
+
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal("Cannot interrupt the webserver:", err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("the webserver failed: %v\n%s", err, stderr.String())
+	}
+
+	logged, err := os.ReadFile(logName)
+	if err != nil {
+		t.Fatal("Cannot read the access log:", err)
+	}
+
+	logRE := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^]]+\]` +
+		` "GET /some/path\?q=1 HTTP/1\.1" 418 7 \S+\n$`)
+	if !logRE.Match(logged) {
+		t.Log("wrapped handler")
+		t.Errorf("\t: unexpected access log: %q", logged)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/nickwells/check.mod/v2/check"
+	"github.com/nickwells/location.mod/location"
+	"github.com/nickwells/param.mod/v7/paction"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/psetter"
+)
+
+const (
+	paramNameHTTPRoute        = "http-route"
+	paramNameHTTPRouteExec    = "http-route-exec"
+	paramNameHTTPRouteSnippet = "http-route-snippet"
+
+	routeSectPrefix    = "route-"
+	routeHandlerPrefix = "goshRoute"
+
+	routeErrCategory = "route wildcards"
+)
+
+var httpRouteParamNames = []string{
+	paramNameHTTPRoute,
+	paramNameHTTPRouteExec,
+	paramNameHTTPRouteSnippet,
+}
+
+// routeWildcardRE matches the wildcards in a ServeMux pattern. The name of
+// the wildcard is the first sub-match. The '{$}' wildcard, which matches
+// only the end of the path, is not matched.
+var routeWildcardRE = regexp.MustCompile(`\{([^}.$]+)(\.\.\.)?\}`)
+
+// routeRegisteredAtRE matches the part of the ServeMux error message giving
+// where the pattern was registered. This is where gosh checks the routes
+// rather than where the user gave them and so it is removed.
+var routeRegisteredAtRE = regexp.MustCompile(`\s*\(registered at [^)]*\)`)
+
+// httpRoute records a route to be handled by the webserver. The code for
+// the route is held in its own script section.
+type httpRoute struct {
+	pattern string
+	sect    string
+	handler string
+}
+
+// wildcards returns the names of the wildcards in the route's pattern
+func (r httpRoute) wildcards() []string {
+	var names []string
+
+	for _, m := range routeWildcardRE.FindAllStringSubmatch(r.pattern, -1) {
+		names = append(names, m[1])
+	}
+
+	return names
+}
+
+// addRoute adds a new route with the given pattern. A new script section is
+// created to hold the code for the route.
+func (g *gosh) addRoute(pattern string) {
+	idx := len(g.httpRoutes)
+	r := httpRoute{
+		pattern: pattern,
+		sect:    fmt.Sprintf("%s%d", routeSectPrefix, idx),
+		handler: fmt.Sprintf("%s%d", routeHandlerPrefix, idx),
+	}
+
+	g.scripts[r.sect] = []scriptEntry{}
+	g.httpRoutes = append(g.httpRoutes, r)
+}
+
+// lastRouteSect returns the name of the script section of the most
+// recently added route. It returns an error if no routes have been added.
+func (g *gosh) lastRouteSect() (string, error) {
+	if len(g.httpRoutes) == 0 {
+		return "", fmt.Errorf("no route has been given yet, use the %q"+
+			" parameter before giving the code to run for the route",
+			"-"+paramNameHTTPRoute)
+	}
+
+	return g.httpRoutes[len(g.httpRoutes)-1].sect, nil
+}
+
+// routeScriptPAF generates the Post-Action func (PAF) that adds the text
+// to the script section of the most recently added route.
+func routeScriptPAF(g *gosh, text *string) param.ActionFunc {
+	return func(_ location.L, p *param.BaseParam, _ []string) error {
+		sect, err := g.lastRouteSect()
+		if err != nil {
+			return err
+		}
+
+		g.addScriptEntryFrom(sect, *text, verbatim, g.paramOrigin(p))
+
+		return nil
+	}
+}
+
+// routeSnippetPAF generates the Post-Action func (PAF) that adds the
+// snippet to the script section of the most recently added route.
+func routeSnippetPAF(g *gosh, sName *string) param.ActionFunc {
+	return func(_ location.L, _ *param.BaseParam, _ []string) error {
+		sect, err := g.lastRouteSect()
+		if err != nil {
+			return err
+		}
+
+		name, err := g.cacheSnippetArg(*sName)
+		if err != nil {
+			return err
+		}
+
+		g.addScriptEntryFrom(sect, *sName, snippetExpand,
+			g.snippetOrigin(name))
+
+		return nil
+	}
+}
+
+// needsDefaultHandler returns true if the default path should be handled by
+// the goshHandler (or the handler given by the user). This is not needed
+// if routes have been given and there is no code for the default handler.
+func (g *gosh) needsDefaultHandler() bool {
+	return len(g.httpRoutes) == 0 ||
+		len(g.scripts[execSect]) > 0 ||
+		g.httpHandler != dfltHTTPHandlerName
+}
+
+// checkRoutes checks that the routes can all be registered with the
+// webserver without conflicting with each other and that each of them has
+// some code to run. It returns an error if any problem is found.
+func (g *gosh) checkRoutes() error {
+	if len(g.httpRoutes) == 0 {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	h := http.NotFoundHandler()
+
+	register := func(pattern string) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("bad route %q: %s", pattern,
+					routeRegisteredAtRE.ReplaceAllString(fmt.Sprint(r), ""))
+			}
+		}()
+
+		mux.Handle(pattern, h)
+
+		return nil
+	}
+
+	if g.needsDefaultHandler() {
+		if err := register(g.httpPath); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range g.httpRoutes {
+		if err := register(r.pattern); err != nil {
+			return err
+		}
+
+		if len(g.scripts[r.sect]) == 0 {
+			return fmt.Errorf("route %q has no code to run,"+
+				" use the %q or %q parameter to give some",
+				r.pattern,
+				"-"+paramNameHTTPRouteExec, "-"+paramNameHTTPRouteSnippet)
+		}
+
+	}
+
+	return nil
+}
+
+// importNames returns the names by which the imported packages are known
+// in the program. Imports with an alias are known by the alias and the
+// rest by the last part of the import path.
+func importNames(imports []string) map[string]string {
+	names := map[string]string{}
+
+	for _, imp := range imports {
+		name, pkgPath, ok := strings.Cut(imp, "=")
+		if !ok {
+			pkgPath = imp
+			name = path.Base(imp)
+		}
+
+		names[name] = pkgPath
+	}
+
+	return names
+}
+
+// checkRouteWildcards checks that the names of the wildcards in the routes
+// can be used as variable names in the route handlers. A name must be a Go
+// identifier which is neither reserved for gosh, by starting with an
+// underscore, nor the name of an imported package which it would hide. Any
+// problems are added to the error map.
+func (g *gosh) checkRouteWildcards() {
+	pkgs := importNames(append(g.webserverImports(), g.imports...))
+
+	for _, r := range g.httpRoutes {
+		for _, name := range r.wildcards() {
+			var err error
+
+			switch {
+			case !token.IsIdentifier(name):
+				err = fmt.Errorf("route %q: the wildcard %q cannot be"+
+					" used as a variable name",
+					r.pattern, name)
+			case strings.HasPrefix(name, "_"):
+				err = fmt.Errorf("route %q: the wildcard %q cannot be"+
+					" used as a variable name, names starting with '_'"+
+					" are reserved for gosh",
+					r.pattern, name)
+			case pkgs[name] != "":
+				err = fmt.Errorf("route %q: the wildcard %q cannot be"+
+					" used as a variable name, it would hide the"+
+					" imported package %q",
+					r.pattern, name, pkgs[name])
+			}
+
+			if err != nil {
+				g.addError(routeErrCategory, err)
+			}
+		}
+	}
+}
+
+// addWebRouteParams adds the parameters which add routes to the webserver.
+// These are all in the "web" parameter group.
+func addWebRouteParams(g *gosh, ps *param.PSet) {
+	var pattern, codeVal, snippetName string
+
+	checkStringNotEmpty := check.StringLength[string](check.ValGT(0))
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPRoute,
+			psetter.String[string]{
+				Value:  &pattern,
+				Checks: []check.String{checkStringNotEmpty},
+			},
+			"add a route to the webserver. This takes a pattern as used"+
+				" by the standard ServeMux, such as"+
+				" 'GET /items/{id}', giving an optional method and"+
+				" host and a path which may contain wildcards. The code"+
+				" to handle the route is given by the following"+
+				" '"+paramNameHTTPRouteExec+"' and"+
+				" '"+paramNameHTTPRouteSnippet+"' parameters."+
+				"\n\n"+
+				"Each route has its own handler with the"+
+				" '_rw' and '_req' variables available as for the"+
+				" default handler. The value of each wildcard in the"+
+				" pattern is available in a variable with the same"+
+				" name as the wildcard. The name must not start with"+
+				" an '_' or be the name of an imported package."+
+				"\n\n"+
+				"If any routes are given, the default handler (see"+
+				" 'http-path') is only added if there is some code"+
+				" for it to run. The routes are checked for conflicts"+
+				" before the program is built."+
+				" Setting this will also force the program to be run"+
+				" as a web server.",
+			param.AltNames("route"),
+			param.ValueName("pattern"),
+			param.PostAction(func(_ location.L, _ *param.BaseParam,
+				_ []string,
+			) error {
+				g.addRoute(pattern)
+				return nil
+			}),
+			param.PostAction(paction.SetVal(&g.runAsWebserver, true)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(httpRouteParamNames...),
+		),
+	)
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPRouteExec, psetter.String[string]{Value: &codeVal},
+			"follow this with Go code to be run when a request matches"+
+				" the most recently given route. These statements will"+
+				" appear with others for that route in the order they"+
+				" are given.",
+			param.AltNames("route-exec", "r-e"),
+			param.ValueName("Go-code"),
+			param.PostAction(routeScriptPAF(g, &codeVal)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(httpRouteParamNames...),
+		),
+	)
+
+	g.runAsWebserverSetters = append(g.runAsWebserverSetters,
+		ps.Add(paramNameHTTPRouteSnippet,
+			psetter.String[string]{
+				Value:  &snippetName,
+				Checks: []check.String{checkStringNotEmpty},
+			},
+			"insert a snippet of code from the given filename (which"+
+				" must be in one of the snippets directories or a"+
+				" complete pathname) into the code run when a request"+
+				" matches the most recently given route.",
+			param.AltNames("route-snippet", "r-s"),
+			param.ValueName("filename"),
+			param.PostAction(routeSnippetPAF(g, &snippetName)),
+			param.GroupName(paramGroupNameWeb),
+			param.SeeAlso(httpRouteParamNames...),
+		),
+	)
+
+	ps.AddFinalCheck(g.checkRoutes)
+}
+
+// writeRouteHandlers writes a handler type for each of the routes
+func (g *gosh) writeRouteHandlers() {
+	tag := webTag + routeSfx
+
+	for _, r := range g.httpRoutes {
+		g.gPrint("", tag)
+		g.gPrint(fmt.Sprintf("// %s handles requests matching %q",
+			r.handler, r.pattern), tag)
+		g.gPrint("type "+r.handler+" struct{}", tag)
+		g.gPrint("", tag)
+		g.gPrint(fmt.Sprintf("func (%s) ServeHTTP(%s, %s) {",
+			r.handler, g.nameType("_rw"), g.nameType("_req")), tag)
+		g.in()
+
+		for _, name := range r.wildcards() {
+			g.gPrint(fmt.Sprintf("%s := _req.PathValue(%q)", name, name), tag)
+			g.gPrint("_ = "+name, tag) // force the use of the wildcard value
+		}
+
+		g.writeScript(r.sect)
+		g.out()
+		g.gPrint("}", tag)
+	}
+}
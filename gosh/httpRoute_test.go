@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/nickwells/errutil.mod/errutil"
+	"github.com/nickwells/param.mod/v7/paramtest"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// TestParseParamsHTTPRoute will use the paramtest.Parser to make sure the
+// behaviour of the route parameters is as expected.
+func TestParseParamsHTTPRoute(t *testing.T) {
+	testCases := []paramtest.Parser{}
+
+	testCases = append(testCases,
+		mkTestParser(nil, testhelper.MkID("two routes"),
+			func(g *gosh) {
+				g.runAsWebserver = true
+				g.addRoute("GET /items/{id}")
+				g.AddScriptEntry(routeSectPrefix+"0", "a()", verbatim)
+				g.AddScriptEntry(routeSectPrefix+"0", "b()", verbatim)
+				g.addRoute("POST /items/")
+				g.AddScriptEntry(routeSectPrefix+"1", "c()", verbatim)
+			},
+			"-"+paramNameHTTPRoute, "GET /items/{id}",
+			"-r-e", "a()",
+			"-route-exec", "b()",
+			"-route", "POST /items/",
+			"-"+paramNameHTTPRouteExec, "c()"))
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"http-route-exec",
+			errors.New(`no route has been given yet, use the "-http-route"`+
+				` parameter before giving the code to run for the route`+
+				"\nAt: [command line]: Supplied Parameter:2:"+
+				` "-r-e" "a()"`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs, testhelper.MkID("code but no route"),
+				func(_ *gosh) {},
+				"-r-e", "a()"))
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(`bad route "GET /items/{name}":`+
+				` pattern "GET /items/{name}" conflicts`+
+				` with pattern "GET /items/{id}":`+
+				"\nGET /items/{name} matches the same requests"+
+				" as GET /items/{id}"))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs, testhelper.MkID("conflicting routes"),
+				func(g *gosh) {
+					g.runAsWebserver = true
+					g.addRoute("GET /items/{id}")
+					g.AddScriptEntry(routeSectPrefix+"0", "a()", verbatim)
+					g.addRoute("GET /items/{name}")
+					g.AddScriptEntry(routeSectPrefix+"1", "b()", verbatim)
+				},
+				"-route", "GET /items/{id}", "-r-e", "a()",
+				"-route", "GET /items/{name}", "-r-e", "b()"))
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New(`route "GET /items/" has no code to run,`+
+				` use the "-http-route-exec" or "-http-route-snippet"`+
+				` parameter to give some`))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs, testhelper.MkID("route with no code"),
+				func(g *gosh) {
+					g.runAsWebserver = true
+					g.addRoute("GET /items/")
+				},
+				"-route", "GET /items/"))
+	}
+
+	for _, tc := range testCases {
+		_ = tc.Test(t)
+	}
+}
+
+func TestCheckRouteWildcards(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		pattern string
+		imports []string
+		expErrs []string
+	}{
+		{
+			ID:      testhelper.MkID("good"),
+			pattern: "GET /items/{id}/{rest...}",
+		},
+		{
+			ID:      testhelper.MkID("keyword"),
+			pattern: "GET /items/{type}",
+			expErrs: []string{
+				`route "GET /items/{type}": the wildcard "type"` +
+					` cannot be used as a variable name`,
+			},
+		},
+		{
+			ID:      testhelper.MkID("reserved"),
+			pattern: "GET /items/{_rw}",
+			expErrs: []string{
+				`route "GET /items/{_rw}": the wildcard "_rw"` +
+					` cannot be used as a variable name, names starting` +
+					` with '_' are reserved for gosh`,
+			},
+		},
+		{
+			ID:      testhelper.MkID("imported packages"),
+			pattern: "GET /{http}/{os}/{strings}/{str}/{sb}",
+			imports: []string{"strings", "sb=strings"},
+			expErrs: []string{
+				`route "GET /{http}/{os}/{strings}/{str}/{sb}":` +
+					` the wildcard "http" cannot be used as a variable` +
+					` name, it would hide the imported package "net/http"`,
+				`route "GET /{http}/{os}/{strings}/{str}/{sb}":` +
+					` the wildcard "os" cannot be used as a variable` +
+					` name, it would hide the imported package "os"`,
+				`route "GET /{http}/{os}/{strings}/{str}/{sb}":` +
+					` the wildcard "strings" cannot be used as a variable` +
+					` name, it would hide the imported package "strings"`,
+				`route "GET /{http}/{os}/{strings}/{str}/{sb}":` +
+					` the wildcard "sb" cannot be used as a variable` +
+					` name, it would hide the imported package "strings"`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(func(g *gosh) {
+			g.runAsWebserver = true
+			g.imports = tc.imports
+			g.addRoute(tc.pattern)
+		})
+
+		g.checkRouteWildcards()
+
+		expErrs := errutil.ErrMap{}
+		for _, e := range tc.expErrs {
+			expErrs.AddError(routeErrCategory, errors.New(e))
+		}
+
+		if err := g.errMap.Matches(expErrs); err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: unexpected errors: %v", err)
+		}
+	}
+}
+
+func TestRouteWildcards(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		pattern string
+		expVals []string
+	}{
+		{ID: testhelper.MkID("none"), pattern: "GET /items/"},
+		{ID: testhelper.MkID("end marker"), pattern: "GET /{$}"},
+		{
+			ID:      testhelper.MkID("several"),
+			pattern: "example.com/a/{x}/b/{y}/{rest...}",
+			expVals: []string{"x", "y", "rest"},
+		},
+	}
+
+	for _, tc := range testCases {
+		r := httpRoute{pattern: tc.pattern}
+		if err := testhelper.DiffVals(r.wildcards(), tc.expVals); err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: %s", err)
+		}
+	}
+}
+
+func TestWriteRoutes(t *testing.T) {
+	port := freeTestPort(t)
+
+	g := mkTestGosh(func(g *gosh) {
+		g.runAsWebserver = true
+		g.httpPort = port
+		g.imports = []string{"fmt"}
+		g.addRoute("GET /items/{id}")
+		g.AddScriptEntry(routeSectPrefix+"0",
+			`fmt.Fprintln(_rw, "get", id)`, verbatim)
+		g.addRoute("POST /items/{id}/{rest...}")
+		g.AddScriptEntry(routeSectPrefix+"1",
+			`fmt.Fprintln(_rw, _req.Method, id, rest)`, verbatim)
+	})
+
+	execPath := buildTestProg(t, g)
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(execPath)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal("Cannot start the webserver:", err)
+	}
+
+	defer func() {
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			t.Fatal("Cannot interrupt the webserver:", err)
+		}
+
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("the webserver failed: %v\n%s", err, stderr.String())
+		}
+	}()
+
+	url := fmt.Sprintf("http://localhost:%d", port)
+	client := &http.Client{Timeout: time.Second}
+
+	testCases := []struct {
+		testhelper.ID
+		method    string
+		path      string
+		expStatus int
+		expBody   string
+	}{
+		{
+			ID:        testhelper.MkID("get"),
+			method:    http.MethodGet,
+			path:      "/items/42",
+			expStatus: http.StatusOK,
+			expBody:   "get 42\n",
+		},
+		{
+			ID:        testhelper.MkID("post"),
+			method:    http.MethodPost,
+			path:      "/items/42/a/b",
+			expStatus: http.StatusOK,
+			expBody:   "POST 42 a/b\n",
+		},
+		{
+			ID:        testhelper.MkID("no default handler"),
+			method:    http.MethodGet,
+			path:      "/",
+			expStatus: http.StatusNotFound,
+			expBody:   "404 page not found\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		var (
+			resp *http.Response
+			err  error
+		)
+
+		for range 100 {
+			req, reqErr := http.NewRequest(tc.method, url+tc.path, nil)
+			if reqErr != nil {
+				t.Fatal("Cannot make the request:", reqErr)
+			}
+
+			resp, err = client.Do(req)
+			if err == nil {
+				break
+			}
+
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: the request failed: %v", err)
+
+			continue
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		testhelper.DiffInt(t, tc.IDStr(), "status",
+			resp.StatusCode, tc.expStatus)
+		testhelper.DiffString(t, tc.IDStr(), "body", string(body), tc.expBody)
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"slices"
 	"strings"
+	"syscall"
 
 	"github.com/nickwells/cli.mod/cli/responder"
 	"github.com/nickwells/gogen.mod/gogen"
@@ -18,6 +21,8 @@ import (
 // Created: Wed Sep  4 09:58:54 2019
 
 func main() {
+	runRlimitsShim()
+
 	g := newGosh()
 	slp := &snippetListParams{}
 
@@ -25,24 +30,47 @@ func main() {
 
 	ps.Parse()
 	g.HandleRemainder(ps.TrailingParams())
+	g.goshArgs = os.Args[1 : len(os.Args)-len(ps.TrailingParams())]
+	g.configFiles = configFileNames(ps)
 
 	preCheck(g)
 
 	listSnippets(g, slp)
+	checkSnippets(g, slp)
+	manageBuildCache(g)
+	manageHistory(g)
 
 	defer func() { os.Exit(g.exitStatus) }()
 	defer g.dbgStack.Start("main", os.Args[0])()
 
 	g.snippets.Check(g.errMap)
 	g.checkScripts()
+	g.checkEmbedFiles()
+	g.checkRouteWildcards()
 	g.reportErrors()
 
 	g.setEditor()
 	g.reportErrors()
 
+	if g.repl {
+		g.runRepl()
+		return
+	}
+
+	if g.runShebangFromBuildCache() {
+		g.recordHistory(ps)
+		return
+	}
+
 	g.constructGoProgram()
 	g.reportErrors()
 
+	if g.runFromBuildCache() {
+		g.recordHistory(ps)
+		g.cleanup()
+		return
+	}
+
 	for {
 		g.dontCleanup = g.dontCleanupUserChoice
 
@@ -59,6 +87,8 @@ func main() {
 		g.chdirInto(g.goshDir)
 	}
 
+	g.ejectProgram()
+	g.recordHistory(ps)
 	g.cleanup()
 }
 
@@ -80,7 +110,7 @@ func listSnippets(g *gosh, slp *snippetListParams) {
 		lc, err := snippet.NewListCfg(os.Stdout, g.snippetDirs, g.errMap,
 			snippet.SetConstraints(slp.constraints...),
 			snippet.SetParts(slp.parts...),
-			snippet.SetTags(slp.tags...),
+			snippet.SetTags(slp.listTags()...),
 			snippet.HideIntro(slp.hideIntro))
 		g.reportFatalError("configure the snippet list", "", err)
 
@@ -101,7 +131,7 @@ func (g *gosh) reportGoshfiles() {
 	fmt.Println()
 	fmt.Println("gosh directory   " + g.goshDir)
 	fmt.Println("gosh code        " + filepath.Join(g.goshDir, goshFilename))
-	fmt.Println("gosh executable  " + filepath.Join(g.goshDir, g.execName))
+	fmt.Println("gosh executable  " + g.execPath())
 	fmt.Println()
 }
 
@@ -237,18 +267,29 @@ func (g *gosh) createGoshTmpDir() {
 	g.initWorkspace()
 }
 
-// makeExecutable runs go build to make the executable file
+// makeExecutable runs go build (or go test, see buildCmdArgs) to make the
+// executable file
 func (g *gosh) makeExecutable() bool {
 	defer g.dbgStack.Start("makeExecutable", "Building the program")()
 
 	intro := g.dbgStack.Tag()
 
-	buildCmd := []string{"build"}
-	buildCmd = append(buildCmd, g.buildArgs...)
+	buildCmd := g.buildCmdArgs()
 
 	verbose.Println(intro, " Command: go "+strings.Join(buildCmd, " "))
 
-	if !gogen.ExecGoCmdNoExit(gogen.ShowCmdIO, buildCmd...) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(gogen.GetGoCmdName(), buildCmd...) //nolint:gosec
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = &stderr
+	cmd.Env = g.buildEnv()
+
+	err := cmd.Run()
+
+	os.Stderr.Write(g.mapBuildErrors(stderr.Bytes())) //nolint:errcheck
+
+	if err != nil {
 		verbose.Println(intro, " Build failed")
 
 		g.exitStatus = goshExitStatusBuildFail
@@ -260,39 +301,80 @@ func (g *gosh) makeExecutable() bool {
 	return true
 }
 
+// buildCmdArgs returns the arguments to the go command which will build the
+// program. The benchmarks and the assertions are built as a test binary
+// which is then run like any other program.
+func (g *gosh) buildCmdArgs() []string {
+	if g.benchmark || g.hasAsserts() {
+		args := []string{"test"}
+		args = append(args, g.buildArgs...)
+
+		return append(args, "-c", "-o", g.testOutputPath())
+	}
+
+	args := []string{"build"}
+	args = append(args, g.buildArgs...)
+
+	return append(args, g.buildOutputArgs()...)
+}
+
 // runGoFile will call go build to generate the executable and then will run
-// it unless dontRun is set.
-func (g *gosh) runGoFile() {
+// it unless dontRun is set. It returns false if the program could not be
+// built.
+func (g *gosh) runGoFile() bool {
 	defer g.dbgStack.Start("runGoFile", "Running the program")()
 
 	intro := g.dbgStack.Tag()
 
+	if g.benchmark {
+		g.runBenchmarks()
+		return true
+	}
+
+	if g.hasAsserts() {
+		g.runAsserts(os.Stdout)
+		return true
+	}
+
 	if !g.makeExecutable() {
-		return
+		return false
 	}
 
+	g.addToBuildCache()
+
 	if g.dontRun {
 		verbose.Println(intro, " Skipping execution")
-		return
+		return true
 	}
 
 	g.chdirInto(g.runDir)
 
-	g.executeProgram()
+	g.executeProgram(g.args, os.Stdout)
+
+	return true
 }
 
-// executeProgram executes the newly built executeProgram
-func (g *gosh) executeProgram() {
+// executeProgram executes the newly built program with the given
+// arguments, writing its standard output to the stdout Writer
+func (g *gosh) executeProgram(args []string, stdout io.Writer) {
 	defer g.dbgStack.Start("executeProgram",
 		"Executing the program: "+g.execName)()
 
 	intro := g.dbgStack.Tag()
 
-	cmd := exec.Command( //nolint:gosec
-		filepath.Join(g.goshDir, g.execName), g.args...)
+	cmd, ctx, cancel := g.makeRunCmd(args)
+	defer cancel()
+
 	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = stdout
 	cmd.Stderr = os.Stderr
+
+	if g.repl {
+		cmd.Stdin = nil // the standard input is being read by the REPL
+		cmd.Stdout = g.replStdout
+		cmd.Stderr = g.replStderr
+	}
+
 	env := os.Environ()
 
 	if g.clearEnv {
@@ -303,18 +385,34 @@ func (g *gosh) executeProgram() {
 
 	g.exitStatus = 0
 
-	err := cmd.Run()
+	limit, err := g.runCmd(ctx, cmd)
+	if limit != "" {
+		verbose.Println(intro, " Program stopped: it reached ", limit)
+		g.reportRunLimitHit(limit)
+
+		return
+	}
+
 	if err != nil {
-		var ec int
+		var (
+			ec  int
+			sig syscall.Signal
+			ok  bool
+		)
 
-		if ee, ok := err.(*exec.ExitError); ok {
+		if ee, isEE := err.(*exec.ExitError); isEE {
 			ec = ee.ExitCode()
+			sig, ok = termSignal(ee.ProcessState)
 		}
 
 		switch {
 		case ec > 0:
 			verbose.Println(intro, fmt.Sprintf(" Program Exit Status: %d", ec))
 			g.exitStatus = ec
+		case ec == -1 && ok:
+			verbose.Println(intro,
+				fmt.Sprintf(" Program ended by signal: %s (%d)", sig, sig))
+			g.exitStatus = signalExitBase + int(sig)
 		case ec == -1:
 			verbose.Println(intro, " Program interrupted")
 		default:
@@ -360,13 +458,23 @@ func (g *gosh) queryEditAgain() bool {
 }
 
 // constructGoProgram creates the Go file and then writes the code into the
-// file. Finally, it copies in any requested files.
+// file. Finally, it copies in any requested files. The gosh directory is
+// only created the first time this is called, subsequent calls will reuse
+// it.
 func (g *gosh) constructGoProgram() {
 	defer g.dbgStack.Start("constructGoProgram", "Constructing the program")()
 
-	g.createGoshTmpDir()
+	if g.goshDir == "" {
+		g.createGoshTmpDir()
+	} else {
+		g.chdirInto(g.goshDir)
+	}
 	g.writeGoFile()
 	g.copyFiles()
+	g.copyDiffFile()
+	g.copyEmbedFiles()
+	g.writeBenchTestFile()
+	g.writeAssertTestFile()
 }
 
 // copyFiles will read the files to be copied and write them into the gosh
@@ -17,6 +17,13 @@ func packageRename(fileName string) ([]byte, error) {
 		return []byte{}, err
 	}
 
+	return packageRenameContent(fileName, content)
+}
+
+// packageRenameContent replaces the package name in the content with 'main'
+// if it is not already called 'main'. The fileName is only used to report
+// errors.
+func packageRenameContent(fileName string, content []byte) ([]byte, error) {
 	fset := token.NewFileSet()
 
 	f, err := parser.ParseFile(
@@ -30,10 +37,11 @@ func packageRename(fileName string) ([]byte, error) {
 	}
 
 	start := fset.Position(f.Package).Offset
-	end := f.Name.End()
+	end := fset.Position(f.Name.End()).Offset
 
-	pkgMain := []byte("package main\n")
-	rval := content[:start]
+	pkgMain := []byte("package main")
+	rval := make([]byte, 0, len(content)+len(pkgMain))
+	rval = append(rval, content[:start]...)
 	rval = append(rval, pkgMain...)
 	rval = append(rval, content[end:]...)
 
@@ -26,6 +26,15 @@ var a int
 			filename: "testdata/packageRename/_pkgNEmain.go",
 			expContent: `package main
 
+var a int
+`,
+		},
+		{
+			ID:       testhelper.MkID("package name shorter than main"),
+			filename: "testdata/packageRename/_pkgShortName.go",
+			expContent: `package main
+
+// a comment
 var a int
 `,
 		},
@@ -23,6 +23,15 @@ func paramOptFuncs(g *gosh, slp *snippetListParams) []param.PSetOptFunc {
 		addWebParams(g),
 		addReadloopParams(g),
 		addGoshParams(g),
+		addBuildCacheParams(g),
+		addReplParams(g),
+		addEjectParams(g),
+		addBuildOutputParams(g),
+		addRunLimitsParams(g),
+		addEmbedParams(g),
+		addBenchmarkParams(g),
+		addAssertParams(g),
+		addHistoryParams(g),
 		addStdinParams(g),
 		addParams(g),
 
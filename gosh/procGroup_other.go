@@ -0,0 +1,9 @@
+//go:build !unix || aix
+
+package main
+
+import "os/exec"
+
+// setProcGroup does nothing, the program is not run in its own process
+// group on this operating system
+func setProcGroup(_ *exec.Cmd) func() { return func() {} }
@@ -0,0 +1,69 @@
+//go:build unix && !aix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setProcGroup changes the command so that the program is started in its
+// own process group. This means that signals sent by the terminal (when
+// the user types Ctrl-C or Ctrl-\) are not delivered to both gosh and the
+// program; gosh relays any signals it gets to the program (see
+// relaySignals).
+//
+// If gosh is in the foreground of its terminal then the terminal is handed
+// to the program's process group, so that the program can read from it,
+// and the returned func will hand it back to gosh. The returned func must
+// be called once the program has finished.
+func setProcGroup(cmd *exec.Cmd) func() {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Setpgid = true
+
+	tty, pgrp, ok := foregroundTTY()
+	if !ok {
+		return func() {}
+	}
+
+	cmd.SysProcAttr.Foreground = true
+	cmd.SysProcAttr.Ctty = tty
+
+	return func() {
+		// gosh is not in the foreground while the program has the
+		// terminal and so it would be stopped by the SIGTTOU signal
+		// when it takes the terminal back unless the signal is ignored
+		signal.Ignore(syscall.SIGTTOU)
+		defer signal.Reset(syscall.SIGTTOU)
+
+		_ = unix.IoctlSetPointerInt(tty, unix.TIOCSPGRP, pgrp)
+	}
+}
+
+// foregroundTTY returns the file descriptor of the first of the standard
+// files which is a terminal having gosh's process group in the foreground,
+// the process group and true, or false if there is no such terminal
+func foregroundTTY() (int, int, bool) {
+	pgrp, err := unix.Getpgid(0)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	for _, f := range []*os.File{os.Stdin, os.Stdout, os.Stderr} {
+		fd := int(f.Fd())
+
+		fgPgrp, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP)
+		if err == nil && fgPgrp == pgrp {
+			return fd, pgrp, true
+		}
+	}
+
+	return 0, 0, false
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/nickwells/errutil.mod/errutil"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/psetter"
+	"github.com/nickwells/verbose.mod/verbose"
+)
+
+const (
+	paramNameRepl = "repl"
+
+	replPrompt     = "gosh> "
+	replMorePrompt = "....> "
+
+	replCmdIntro = ":"
+)
+
+// replSectParams maps the code sections (other than the exec section) to
+// the names of the parameters that add code to them. It is used when
+// saving the REPL session as a shebang script.
+var replSectParams = map[string]string{
+	globalSect:      "global",
+	beforeSect:      "before",
+	beforeInnerSect: "inner-before",
+	afterInnerSect:  "inner-after",
+	afterSect:       "after",
+}
+
+// replOutput records the output of the program after a step of the REPL
+type replOutput struct {
+	stdout string
+	stderr string
+}
+
+// replCmd describes a command that can be given to the REPL
+type replCmd struct {
+	name   string
+	alt    string
+	argMsg string
+	desc   string
+	action func(g *gosh, arg string) bool
+}
+
+// replCmds returns the commands that can be given to the REPL. Each action
+// func returns true if the program has changed and should be rebuilt.
+func replCmds() []replCmd {
+	return []replCmd{
+		{
+			name: "help", alt: "h",
+			desc:   "show this help message",
+			action: (*gosh).replHelp,
+		},
+		{
+			name: "show", alt: "s",
+			desc:   "show the current program",
+			action: (*gosh).replShow,
+		},
+		{
+			name: "undo", alt: "u",
+			desc:   "remove the last statement",
+			action: (*gosh).replUndo,
+		},
+		{
+			name: "import", alt: "i", argMsg: "package",
+			desc: "add a package to the import statements." +
+				" The next statement should use it",
+			action: (*gosh).replImport,
+		},
+		{
+			name: "snippet", alt: "sn", argMsg: "snippet-name",
+			desc:   "add a snippet to the exec section",
+			action: (*gosh).replSnippet,
+		},
+		{
+			name: "save", argMsg: "filename",
+			desc:   "save the session as a gosh shebang script",
+			action: (*gosh).replSave,
+		},
+		{
+			name: "quit", alt: "q",
+			desc: "end the session (as does end-of-file)",
+		},
+	}
+}
+
+// addReplParams returns a func that will add parameters concerned with
+// running gosh interactively to the passed param.PSet.
+func addReplParams(g *gosh) func(ps *param.PSet) error {
+	return func(ps *param.PSet) error {
+		ps.Add(paramNameRepl, psetter.Bool{Value: &g.repl},
+			"run gosh interactively. Each line of code that you type"+
+				" is added to the '"+execSect+"' section and the"+
+				" program is rebuilt and run. Only the output that"+
+				" was not shown after the previous run is shown."+
+				" A statement that opens a block is continued until"+
+				" the block is closed. If the program cannot be built"+
+				" the statement is removed."+
+				"\n\n"+
+				"Lines starting with '"+replCmdIntro+"' are commands"+
+				" to the REPL; type '"+replCmdIntro+"help' to see them."+
+				"\n\n"+
+				"Note that the whole program is run each time so any"+
+				" side effects of the earlier statements will be"+
+				" repeated.",
+			param.AltNames("interactive"),
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameGosh),
+		)
+
+		ps.AddFinalCheck(func() error {
+			if !g.repl {
+				return nil
+			}
+
+			if g.runInReadLoop || g.runAsWebserver {
+				return errors.New(
+					"gosh cannot run interactively in a read-loop" +
+						" or as a webserver")
+			}
+
+			if g.edit {
+				return errors.New(
+					"gosh cannot run interactively and edit the program")
+			}
+
+			for _, pName := range stdinParamNames {
+				if p, err := ps.GetParamByName(pName); err == nil &&
+					p.HasBeenSet() {
+					return fmt.Errorf(
+						"gosh cannot run interactively and read code"+
+							" from standard input (%q)",
+						"-"+pName)
+				}
+			}
+
+			return nil
+		})
+
+		return nil
+	}
+}
+
+// runRepl reads statements from the standard input and, after each one,
+// rebuilds and runs the program.
+func (g *gosh) runRepl() {
+	defer g.dbgStack.Start("runRepl", "Running interactively")()
+
+	g.replStdout = &bytes.Buffer{}
+	g.replStderr = &bytes.Buffer{}
+	g.replOutputs = []replOutput{{}}
+	g.replBase = len(g.scripts[execSect])
+	g.ignoreGoModTidyErrs = true
+
+	if len(g.scripts[execSect]) > 0 {
+		g.replRun()
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+
+	for {
+		stmt, ok := replRead(in)
+		if !ok {
+			break
+		}
+
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+
+		if cmdLine, isCmd := strings.CutPrefix(
+			strings.TrimSpace(stmt), replCmdIntro); isCmd {
+			cmdName, arg, _ := strings.Cut(cmdLine, " ")
+			if cmdName == "quit" || cmdName == "q" {
+				break
+			}
+
+			if g.replCommand(cmdName, strings.TrimSpace(arg)) {
+				g.replRun()
+			}
+
+			continue
+		}
+
+		g.AddScriptEntry(execSect, stmt, replStmtExpand)
+		g.replRun()
+	}
+
+	fmt.Println()
+
+	g.dontCleanup = g.dontCleanupUserChoice
+	g.cleanup()
+}
+
+// replRead reads a statement from the scanner. It will keep reading lines
+// until the statement is complete. It returns false if there is nothing more
+// to read.
+func replRead(in *bufio.Scanner) (string, bool) {
+	var stmt strings.Builder
+
+	prompt := replPrompt
+
+	for {
+		fmt.Print(prompt)
+
+		if !in.Scan() {
+			return stmt.String(), stmt.Len() > 0
+		}
+
+		stmt.WriteString(in.Text())
+
+		if strings.HasPrefix(strings.TrimSpace(stmt.String()), replCmdIntro) ||
+			!replNeedsMore(stmt.String()) {
+			return stmt.String(), true
+		}
+
+		stmt.WriteString("\n")
+
+		prompt = replMorePrompt
+	}
+}
+
+// replNeedsMore returns true if the code has unclosed brackets or an
+// unterminated raw string and so more lines are needed to complete it.
+func replNeedsMore(code string) bool {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(code))
+
+	unterminated := false
+
+	var s scanner.Scanner
+
+	s.Init(file, []byte(code),
+		func(_ token.Position, msg string) {
+			if strings.Contains(msg, "not terminated") {
+				unterminated = true
+			}
+		},
+		scanner.ScanComments)
+
+	depth := 0
+
+	for {
+		_, tok, _ := s.Scan()
+		switch tok {
+		case token.EOF:
+			return depth > 0 || unterminated
+		case token.LPAREN, token.LBRACE, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACE, token.RBRACK:
+			depth--
+		}
+	}
+}
+
+// replStmtExpand returns the statement followed by a blank assignment of
+// each variable that it declares. This stops the program from failing to
+// build because a variable has not been used yet.
+func replStmtExpand(_ *gosh, stmt string) ([]string, error) {
+	lines := []string{stmt}
+
+	f, err := parser.ParseFile(token.NewFileSet(), "",
+		"package p; func _() {\n"+stmt+"\n}", parser.SkipObjectResolution)
+	if err != nil {
+		return lines, nil //nolint:nilerr // the build will report the error
+	}
+
+	body := f.Decls[0].(*ast.FuncDecl).Body //nolint:forcetypeassert
+
+	var names []string
+
+	for _, s := range body.List {
+		switch s := s.(type) {
+		case *ast.AssignStmt:
+			if s.Tok != token.DEFINE {
+				continue
+			}
+
+			for _, e := range s.Lhs {
+				if id, ok := e.(*ast.Ident); ok {
+					names = append(names, id.Name)
+				}
+			}
+		case *ast.DeclStmt:
+			gd, ok := s.Decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.VAR {
+				continue
+			}
+
+			for _, spec := range gd.Specs {
+				if vs, ok := spec.(*ast.ValueSpec); ok {
+					for _, id := range vs.Names {
+						names = append(names, id.Name)
+					}
+				}
+			}
+		}
+	}
+
+	for _, name := range names {
+		if name != "_" {
+			lines = append(lines, "_ = "+name)
+		}
+	}
+
+	return lines, nil
+}
+
+// replCommand runs the named REPL command. It returns true if the program
+// should be rebuilt.
+func (g *gosh) replCommand(name, arg string) bool {
+	for _, c := range replCmds() {
+		if name != c.name && name != c.alt {
+			continue
+		}
+
+		if c.argMsg != "" && arg == "" {
+			fmt.Fprintf(os.Stderr, "%s%s needs a %s\n",
+				replCmdIntro, c.name, c.argMsg)
+
+			return false
+		}
+
+		return c.action(g, arg)
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %q, try %shelp\n",
+		replCmdIntro+name, replCmdIntro)
+
+	return false
+}
+
+// replHelp prints the REPL commands
+func (g *gosh) replHelp(_ string) bool {
+	for _, c := range replCmds() {
+		name := replCmdIntro + c.name
+		if c.alt != "" {
+			name += " (" + replCmdIntro + c.alt + ")"
+		}
+
+		if c.argMsg != "" {
+			name += " " + c.argMsg
+		}
+
+		fmt.Printf("%-28s %s\n", name, c.desc)
+	}
+
+	return false
+}
+
+// replShow prints the last program that was successfully built
+func (g *gosh) replShow(_ string) bool {
+	if g.goshDir == "" {
+		fmt.Println("There is no program yet")
+		return false
+	}
+
+	content, err := os.ReadFile(filepath.Join(g.goshDir, goshFilename))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gosh couldn't read the program:", err)
+		return false
+	}
+
+	fmt.Print(string(content))
+
+	return false
+}
+
+// replUndo removes the last statement added in the REPL. It returns true
+// if a statement was removed.
+func (g *gosh) replUndo(_ string) bool {
+	script := g.scripts[execSect]
+	if len(script) <= g.replBase {
+		fmt.Fprintln(os.Stderr, "there is nothing to undo")
+		return false
+	}
+
+	g.scripts[execSect] = script[:len(script)-1]
+
+	return true
+}
+
+// replImport adds the package to the imports. The program is not rebuilt
+// as the package will not be used until the next statement is given.
+func (g *gosh) replImport(imp string) bool {
+	if err := checkImports(imp); err != nil {
+		fmt.Fprintln(os.Stderr, "bad import:", err)
+		return false
+	}
+
+	g.imports = append(g.imports, imp)
+
+	return false
+}
+
+// replSnippet adds the snippet to the exec section
+func (g *gosh) replSnippet(sName string) bool {
+	if _, err := g.cacheSnippetArg(sName); err != nil {
+		fmt.Fprintln(os.Stderr, "bad snippet:", err)
+		return false
+	}
+
+	g.AddScriptEntry(execSect, sName, snippetExpand)
+
+	return true
+}
+
+// replSave writes the REPL session to the named file as a gosh shebang
+// script
+func (g *gosh) replSave(fileName string) bool {
+	const scriptPerms = 0o700 // Owner: Read/Write/Exec, the rest, none
+
+	goshPath, err := os.Executable()
+	if err != nil {
+		goshPath = "gosh"
+	}
+
+	var script bytes.Buffer
+
+	if err := g.writeReplScript(&script, goshPath); err != nil {
+		fmt.Fprintln(os.Stderr, "gosh couldn't make the script:", err)
+		return false
+	}
+
+	if !filepath.IsAbs(fileName) {
+		fileName = filepath.Join(g.runDir, fileName)
+	}
+
+	err = os.WriteFile(fileName, script.Bytes(), scriptPerms)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gosh couldn't save the script:", err)
+		return false
+	}
+
+	fmt.Println("saved to", fileName)
+
+	return false
+}
+
+// writeReplScript writes the program as a gosh shebang script. The code
+// in the exec section forms the body of the script and everything else is
+// given as parameters in the '#gosh.param:' lines.
+func (g *gosh) writeReplScript(w io.Writer, goshPath string) error {
+	fmt.Fprintf(w, "#!%s -%s\n", goshPath, paramNameExecFile)
+
+	imports := slices.Clone(g.imports)
+	slices.Sort(imports)
+
+	for _, imp := range slices.Compact(imports) {
+		fmt.Fprintf(w, "%s %s=%s\n", shebangGoshParam, paramNameImport, imp)
+	}
+
+	for _, sName := range []string{
+		globalSect,
+		beforeSect,
+		beforeInnerSect,
+		afterInnerSect,
+		afterSect,
+	} {
+		lines, err := g.expandScript(sName)
+		if err != nil {
+			return err
+		}
+
+		for _, l := range lines {
+			if strings.TrimSpace(l) == "" {
+				continue
+			}
+
+			fmt.Fprintf(w, "%s %s=%s\n",
+				shebangGoshParam, replSectParams[sName], l)
+		}
+	}
+
+	lines, err := g.expandScript(execSect)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+
+	return nil
+}
+
+// expandScript returns the lines of code in the named script, split at
+// newlines
+func (g *gosh) expandScript(sName string) ([]string, error) {
+	var lines []string
+
+	for _, se := range g.scripts[sName] {
+		exp, err := se.expand(g, se.value)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range exp {
+			lines = append(lines, strings.Split(s, "\n")...)
+		}
+	}
+
+	return lines, nil
+}
+
+// replRun rebuilds the program and runs it. Only the output not seen after
+// the previous step is shown. If the program cannot be built then the last
+// statement is removed.
+func (g *gosh) replRun() {
+	defer g.dbgStack.Start("replRun", "Rebuilding the program")()
+
+	intro := g.dbgStack.Tag()
+
+	g.snippetUsed = map[string]bool{}
+
+	g.constructGoProgram()
+
+	if g.errMap.HasErrors() {
+		g.errMap.Report(os.Stderr, "gosh")
+		g.errMap = errutil.NewErrMap()
+		g.replDropLast()
+
+		return
+	}
+
+	g.populateImports()
+	g.formatFile()
+	g.tidyModule()
+
+	g.replStdout.Reset()
+	g.replStderr.Reset()
+
+	g.exitStatus = 0
+
+	if !g.runGoFile() {
+		g.replDropLast()
+		return
+	}
+
+	out := replOutput{
+		stdout: g.replStdout.String(),
+		stderr: g.replStderr.String(),
+	}
+	prev := g.replStepOutput(out)
+
+	replShowNew(os.Stdout, prev.stdout, out.stdout)
+	replShowNew(os.Stderr, prev.stderr, out.stderr)
+
+	if g.exitStatus != 0 {
+		verbose.Println(intro, fmt.Sprintf(" Exit status: %d", g.exitStatus))
+	}
+}
+
+// replStepOutput records the output of the program for the current step
+// and returns the output recorded for the step before. If the program is
+// being run again for a step that has already been recorded (after an
+// undo) then the earlier output for that step is returned so that only
+// output which has changed is shown.
+func (g *gosh) replStepOutput(out replOutput) replOutput {
+	step := len(g.scripts[execSect]) - g.replBase
+	prev := g.replOutputs[min(step, len(g.replOutputs)-1)]
+
+	g.replOutputs = append(g.replOutputs[:step], out)
+
+	return prev
+}
+
+// replDropLast removes the last statement after the program could not be
+// built.
+func (g *gosh) replDropLast() {
+	script := g.scripts[execSect]
+	if len(script) <= g.replBase {
+		return
+	}
+
+	g.scripts[execSect] = script[:len(script)-1]
+
+	fmt.Fprintln(os.Stderr, "the last statement has been removed")
+}
+
+// replShowNew writes the part of the output that was not in the previous
+// output. If the output does not start with the previous output then it is
+// all shown.
+func replShowNew(w io.Writer, prev, out string) {
+	if newOut, ok := strings.CutPrefix(out, prev); ok {
+		out = newOut
+	}
+
+	fmt.Fprint(w, out)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/nickwells/errutil.mod/errutil"
+	"github.com/nickwells/param.mod/v7/paramtest"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestReplNeedsMore(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		code    string
+		expMore bool
+	}{
+		{ID: testhelper.MkID("empty"), code: ""},
+		{ID: testhelper.MkID("simple"), code: `x := 1`},
+		{ID: testhelper.MkID("open brace"), code: `for i := range 3 {`, expMore: true},
+		{
+			ID:   testhelper.MkID("closed brace"),
+			code: "for i := range 3 {\nfmt.Println(i)\n}",
+		},
+		{ID: testhelper.MkID("open paren"), code: `fmt.Println(1,`, expMore: true},
+		{ID: testhelper.MkID("brace in string"), code: `s := "{"`},
+		{ID: testhelper.MkID("brace in comment"), code: `x := 1 // {`},
+		{ID: testhelper.MkID("open raw string"), code: "s := `abc", expMore: true},
+	}
+
+	for _, tc := range testCases {
+		testhelper.DiffBool(t, tc.IDStr(), "needs more",
+			replNeedsMore(tc.code), tc.expMore)
+	}
+}
+
+func TestWriteReplScript(t *testing.T) {
+	g := mkTestGosh(func(g *gosh) {
+		g.imports = []string{"fmt", "os", "fmt"}
+		g.AddScriptEntry(beforeSect, "x := 1\n\ny := 2", verbatim)
+		g.AddScriptEntry(execSect, "x++", verbatim)
+		g.AddScriptEntry(execSect, "fmt.Println(x, y)", verbatim)
+	})
+
+	var buf bytes.Buffer
+
+	if err := g.writeReplScript(&buf, "/bin/gosh"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	testhelper.DiffString(t, "writeReplScript", "script", buf.String(),
+		"#!/bin/gosh -exec-file\n"+
+			"#gosh.param: import=fmt\n"+
+			"#gosh.param: import=os\n"+
+			"#gosh.param: before=x := 1\n"+
+			"#gosh.param: before=y := 2\n"+
+			"x++\n"+
+			"fmt.Println(x, y)\n")
+}
+
+// TestParseParamsRepl will use the paramtest.Parser to make sure the
+// behaviour of the REPL parameter setting is as expected.
+func TestParseParamsRepl(t *testing.T) {
+	testCases := []paramtest.Parser{}
+
+	for _, p := range []string{"-repl", "-interactive"} {
+		testCases = append(testCases,
+			mkTestParser(nil, testhelper.MkID("run interactively: "+p),
+				func(g *gosh) { g.repl = true },
+				p))
+	}
+
+	{
+		parseErrs := errutil.ErrMap{}
+		parseErrs.AddError(
+			"Final Checks",
+			errors.New("gosh cannot run interactively in a read-loop"+
+				" or as a webserver"))
+
+		testCases = append(testCases,
+			mkTestParser(parseErrs, testhelper.MkID("repl and readloop"),
+				func(g *gosh) {
+					g.repl = true
+					g.runInReadLoop = true
+				},
+				"-repl", "-n"))
+	}
+
+	for _, tc := range testCases {
+		_ = tc.Test(t)
+	}
+}
+
+func TestReplStepOutput(t *testing.T) {
+	g := mkTestGosh(func(g *gosh) {
+		g.replOutputs = []replOutput{{}}
+	})
+
+	type step struct {
+		name    string
+		undo    bool
+		out     string
+		expPrev string
+	}
+
+	for _, s := range []step{
+		{name: "first", out: "1\n", expPrev: ""},
+		{name: "second", out: "1\n2\n", expPrev: "1\n"},
+		{name: "third", out: "1\n2\n3\n", expPrev: "1\n2\n"},
+		{name: "undo", undo: true, out: "1\n2\n", expPrev: "1\n2\n"},
+		{name: "after undo", out: "1\n2\n4\n", expPrev: "1\n2\n"},
+	} {
+		if s.undo {
+			g.replUndo("")
+		} else {
+			g.AddScriptEntry(execSect, s.name, verbatim)
+		}
+
+		prev := g.replStepOutput(replOutput{stdout: s.out})
+		testhelper.DiffString(t, s.name, "previous output",
+			prev.stdout, s.expPrev)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/nickwells/check.mod/v2/check"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/param.mod/v7/psetter"
+)
+
+const (
+	paramGroupNameRunLimits = "cmd-run-limits"
+
+	paramNameRunTimeout      = "run-timeout"
+	paramNameRunTimeoutGrace = "run-timeout-grace"
+	paramNameRunCPULimit     = "run-cpu-limit"
+	paramNameRunMemLimit     = "run-mem-limit"
+	paramNameRunFilesLimit   = "run-files-limit"
+
+	dfltRunTimeoutGrace = 5 * time.Second
+)
+
+var runLimitsParamNames = []string{
+	paramNameRunTimeout,
+	paramNameRunTimeoutGrace,
+	paramNameRunCPULimit,
+	paramNameRunMemLimit,
+	paramNameRunFilesLimit,
+}
+
+// addRunLimitsParams returns a func that will add parameters concerned
+// with limiting the time and resources used by the generated program to
+// the passed param.PSet.
+func addRunLimitsParams(g *gosh) func(ps *param.PSet) error {
+	return func(ps *param.PSet) error {
+		ps.AddGroup(paramGroupNameRunLimits,
+			"parameters limiting the time and resources that the"+
+				" generated program can use when it is run.")
+
+		ps.Add(paramNameRunTimeout,
+			psetter.Duration{
+				Value: &g.runTimeout,
+				Checks: []check.Duration{
+					check.ValGT[time.Duration](0),
+				},
+			},
+			"set the maximum time that the generated program can run"+
+				" for. If it is still running after this time it is"+
+				" sent a terminate (SIGTERM) signal and if it has not"+
+				" stopped by the end of the grace period it is killed."+
+				" The gosh exit status shows that the limit was hit.",
+			param.AltNames("timeout"),
+			param.GroupName(paramGroupNameRunLimits),
+			param.SeeAlso(runLimitsParamNames...),
+			param.SeeNote(noteGoshExitStatus),
+		)
+
+		ps.Add(paramNameRunTimeoutGrace,
+			psetter.Duration{
+				Value: &g.runTimeoutGrace,
+				Checks: []check.Duration{
+					check.ValGT[time.Duration](0),
+				},
+			},
+			"set the time that the generated program is given to"+
+				" stop after it has been sent a terminate (SIGTERM)"+
+				" signal because the timeout has been reached. After"+
+				" this time it is killed.",
+			param.AltNames("timeout-grace"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameRunLimits),
+			param.SeeAlso(runLimitsParamNames...),
+		)
+
+		ps.Add(paramNameRunCPULimit,
+			psetter.Duration{
+				Value: &g.runCPULimit,
+				Checks: []check.Duration{
+					check.ValGE(time.Second),
+				},
+			},
+			"set the maximum CPU time that the generated program can"+
+				" use. The limit is rounded up to a whole number of"+
+				" seconds. If the program uses more than this it is"+
+				" killed and the gosh exit status shows that the limit"+
+				" was hit."+
+				"\n\n"+
+				rlimitsNote,
+			param.AltNames("cpu-limit"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameRunLimits),
+			param.SeeAlso(runLimitsParamNames...),
+			param.SeeNote(noteGoshExitStatus),
+		)
+
+		ps.Add(paramNameRunMemLimit,
+			psetter.Int[int64]{
+				Value: &g.runMemLimitMB,
+				Checks: []check.Int64{
+					check.ValGT[int64](0),
+				},
+			},
+			"set the maximum size in megabytes of the address space"+
+				" of the generated program. Attempts to allocate more"+
+				" memory than this will fail. Note that the Go runtime"+
+				" reserves more address space than the memory it uses"+
+				" so the limit should be generous."+
+				"\n\n"+
+				rlimitsNote,
+			param.AltNames("mem-limit"),
+			param.ValueName("MB"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameRunLimits),
+			param.SeeAlso(runLimitsParamNames...),
+		)
+
+		ps.Add(paramNameRunFilesLimit,
+			psetter.Int[int64]{
+				Value: &g.runFilesLimit,
+				Checks: []check.Int64{
+					check.ValGT[int64](0),
+				},
+			},
+			"set the maximum number of files that the generated"+
+				" program can have open at the same time. Attempts to"+
+				" open more files than this will fail."+
+				"\n\n"+
+				rlimitsNote,
+			param.AltNames("files-limit"),
+			param.Attrs(param.DontShowInStdUsage),
+			param.GroupName(paramGroupNameRunLimits),
+			param.SeeAlso(runLimitsParamNames...),
+		)
+
+		ps.AddFinalCheck(func() error {
+			if rlimitsAvailable {
+				return nil
+			}
+
+			for _, pName := range []string{
+				paramNameRunCPULimit,
+				paramNameRunMemLimit,
+				paramNameRunFilesLimit,
+			} {
+				if p, err := ps.GetParamByName(pName); err == nil &&
+					p.HasBeenSet() {
+					return fmt.Errorf(
+						"the %q parameter is not supported on this"+
+							" operating system",
+						"-"+pName)
+				}
+			}
+
+			return nil
+		})
+
+		return nil
+	}
+}
+
+// hasRlimits returns true if any of the resource limits have been set
+func (g *gosh) hasRlimits() bool {
+	return g.runCPULimit > 0 || g.runMemLimitMB > 0 || g.runFilesLimit > 0
+}
+
+// cpuLimitSecs returns the CPU limit in whole seconds, rounded up
+func (g *gosh) cpuLimitSecs() uint64 {
+	return uint64((g.runCPULimit + time.Second - 1) / time.Second)
+}
+
+// makeRunCmd returns the command which will run the generated program
+// with the given arguments. If there is a timeout the command is given a
+// context which will end it and the returned cancel func must be called
+// once the command has finished.
+func (g *gosh) makeRunCmd(args []string) (
+	*exec.Cmd, context.Context, context.CancelFunc,
+) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if g.runTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, g.runTimeout)
+	}
+
+	cmd := exec.CommandContext(ctx, g.execPath(), args...) //nolint:gosec
+	if g.runTimeout > 0 {
+		cmd.Cancel = func() error {
+			return cmd.Process.Signal(syscall.SIGTERM)
+		}
+		cmd.WaitDelay = g.runTimeoutGrace
+	}
+
+	return cmd, ctx, cancel
+}
+
+// runCmd starts the command in its own process group, with any resource
+// limits applied, and waits for it to complete, relaying any interrupt,
+// terminate, hangup or quit signals that gosh receives. It returns a
+// description of the limit, if any, that stopped the program together with
+// the error from running it.
+func (g *gosh) runCmd(ctx context.Context, cmd *exec.Cmd) (string, error) {
+	if g.hasRlimits() {
+		if err := g.setRlimitsShim(cmd); err != nil {
+			return "", fmt.Errorf("cannot set the resource limits: %w", err)
+		}
+	}
+
+	defer setProcGroup(cmd)()
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	defer relaySignals(cmd.Process)()
+
+	err := cmd.Wait()
+
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Sprintf("the timeout (%s)", g.runTimeout), err
+	}
+
+	if err != nil {
+		if limit := g.rlimitHit(cmd.ProcessState); limit != "" {
+			return limit, err
+		}
+	}
+
+	return "", err
+}
+
+// reportRunLimitHit reports that the program was stopped because it hit
+// the limit and sets the exit status accordingly
+func (g *gosh) reportRunLimitHit(limit string) {
+	fmt.Fprintln(os.Stderr,
+		"gosh: the program was stopped: it reached "+limit)
+
+	g.exitStatus = goshExitStatusRunLimit
+}
@@ -0,0 +1,164 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// rlimitsAvailable records whether resource limits can be set on the
+// generated program
+const rlimitsAvailable = true
+
+// rlimitsNote is added to the description of the resource limit parameters
+const rlimitsNote = "The limit is applied before the program starts and" +
+	" it cannot be raised by the program."
+
+// envRlimits is the environment variable which passes the resource limits
+// to the gosh process which sets them before running the program
+const envRlimits = "GOSH_RUN_RLIMITS"
+
+// rlimitNames maps the resources which can be limited to their names
+var rlimitNames = map[int]string{
+	unix.RLIMIT_CPU:    "CPU time",
+	unix.RLIMIT_AS:     "address space",
+	unix.RLIMIT_NOFILE: "open files",
+}
+
+// rlimitsVal returns the value of the envRlimits environment variable
+// giving the resource limits which have been set. Each limit is given as
+// the resource and the limit separated by an '=' and the limits are
+// separated by commas.
+func (g *gosh) rlimitsVal() string {
+	limits := []struct {
+		resource int
+		val      uint64
+	}{
+		{unix.RLIMIT_CPU, g.cpuLimitSecs()},
+		{unix.RLIMIT_AS, uint64(g.runMemLimitMB) * bytesPerMB},
+		{unix.RLIMIT_NOFILE, uint64(g.runFilesLimit)},
+	}
+
+	vals := []string{}
+
+	for _, l := range limits {
+		if l.val != 0 {
+			vals = append(vals, fmt.Sprintf("%d=%d", l.resource, l.val))
+		}
+	}
+
+	return strings.Join(vals, ",")
+}
+
+// setRlimitsShim changes the command so that it runs gosh rather than the
+// program. The resource limits are passed in the environment and gosh
+// sets them and then replaces itself with the program (see
+// runRlimitsShim). This means that the limits apply from the start of the
+// program rather than from some point after it has started.
+func (g *gosh) setRlimitsShim(cmd *exec.Cmd) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+
+	cmd.Env = append(env, envRlimits+"="+g.rlimitsVal())
+	cmd.Args = append([]string{self, cmd.Path}, cmd.Args...)
+	cmd.Path = self
+
+	return nil
+}
+
+// setRlimits sets the resource limits given in the value of the envRlimits
+// environment variable. Both the soft and hard limits are set so the
+// program cannot raise them.
+func setRlimits(val string) error {
+	for l := range strings.SplitSeq(val, ",") {
+		r, v, ok := strings.Cut(l, "=")
+		if !ok {
+			return fmt.Errorf("bad resource limit: %q", l)
+		}
+
+		resource, err := strconv.Atoi(r)
+		if err != nil || rlimitNames[resource] == "" {
+			return fmt.Errorf("bad resource: %q", r)
+		}
+
+		limit, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad limit: %q", v)
+		}
+
+		rl := unix.Rlimit{Cur: limit, Max: limit}
+		if err := unix.Setrlimit(resource, &rl); err != nil {
+			return fmt.Errorf("%s: %w", rlimitNames[resource], err)
+		}
+	}
+
+	return nil
+}
+
+// runRlimitsShim checks the environment for resource limits to be set. If
+// there are none it returns, otherwise it sets the limits and replaces gosh
+// with the program given by the arguments. It only returns if there are no
+// limits.
+func runRlimitsShim() {
+	val, ok := os.LookupEnv(envRlimits)
+	if !ok {
+		return
+	}
+
+	_ = os.Unsetenv(envRlimits)
+
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, "gosh: there is no program to run")
+		os.Exit(goshExitStatusRunFail)
+	}
+
+	if err := setRlimits(val); err != nil {
+		fmt.Fprintln(os.Stderr, "gosh: cannot set the resource limits:", err)
+		os.Exit(goshExitStatusRunFail)
+	}
+
+	err := syscall.Exec(os.Args[1], os.Args[2:], os.Environ())
+	fmt.Fprintln(os.Stderr, "gosh: cannot run the program:", err)
+	os.Exit(goshExitStatusRunFail)
+}
+
+// rlimitHit returns a description of the resource limit that stopped the
+// program, or the empty string if it was not stopped by a limit. Only the
+// CPU time limit can be detected, the kernel kills the program when it is
+// reached.
+func (g *gosh) rlimitHit(ps *os.ProcessState) string {
+	if g.runCPULimit == 0 || ps == nil {
+		return ""
+	}
+
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() || ws.Signal() != syscall.SIGKILL {
+		return ""
+	}
+
+	// The CPU time reported for the program can be less than the time
+	// the kernel used when applying the limit so a margin is allowed
+	const marginPct = 25
+
+	limit := time.Duration(g.cpuLimitSecs()) * time.Second
+	if (ps.UserTime()+ps.SystemTime())*100 < limit*(100-marginPct) {
+		return ""
+	}
+
+	return fmt.Sprintf("the CPU time limit (%s)", limit)
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// rlimitsAvailable records whether resource limits can be set on the
+// generated program
+const rlimitsAvailable = false
+
+// rlimitsNote is added to the description of the resource limit parameters
+const rlimitsNote = "Resource limits are only supported on Linux."
+
+// setRlimitsShim does nothing, resource limits are not supported
+func (g *gosh) setRlimitsShim(_ *exec.Cmd) error { return nil }
+
+// runRlimitsShim does nothing, resource limits are not supported
+func runRlimitsShim() {}
+
+// rlimitHit always returns the empty string, resource limits are not
+// supported
+func (g *gosh) rlimitHit(_ *os.ProcessState) string { return "" }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nickwells/param.mod/v7/paramtest"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+const (
+	// envTestRunGosh is set in the environment of the test binary when it
+	// is to be run as gosh
+	envTestRunGosh = "GOSH_TEST_RUN_GOSH"
+	// envTestAddHistory is set in the environment of the test binary to
+	// the name of a history file when it is to add an entry to it
+	envTestAddHistory = "GOSH_TEST_ADD_HISTORY"
+)
+
+// TestMain lets the test binary stand in for gosh when a test program is
+// run with resource limits (see runRlimitsShim), when gosh itself is to be
+// run (see envTestRunGosh) or when several gosh processes add to the
+// history at the same time (see envTestAddHistory)
+func TestMain(m *testing.M) {
+	runRlimitsShim()
+
+	if _, ok := os.LookupEnv(envTestRunGosh); ok {
+		_ = os.Unsetenv(envTestRunGosh)
+
+		main()
+		os.Exit(0)
+	}
+
+	if historyFile, ok := os.LookupEnv(envTestAddHistory); ok {
+		addTestHistoryEntry(historyFile)
+	}
+
+	os.Exit(m.Run())
+}
+
+// TestParseParamsRunLimits will use the paramtest.Parser to make sure the
+// behaviour of the run limits parameters is as expected.
+func TestParseParamsRunLimits(t *testing.T) {
+	testCases := []paramtest.Parser{
+		mkTestParser(nil, testhelper.MkID("timeout"),
+			func(g *gosh) {
+				g.runTimeout = time.Minute
+				g.runTimeoutGrace = time.Second
+			},
+			"-"+paramNameRunTimeout, "1m",
+			"-timeout-grace", "1s"),
+		mkTestParser(nil, testhelper.MkID("resource limits"),
+			func(g *gosh) {
+				g.runCPULimit = 90 * time.Second
+				g.runMemLimitMB = 1024
+				g.runFilesLimit = 64
+			},
+			"-cpu-limit", "90s",
+			"-"+paramNameRunMemLimit, "1024",
+			"-files-limit", "64"),
+	}
+
+	for _, tc := range testCases {
+		_ = tc.Test(t)
+	}
+}
+
+func TestRunCmdLimits(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		setLimits    func(g *gosh)
+		needsRlimits bool
+		code         string
+		expLimit     string
+	}{
+		{
+			ID:        testhelper.MkID("no limit hit"),
+			setLimits: func(g *gosh) { g.runTimeout = time.Minute },
+			code:      "_ = time.Now()",
+		},
+		{
+			ID: testhelper.MkID("timeout"),
+			setLimits: func(g *gosh) {
+				g.runTimeout = 200 * time.Millisecond
+				g.runTimeoutGrace = time.Second
+			},
+			code:     "time.Sleep(time.Minute)",
+			expLimit: "the timeout (200ms)",
+		},
+		{
+			ID:           testhelper.MkID("CPU limit"),
+			setLimits:    func(g *gosh) { g.runCPULimit = time.Second },
+			needsRlimits: true,
+			code:         "for time.Now().Unix() > 0 {}",
+			expLimit:     "the CPU time limit (1s)",
+		},
+	}
+
+	for _, tc := range testCases {
+		if tc.needsRlimits && !rlimitsAvailable {
+			continue
+		}
+
+		g := mkTestGosh(func(g *gosh) {
+			g.imports = []string{"time"}
+			g.AddScriptEntry(execSect, tc.code, verbatim)
+		})
+
+		g.cachedExec = buildTestProg(t, g)
+		tc.setLimits(g)
+
+		cmd, ctx, cancel := g.makeRunCmd(g.args)
+		limit, _ := g.runCmd(ctx, cmd)
+
+		cancel()
+
+		testhelper.DiffString(t, tc.IDStr(), "limit", limit, tc.expLimit)
+	}
+}
+
+func TestRlimitsBeforeStart(t *testing.T) {
+	if !rlimitsAvailable {
+		t.Skip("resource limits are not supported")
+	}
+
+	// the limit is read when the program is initialised and the
+	// environment variable passing the limits should not be seen
+	g := mkTestGosh(func(g *gosh) {
+		g.imports = []string{"fmt", "os", "syscall"}
+		g.AddScriptEntry(globalSect,
+			"var lim = func() (l syscall.Rlimit) {"+
+				" _ = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &l);"+
+				" return l }()",
+			verbatim)
+		g.AddScriptEntry(execSect,
+			`fmt.Println(lim.Cur, lim.Max, os.Getenv("GOSH_RUN_RLIMITS"))`,
+			verbatim)
+	})
+
+	g.cachedExec = buildTestProg(t, g)
+	g.runFilesLimit = 17
+
+	var stdout bytes.Buffer
+
+	cmd, ctx, cancel := g.makeRunCmd(g.args)
+	cmd.Stdout = &stdout
+
+	_, err := g.runCmd(ctx, cmd)
+
+	cancel()
+
+	if err != nil {
+		t.Fatal("cannot run the program:", err)
+	}
+
+	testhelper.DiffString(t, "files limit", "limits seen by the program",
+		stdout.String(), "17 17 \n")
+}
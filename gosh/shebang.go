@@ -8,17 +8,23 @@ import (
 const shebangGoshParam = "#gosh.param:"
 
 // shebangFileContents this will read the contents of the file removing any
-// initial line starting with '#!'. It returns the edited content and any
-// error. If the error is not nil the returned string should not be used.
-func shebangFileContents(fileName string) ([]byte, []byte, error) {
+// initial line starting with '#!'. It returns the edited content, the
+// config, the original content and any error. If the error is not nil the
+// returned values should not be used.
+func shebangFileContents(fileName string) ([]byte, []byte, []byte, error) {
 	content, err := os.ReadFile(fileName) //nolint:gosec
 	if err != nil {
-		return []byte{}, []byte{}, err
+		return []byte{}, []byte{}, []byte{}, err
 	}
 
 	script, config := shebangStrip(content)
 
-	return script, config, nil
+	return script, config, content, nil
+}
+
+// isShebangScript returns true if the content starts with '#!'
+func isShebangScript(content []byte) bool {
+	return bytes.HasPrefix(content, []byte("#!"))
 }
 
 // shebangStrip removes the "#!" from the start of the file and any lines
@@ -31,7 +37,7 @@ func shebangStrip(content []byte) ([]byte, []byte) {
 	var config []byte
 
 	// strip the leading #! (if any)
-	if bytes.HasPrefix(content, []byte("#!")) {
+	if isShebangScript(content) {
 		if i := bytes.IndexByte(content, '\n'); i > 0 {
 			content = content[i+1:]
 		} else {
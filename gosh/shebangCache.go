@@ -0,0 +1,533 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nickwells/gogen.mod/gogen"
+	"github.com/nickwells/param.mod/v7/param"
+	"github.com/nickwells/verbose.mod/verbose"
+)
+
+const (
+	// shebangCacheInfoFile is the name of the file in a build cache entry
+	// which records the shebang scripts that the program was built from. It
+	// is used to find the entries which are stale.
+	shebangCacheInfoFile = "shebang.info"
+
+	shebangInfoGoshVersion = "gosh-version"
+	shebangInfoGoVersion   = "go-version"
+	shebangInfoScript      = "script"
+	shebangInfoEmbedFile   = "embed-file"
+	shebangInfoFile        = "file"
+	shebangInfoDir         = "dir"
+	shebangInfoConfigFile  = "config-file"
+
+	// shebangInfoNoFile is recorded in place of the hash of a
+	// configuration file which does not exist
+	shebangInfoNoFile = "-"
+)
+
+// shebangScript records the details of a shebang script which is used to
+// construct the program
+type shebangScript struct {
+	path string
+	hash string
+}
+
+// newShebangScript returns the shebang script details for the named file
+// with the given contents
+func newShebangScript(fileName string, content []byte) (shebangScript, error) {
+	path, err := filepath.Abs(fileName)
+	if err != nil {
+		return shebangScript{}, err
+	}
+
+	return shebangScript{path: path, hash: contentHash(content)}, nil
+}
+
+// addShebangDep records the named file as one that the program depends on.
+// The name is made absolute so that the same name given from different
+// directories is not taken to be the same file.
+func (g *gosh) addShebangDep(fileName string) {
+	if path, err := filepath.Abs(fileName); err == nil {
+		fileName = path
+	}
+
+	if !slices.Contains(g.shebangDeps, fileName) {
+		g.shebangDeps = append(g.shebangDeps, fileName)
+	}
+}
+
+// shebangDepFiles returns the absolute pathnames of the files, other than
+// the shebang scripts and the embedded files, that the program depends on
+func (g *gosh) shebangDepFiles() ([]string, error) {
+	files := slices.Clone(g.shebangDeps)
+
+	for _, name := range g.copyGoFiles {
+		path, err := filepath.Abs(name)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, path)
+	}
+
+	slices.Sort(files)
+
+	return slices.Compact(files), nil
+}
+
+// configFileNames returns the names of the configuration files which the
+// parameter set reads, whether or not they exist
+func configFileNames(ps *param.PSet) []string {
+	names := []string{}
+
+	for _, cf := range ps.ConfigFiles() {
+		names = append(names, cf.Name)
+	}
+
+	for _, grp := range ps.GetGroups() {
+		for _, cf := range grp.ConfigFiles() {
+			names = append(names, cf.Name)
+		}
+	}
+
+	return names
+}
+
+// configFileHash returns the hash of the contents of the configuration
+// file or shebangInfoNoFile if it does not exist
+func configFileHash(path string) (string, error) {
+	content, err := os.ReadFile(path) //nolint:gosec
+	if err != nil {
+		if os.IsNotExist(err) {
+			return shebangInfoNoFile, nil
+		}
+
+		return "", err
+	}
+
+	return contentHash(content), nil
+}
+
+// shebangDepDirs returns the absolute pathnames of the local module and
+// workspace directories that the program depends on
+func (g *gosh) shebangDepDirs() ([]string, error) {
+	dirs := slices.Collect(maps.Values(g.localModules))
+
+	for _, dir := range g.workspace {
+		path, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		dirs = append(dirs, path)
+	}
+
+	slices.Sort(dirs)
+
+	return slices.Compact(dirs), nil
+}
+
+// dirHash returns the hash of the names and contents of the files in the
+// directory tree as a hex string. Hidden files and directories (such as
+// '.git') are skipped.
+func dirHash(dir string) (string, error) {
+	h := sha256.New()
+
+	err := filepath.WalkDir(dir,
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+
+				return nil
+			}
+
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			content, err := os.ReadFile(path) //nolint:gosec
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+
+			addToHash(h, "file", filepath.ToSlash(rel), string(content))
+
+			return nil
+		})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// contentHash returns the hash of the content as a hex string
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// goshVersion returns a string identifying the version of gosh. This is
+// taken from the build information and includes the version control
+// details if they are available.
+func goshVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	v := bi.Main.Version
+
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			v += " " + s.Key + "=" + s.Value
+		}
+	}
+
+	return v
+}
+
+// goVersion returns the version of the Go command used to build programs
+func goVersion() (string, error) {
+	out, err := exec.Command( //nolint:gosec
+		gogen.GetGoCmdName(), "env", "GOVERSION").Output()
+	if err != nil {
+		return "", fmt.Errorf("couldn't get the Go version: %w", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// makeShebangCacheInfo returns the contents of the shebang info file for
+// the program being built with the given version of Go. The gosh
+// configuration files, any files to be embedded in the program, any other
+// files which it depends on (snippets, copied Go files and the files giving
+// code) and any local module or workspace directories are recorded along
+// with the scripts.
+func (g *gosh) makeShebangCacheInfo(goVer string) (string, error) {
+	var info strings.Builder
+
+	fmt.Fprintln(&info, shebangInfoGoshVersion, goshVersion())
+	fmt.Fprintln(&info, shebangInfoGoVersion, goVer)
+
+	for _, path := range g.configFiles {
+		hash, err := configFileHash(path)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintln(&info, shebangInfoConfigFile, hash, path)
+	}
+
+	for _, s := range g.shebangScripts {
+		fmt.Fprintln(&info, shebangInfoScript, s.hash, s.path)
+	}
+
+	for _, ef := range g.embedFiles {
+		content, err := os.ReadFile(ef.path)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintln(&info, shebangInfoEmbedFile, contentHash(content), ef.path)
+	}
+
+	files, err := g.shebangDepFiles()
+	if err != nil {
+		return "", err
+	}
+
+	for _, path := range files {
+		content, err := os.ReadFile(path) //nolint:gosec
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintln(&info, shebangInfoFile, contentHash(content), path)
+	}
+
+	dirs, err := g.shebangDepDirs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, path := range dirs {
+		hash, err := dirHash(path)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintln(&info, shebangInfoDir, hash, path)
+	}
+
+	return info.String(), nil
+}
+
+// makeShebangCacheKey returns a hash of the shebang info (see
+// makeShebangCacheInfo), the gosh arguments and the environment variables
+// which affect the build. Unlike the key made by makeBuildCacheKey it can
+// be made before the program is constructed.
+func (g *gosh) makeShebangCacheKey() (string, error) {
+	goVer, err := goVersion()
+	if err != nil {
+		return "", err
+	}
+
+	g.shebangCacheInfo, err = g.makeShebangCacheInfo(goVer)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+
+	addToHash(h, "version", buildCacheVersion)
+	addToHash(h, "shebang-info", g.shebangCacheInfo)
+	addToHash(h, "gosh-args", shebangKeyArgs(g.goshArgs)...)
+
+	for _, ev := range buildCacheEnvVars {
+		addToHash(h, "env", ev, os.Getenv(ev))
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// shebangKeyArgs returns those of the gosh arguments which are used to make
+// the shebang cache key. The parameter forcing a rebuild is left out so that
+// the rebuilt program replaces the cached copy.
+func shebangKeyArgs(args []string) []string {
+	rebuildNames := append([]string{paramNameBuildCacheBuild},
+		buildCacheRebuildAltNames...)
+
+	keyArgs := make([]string, 0, len(args))
+
+	for _, a := range args {
+		name, _, _ := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if strings.HasPrefix(a, "-") && slices.Contains(rebuildNames, name) {
+			continue
+		}
+
+		keyArgs = append(keyArgs, a)
+	}
+
+	return keyArgs
+}
+
+// runShebangFromBuildCache looks in the build cache for a program built
+// from the same shebang scripts and, if one is found, runs it. It returns
+// true if the cached program was run, false otherwise. It is run before the
+// program is constructed so that, if the program is found, none of the work
+// of constructing it is done.
+func (g *gosh) runShebangFromBuildCache() bool {
+	if !g.buildCacheUsable() || len(g.shebangScripts) == 0 {
+		return false
+	}
+
+	defer g.dbgStack.Start("runShebangFromBuildCache",
+		"Checking the build cache for the shebang script")()
+
+	intro := g.dbgStack.Tag()
+
+	key, err := g.makeShebangCacheKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr,
+			"gosh couldn't make the shebang script cache key:", err)
+
+		return false
+	}
+
+	g.buildCacheKey = key
+	verbose.Println(intro, " Cache key: ", key)
+
+	if !g.shebangCacheInfoMatches(intro) {
+		return false
+	}
+
+	if !g.findInBuildCache(intro) {
+		return false
+	}
+
+	g.executeProgram(g.args, os.Stdout)
+
+	return true
+}
+
+// shebangCacheInfoMatches returns true if the shebang info recorded in the
+// build cache entry, if there is one, is the same as that for the program
+// being built. This means that a cached program is only run if none of the
+// files it was built from have changed.
+func (g *gosh) shebangCacheInfoMatches(intro string) bool {
+	info, err := os.ReadFile(
+		filepath.Join(g.buildCacheEntryDir(), shebangCacheInfoFile))
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+
+	if string(info) != g.shebangCacheInfo {
+		verbose.Println(intro, " The cached shebang info does not match")
+
+		return false
+	}
+
+	return true
+}
+
+// staleBuildCacheEntry records a build cache entry which can no longer be
+// used and the reason why
+type staleBuildCacheEntry struct {
+	buildCacheEntry
+
+	reason string
+}
+
+// staleBuildCacheEntries returns those build cache entries which were built
+// from shebang scripts and which will never be used again. This is because
+// one of the scripts has been changed or removed or because gosh or Go has
+// changed since the program was built.
+func staleBuildCacheEntries(
+	entries []buildCacheEntry,
+) ([]staleBuildCacheEntry, error) {
+	goVer, err := goVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	goshVer := goshVersion()
+
+	stale := []staleBuildCacheEntry{}
+
+	for _, e := range entries {
+		info, err := os.ReadFile(filepath.Join(e.path, shebangCacheInfoFile))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		reason := shebangStaleReason(string(info), goshVer, goVer)
+		if reason != "" {
+			stale = append(stale,
+				staleBuildCacheEntry{buildCacheEntry: e, reason: reason})
+		}
+	}
+
+	return stale, nil
+}
+
+// shebangStaleReason returns the reason why the build cache entry with the
+// given shebang info is stale or the empty string if it is not.
+func shebangStaleReason(info, goshVer, goVer string) string {
+	for l := range strings.Lines(info) {
+		tag, val, _ := strings.Cut(strings.TrimSuffix(l, "\n"), " ")
+
+		switch tag {
+		case shebangInfoGoshVersion:
+			if val != goshVer {
+				return "gosh has changed, it was built by: " + val
+			}
+		case shebangInfoGoVersion:
+			if val != goVer {
+				return "Go has changed, it was built with: " + val
+			}
+		case shebangInfoConfigFile:
+			hash, path, _ := strings.Cut(val, " ")
+
+			cfHash, err := configFileHash(path)
+			if err != nil {
+				return "the config file cannot be read: " + path
+			}
+
+			if cfHash != hash {
+				return "the config file has changed: " + path
+			}
+		case shebangInfoDir:
+			hash, path, _ := strings.Cut(val, " ")
+
+			dHash, err := dirHash(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return "the directory has been removed: " + path
+				}
+
+				return "the directory cannot be read: " + path
+			}
+
+			if dHash != hash {
+				return "the directory has changed: " + path
+			}
+		case shebangInfoScript, shebangInfoEmbedFile, shebangInfoFile:
+			what := "script"
+
+			switch tag {
+			case shebangInfoEmbedFile:
+				what = "embedded file"
+			case shebangInfoFile:
+				what = "file"
+			}
+
+			hash, path, _ := strings.Cut(val, " ")
+
+			content, err := os.ReadFile(path) //nolint:gosec
+			if err != nil {
+				if os.IsNotExist(err) {
+					return "the " + what + " has been removed: " + path
+				}
+
+				return "the " + what + " cannot be read: " + path
+			}
+
+			if contentHash(content) != hash {
+				return "the " + what + " has changed: " + path
+			}
+		default:
+			return fmt.Sprintf("bad shebang info line: %q", l)
+		}
+	}
+
+	return ""
+}
+
+// listStaleBuildCache prints the stale build cache entries with the reason
+// why each entry is stale
+func listStaleBuildCache(stale []staleBuildCacheEntry) {
+	var total int64
+
+	for _, e := range stale {
+		fmt.Printf("%s %8.1fMB %s\n\t%s\n",
+			e.lastUsed.Format(time.DateTime),
+			float64(e.size)/bytesPerMB,
+			e.path,
+			e.reason)
+
+		total += e.size
+	}
+
+	fmt.Printf("%d stale entries, %.1fMB in total\n",
+		len(stale), float64(total)/bytesPerMB)
+}
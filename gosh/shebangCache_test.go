@@ -0,0 +1,384 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/nickwells/gogen.mod/gogen"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestShebangKeyArgs(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		args    []string
+		expArgs []string
+	}{
+		{
+			ID:      testhelper.MkID("no args"),
+			args:    []string{},
+			expArgs: []string{},
+		},
+		{
+			ID:      testhelper.MkID("no rebuild"),
+			args:    []string{"-exec-file", "s", "-cache"},
+			expArgs: []string{"-exec-file", "s", "-cache"},
+		},
+		{
+			ID: testhelper.MkID("rebuild"),
+			args: []string{
+				"-rebuild", "--build-cache-rebuild=true", "-exec-file", "s",
+			},
+			expArgs: []string{"-exec-file", "s"},
+		},
+		{
+			ID:      testhelper.MkID("rebuild as a value"),
+			args:    []string{"-exec", "rebuild"},
+			expArgs: []string{"-exec", "rebuild"},
+		},
+	}
+
+	for _, tc := range testCases {
+		testhelper.DiffStringSlice(t, tc.IDStr(), "key args",
+			shebangKeyArgs(tc.args), tc.expArgs)
+	}
+}
+
+func TestShebangStaleReason(t *testing.T) {
+	const (
+		goshVer = "v1.0.0"
+		goVer   = "go1.26.0"
+		content = "#!/path/to/gosh -exec-file\nfmt.Println()\n"
+	)
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script")
+	missing := filepath.Join(dir, "missing")
+
+	if err := os.WriteFile(script, []byte(content), 0o600); err != nil {
+		t.Fatal("Cannot write the script:", err)
+	}
+
+	mkInfo := func(goshV, goV, hash, path string) string {
+		return shebangInfoGoshVersion + " " + goshV + "\n" +
+			shebangInfoGoVersion + " " + goV + "\n" +
+			shebangInfoScript + " " + hash + " " + path + "\n"
+	}
+
+	hash := contentHash([]byte(content))
+
+	dHash, err := dirHash(dir)
+	if err != nil {
+		t.Fatal("Cannot hash the directory:", err)
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		info      string
+		expReason string
+	}{
+		{
+			ID:   testhelper.MkID("not stale"),
+			info: mkInfo(goshVer, goVer, hash, script),
+		},
+		{
+			ID:        testhelper.MkID("gosh changed"),
+			info:      mkInfo("v0.9.0", goVer, hash, script),
+			expReason: "gosh has changed, it was built by: v0.9.0",
+		},
+		{
+			ID:        testhelper.MkID("go changed"),
+			info:      mkInfo(goshVer, "go1.25.0", hash, script),
+			expReason: "Go has changed, it was built with: go1.25.0",
+		},
+		{
+			ID:        testhelper.MkID("script changed"),
+			info:      mkInfo(goshVer, goVer, contentHash(nil), script),
+			expReason: "the script has changed: " + script,
+		},
+		{
+			ID:        testhelper.MkID("script removed"),
+			info:      mkInfo(goshVer, goVer, hash, missing),
+			expReason: "the script has been removed: " + missing,
+		},
+		{
+			ID: testhelper.MkID("embedded file removed"),
+			info: mkInfo(goshVer, goVer, hash, script) +
+				shebangInfoEmbedFile + " " + hash + " " + script + "x\n",
+			expReason: "the embedded file has been removed: " + script + "x",
+		},
+		{
+			ID: testhelper.MkID("file changed"),
+			info: mkInfo(goshVer, goVer, hash, script) +
+				shebangInfoFile + " " + contentHash(nil) + " " + script + "\n",
+			expReason: "the file has changed: " + script,
+		},
+		{
+			ID: testhelper.MkID("directory not changed"),
+			info: mkInfo(goshVer, goVer, hash, script) +
+				shebangInfoDir + " " + dHash + " " + dir + "\n",
+		},
+		{
+			ID: testhelper.MkID("directory changed"),
+			info: mkInfo(goshVer, goVer, hash, script) +
+				shebangInfoDir + " " + hash + " " + dir + "\n",
+			expReason: "the directory has changed: " + dir,
+		},
+		{
+			ID: testhelper.MkID("directory removed"),
+			info: mkInfo(goshVer, goVer, hash, script) +
+				shebangInfoDir + " " + dHash + " " + missing + "\n",
+			expReason: "the directory has been removed: " + missing,
+		},
+		{
+			ID: testhelper.MkID("config file not changed"),
+			info: mkInfo(goshVer, goVer, hash, script) +
+				shebangInfoConfigFile + " " + hash + " " + script + "\n" +
+				shebangInfoConfigFile + " " + shebangInfoNoFile + " " +
+				missing + "\n",
+		},
+		{
+			ID: testhelper.MkID("config file changed"),
+			info: mkInfo(goshVer, goVer, hash, script) +
+				shebangInfoConfigFile + " " + contentHash(nil) + " " +
+				script + "\n",
+			expReason: "the config file has changed: " + script,
+		},
+		{
+			ID: testhelper.MkID("config file created"),
+			info: mkInfo(goshVer, goVer, hash, script) +
+				shebangInfoConfigFile + " " + shebangInfoNoFile + " " +
+				script + "\n",
+			expReason: "the config file has changed: " + script,
+		},
+		{
+			ID: testhelper.MkID("config file removed"),
+			info: mkInfo(goshVer, goVer, hash, script) +
+				shebangInfoConfigFile + " " + hash + " " + missing + "\n",
+			expReason: "the config file has changed: " + missing,
+		},
+		{
+			ID:        testhelper.MkID("bad info"),
+			info:      "nonesuch\n",
+			expReason: `bad shebang info line: "nonesuch\n"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		testhelper.DiffString(t, tc.IDStr(), "reason",
+			shebangStaleReason(tc.info, goshVer, goVer), tc.expReason)
+	}
+}
+
+func TestMakeShebangCacheKey(t *testing.T) {
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is not available")
+	}
+
+	origGoCmd := gogen.GetGoCmdName()
+	if err := gogen.SetGoCmdName(goCmd); err != nil {
+		t.Fatal("Cannot set the go command:", err)
+	}
+
+	t.Cleanup(func() { _ = gogen.SetGoCmdName(origGoCmd) })
+
+	makeKey := func(g *gosh) string {
+		t.Helper()
+
+		key, err := g.makeShebangCacheKey()
+		if err != nil {
+			t.Fatal("Cannot make the shebang cache key:", err)
+		}
+
+		if !isBuildCacheKey(key) {
+			t.Errorf("bad shebang cache key: %q", key)
+		}
+
+		return key
+	}
+
+	script := shebangScript{path: "/a/script", hash: contentHash([]byte("x"))}
+
+	baseGosh := func(g *gosh) {
+		g.shebangScripts = []shebangScript{script}
+		g.goshArgs = []string{"-exec-file", script.path}
+	}
+
+	baseKey := makeKey(mkTestGosh(baseGosh))
+
+	testhelper.DiffString(t, "same script", "key",
+		makeKey(mkTestGosh(baseGosh)), baseKey)
+
+	testhelper.DiffString(t, "rebuilt script", "key",
+		makeKey(mkTestGosh(baseGosh, func(g *gosh) {
+			g.goshArgs = append([]string{"-rebuild"}, g.goshArgs...)
+		})), baseKey)
+
+	testCases := []struct {
+		testhelper.ID
+		gs func(g *gosh)
+	}{
+		{
+			ID: testhelper.MkID("script moved"),
+			gs: func(g *gosh) { g.shebangScripts[0].path = "/b/script" },
+		},
+		{
+			ID: testhelper.MkID("script changed"),
+			gs: func(g *gosh) {
+				g.shebangScripts[0].hash = contentHash([]byte("y"))
+			},
+		},
+		{
+			ID: testhelper.MkID("script added"),
+			gs: func(g *gosh) {
+				g.shebangScripts = append(g.shebangScripts,
+					shebangScript{path: "/b/script", hash: script.hash})
+			},
+		},
+		{
+			ID: testhelper.MkID("gosh args"),
+			gs: func(g *gosh) {
+				g.goshArgs = append(g.goshArgs, "-exec", "x++")
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		if key := makeKey(mkTestGosh(baseGosh, tc.gs)); key == baseKey {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: the shebang cache key should have changed")
+		}
+	}
+
+	dir := t.TempDir()
+	snippetFile := filepath.Join(dir, "snippet")
+	codeFile := filepath.Join(dir, "code.go")
+	configFile := filepath.Join(dir, "common.cfg")
+	modDir := filepath.Join(dir, "mod")
+	workDir := filepath.Join(dir, "work")
+
+	for _, d := range []string{modDir, workDir} {
+		if err := os.Mkdir(d, 0o700); err != nil {
+			t.Fatal("Cannot make the directory:", err)
+		}
+	}
+
+	depsGosh := func(g *gosh) {
+		baseGosh(g)
+		g.addShebangDep(snippetFile)
+		g.copyGoFiles = []string{codeFile}
+		g.localModules = map[string]string{"example.com/mod": modDir}
+		g.workspace = []string{workDir}
+		g.configFiles = []string{configFile}
+	}
+
+	depFiles := []string{
+		snippetFile,
+		codeFile,
+		configFile,
+		filepath.Join(modDir, "mod.go"),
+		filepath.Join(workDir, "work.go"),
+	}
+
+	writeFile := func(fName, content string) {
+		if err := os.WriteFile(fName, []byte(content), 0o600); err != nil {
+			t.Fatal("Cannot write the file:", err)
+		}
+	}
+
+	for _, fName := range depFiles {
+		if fName != configFile {
+			writeFile(fName, "a")
+		}
+	}
+
+	noConfigKey := makeKey(mkTestGosh(depsGosh))
+
+	writeFile(configFile, "a")
+
+	depsKey := makeKey(mkTestGosh(depsGosh))
+	if depsKey == noConfigKey {
+		t.Errorf("creating the config file should change the key")
+	}
+
+	for _, fName := range depFiles {
+		writeFile(fName, "b")
+
+		if makeKey(mkTestGosh(depsGosh)) == depsKey {
+			t.Log(fName)
+			t.Errorf("\t: the shebang cache key should have changed")
+		}
+
+		writeFile(fName, "a")
+	}
+}
+
+func TestAddShebangDep(t *testing.T) {
+	dir1 := t.TempDir()
+	dir2 := t.TempDir()
+
+	g := mkTestGosh()
+
+	t.Chdir(dir1)
+	g.addShebangDep("snippet")
+	g.addShebangDep("snippet")
+
+	t.Chdir(dir2)
+	g.addShebangDep("snippet")
+
+	testhelper.DiffStringSlice(t, "addShebangDep", "deps", g.shebangDeps,
+		[]string{
+			filepath.Join(dir1, "snippet"),
+			filepath.Join(dir2, "snippet"),
+		})
+}
+
+func TestShebangCacheInfoMatches(t *testing.T) {
+	const info = shebangInfoScript + " abc /a/script\n"
+
+	testCases := []struct {
+		testhelper.ID
+		cachedInfo *string
+		expMatch   bool
+	}{
+		{
+			ID:       testhelper.MkID("no info"),
+			expMatch: true,
+		},
+		{
+			ID:         testhelper.MkID("same info"),
+			cachedInfo: &[]string{info}[0],
+			expMatch:   true,
+		},
+		{
+			ID:         testhelper.MkID("different info"),
+			cachedInfo: &[]string{shebangInfoScript + " def /a/script\n"}[0],
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(func(g *gosh) {
+			g.buildCacheDir = t.TempDir()
+			g.buildCacheKey = "key"
+			g.shebangCacheInfo = info
+		})
+
+		if tc.cachedInfo != nil {
+			if err := os.MkdirAll(g.buildCacheEntryDir(), 0o700); err != nil {
+				t.Fatal("Cannot make the cache entry:", err)
+			}
+
+			if err := os.WriteFile(
+				filepath.Join(g.buildCacheEntryDir(), shebangCacheInfoFile),
+				[]byte(*tc.cachedInfo), 0o600); err != nil {
+				t.Fatal("Cannot write the shebang info:", err)
+			}
+		}
+
+		testhelper.DiffBool(t, tc.IDStr(), "matches",
+			g.shebangCacheInfoMatches(""), tc.expMatch)
+	}
+}
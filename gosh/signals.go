@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// signalExitBase is added to the number of the signal that ended the
+// program to give the gosh exit status. This follows the shell convention
+// so that gosh appears to have been ended by the signal.
+const signalExitBase = 128
+
+// relayedSignals lists the signals which gosh passes on to the generated
+// program while it is running. The program is run in its own process group
+// (see setProcGroup) so it only gets these signals through gosh.
+var relayedSignals = []os.Signal{
+	os.Interrupt,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+}
+
+// relaySignals passes any of the relayed signals that gosh receives on to
+// the process until the returned func is called. While the signals are
+// being relayed they will not end gosh and so it can still clean up.
+func relaySignals(p *os.Process) func() {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+
+	signal.Notify(sigs, relayedSignals...)
+
+	go func() {
+		for {
+			select {
+			case s := <-sigs:
+				_ = p.Signal(s)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// termSignal returns the signal that ended the process and true or, if the
+// process was not ended by a signal, false
+func termSignal(ps *os.ProcessState) (syscall.Signal, bool) {
+	ws, ok := ps.Sys().(interface {
+		Signaled() bool
+		Signal() syscall.Signal
+	})
+	if !ok || !ws.Signaled() {
+		return 0, false
+	}
+
+	return ws.Signal(), true
+}
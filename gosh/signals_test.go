@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestRelaySignals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals cannot be relayed on Windows")
+	}
+
+	sleepCmd, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("the sleep command is not available")
+	}
+
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal("Cannot find the test process:", err)
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		sig syscall.Signal
+	}{
+		{ID: testhelper.MkID("interrupt"), sig: syscall.SIGINT},
+		{ID: testhelper.MkID("terminate"), sig: syscall.SIGTERM},
+		{ID: testhelper.MkID("hangup"), sig: syscall.SIGHUP},
+		{ID: testhelper.MkID("quit"), sig: syscall.SIGQUIT},
+	}
+
+	for _, tc := range testCases {
+		cmd := exec.Command(sleepCmd, "60")
+		if err := cmd.Start(); err != nil {
+			t.Fatal("Cannot start the command:", err)
+		}
+
+		stop := relaySignals(cmd.Process)
+
+		if err := self.Signal(tc.sig); err != nil {
+			t.Fatal("Cannot signal the test process:", err)
+		}
+
+		waitErr := make(chan error, 1)
+		go func() { waitErr <- cmd.Wait() }()
+
+		select {
+		case <-waitErr:
+		case <-time.After(10 * time.Second):
+			_ = cmd.Process.Kill()
+			<-waitErr
+
+			stop()
+
+			t.Log(tc.IDStr())
+			t.Error("\t: the signal was not relayed")
+
+			continue
+		}
+
+		stop()
+
+		sig, ok := termSignal(cmd.ProcessState)
+		if !ok {
+			t.Log(tc.IDStr())
+			t.Error("\t: the command was not ended by a signal")
+
+			continue
+		}
+
+		testhelper.DiffInt(t, tc.IDStr(), "signal", int(sig), int(tc.sig))
+	}
+}
+
+// TestInterruptGosh runs the test binary as gosh (see TestMain) and sends
+// an interrupt to the gosh process. The program is in its own process
+// group so it only gets the signal if gosh relays it.
+func TestInterruptGosh(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals cannot be relayed on Windows")
+	}
+
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("the go command is not available")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal("Cannot find the test executable:", err)
+	}
+
+	cmd := exec.Command(self,
+		"-dont-populate-imports", "-import", "fmt", "-import", "time",
+		"-e", `fmt.Println("ready"); time.Sleep(time.Minute)`)
+	cmd.Dir = t.TempDir()
+	cmd.Env = append(os.Environ(),
+		envTestRunGosh+"=true",
+		"XDG_CONFIG_HOME="+t.TempDir(),
+		"XDG_CONFIG_DIRS="+t.TempDir(),
+		xdgStateHomeEnvVar+"="+t.TempDir())
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal("Cannot get the standard output of gosh:", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal("Cannot start gosh:", err)
+	}
+
+	ready := make(chan bool, 1)
+	go func() {
+		s := bufio.NewScanner(stdout)
+		ready <- s.Scan() && s.Text() == "ready"
+	}()
+
+	select {
+	case ok := <-ready:
+		if !ok {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+
+			t.Fatal("the program did not start")
+		}
+	case <-time.After(2 * time.Minute):
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+
+		t.Fatal("the program did not start in time")
+	}
+
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal("Cannot interrupt gosh:", err)
+	}
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- cmd.Wait() }()
+
+	select {
+	case err = <-waitErr:
+	case <-time.After(30 * time.Second):
+		_ = cmd.Process.Kill()
+		<-waitErr
+
+		t.Fatal("gosh did not stop after the interrupt")
+	}
+
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		t.Fatal("gosh should have failed, err:", err)
+	}
+
+	testhelper.DiffInt(t, "interrupted gosh", "exit status",
+		ee.ExitCode(), signalExitBase+int(syscall.SIGINT))
+}
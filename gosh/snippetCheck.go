@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/nickwells/gogen.mod/gogen"
+	"github.com/nickwells/verbose.mod/verbose"
+)
+
+var (
+	// undefinedRE matches the compiler error for an undefined, unqualified
+	// name. Snippets can refer to variables which the user must provide,
+	// these are not errors in the snippet if the snippet declares them.
+	undefinedRE = regexp.MustCompile(`^undefined: ([\pL_][\pL\pN_]*)$`)
+
+	// notUsedRE matches the compiler error for a variable that is not
+	// used. Snippets can declare variables for the user to use, these are
+	// not errors in the snippet.
+	notUsedRE = regexp.MustCompile(`^declared and not used: `)
+)
+
+// snippetCheckResult records the outcome of checking a group of snippets.
+// The declared names are those the snippets say the user must provide and
+// the externals are those of them which the snippets use.
+type snippetCheckResult struct {
+	names     []string
+	problems  []string
+	declared  []string
+	externals []string
+	syntaxErr bool
+}
+
+// broken returns true if any problems were found with the snippets
+func (r snippetCheckResult) broken() bool {
+	return len(r.problems) > 0
+}
+
+// addExternal records a name that the snippets expect the user to provide
+func (r *snippetCheckResult) addExternal(name string) {
+	if !slices.Contains(r.externals, name) {
+		r.externals = append(r.externals, name)
+	}
+}
+
+// checkSnippets checks the snippets in the snippet directories, if
+// requested, by building each snippet in a minimal program and reporting
+// any errors. The program will exit after the check is complete.
+func checkSnippets(g *gosh, slp *snippetListParams) {
+	if !slp.checkSnippets {
+		return
+	}
+
+	names, err := findSnippets(g.snippetDirs)
+	g.reportFatalError("find the snippets", "", err)
+
+	groups, results := g.snippetCheckGroups(names)
+
+	for _, grp := range groups {
+		results = append(results, g.checkSnippetGroup(grp))
+	}
+
+	broken := 0
+
+	for _, r := range results {
+		if r.broken() {
+			broken++
+		}
+
+		reportSnippetCheck(r)
+	}
+
+	fmt.Printf("%d snippet groups checked, %d broken\n", len(results), broken)
+
+	if broken > 0 {
+		os.Exit(goshExitStatusSnippetCheck)
+	}
+
+	os.Exit(0)
+}
+
+// reportSnippetCheck prints the result of checking the snippets
+func reportSnippetCheck(r snippetCheckResult) {
+	status := "OK"
+	if r.broken() {
+		status = "BROKEN"
+	}
+
+	fmt.Printf("%s: %s", status, strings.Join(r.names, ", "))
+
+	if len(r.externals) > 0 {
+		fmt.Printf(" (expects: %s)", strings.Join(r.externals, ", "))
+	}
+
+	fmt.Println()
+
+	for _, p := range r.problems {
+		fmt.Println("\t" + p)
+	}
+}
+
+// isSnippetFile returns true if the named file should be treated as a
+// snippet. Hidden files and any copies of the original snippet made when
+// the snippets were installed are ignored.
+func isSnippetFile(name string) bool {
+	return !strings.HasPrefix(name, ".") &&
+		!strings.HasSuffix(name, ".orig") &&
+		!strings.Contains(name, ".orig.")
+}
+
+// findSnippets returns the names of all the snippets in the snippet
+// directories. If the same name appears in more than one directory it is
+// only given once, as the snippet in the first directory hides the others.
+func findSnippets(dirs []string) ([]string, error) {
+	names := []string{}
+
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir,
+			func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					if path == dir && errors.Is(err, fs.ErrNotExist) {
+						return fs.SkipDir
+					}
+
+					return err
+				}
+
+				if !isSnippetFile(d.Name()) && path != dir {
+					if d.IsDir() {
+						return fs.SkipDir
+					}
+
+					return nil
+				}
+
+				if !d.Type().IsRegular() {
+					return nil
+				}
+
+				rel, err := filepath.Rel(dir, path)
+				if err != nil {
+					return err
+				}
+
+				name := filepath.ToSlash(rel)
+				if !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	slices.Sort(names)
+
+	return names, nil
+}
+
+// snippetCheckGroups caches the named snippets and splits them into groups
+// that must be checked together. Snippets which refer to each other
+// through Follows or Expects comments are in the same group and the group
+// is ordered so that each snippet comes after those it follows. Any
+// snippets which cannot be grouped are returned as broken results.
+func (g *gosh) snippetCheckGroups(
+	names []string,
+) ([][]string, []snippetCheckResult) {
+	var results []snippetCheckResult
+
+	group := map[string]int{}
+	follows := map[string][]string{}
+
+	for i, name := range names {
+		group[name] = i
+	}
+
+	merge := func(from, to int) {
+		for n, grp := range group {
+			if grp == from {
+				group[n] = to
+			}
+		}
+	}
+
+	for _, name := range names {
+		if err := g.CacheSnippet(name); err != nil {
+			results = append(results, snippetCheckResult{
+				names:    []string{name},
+				problems: []string{err.Error()},
+			})
+			delete(group, name)
+
+			continue
+		}
+
+		s, _ := g.snippets.Get(name)
+		follows[name] = s.Follows()
+
+		for _, other := range slices.Concat(s.Follows(), s.Expects()) {
+			if _, ok := group[other]; ok {
+				merge(group[other], group[name])
+			}
+		}
+	}
+
+	var groups [][]string
+
+	for _, name := range names {
+		grp, ok := group[name]
+		if !ok || grp < 0 {
+			continue
+		}
+
+		var members []string
+
+		for _, n := range names {
+			if nGrp, ok := group[n]; ok && nGrp == grp {
+				members = append(members, n)
+				group[n] = -1
+			}
+		}
+
+		groups = append(groups, orderSnippets(members, follows))
+	}
+
+	return groups, results
+}
+
+// orderSnippets returns the snippets ordered so that each snippet comes
+// after the snippets that it follows. Otherwise the order is unchanged.
+func orderSnippets(names []string, follows map[string][]string) []string {
+	ordered := make([]string, 0, len(names))
+	done := map[string]bool{}
+
+	for len(ordered) < len(names) {
+		added := false
+
+		for _, name := range names {
+			if done[name] {
+				continue
+			}
+
+			if slices.ContainsFunc(follows[name], func(f string) bool {
+				return slices.Contains(names, f) && !done[f]
+			}) {
+				continue
+			}
+
+			ordered = append(ordered, name)
+			done[name] = true
+			added = true
+
+			break
+		}
+
+		if !added { // the Follows comments form a loop
+			for _, name := range names {
+				if !done[name] {
+					ordered = append(ordered, name)
+					done[name] = true
+				}
+			}
+		}
+	}
+
+	return ordered
+}
+
+// checkSnippetGroup checks the group of snippets. They are first checked in
+// the exec section of a program running in a read-loop and, if that gives
+// syntax errors, in the global section.
+func (g *gosh) checkSnippetGroup(names []string) snippetCheckResult {
+	defer g.dbgStack.Start("checkSnippetGroup",
+		"Checking: "+strings.Join(names, ", "))()
+
+	r := g.buildSnippetCheck(names, execSect)
+	if r.syntaxErr {
+		verbose.Println(g.dbgStack.Tag(),
+			" Syntax errors, checking in the global section")
+
+		if rg := g.buildSnippetCheck(names, globalSect); !rg.syntaxErr {
+			return rg
+		}
+	}
+
+	return r
+}
+
+// snippetCheckArg caches the snippet and returns the value to use for
+// the snippet entry and the names the snippet expects the user to
+// provide. Any snippet parameters without a default value are given the
+// parameter name as their value and so the parameter names are expected as
+// are any defaults which are names and any names given in the
+// snippetExpectsVarTag tags.
+func (g *gosh) snippetCheckArg(name string) (string, []string, error) {
+	if err := g.CacheSnippet(name); err != nil {
+		return "", nil, err
+	}
+
+	s, err := g.snippets.Get(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	params, err := snippetParams(s)
+	if err != nil {
+		return "", nil, err
+	}
+
+	arg := name
+	expected := snippetExpectedVars(s)
+
+	for _, sp := range params {
+		if !sp.hasDflt {
+			arg += snippetArgSep + sp.name + "=" + sp.name
+			expected = append(expected, sp.name)
+		} else if token.IsIdentifier(sp.dflt) {
+			expected = append(expected, sp.dflt)
+		}
+	}
+
+	return arg, expected, nil
+}
+
+// buildSnippetCheck builds a program holding the snippets in the given
+// section and returns the problems found.
+func (g *gosh) buildSnippetCheck(
+	names []string, sect string,
+) snippetCheckResult {
+	intro := g.dbgStack.Tag()
+	r := snippetCheckResult{names: names}
+
+	cg := newGosh()
+	cg.dbgStack = g.dbgStack
+	cg.snippetDirs = g.snippetDirs
+	cg.localModules = g.localModules
+	cg.workspace = g.workspace
+	cg.baseTempDir = g.baseTempDir
+	cg.dontRunGoModTidy = g.dontRunGoModTidy
+	cg.dontPopulateImports = g.dontPopulateImports
+	cg.importPopulator = g.importPopulator
+	cg.importPopulatorSet = g.importPopulatorSet
+	cg.importPopulatorArgs = g.importPopulatorArgs
+	cg.ignoreGoModTidyErrs = true
+	cg.runInReadLoop = sect == execSect
+
+	for _, name := range names {
+		arg, expected, err := cg.snippetCheckArg(name)
+		if err != nil {
+			r.problems = append(r.problems, err.Error())
+			continue
+		}
+
+		r.declared = append(r.declared, expected...)
+
+		cg.addScriptEntryFrom(sect, arg, snippetExpand,
+			cg.snippetOrigin(name))
+	}
+
+	if r.broken() {
+		return r
+	}
+
+	cg.createGoshTmpDir()
+
+	defer func() {
+		cg.chdirInto(g.runDir)
+
+		err := os.RemoveAll(cg.goshDir)
+		g.reportFatalError("remove the gosh directory", cg.goshDir, err)
+	}()
+
+	cg.writeGoFile()
+
+	if cg.errMap.HasErrors() {
+		var errs bytes.Buffer
+
+		cg.errMap.Report(&errs, "gosh")
+		r.problems = append(r.problems, strings.TrimSpace(errs.String()))
+
+		return r
+	}
+
+	if out := parseErrors(goshFilename); len(out) > 0 {
+		r.syntaxErr = true
+		cg.addSnippetCheckProblems(&r, out, nil)
+
+		return r
+	}
+
+	cg.populateImports()
+	cg.tidyModule()
+
+	out, err := snippetCheckCmd(intro,
+		"build", "-gcflags=-e", "-o", os.DevNull, ".")
+	cg.addSnippetCheckProblems(&r, out, err)
+
+	if err == nil && !r.broken() {
+		out, err = snippetCheckCmd(intro, "vet", ".")
+		cg.addSnippetCheckProblems(&r, out, err)
+	}
+
+	return r
+}
+
+// parseErrors parses the named file and returns any syntax errors in the
+// same form as the compiler reports them. The file is parsed before the
+// imports are populated as the import populator will fail if there are
+// syntax errors.
+func parseErrors(fileName string) []byte {
+	_, err := parser.ParseFile(token.NewFileSet(), fileName, nil,
+		parser.AllErrors)
+
+	var errList scanner.ErrorList
+	if !errors.As(err, &errList) {
+		return nil
+	}
+
+	var out bytes.Buffer
+
+	for _, e := range errList {
+		out.WriteString(e.Error() + "\n")
+	}
+
+	return out.Bytes()
+}
+
+// snippetCheckCmd runs the go command with the given arguments and returns
+// the standard error
+func snippetCheckCmd(intro string, args ...string) ([]byte, error) {
+	verbose.Println(intro, " Command: go "+strings.Join(args, " "))
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(gogen.GetGoCmdName(), args...) //nolint:gosec
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	return stderr.Bytes(), err
+}
+
+// addSnippetCheckProblems adds any problems reported in the command output
+// to the result. Errors caused by names which the snippets declare that
+// the user must provide are not problems but any other undefined names in
+// the snippets are.
+func (g *gosh) addSnippetCheckProblems(
+	r *snippetCheckResult, out []byte, cmdErr error,
+) {
+	var (
+		kept     bytes.Buffer
+		keepNext bool
+		diags    int
+	)
+
+	for line := range strings.Lines(string(out)) {
+		if strings.HasPrefix(line, "\t") {
+			if keepNext {
+				kept.WriteString(line)
+			}
+
+			continue
+		}
+
+		keepNext = false
+
+		m := buildErrRE.FindStringSubmatch(strings.TrimRight(line, "\n"))
+		if m == nil {
+			continue
+		}
+
+		diags++
+
+		msg := m[5]
+		if um := undefinedRE.FindStringSubmatch(msg); um != nil {
+			// an undefined name in the gosh code is a missing import
+			// that the import populator would have added
+			if string(g.mapBuildErrors([]byte(line))) == line {
+				continue
+			}
+
+			if slices.Contains(r.declared, um[1]) {
+				r.addExternal(um[1])
+				continue
+			}
+		}
+
+		if notUsedRE.MatchString(msg) {
+			continue
+		}
+
+		kept.WriteString(line)
+
+		keepNext = true
+	}
+
+	for l := range strings.Lines(string(g.mapBuildErrors(kept.Bytes()))) {
+		r.problems = append(r.problems, strings.TrimRight(l, "\n"))
+	}
+
+	if cmdErr != nil && diags == 0 {
+		r.problems = append(r.problems,
+			strings.TrimSpace(cmdErr.Error()+"\n"+string(out)))
+	}
+}
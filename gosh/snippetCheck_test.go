@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/nickwells/gogen.mod/gogen"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// writeTestSnippets writes the snippets into the directory
+func writeTestSnippets(t *testing.T, dir string, snippets map[string]string) {
+	t.Helper()
+
+	for name, content := range snippets {
+		fName := filepath.Join(dir, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(fName), 0o700); err != nil {
+			t.Fatal("Cannot make the snippet directory:", err)
+		}
+
+		if err := os.WriteFile(fName, []byte(content), 0o600); err != nil {
+			t.Fatal("Cannot write the snippet:", err)
+		}
+	}
+}
+
+func TestFindSnippets(t *testing.T) {
+	dir1 := t.TempDir()
+	dir2 := t.TempDir()
+
+	writeTestSnippets(t, dir1, map[string]string{
+		"a":            "",
+		"a.orig":       "",
+		"a.orig.12345": "",
+		".hidden":      "",
+		".git/x":       "",
+		"grp/1-init":   "",
+		"grp/2-end":    "",
+	})
+	writeTestSnippets(t, dir2, map[string]string{
+		"a": "",
+		"b": "",
+	})
+
+	names, err := findSnippets(
+		[]string{dir1, dir2, filepath.Join(dir1, "nonesuch")})
+	if err != nil {
+		t.Fatal("Cannot find the snippets:", err)
+	}
+
+	testhelper.DiffStringSlice(t, "findSnippets", "names", names,
+		[]string{"a", "b", "grp/1-init", "grp/2-end"})
+}
+
+func TestSnippetCheckGroups(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTestSnippets(t, dir, map[string]string{
+		"solo":    "x := 1\n",
+		"t/3-end": "// snippet: Follows: t/2-mid\n}\n",
+		"t/2-mid": "// snippet: Follows: t/1-init\n{\n",
+		"t/1-init": "// snippet: Expects: t/3-end\n" +
+			"var __t int\n",
+	})
+
+	g := mkTestGosh(func(g *gosh) { g.snippetDirs = []string{dir} })
+
+	groups, results := g.snippetCheckGroups(
+		[]string{"solo", "t/3-end", "t/2-mid", "t/1-init"})
+
+	testhelper.DiffInt(t, "snippetCheckGroups", "broken results",
+		len(results), 0)
+
+	if err := testhelper.DiffVals(groups, [][]string{
+		{"solo"},
+		{"t/1-init", "t/2-mid", "t/3-end"},
+	}); err != nil {
+		t.Log("snippetCheckGroups")
+		t.Errorf("\t: %s", err)
+	}
+}
+
+func TestCheckSnippetGroup(t *testing.T) {
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is not available")
+	}
+
+	origGoCmd := gogen.GetGoCmdName()
+	if err := gogen.SetGoCmdName(goCmd); err != nil {
+		t.Fatal("Cannot set the go command:", err)
+	}
+
+	t.Cleanup(func() { _ = gogen.SetGoCmdName(origGoCmd) })
+
+	t.Setenv("GOFLAGS", "")
+	t.Setenv("GOWORK", "off")
+	t.Chdir(t.TempDir())
+
+	dir := t.TempDir()
+
+	writeTestSnippets(t, dir, map[string]string{
+		"good": "// snippet: Tag: Param: n the value\n" +
+			"// snippet: Tag: ExpectsVar: total the running total\n" +
+			"total += {{n}}\n",
+		"dflt": "// snippet: Tag: Param: n=count the value\n" +
+			"_ = {{n}}\n",
+		"undeclared": "// snippet: Tag: ExpectsVar: total the running total\n" +
+			"total += count\n",
+		"global": "func __f() int {\n" +
+			"\treturn 1\n" +
+			"}\n",
+		"bad": "x := 1\n" +
+			"x = \"s\"\n",
+	})
+
+	testCases := []struct {
+		testhelper.ID
+		names        []string
+		expProblems  []string
+		expExternals []string
+	}{
+		{
+			ID:           testhelper.MkID("good"),
+			names:        []string{"good"},
+			expExternals: []string{"total", "n"},
+		},
+		{
+			ID:           testhelper.MkID("default name"),
+			names:        []string{"dflt"},
+			expExternals: []string{"count"},
+		},
+		{
+			ID:    testhelper.MkID("undeclared"),
+			names: []string{"undeclared"},
+			expProblems: []string{
+				`error in snippet "` + filepath.Join(dir, "undeclared") +
+					`", line 2 (col 10): undefined: count`,
+			},
+			expExternals: []string{"total"},
+		},
+		{
+			ID:    testhelper.MkID("global"),
+			names: []string{"global"},
+		},
+		{
+			ID:    testhelper.MkID("bad"),
+			names: []string{"bad"},
+			expProblems: []string{
+				`error in snippet "` + filepath.Join(dir, "bad") + `",` +
+					` line 2 (col 5): cannot use "s" (untyped string` +
+					` constant) as int value in assignment`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(func(g *gosh) {
+			g.snippetDirs = []string{dir}
+			g.dontRunGoModTidy = true
+			g.dontPopulateImports = true
+		})
+
+		r := g.checkSnippetGroup(tc.names)
+
+		testhelper.DiffStringSlice(t, tc.IDStr(), "problems",
+			r.problems, tc.expProblems)
+		testhelper.DiffStringSlice(t, tc.IDStr(), "externals",
+			r.externals, tc.expExternals)
+	}
+}
@@ -17,12 +17,14 @@ const (
 	paramNameSnippetListPart       = "snippet-list-part"
 	paramNameSnippetListTag        = "snippet-list-tag"
 	paramNameSnippetListDir        = "snippet-list-dir"
+	paramNameSnippetCheck          = "snippet-check"
 )
 
 // snippetListParams holds the values needed to configure the snippet list
 type snippetListParams struct {
-	listSnippets bool
-	listDirs     bool
+	listSnippets  bool
+	listDirs      bool
+	checkSnippets bool
 
 	constraints []string
 	parts       []string
@@ -30,6 +32,16 @@ type snippetListParams struct {
 	hideIntro   bool
 }
 
+// listTags returns the tags to show when listing the snippets. The snippet
+// parameters are always shown.
+func (slp snippetListParams) listTags() []string {
+	if slices.Contains(slp.tags, snippetParamTag) {
+		return slp.tags
+	}
+
+	return append(slices.Clone(slp.tags), snippetParamTag)
+}
+
 // addSnippetListParams returns a func that will add parameters concerned
 // with listing snippets to the passed param.PSet. Parameter values are set
 // in the supplied snippetListParams
@@ -130,6 +142,32 @@ func addSnippetListParams(slp *snippetListParams) func(ps *param.PSet) error {
 			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
 		)
 
+		ps.Add(paramNameSnippetCheck, psetter.Bool{Value: &slp.checkSnippets},
+			"check all the available snippets and exit, no program is"+
+				" run. Each snippet is built in a minimal program with"+
+				" its declared imports, snippets which follow or expect"+
+				" one another are built together, in order. Any"+
+				" compiler or vet errors are reported against the"+
+				" snippet file and line."+
+				"\n\n"+
+				"Names which a snippet uses but which are not defined"+
+				" are errors unless the snippet declares that the user"+
+				" must provide them, with an '"+snippetExpectsVarTag+"'"+
+				" tag. These are reported as expected rather than as"+
+				" errors. Any snippet parameters without a default"+
+				" value, and any defaults which are names, are treated"+
+				" in the same way."+
+				"\n\n"+
+				"If any snippets are broken gosh exits with a non-zero"+
+				" exit status so this can be used to check a shared"+
+				" snippet directory.",
+			param.GroupName(snippetListParamGroup),
+			param.AltNames("snippets-check", "s-c"),
+			param.SeeAlso(paramNameSnippetList, paramNameSnippetDir),
+			param.SeeNote(noteGoshExitStatus),
+			param.Attrs(param.CommandLineOnly|param.DontShowInStdUsage),
+		)
+
 		return nil
 	}
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/nickwells/snippet.mod/snippet"
+)
+
+const (
+	// snippetParamTag is the name of the snippet tag which declares a
+	// snippet parameter. The tag value is the parameter name, optionally
+	// followed by '=' and a default value, and then a description. For
+	// instance:
+	//
+	//     // snippet: Tag: Param: num=a the value to show
+	snippetParamTag = "Param"
+
+	// snippetExpectsVarTag is the name of the snippet tag which declares a
+	// variable that the snippet uses but which the user must provide. The
+	// tag value is the variable name followed by a description. For
+	// instance:
+	//
+	//     // snippet: Tag: ExpectsVar: total the running total
+	snippetExpectsVarTag = "ExpectsVar"
+
+	// snippetArgSep separates the snippet name and the parameter values
+	// given on the command line
+	snippetArgSep = ","
+)
+
+// snippetParam holds the details of a parameter declared by a snippet
+type snippetParam struct {
+	name    string
+	dflt    string
+	hasDflt bool
+}
+
+// placeholder returns the text in the snippet which is replaced by the
+// parameter value
+func (sp snippetParam) placeholder() string {
+	return "{{" + sp.name + "}}"
+}
+
+// snippetParams returns the parameters declared by the snippet
+func snippetParams(s *snippet.S) ([]snippetParam, error) {
+	params := []snippetParam{}
+
+	for _, decl := range s.Tags()[snippetParamTag] {
+		nameVal, _, _ := strings.Cut(strings.TrimSpace(decl), " ")
+
+		var sp snippetParam
+
+		sp.name, sp.dflt, sp.hasDflt = strings.Cut(nameVal, "=")
+		if !token.IsIdentifier(sp.name) {
+			return nil, fmt.Errorf("bad snippet parameter name: %q", sp.name)
+		}
+
+		if slices.ContainsFunc(params,
+			func(p snippetParam) bool { return p.name == sp.name }) {
+			return nil, fmt.Errorf("snippet parameter %q is declared twice",
+				sp.name)
+		}
+
+		params = append(params, sp)
+	}
+
+	return params, nil
+}
+
+// snippetExpectedVars returns the names of the variables which the
+// snippet declares that the user must provide
+func snippetExpectedVars(s *snippet.S) []string {
+	names := []string{}
+
+	for _, decl := range s.Tags()[snippetExpectsVarTag] {
+		name, _, _ := strings.Cut(strings.TrimSpace(decl), " ")
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// snippetArgNameRE matches a snippet parameter name followed by '=' at the
+// start of a snippet parameter value
+var snippetArgNameRE = regexp.MustCompile(`^[\pL_][\pL\pN_]*=`)
+
+// isSnippetArgStart returns true if the text starts with a snippet
+// parameter name followed by '=' but not by '==' (which would be part of a
+// value).
+func isSnippetArgStart(s string) bool {
+	m := snippetArgNameRE.FindString(s)
+
+	return m != "" && !strings.HasPrefix(s[len(m):], "=")
+}
+
+// splitSnippetVals splits the text into the name=value pairs. A pair only
+// ends at a comma which is followed by the start of the next pair so that
+// the values can contain commas (as in "num=f(a,b)" or `den=m["x,y"]`).
+func splitSnippetVals(s string) []string {
+	parts := []string{}
+	start := 0
+
+	for i := range len(s) {
+		if strings.HasPrefix(s[i:], snippetArgSep) &&
+			isSnippetArgStart(s[i+len(snippetArgSep):]) {
+			parts = append(parts, s[start:i])
+			start = i + len(snippetArgSep)
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// splitSnippetArg splits the value given to a snippet parameter into the
+// snippet name and the values for any snippet parameters. The values are
+// given after the name as a comma-separated list of name=value pairs.
+func splitSnippetArg(v string) (string, map[string]string, error) {
+	sName, rest, hasVals := strings.Cut(v, snippetArgSep)
+	vals := map[string]string{}
+
+	if !hasVals {
+		return sName, vals, nil
+	}
+
+	for _, part := range splitSnippetVals(rest) {
+		name, val, ok := strings.Cut(part, "=")
+		if !ok || name == "" {
+			return "", nil,
+				fmt.Errorf("bad snippet parameter value: %q"+
+					" (it should be of the form name=value)", part)
+		}
+
+		if _, dup := vals[name]; dup {
+			return "", nil,
+				fmt.Errorf("snippet parameter %q is given twice", name)
+		}
+
+		vals[name] = val
+	}
+
+	return sName, vals, nil
+}
+
+// cacheSnippetArg caches the snippet named in the value given to a snippet
+// parameter and returns the snippet name.
+func (g *gosh) cacheSnippetArg(v string) (string, error) {
+	sName, _, err := splitSnippetArg(v)
+	if err != nil {
+		return "", err
+	}
+
+	return sName, g.CacheSnippet(sName)
+}
+
+// substSnippetParams returns a copy of the snippet text with the parameter
+// placeholders replaced by the given values or the parameter defaults. Any
+// parameters which are not given and have no default and any values given
+// for parameters which the snippet does not declare are reported as errors.
+func substSnippetParams(
+	text []string, params []snippetParam, vals map[string]string,
+) ([]string, error) {
+	var errs []error
+
+	r := []string{}
+
+	for _, sp := range params {
+		v, ok := vals[sp.name]
+		if !ok {
+			if !sp.hasDflt {
+				errs = append(errs,
+					fmt.Errorf("no value given for snippet parameter %q",
+						sp.name))
+
+				continue
+			}
+
+			v = sp.dflt
+		}
+
+		r = append(r, sp.placeholder(), v)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(vals)) {
+		if !slices.ContainsFunc(params,
+			func(p snippetParam) bool { return p.name == name }) {
+			errs = append(errs,
+				fmt.Errorf("unknown snippet parameter: %q", name))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if len(r) == 0 {
+		return text, nil
+	}
+
+	replacer := strings.NewReplacer(r...)
+
+	subst := make([]string, 0, len(text))
+	for _, l := range text {
+		subst = append(subst, replacer.Replace(l))
+	}
+
+	return subst, nil
+}
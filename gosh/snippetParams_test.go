@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/nickwells/errutil.mod/errutil"
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestSplitSnippetArg(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		testhelper.ExpErr
+		arg     string
+		expName string
+		expVals map[string]string
+	}{
+		{
+			ID:      testhelper.MkID("no params"),
+			arg:     "perc",
+			expName: "perc",
+			expVals: map[string]string{},
+		},
+		{
+			ID:      testhelper.MkID("params"),
+			arg:     "perc,num=hits,den=len(s)",
+			expName: "perc",
+			expVals: map[string]string{"num": "hits", "den": "len(s)"},
+		},
+		{
+			ID:      testhelper.MkID("values with commas"),
+			arg:     `perc,num=f(a,b),den=m["x,y"]`,
+			expName: "perc",
+			expVals: map[string]string{"num": "f(a,b)", "den": `m["x,y"]`},
+		},
+		{
+			ID:      testhelper.MkID("value with a comparison"),
+			arg:     "perc,num=f(a,b==c),den=1",
+			expName: "perc",
+			expVals: map[string]string{"num": "f(a,b==c)", "den": "1"},
+		},
+		{
+			ID:      testhelper.MkID("empty value"),
+			arg:     "perc,num=,den=1",
+			expName: "perc",
+			expVals: map[string]string{"num": "", "den": "1"},
+		},
+		{
+			ID:  testhelper.MkID("bad param"),
+			arg: "perc,num",
+			ExpErr: testhelper.MkExpErr(`bad snippet parameter value: "num"`,
+				"it should be of the form name=value"),
+		},
+		{
+			ID:  testhelper.MkID("bad param before a value"),
+			arg: "perc,num,den=1",
+			ExpErr: testhelper.MkExpErr(`bad snippet parameter value: "num"`,
+				"it should be of the form name=value"),
+		},
+		{
+			ID:     testhelper.MkID("repeated param"),
+			arg:    "perc,num=a,num=b",
+			ExpErr: testhelper.MkExpErr(`snippet parameter "num" is given twice`),
+		},
+	}
+
+	for _, tc := range testCases {
+		name, vals, err := splitSnippetArg(tc.arg)
+		if testhelper.CheckExpErr(t, err, tc) && err == nil {
+			testhelper.DiffString(t, tc.IDStr(), "name", name, tc.expName)
+
+			if err := testhelper.DiffVals(vals, tc.expVals); err != nil {
+				t.Log(tc.IDStr())
+				t.Errorf("\t: %s", err)
+			}
+		}
+	}
+}
+
+func TestSnippetExpandParams(t *testing.T) {
+	const sName = "sParams"
+
+	sPath := filepath.Join("testdata", snippetsDir, sName)
+
+	testCases := []struct {
+		testhelper.ID
+		arg     string
+		expText string
+		expErr  string
+	}{
+		{
+			ID:      testhelper.MkID("value and default"),
+			arg:     sName + ",x=a",
+			expText: "z := a + 2 + a",
+		},
+		{
+			ID:      testhelper.MkID("both values"),
+			arg:     sName + ",x=a,y=b[0]",
+			expText: "z := a + b[0] + a",
+		},
+		{
+			ID:  testhelper.MkID("missing and unknown"),
+			arg: sName + ",w=1",
+			expErr: `snippet "sParams":` +
+				` no value given for snippet parameter "x"` + "\n" +
+				`unknown snippet parameter: "w"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		g := mkTestGosh(func(g *gosh) {
+			g.snippetDirs = []string{filepath.Join("testdata", snippetsDir)}
+		})
+
+		if _, err := g.cacheSnippetArg(tc.arg); err != nil {
+			t.Fatal("Cannot cache the snippet:", err)
+		}
+
+		content, err := snippetExpand(g, tc.arg)
+		if err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: unexpected error: %v", err)
+
+			continue
+		}
+
+		expErrs := errutil.ErrMap{}
+		if tc.expErr != "" {
+			expErrs.AddError("Snippet parameters", errors.New(tc.expErr))
+		}
+
+		if err := g.errMap.Matches(expErrs); err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: unexpected errors: %v", err)
+		}
+
+		if tc.expErr != "" {
+			testhelper.DiffInt(t, tc.IDStr(), "content lines", len(content), 0)
+			continue
+		}
+
+		testhelper.DiffStringSlice(t, tc.IDStr(), "content", content,
+			[]string{
+				"//" + goshCommentIntro + "snippet : BEGIN " + tc.arg,
+				"// " + sPath,
+				tc.expText,
+				"//" + goshCommentIntro + "snippet : END",
+			})
+	}
+}
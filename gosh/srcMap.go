@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nickwells/param.mod/v7/param"
+)
+
+// alignLookahead is the maximum number of lines of the program as written
+// that will be searched for a line matching the next line of the final
+// program. Lines are added to the program (by the import populator) and
+// removed (by the formatter) after it is written and so the line numbers of
+// the final program are not those of the program as written.
+const alignLookahead = 50
+
+// buildErrRE matches a compiler diagnostic giving the file, line and column
+// of the error
+var buildErrRE = regexp.MustCompile(
+	`^(?:\./)?(` + regexp.QuoteMeta(goshFilename) +
+		`|goshCopy(\d+)[^:]*\.go):(\d+):(\d+): (.*)$`)
+
+// srcOrigin describes where a script entry came from. The firstLine is the
+// line number within the origin of the first line of the expanded entry. If
+// the lineNums are given they hold the line number within the origin of
+// each line of the expanded entry.
+type srcOrigin struct {
+	desc      string
+	firstLine int
+	lineNums  []int
+	showLine  bool
+}
+
+// lineNum returns the line number within the origin of the i'th line of
+// the expanded entry
+func (o srcOrigin) lineNum(i int) int {
+	if i < len(o.lineNums) {
+		return o.lineNums[i]
+	}
+
+	return o.firstLine + i
+}
+
+// srcLoc describes where a line of the generated program came from. The
+// indent is the length of any leading white space on the original line, it
+// is used to correct the column of a compiler error.
+type srcLoc struct {
+	desc     string
+	line     int
+	showLine bool
+	indent   int
+}
+
+// String returns a description of the location
+func (sl srcLoc) String() string {
+	if sl.showLine {
+		return fmt.Sprintf("%s, line %d", sl.desc, sl.line)
+	}
+
+	return sl.desc
+}
+
+// progWriter writes the generated program. It counts the lines written and
+// keeps a copy of the program so that compiler errors can be mapped back to
+// the origin of the code.
+type progWriter struct {
+	f       *os.File
+	lines   int
+	written bytes.Buffer
+}
+
+// Write writes to the program file and records what was written
+func (pw *progWriter) Write(b []byte) (int, error) {
+	n, err := pw.f.Write(b)
+	pw.written.Write(b[:n])
+	pw.lines += bytes.Count(b[:n], []byte("\n"))
+
+	return n, err
+}
+
+// Close closes the program file
+func (pw *progWriter) Close() error {
+	return pw.f.Close()
+}
+
+// paramOrigin returns the origin of a script entry given through the
+// parameter. Each use of a parameter is numbered so that the entry can be
+// identified.
+func (g *gosh) paramOrigin(p *param.BaseParam) srcOrigin {
+	g.paramUses[p.Name()]++
+
+	return srcOrigin{
+		desc:      fmt.Sprintf("-%s #%d", p.Name(), g.paramUses[p.Name()]),
+		firstLine: 1,
+	}
+}
+
+// fileOrigin returns the origin of a script entry taken from the named
+// file. The text is the part of the file used in the entry and is expected
+// to be the end of the file; the line numbers are adjusted to allow for any
+// part of the file which has been removed.
+func fileOrigin(fileName, text string) srcOrigin {
+	o := srcOrigin{
+		desc:      fmt.Sprintf("file %q", fileName),
+		firstLine: 1,
+		showLine:  true,
+	}
+
+	content, err := os.ReadFile(fileName) //nolint:gosec
+	if err == nil && len(content) >= len(text) {
+		o.firstLine += bytes.Count(content[:len(content)-len(text)],
+			[]byte("\n"))
+	}
+
+	return o
+}
+
+// snippetOrigin returns the origin of a script entry holding the named
+// snippet. The snippet must already have been cached. The expanded snippet
+// has two comment lines before the text of the snippet. The snippet file
+// may have lines which are not part of the text and so the line numbers of
+// the text are found by matching the text against the file.
+func (g *gosh) snippetOrigin(sName string) srcOrigin {
+	o := srcOrigin{
+		desc:      fmt.Sprintf("snippet %q", sName),
+		firstLine: -1,
+		showLine:  true,
+	}
+
+	s, err := g.snippets.Get(sName)
+	if err != nil {
+		return o
+	}
+
+	o.desc = fmt.Sprintf("snippet %q", s.Path())
+
+	content, err := os.ReadFile(s.Path())
+	if err != nil {
+		return o
+	}
+
+	o.lineNums = append(o.lineNums, -1, 0)
+	fileLines := strings.Split(string(content), "\n")
+	next := 0
+
+	for _, tl := range s.Text() {
+		for i := next; i < len(fileLines); i++ {
+			if strings.TrimRight(fileLines[i], "\r") == tl {
+				next = i + 1
+				break
+			}
+		}
+
+		o.lineNums = append(o.lineNums, next)
+	}
+
+	return o
+}
+
+// addScriptEntryFrom adds the script entry to the named script recording
+// its origin.
+func (g *gosh) addScriptEntryFrom(
+	sName, v string, ef expandFunc, o srcOrigin,
+) {
+	g.AddScriptEntry(sName, v, ef)
+
+	s := g.scripts[sName]
+	s[len(s)-1].origin = o
+}
+
+// printEntry prints the lines from an expanded script entry, recording the
+// origin of each line written.
+func (g *gosh) printEntry(se scriptEntry, lines []string) {
+	entryLine := 0
+
+	var nLines int
+	for _, s := range lines {
+		nLines += strings.Count(s, "\n") + 1
+	}
+
+	for _, s := range lines {
+		start := g.w.lines
+
+		for i, l := range strings.Split(s, "\n") {
+			if se.origin.desc != "" {
+				g.srcLocs[start+i+1] = srcLoc{
+					desc:     se.origin.desc,
+					line:     se.origin.lineNum(entryLine),
+					showLine: se.origin.showLine || nLines > 1,
+					indent:   len(l) - len(strings.TrimLeft(l, " \t")),
+				}
+			}
+
+			entryLine++
+		}
+
+		g.print(s)
+	}
+}
+
+// squash removes all the white space from the line
+func squash(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+// alignLines returns a map from the line numbers of the final program to
+// the line numbers of the program as written. Blank lines are ignored and
+// lines are compared ignoring white space. A line of the final program that
+// cannot be found in the written program is taken to have been added.
+func alignLines(written, final []string) map[int]int {
+	m := map[int]int{}
+	j := 0
+
+	for i, fl := range final {
+		key := squash(fl)
+		if key == "" {
+			continue
+		}
+
+		for k := j; k < len(written) && k < j+alignLookahead; k++ {
+			if squash(written[k]) == key {
+				m[i+1] = k + 1
+				j = k + 1
+
+				break
+			}
+		}
+	}
+
+	return m
+}
+
+// mapBuildErrors rewrites any compiler diagnostics in the build output so
+// that they refer to the origin of the code rather than to the generated
+// program. Diagnostics which cannot be mapped are left unchanged. It is run
+// from within the gosh directory.
+func (g *gosh) mapBuildErrors(out []byte) []byte {
+	var (
+		lineMap map[int]int
+		final   []string
+		buf     bytes.Buffer
+	)
+
+	if content, err := os.ReadFile(goshFilename); err == nil {
+		final = strings.Split(string(content), "\n")
+		lineMap = alignLines(
+			strings.Split(g.w.written.String(), "\n"), final)
+	}
+
+	for line := range strings.Lines(string(out)) {
+		m := buildErrRE.FindStringSubmatch(strings.TrimRight(line, "\n"))
+		if m == nil {
+			buf.WriteString(line)
+			continue
+		}
+
+		errLine, _ := strconv.Atoi(m[3])
+		col, _ := strconv.Atoi(m[4])
+
+		var (
+			mapped string
+			ok     bool
+		)
+
+		if m[2] == "" {
+			mapped, ok = g.mapProgError(lineMap, final, errLine, col, m[5])
+		} else {
+			mapped, ok = g.mapCopyError(m[1], m[2], errLine, col, m[5])
+		}
+
+		if !ok {
+			buf.WriteString(line)
+			continue
+		}
+
+		buf.WriteString(mapped + "\n")
+	}
+
+	return buf.Bytes()
+}
+
+// mapProgError maps an error in the generated program back to the origin
+// of the code. It returns false if the code was generated by gosh.
+func (g *gosh) mapProgError(
+	lineMap map[int]int, final []string, errLine, col int, msg string,
+) (string, bool) {
+	sl, ok := g.srcLocs[lineMap[errLine]]
+	if !ok || errLine > len(final) {
+		return "", false
+	}
+
+	fl := final[errLine-1]
+	col = max(col-(len(fl)-len(strings.TrimLeft(fl, " \t")))+sl.indent, 1)
+
+	return fmt.Sprintf("error in %s (col %d): %s", sl, col, msg), true
+}
+
+// mapCopyError maps an error in a copied Go file back to the original
+// file. The line number is corrected for any change in the number of lines
+// when the package was renamed.
+func (g *gosh) mapCopyError(
+	copyName, idxStr string, errLine, col int, msg string,
+) (string, bool) {
+	idx, err := strconv.Atoi(idxStr)
+	if err != nil || idx >= len(g.copyGoFiles) {
+		return "", false
+	}
+
+	fromName := g.copyGoFiles[idx]
+	if !filepath.IsAbs(fromName) {
+		fromName = filepath.Clean(filepath.Join(g.runDir, fromName))
+	}
+
+	from, errFrom := os.ReadFile(fromName) //nolint:gosec
+	copied, errCopy := os.ReadFile(copyName)
+
+	if errFrom == nil && errCopy == nil {
+		errLine -= bytes.Count(copied, []byte("\n")) -
+			bytes.Count(from, []byte("\n"))
+	}
+
+	return fmt.Sprintf("error in file %q, line %d (col %d): %s",
+		g.copyGoFiles[idx], max(errLine, 1), col, msg), true
+}
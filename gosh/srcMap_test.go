@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+func TestAlignLines(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		written []string
+		final   []string
+		expMap  map[int]int
+	}{
+		{
+			ID:      testhelper.MkID("identical"),
+			written: []string{"a", "b"},
+			final:   []string{"a", "b"},
+			expMap:  map[int]int{1: 1, 2: 2},
+		},
+		{
+			ID:      testhelper.MkID("reformatted"),
+			written: []string{"x:=1", "", "", "y  =  2"},
+			final:   []string{"\tx := 1", "", "\ty = 2"},
+			expMap:  map[int]int{1: 1, 3: 4},
+		},
+		{
+			ID:      testhelper.MkID("lines added"),
+			written: []string{"import (", `"fmt"`, ")", "x"},
+			final:   []string{"import (", `"fmt"`, `"os"`, ")", "x"},
+			expMap:  map[int]int{1: 1, 2: 2, 4: 3, 5: 4},
+		},
+	}
+
+	for _, tc := range testCases {
+		if err := testhelper.DiffVals(
+			alignLines(tc.written, tc.final), tc.expMap); err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: %s", err)
+		}
+	}
+}
+
+func TestMapBuildErrors(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	g := mkTestGosh(func(g *gosh) {
+		g.addScriptEntryFrom(execSect, "x := 1", verbatim,
+			srcOrigin{desc: "-exec #1", firstLine: 1})
+		g.addScriptEntryFrom(execSect, "if true {\n    y++\n}", verbatim,
+			srcOrigin{desc: "-exec #2", firstLine: 1})
+		g.addScriptEntryFrom(execSect, "z()", verbatim,
+			srcOrigin{desc: `file "a.gosh"`, firstLine: 4, showLine: true})
+	})
+
+	g.writeGoFile()
+
+	content, err := os.ReadFile(goshFilename)
+	if err != nil {
+		t.Fatal("Cannot read the program:", err)
+	}
+
+	// posOf returns the line number of the code in the program and the
+	// column of the first non-blank character
+	posOf := func(code string) (int, int) {
+		for i, l := range strings.Split(string(content), "\n") {
+			if strings.TrimSpace(l) == code {
+				return i + 1, len(l) - len(strings.TrimLeft(l, " \t")) + 1
+			}
+		}
+
+		t.Fatalf("%q is not in the program", code)
+
+		return 0, 0
+	}
+
+	xLine, xCol := posOf("x := 1")
+	yLine, yCol := posOf("y++")
+	zLine, zCol := posOf("z()")
+
+	out := fmt.Sprintf("# G\n"+
+		"./gosh.go:%d:%d: declared and not used: x\n"+
+		"./gosh.go:%d:%d: undefined: y\n"+
+		"./gosh.go:%d:%d: undefined: z\n"+
+		"./gosh.go:1:1: some other error\n",
+		xLine, xCol, yLine, yCol, zLine, zCol)
+
+	testhelper.DiffString(t, "mapBuildErrors", "output",
+		string(g.mapBuildErrors([]byte(out))),
+		"# G\n"+
+			"error in -exec #1 (col 1): declared and not used: x\n"+
+			"error in -exec #2, line 2 (col 5): undefined: y\n"+
+			`error in file "a.gosh", line 4 (col 1): undefined: z`+"\n"+
+			"./gosh.go:1:1: some other error\n")
+}
@@ -0,0 +1,4 @@
+package p
+
+// a comment
+var a int
@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/nickwells/gogen.mod/gogen"
 	"github.com/nickwells/verbose.mod/verbose"
@@ -18,8 +21,16 @@ const (
 	rlTag    = "readloop"
 
 	splitSfx = " - splitline"
+	csvSfx   = " - csv"
+	jsonSfx  = " - json"
+	parSfx   = " - parallel"
+	zipSfx   = " - decompress"
+	walkSfx  = " - walk"
+	bakSfx   = " - backup"
+	diffSfx  = " - diff"
 	filesSfx = " - filelist"
 	ipeSfx   = " - in-place-edit"
+	routeSfx = " - route"
 )
 
 // writeScript writes the contents of the named script. It panics if the
@@ -55,277 +66,1419 @@ func (g *gosh) writeScript(scriptName string) {
 			continue
 		}
 
-		for _, s := range lines {
-			g.print(s)
+		g.printEntry(se, lines)
+	}
+
+	if g.addComments {
+		g.print(g.comment(sectionFrame))
+		g.print(g.comment(sectionEnd))
+		g.print(g.comment(sectionFrame))
+		g.printBlank()
+	}
+}
+
+// writeImports writes the import statements into the Go file
+func (g *gosh) writeImports() {
+	if len(g.args) > 0 && !g.skipArgLoop {
+		g.imports = append(g.imports, "os")
+	}
+
+	if g.runInReadLoop {
+		if g.csvRecords {
+			g.imports = append(g.imports, "encoding/csv", "errors", "io")
+		} else {
+			g.imports = append(g.imports, "bufio")
+		}
+
+		if g.jsonLines {
+			g.imports = append(g.imports, "encoding/json")
+		}
+
+		if g.inPlaceEdit {
+			g.imports = append(g.imports, "bytes", "os", "path/filepath")
+
+			if g.ipeDryRun {
+				g.imports = append(g.imports, "fmt", "sync/atomic")
+			}
+		}
+
+		if g.replacesFiles() {
+			switch g.backupMode {
+			case backupModeNumbered:
+				g.imports = append(g.imports,
+					"errors", "io/fs", "os", "strconv")
+			case backupModeTimestamp:
+				g.imports = append(g.imports, "fmt", "io/fs", "os", "time")
+			case backupModeDir:
+				g.imports = append(g.imports, "os")
+			}
+		}
+
+		if g.inParallel() {
+			g.imports = append(g.imports, "bytes")
+		}
+
+		if g.walkDirs && g.filesToRead {
+			g.imports = append(g.imports,
+				"fmt", "io/fs", "os", "path/filepath")
+
+			if g.walkSkipHidden {
+				g.imports = append(g.imports, "strings")
+			}
+		}
+
+		if g.decompress && g.filesToRead {
+			g.imports = append(g.imports,
+				"bufio", "bytes", "compress/bzip2", "compress/gzip",
+				"io", "os", "strings")
+
+			if g.replacesFiles() {
+				g.imports = append(g.imports,
+					"errors", "fmt", "path/filepath")
+			}
+		}
+
+		if g.splitLine {
+			g.imports = append(g.imports, "regexp")
+		}
+	}
+
+	if g.runAsWebserver {
+		g.imports = append(g.imports, g.webserverImports()...)
+	}
+
+	if g.benchmark {
+		g.imports = append(g.imports, "testing")
+	} else if g.hasAsserts() {
+		g.imports = append(g.imports, "testing")
+
+		if g.hasAssertEqual() {
+			g.imports = append(g.imports, "reflect")
+		}
+	} else if g.profile {
+		g.imports = append(g.imports, "fmt", "os", "runtime", "runtime/pprof")
+	}
+
+	if imp := g.embedImport(); imp != "" {
+		g.imports = append(g.imports, imp)
+	}
+
+	gogen.PrintImports(g.w, g.imports...)
+}
+
+// webserverImports returns the packages imported by the code which runs the
+// webserver
+func (g *gosh) webserverImports() []string {
+	imports := []string{
+		"net/http", "log",
+		"context", "errors", "fmt", "net", "os", "os/signal",
+		"syscall", "time",
+	}
+
+	if g.httpUnixSocket != "" {
+		imports = append(imports, "io/fs")
+	}
+
+	if g.httpAccessLog != accessLogNone {
+		imports = append(imports, "io", "sync")
+
+		if g.httpAccessLog == accessLogJSON {
+			imports = append(imports, "encoding/json")
+		}
+	}
+
+	if g.httpTLSSelfSigned {
+		imports = append(imports,
+			"crypto/ecdsa", "crypto/elliptic", "crypto/rand",
+			"crypto/tls", "crypto/x509", "crypto/x509/pkix",
+			"math/big", "net")
+	}
+
+	return imports
+}
+
+// writeArgsLoop writes the statements of the loop over the arguments
+// (if any) into the Go file
+func (g *gosh) writeArgsLoop() {
+	tag := argTag
+
+	g.writeScript(beforeSect)
+
+	if !g.skipArgLoop {
+		g.gPrint("for _, _arg := range os.Args[1:] {", tag)
+		g.in()
+		g.gPrint("_ = _arg", tag) // force the use of _arg
+	}
+
+	g.writeScript(beforeInnerSect)
+
+	g.writeScript(execSect)
+
+	g.writeScript(afterInnerSect)
+
+	if !g.skipArgLoop {
+		g.out()
+		g.gPrint("}", tag)
+	}
+
+	g.writeScript(afterSect)
+}
+
+// writeReadLoop writes the statements of the readloop
+// (if any) into the Go file
+func (g *gosh) writeReadLoop() {
+	tag := rlTag
+
+	g.gDecl("_fn", ` = "standard input"`, tag)
+	g.gDecl("_fl", "", tag)
+
+	if g.inParallel() {
+		// each file has its own _fn and _fl, these are only used in the
+		// sections outside the loop over the files
+		g.gPrint("_, _ = _fn, _fl", tag+parSfx) // force their use
+	}
+
+	if g.splitLine {
+		g.gDecl("_sre",
+			fmt.Sprintf(" = regexp.MustCompile(%q)", g.splitPattern),
+			tag+splitSfx)
+	}
+
+	g.writeScript(beforeSect)
+
+	if g.filesToRead && g.ipeDryRun {
+		g.gPrint("var _nChanged, _nUnchanged atomic.Int64", tag+diffSfx)
+	}
+
+	if g.filesToRead {
+		g.writeFileLoopOpen(tag + filesSfx)
+
+		if g.decompress {
+			g.writeReaderDecl("_r", tag)
+		} else {
+			g.writeReaderDecl("_f", tag)
+		}
+	} else {
+		g.writeReaderDecl("os.Stdin", tag)
+	}
+
+	g.writeScript(beforeInnerSect)
+
+	if g.csvRecords {
+		g.writeCSVLoopOpen(tag + csvSfx)
+	} else {
+		g.writeScanLoopOpen(tag)
+	}
+
+	g.writeScript(execSect)
+
+	if g.csvRecords {
+		g.writeCSVLoopClose(tag + csvSfx)
+	} else {
+		g.writeScanLoopClose(tag)
+	}
+
+	g.writeScript(afterInnerSect)
+
+	if g.filesToRead {
+		g.writeFileLoopClose(tag + filesSfx)
+	}
+
+	if g.filesToRead && g.ipeDryRun {
+		g.gPrintErr(`"%d files changed, %d unchanged\n",`+
+			` _nChanged.Load(), _nUnchanged.Load()`, tag+diffSfx)
+	}
+
+	g.writeScript(afterSect)
+}
+
+// writeReaderDecl writes the declaration of the reader (either the scanner or
+// the CSV reader) which reads from the given source.
+func (g *gosh) writeReaderDecl(src, tag string) {
+	if !g.csvRecords {
+		g.gDecl("_l", " = bufio.NewScanner("+src+")", tag)
+		return
+	}
+
+	tag += csvSfx
+
+	g.gDecl("_cr", " = csv.NewReader("+src+")", tag)
+	g.gPrint("_cr.FieldsPerRecord = -1", tag)
+
+	if g.csvDelimiter != dfltCSVDelimiter {
+		r, _ := utf8.DecodeRuneInString(g.csvDelimiter)
+		g.gPrint(fmt.Sprintf("_cr.Comma = %q", r), tag)
+	}
+
+	if g.csvComment != "" {
+		r, _ := utf8.DecodeRuneInString(g.csvComment)
+		g.gPrint(fmt.Sprintf("_cr.Comment = %q", r), tag)
+	}
+
+	if g.csvLazyQuotes {
+		g.gPrint("_cr.LazyQuotes = true", tag)
+	}
+
+	if g.csvHeader {
+		g.gDecl("_hdr", "", tag)
+	}
+
+	if g.inPlaceEdit {
+		g.gDecl("_cw", " = csv.NewWriter(_w)", tag)
+		g.gPrint("_cw.Comma = _cr.Comma", tag)
+	}
+}
+
+// writeCSVLoopOpen writes the code to open the loop reading records from the
+// CSV reader. Badly formed records are reported and skipped, any other error
+// ends the loop. If the first record is a header it is used to populate the
+// header map (and copied to the CSV writer if editing in-place) and is not
+// passed to the exec section.
+func (g *gosh) writeCSVLoopOpen(tag string) {
+	g.gPrint("for {", tag)
+	g.in()
+	g.gDecl("_rec", "", tag)
+	g.gDecl("_err", "", tag)
+	g.gPrint("_rec, _err = _cr.Read()", tag)
+	g.gPrint("if errors.Is(_err, io.EOF) {", tag)
+	{
+		g.in()
+		g.gPrint("break", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("if _err != nil {", tag)
+	{
+		g.in()
+		g.gPrintErr(`"Error reading %q : %v\n", _fn, _err`, tag)
+		g.gPrint("var _pe *csv.ParseError", tag)
+		g.gPrint("if errors.As(_err, &_pe) {", tag)
+		{
+			g.in()
+			g.gPrint("continue", tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+		g.gPrint("break", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("_fl, _ = _cr.FieldPos(0)", tag)
+
+	if g.csvHeader {
+		g.gPrint("if _hdr == nil {", tag)
+		{
+			g.in()
+			g.gPrint("_hdr = make(map[string]int, len(_rec))", tag)
+			g.gPrint("for _i, _h := range _rec {", tag)
+			{
+				g.in()
+				g.gPrint("_hdr[_h] = _i", tag)
+				g.out()
+			}
+
+			g.gPrint("}", tag)
+
+			if g.inPlaceEdit {
+				g.gPrint("_cw.Write(_rec)", tag)
+			}
+
+			g.gPrint("continue", tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+	}
+
+	g.gPrint("_, _ = _fl, _rec", tag) // force the use of _fl and _rec
+}
+
+// writeCSVLoopClose writes the code to close the loop reading records from
+// the CSV reader.
+func (g *gosh) writeCSVLoopClose(tag string) {
+	g.out()
+	g.gPrint("}", tag)
+}
+
+// writeScanLoopOpen writes the code to open the loop reading from the scanner.
+func (g *gosh) writeScanLoopOpen(tag string) {
+	g.gPrint("for _l.Scan() {", tag)
+	g.in()
+	g.gPrint("_fl++", tag)
+
+	if g.splitLine {
+		g.gDecl("_lp", " = _sre.Split(_l.Text(), -1)", tag+splitSfx)
+	}
+
+	if g.jsonLines {
+		g.writeJSONDecode(tag + jsonSfx)
+	}
+}
+
+// writeJSONDecode writes the code to decode the line just read into the
+// JSON value. Lines that cannot be decoded are either reported and skipped
+// or else the error is reported and the program exits, any in-place edit of
+// the current file being abandoned.
+func (g *gosh) writeJSONDecode(tag string) {
+	if g.jsonType == dfltJSONType {
+		g.gDecl("_jv", "", tag)
+	} else {
+		g.gPrint("var _jv "+g.jsonType, tag)
+	}
+
+	g.gPrint("if _err := json.Unmarshal(_l.Bytes(), &_jv); _err != nil {", tag)
+	{
+		g.in()
+		g.gPrintErr(`"%s:%d: Bad JSON: %v\n", _fn, _fl, _err`, tag)
+
+		if g.jsonErrsFatal {
+			if g.inPlaceEdit {
+				g.gPrint(`_w.Close()`, tag)
+				g.gPrint(`os.Remove(_w.Name())`, tag)
+			}
+
+			g.gPrint("os.Exit(1)", tag)
+		} else {
+			g.gPrint("continue", tag)
+		}
+
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+}
+
+// writeScanLoopClose writes the code to close the loop reading from the
+// scanner.
+func (g *gosh) writeScanLoopClose(tag string) {
+	g.out()
+	g.gPrint("}", tag)
+	g.gPrint("if _err := _l.Err(); _err != nil {", tag)
+	g.in()
+	g.gPrintErr(`"Error reading %q : %v\n", _fn, _err`, tag)
+	g.out()
+	g.gPrint("}", tag)
+}
+
+// inParallel returns true if the files to be read are to be processed in
+// parallel.
+func (g *gosh) inParallel() bool {
+	return g.parallelFiles > 0 && g.filesToRead
+}
+
+// skipFileStmt returns the statement which will abandon the processing of
+// the current file and move on to the next.
+func (g *gosh) skipFileStmt() string {
+	if g.inParallel() {
+		return "return"
+	}
+
+	return "continue"
+}
+
+// fileListExpr returns the expression giving the list of files to be read.
+func (g *gosh) fileListExpr() string {
+	if g.walkDirs {
+		return "_walkFiles(os.Args[1:])"
+	}
+
+	return "os.Args[1:]"
+}
+
+// writeWalkFilesFunc writes the function which finds the files to be read
+// by walking any directories given. The files chosen should match those
+// found by the walkDir method.
+func (g *gosh) writeWalkFilesFunc() {
+	if !g.walkDirs || !g.filesToRead {
+		return
+	}
+
+	tag := rlTag + walkSfx
+
+	g.gPrint("", tag)
+	g.gPrint("// _walkFiles returns the files to be read. Any directories"+
+		" are walked and the", tag)
+	g.gPrint("// regular files found in them are added if they match"+
+		" the patterns.", tag)
+	g.gPrint("func _walkFiles(_args []string) []string {", tag)
+	g.in()
+	g.gPrint(fmt.Sprintf("_incl := %#v", g.walkInclude), tag)
+	g.gPrint(fmt.Sprintf("_excl := %#v", g.walkExclude), tag)
+
+	skip := g.walkSkipPatterns()
+	if len(skip) > 0 {
+		g.gPrint(fmt.Sprintf("_skip := %#v", skip), tag)
+	}
+
+	g.gPrint("_match := func(_pats []string, _name string) bool {", tag)
+	{
+		g.in()
+		g.gPrint("for _, _pat := range _pats {", tag)
+		{
+			g.in()
+			g.gPrint("if _m, _ := filepath.Match(_pat, _name); _m {", tag)
+			{
+				g.in()
+				g.gPrint("return true", tag)
+				g.out()
+			}
+
+			g.gPrint("}", tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+		g.gPrint("return false", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("var _fns []string", tag)
+	g.gPrint("for _, _arg := range _args {", tag)
+	g.in()
+	g.gPrint("filepath.WalkDir(_arg,", tag)
+	g.gPrint("	func(_p string, _d fs.DirEntry, _err error) error {", tag)
+	g.in()
+	g.gPrint("if _err != nil {", tag)
+	{
+		g.in()
+		g.gPrintErr(`"Error walking %q : %v\n", _p, _err`, tag)
+		g.gPrint("return nil", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("if _p == _arg {", tag)
+	{
+		g.in()
+		g.gPrint("if !_d.IsDir() {", tag)
+		{
+			g.in()
+			g.gPrint("_fns = append(_fns, _p)", tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+		g.gPrint("return nil", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("if _d.IsDir() {", tag)
+	{
+		g.in()
+
+		if g.walkSkipHidden {
+			g.gPrint(`if strings.HasPrefix(_d.Name(), ".") ||`+
+				` _d.Name() == "testdata" {`, tag)
+			{
+				g.in()
+				g.gPrint("return filepath.SkipDir", tag)
+				g.out()
+			}
+
+			g.gPrint("}", tag)
+		}
+
+		g.gPrint("if _match(_excl, _d.Name()) {", tag)
+		{
+			g.in()
+			g.gPrint("return filepath.SkipDir", tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+
+		if g.inPlaceEdit && g.backupMode == backupModeDir {
+			g.gPrint("if _abs, _ := filepath.Abs(_p);"+
+				fmt.Sprintf(" _abs == %q {", filepath.Clean(g.backupDir)), tag)
+			{
+				g.in()
+				g.gPrint("return filepath.SkipDir", tag)
+				g.out()
+			}
+
+			g.gPrint("}", tag)
+		}
+
+		g.gPrint("return nil", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("if _d.Type().IsRegular() && !_match(_excl, _d.Name()) &&", tag)
+
+	if len(skip) > 0 {
+		g.gPrint("	!_match(_skip, _d.Name()) &&", tag)
+	}
+
+	g.gPrint("	(len(_incl) == 0 || _match(_incl, _d.Name())) {", tag)
+	{
+		g.in()
+		g.gPrint("_fns = append(_fns, _p)", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("return nil", tag)
+	g.out()
+	g.gPrint("})", tag)
+	g.out()
+	g.gPrint("}", tag)
+	g.gPrint("return _fns", tag)
+	g.out()
+	g.gPrint("}", tag)
+}
+
+// writeFileLoopOpen writes the opening of the loop over the list of filenames.
+func (g *gosh) writeFileLoopOpen(tag string) {
+	if g.inParallel() {
+		g.writeParallelLoopOpen(tag + parSfx)
+	} else {
+		g.gPrint("for _, _fn = range "+g.fileListExpr()+" {", tag)
+		g.in()
+	}
+
+	{
+		g.gDecl("_f", "", tag)
+		g.gDecl("_err", "", tag)
+		g.gPrint(`_f, _err = os.Open(_fn)`, tag)
+		g.gPrint(`if _err != nil {`, tag)
+		{
+			g.in()
+			g.gPrintErr(`"Error opening: %q : %v\n", _fn, _err`, tag)
+			g.gPrint(g.skipFileStmt(), tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+		g.gPrint(`_fl = 0`, tag)
+
+		g.writeDecompressOpen(tag + zipSfx)
+		g.writeInPlaceEditOpen(tag + ipeSfx)
+	}
+}
+
+// writeFileLoopClose writes the code to close the loop ranging over the file
+// names.
+func (g *gosh) writeFileLoopClose(tag string) {
+	g.gPrint(`_f.Close()`, tag)
+
+	g.writeInPlaceEditClose(tag + ipeSfx)
+
+	if g.inParallel() {
+		g.writeParallelLoopClose(tag + parSfx)
+		return
+	}
+
+	g.out()
+	g.gPrint("}", tag)
+}
+
+// writeParallelLoopOpen writes the opening of the loop over the list of
+// filenames when the files are processed in parallel. Each file is
+// processed in its own goroutine, with the number running at the same time
+// limited by the size of the semaphore channel. Each file has its own
+// output buffer which is written to the standard output, in the order the
+// files were given, as soon as that file and all the files before it have
+// been processed.
+func (g *gosh) writeParallelLoopOpen(tag string) {
+	g.gPrint(fmt.Sprintf("_sem := make(chan struct{}, %d)", g.parallelFiles),
+		tag)
+	g.gPrint("_fns := "+g.fileListExpr(), tag)
+	g.gPrint("_outs := make([]bytes.Buffer, len(_fns))", tag)
+	g.gPrint("_dones := make([]chan struct{}, len(_fns))", tag)
+	g.gPrint("for _n := range _dones {", tag)
+	{
+		g.in()
+		g.gPrint("_dones[_n] = make(chan struct{})", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("_flushed := make(chan struct{})", tag)
+	g.gPrint("go func() {", tag)
+	{
+		g.in()
+		g.gPrint("defer close(_flushed)", tag)
+		g.gPrint("for _n := range _outs {", tag)
+		{
+			g.in()
+			g.gPrint("<-_dones[_n]", tag)
+			g.gPrint("os.Stdout.Write(_outs[_n].Bytes())", tag)
+			g.gPrint("_outs[_n] = bytes.Buffer{}", tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+		g.out()
+	}
+
+	g.gPrint("}()", tag)
+	g.gPrint("for _n, _fn := range _fns {", tag)
+	g.in()
+	g.gPrint("_sem <- struct{}{}", tag)
+	g.gPrint("go func(_n int, _fn string) {", tag)
+	g.in()
+	g.gPrint("defer func() { <-_sem }()", tag)
+	g.gPrint("defer close(_dones[_n])", tag)
+	g.gDecl("_o", " = &_outs[_n]", tag)
+	g.gPrint("_ = _o", tag) // force the use of _o
+	g.gDecl("_fl", "", tag)
+}
+
+// writeParallelLoopClose writes the closing of the loop over the list of
+// filenames when the files are processed in parallel. It waits until the
+// output for every file has been written.
+func (g *gosh) writeParallelLoopClose(tag string) {
+	g.out()
+	g.gPrint("}(_n, _fn)", tag)
+	g.out()
+	g.gPrint("}", tag)
+	g.gPrint("<-_flushed", tag)
+}
+
+// writeDecompressOpen writes the code to wrap the file just opened in a
+// reader which will decompress its contents if it is compressed. If the
+// file is being edited in-place the compression is recorded so that the new
+// contents can be compressed in the same way.
+func (g *gosh) writeDecompressOpen(tag string) {
+	if !g.decompress {
+		return
+	}
+
+	g.gDecl("_r", "", tag)
+
+	z := "_"
+
+	if g.replacesFiles() {
+		g.gDecl("_z", "", tag)
+		z = "_z"
+	}
+
+	g.gPrint(`_r, `+z+`, _err = _decompress(_fn, _f)`, tag)
+	g.gPrint(`if _err != nil {`, tag)
+	{
+		g.in()
+		g.gPrintErr(`"Error decompressing %q : %v\n", _fn, _err`, tag)
+		g.gPrint(`_f.Close()`, tag)
+		g.gPrint(g.skipFileStmt(), tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+}
+
+// writeDecompressFuncs writes the functions used to decompress the files
+// being read and to recompress any files edited in-place.
+func (g *gosh) writeDecompressFuncs() {
+	if !g.decompress || !g.filesToRead {
+		return
+	}
+
+	tag := rlTag + zipSfx
+
+	g.gPrint("", tag)
+	g.gPrint("// _decompress returns a reader for the file which will"+
+		" decompress its contents", tag)
+	g.gPrint("// if the file name or its first few bytes show that it"+
+		" is compressed. It", tag)
+	g.gPrint("// also returns the type of compression (if any).", tag)
+	g.gPrint("func _decompress(_fn string, _f *os.File)"+
+		" (io.Reader, string, error) {", tag)
+	{
+		g.in()
+		g.gPrint("_br := bufio.NewReader(_f)", tag)
+		g.gPrint("_magic, _ := _br.Peek(3)", tag)
+		g.gPrint("switch {", tag)
+		g.gPrint(`case strings.HasSuffix(_fn, ".gz"),`, tag)
+		g.gPrint(`	bytes.HasPrefix(_magic, []byte("\x1f\x8b")):`, tag)
+		{
+			g.in()
+			g.gPrint("_zr, _err := gzip.NewReader(_br)", tag)
+			g.gPrint(`return _zr, "gzip", _err`, tag)
+			g.out()
+		}
+
+		g.gPrint(`case strings.HasSuffix(_fn, ".bz2"),`, tag)
+		g.gPrint(`	bytes.HasPrefix(_magic, []byte("BZh")):`, tag)
+		{
+			g.in()
+			g.gPrint(`return bzip2.NewReader(_br), "bzip2", nil`, tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+		g.gPrint(`return _br, "", nil`, tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+
+	if !g.replacesFiles() {
+		return
+	}
+
+	g.gPrint("", tag)
+	g.gPrint("// _recompress replaces the contents of the named file with"+
+		" the same contents", tag)
+	g.gPrint("// compressed in the given way. It does nothing if the"+
+		" compression is empty.", tag)
+	g.gPrint("func _recompress(_name, _z string) error {", tag)
+	{
+		g.in()
+		g.gPrint(`if _z == "" {`, tag)
+		{
+			g.in()
+			g.gPrint("return nil", tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+		g.gPrint(`if _z != "gzip" {`, tag)
+		{
+			g.in()
+			g.gPrint(`return fmt.Errorf("cannot write %s-compressed files", _z)`,
+				tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+		g.gPrint("_in, _err := os.Open(_name)", tag)
+		g.writeReturnErr(tag)
+		g.gPrint("defer _in.Close()", tag)
+		g.gPrint("_fi, _err := _in.Stat()", tag)
+		g.writeReturnErr(tag)
+		g.gPrint("_out, _err := os.CreateTemp(", tag)
+		{
+			g.in()
+			g.gPrint(`filepath.Dir(_name), filepath.Base(_name)+".*.gz")`, tag)
+			g.out()
+		}
+
+		g.writeReturnErr(tag)
+		g.gPrint("defer os.Remove(_out.Name())", tag)
+		g.gPrint("_zw := gzip.NewWriter(_out)", tag)
+		g.gPrint("_, _err = io.Copy(_zw, _in)", tag)
+		g.gPrint("_err = errors.Join(_err, _zw.Close(),"+
+			" _out.Chmod(_fi.Mode()), _out.Close())", tag)
+		g.writeReturnErr(tag)
+		g.gPrint("return os.Rename(_out.Name(), _name)", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+}
+
+// writeReturnErr writes the code to return the error if it is not nil.
+func (g *gosh) writeReturnErr(tag string) {
+	g.gPrint("if _err != nil {", tag)
+	{
+		g.in()
+		g.gPrint("return _err", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+}
+
+// writeInPlaceEditOpen writes the declaration and initialisation of the
+// writer used for in-place editing. It writes code to handle any errors
+// detected.
+func (g *gosh) writeInPlaceEditOpen(tag string) {
+	if !g.inPlaceEdit {
+		return
+	}
+
+	g.gDecl("_w", "", tag)
+	g.gPrint(`_w, _err = os.CreateTemp(`, tag)
+	{
+		g.in()
+		g.gPrint(`filepath.Dir(_fn),`, tag)
+		g.gPrint(`filepath.Base(_fn) + ".*.new")`, tag)
+		g.out()
+	}
+
+	g.gPrint(`if _err != nil {`, tag)
+	{
+		g.in()
+		g.gPrintErr(`"Error creating the temp file for %q : %v\n", _fn, _err`,
+			tag)
+		g.gPrint(`_f.Close()`, tag)
+		g.gPrint(g.skipFileStmt(), tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+
+	g.gPrint("{", tag)
+	{
+		g.in()
+		g.gPrint(`_fi, _err := _f.Stat()`, tag)
+		g.gPrint(`if _err != nil {`, tag)
+		{
+			g.in()
+			g.gPrintErr(
+				`"Warning: Couldn't get status for %q: %v\n", _fn, _err`,
+				tag)
+			g.out()
+		}
+
+		g.gPrint("} else {", tag)
+		{
+			g.in()
+			g.gPrint(`_err = _w.Chmod(_fi.Mode())`, tag)
+			g.gPrint(`if _err != nil {`, tag)
+			{
+				g.in()
+				g.gPrintErr(
+					`"Warning: Couldn't set mode for %q: %v\n", _fn, _err`,
+					tag)
+				g.out()
+			}
+
+			g.gPrint("}", tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+}
+
+// writeInPlaceEditClose writes the code to complete the operation of the
+// in-place edit of the given files.
+func (g *gosh) writeInPlaceEditClose(tag string) {
+	if !g.inPlaceEdit {
+		return
+	}
+
+	if g.csvRecords {
+		g.gPrint(`_cw.Flush()`, tag)
+		g.gPrint(`if _err := _cw.Error(); _err != nil {`, tag)
+		{
+			g.in()
+			g.gPrintErr(`"Error writing CSV records for %q : %v\n", _fn, _err`,
+				tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+	}
+
+	g.gPrint(`_w.Close()`, tag)
+
+	g.writeEditCompare(tag)
+
+	if g.ipeDryRun {
+		return
+	}
+
+	if g.decompress {
+		g.gPrint(`if _err := _recompress(_w.Name(), _z); _err != nil {`, tag)
+		{
+			g.in()
+			g.gPrintErr(`"Error compressing %q : %v\n", _fn, _err`, tag)
+			g.gPrint(`os.Remove(_w.Name())`, tag)
+			g.gPrint(g.skipFileStmt(), tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+	}
+
+	g.writeBackupOriginal(tag)
+	g.gPrint(`if _err := os.Rename(_w.Name(), _fn); _err != nil {`, tag)
+	{
+		g.in()
+		g.gPrintErr(`"Error recreating %q : %v\n", _fn, _err`, tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+}
+
+// writeEditCompare writes the code to compare the original contents of the
+// file with the edited contents. If they are the same the edited copy is
+// removed and the file is left alone. If this is a dry-run the differences
+// are shown and the edited copy is removed.
+func (g *gosh) writeEditCompare(tag string) {
+	g.gPrint("{", tag)
+	g.in()
+	g.gPrint("_ob, _nb, _err := _editContents(_fn, _w.Name())", tag)
+	g.gPrint("if _err != nil {", tag)
+	{
+		g.in()
+		g.gPrintErr(`"Error comparing %q with the edited copy : %v\n",`+
+			` _fn, _err`, tag)
+		g.gPrint(`os.Remove(_w.Name())`, tag)
+		g.gPrint(g.skipFileStmt(), tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+	g.gPrint("if bytes.Equal(_ob, _nb) {", tag)
+	{
+		g.in()
+		g.gPrint(`os.Remove(_w.Name())`, tag)
+
+		if g.ipeDryRun {
+			g.gPrint(`_nUnchanged.Add(1)`, tag+diffSfx)
+		}
+
+		g.gPrint(g.skipFileStmt(), tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+
+	if g.ipeDryRun {
+		out := "os.Stdout"
+		if g.inParallel() {
+			out = "_o"
+		}
+
+		g.gPrint(out+".WriteString(_diff(_fn, _ob, _nb))", tag+diffSfx)
+		g.gPrint(`os.Remove(_w.Name())`, tag+diffSfx)
+		g.gPrint(`_nChanged.Add(1)`, tag+diffSfx)
+	}
+
+	g.out()
+	g.gPrint("}", tag)
+}
+
+// writeBackupOriginal writes the code to keep a copy of the original file
+// according to the backup mode. If the copy cannot be made the edited copy
+// is removed and the original file is left alone.
+func (g *gosh) writeBackupOriginal(tag string) {
+	switch g.backupMode {
+	case backupModeNone:
+		return
+	case backupModeSuffix:
+		g.gPrint(fmt.Sprintf(`if _err := os.Rename(_fn, _fn+%q); _err != nil {`,
+			g.backupSuffix), tag)
+	default:
+		g.gPrint(`if _err := _backup(_fn); _err != nil {`, tag)
+	}
+
+	{
+		g.in()
+		g.gPrintErr(`"Error making copy of %q : %v\n", _fn, _err`, tag)
+		g.gPrint(`os.Remove(_w.Name())`, tag)
+		g.gPrint(g.skipFileStmt(), tag)
+		g.out()
+	}
+
+	g.gPrint("}", tag)
+}
+
+// writeBackupFunc writes the function used to keep a copy of the original
+// file for those backup modes where the name of the copy is only known when
+// the file is edited.
+func (g *gosh) writeBackupFunc() {
+	if !g.replacesFiles() ||
+		g.backupMode == backupModeNone ||
+		g.backupMode == backupModeSuffix {
+		return
+	}
+
+	tag := rlTag + bakSfx
+
+	g.gPrint("", tag)
+	g.gPrint("// _backup keeps a copy of the original file before it is"+
+		" replaced", tag)
+	g.gPrint("func _backup(_fn string) error {", tag)
+	g.in()
+
+	switch g.backupMode {
+	case backupModeNumbered:
+		g.gPrint("for _n := 1; ; _n++ {", tag)
+		{
+			g.in()
+			g.gPrint(fmt.Sprintf("_b := _fn + %q + strconv.Itoa(_n)",
+				g.backupSuffix+"."), tag)
+			g.gPrint("if _, _err := os.Lstat(_b);"+
+				" errors.Is(_err, fs.ErrNotExist) {", tag)
+			{
+				g.in()
+				g.gPrint("return os.Rename(_fn, _b)", tag)
+				g.out()
+			}
+
+			g.gPrint("}", tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+	case backupModeTimestamp:
+		g.gPrint(fmt.Sprintf("_b := _fn + %q + time.Now().Format(%q)",
+			g.backupSuffix+".", backupTimeFormat), tag)
+		g.gPrint("if _, _err := os.Lstat(_b); _err == nil {", tag)
+		{
+			g.in()
+			g.gPrint(`return fmt.Errorf("%q: %w", _b, fs.ErrExist)`, tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+		g.gPrint("return os.Rename(_fn, _b)", tag)
+	case backupModeDir:
+		g.gPrint("_abs, _err := filepath.Abs(_fn)", tag)
+		g.writeReturnErr(tag)
+		g.gPrint(fmt.Sprintf("_b := filepath.Join(%q, _abs)", g.backupDir),
+			tag)
+		g.gPrint("_err = os.MkdirAll(filepath.Dir(_b), 0o777)", tag)
+		g.writeReturnErr(tag)
+		g.gPrint("if os.Rename(_fn, _b) == nil {", tag)
+		{
+			g.in()
+			g.gPrint("return nil", tag)
+			g.out()
 		}
-	}
 
-	if g.addComments {
-		g.print(g.comment(sectionFrame))
-		g.print(g.comment(sectionEnd))
-		g.print(g.comment(sectionFrame))
-		g.printBlank()
+		g.gPrint("}", tag)
+		g.gPrint("// the rename can fail if the backup directory is on a"+
+			" different", tag)
+		g.gPrint("// filesystem so copy the file instead", tag)
+		g.gPrint("_fi, _err := os.Stat(_fn)", tag)
+		g.writeReturnErr(tag)
+		g.gPrint("_content, _err := os.ReadFile(_fn)", tag)
+		g.writeReturnErr(tag)
+		g.gPrint("return os.WriteFile(_b, _content, _fi.Mode().Perm())", tag)
 	}
+
+	g.out()
+	g.gPrint("}", tag)
 }
 
-// writeImports writes the import statements into the Go file
-func (g *gosh) writeImports() {
-	if len(g.args) > 0 && !g.skipArgLoop {
-		g.imports = append(g.imports, "os")
+// writeEditFuncs writes the function used to compare the original contents
+// of a file being edited in-place with the edited contents. The code to
+// show the differences for a dry-run is copied in separately (see
+// copyDiffFile).
+func (g *gosh) writeEditFuncs() {
+	if !g.inPlaceEdit || !g.filesToRead {
+		return
 	}
 
-	if g.runInReadLoop {
-		g.imports = append(g.imports, "bufio")
+	tag := rlTag + ipeSfx
 
-		if g.inPlaceEdit {
-			g.imports = append(g.imports, "path/filepath")
+	g.gPrint("", tag)
+	g.gPrint("// _editContents returns the original contents of the file"+
+		" and the edited", tag)
+	g.gPrint("// contents", tag)
+	g.gPrint("func _editContents(_fn, _edited string)"+
+		" ([]byte, []byte, error) {", tag)
+	g.in()
+
+	if g.decompress {
+		g.gPrint("_f, _err := os.Open(_fn)", tag)
+		g.gPrint("if _err != nil {", tag)
+		{
+			g.in()
+			g.gPrint("return nil, nil, _err", tag)
+			g.out()
 		}
 
-		if g.splitLine {
-			g.imports = append(g.imports, "regexp")
+		g.gPrint("}", tag)
+		g.gPrint("defer _f.Close()", tag)
+		g.gPrint("_r, _, _err := _decompress(_fn, _f)", tag)
+		g.gPrint("if _err != nil {", tag)
+		{
+			g.in()
+			g.gPrint("return nil, nil, _err", tag)
+			g.out()
 		}
+
+		g.gPrint("}", tag)
+		g.gPrint("_ob, _err := io.ReadAll(_r)", tag)
+	} else {
+		g.gPrint("_ob, _err := os.ReadFile(_fn)", tag)
 	}
 
-	if g.runAsWebserver {
-		g.imports = append(g.imports, "net/http")
-		g.imports = append(g.imports, "log")
+	g.gPrint("if _err != nil {", tag)
+	{
+		g.in()
+		g.gPrint("return nil, nil, _err", tag)
+		g.out()
 	}
 
-	gogen.PrintImports(g.w, g.imports...)
+	g.gPrint("}", tag)
+	g.gPrint("_nb, _err := os.ReadFile(_edited)", tag)
+	g.gPrint("return _ob, _nb, _err", tag)
+	g.out()
+	g.gPrint("}", tag)
 }
 
-// writeArgsLoop writes the statements of the loop over the arguments
+// writeWebserverInit writes the webserver boilerplate code
 // (if any) into the Go file
-func (g *gosh) writeArgsLoop() {
-	tag := argTag
+func (g *gosh) writeWebserverInit() {
+	tag := webTag
 
 	g.writeScript(beforeSect)
-
-	if !g.skipArgLoop {
-		g.gPrint("for _, _arg := range os.Args[1:] {", tag)
-		g.in()
-		g.gPrint("_ = _arg", tag) // force the use of _arg
-	}
-
 	g.writeScript(beforeInnerSect)
 
-	g.writeScript(execSect)
-
-	g.writeScript(afterInnerSect)
+	if g.needsDefaultHandler() {
+		g.gPrint(fmt.Sprintf(`http.Handle(%q, %s)`,
+			g.httpPath, g.httpHandlerInstance()),
+			tag)
+	}
 
-	if !g.skipArgLoop {
-		g.out()
-		g.gPrint("}", tag)
+	for _, r := range g.httpRoutes {
+		g.gPrint(fmt.Sprintf(`http.Handle(%q, %s{})`, r.pattern, r.handler),
+			tag+routeSfx)
 	}
 
+	g.writeScript(afterInnerSect)
 	g.writeScript(afterSect)
-}
 
-// writeReadLoop writes the statements of the readloop
-// (if any) into the Go file
-func (g *gosh) writeReadLoop() {
-	tag := rlTag
+	g.writeWebserverStart(tag)
 
-	g.gDecl("_fn", ` = "standard input"`, tag)
-	g.gDecl("_fl", "", tag)
+	g.writeScript(afterShutdownSect)
+}
 
-	if g.splitLine {
-		g.gDecl("_sre",
-			fmt.Sprintf(" = regexp.MustCompile(%q)", g.splitPattern),
-			tag+splitSfx)
+// durationExpr returns a Go expression giving the duration using the
+// largest unit that exactly divides it.
+func durationExpr(d time.Duration) string {
+	units := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"time.Hour", time.Hour},
+		{"time.Minute", time.Minute},
+		{"time.Second", time.Second},
+		{"time.Millisecond", time.Millisecond},
+		{"time.Microsecond", time.Microsecond},
 	}
 
-	g.writeScript(beforeSect)
-
-	if g.filesToRead {
-		g.writeFileLoopOpen(tag + filesSfx)
-		g.gDecl("_l", " = bufio.NewScanner(_f)", tag)
-	} else {
-		g.gDecl("_l", " = bufio.NewScanner(os.Stdin)", tag)
+	for _, u := range units {
+		if d%u.d == 0 {
+			return fmt.Sprintf("%d * %s", d/u.d, u.name)
+		}
 	}
 
-	g.writeScript(beforeInnerSect)
-	g.writeScanLoopOpen(tag)
-
-	g.writeScript(execSect)
-
-	g.writeScanLoopClose(tag)
-	g.writeScript(afterInnerSect)
+	return fmt.Sprintf("%d * time.Nanosecond", d)
+}
 
-	if g.filesToRead {
-		g.writeFileLoopClose(tag + filesSfx)
+// writeWebserverStart writes the code to create the webserver, to shut it
+// down cleanly when an interrupt or terminate signal is received and to
+// start it. The code written waits for the shutdown to complete.
+func (g *gosh) writeWebserverStart(tag string) {
+	g.gPrint("_srv := &http.Server{}", tag)
+
+	for _, t := range []struct {
+		field string
+		d     time.Duration
+	}{
+		{"ReadTimeout", g.httpReadTimeout},
+		{"ReadHeaderTimeout", g.httpReadHeaderTimeout},
+		{"WriteTimeout", g.httpWriteTimeout},
+		{"IdleTimeout", g.httpIdleTimeout},
+	} {
+		if t.d > 0 {
+			g.gPrint("_srv."+t.field+" = "+durationExpr(t.d), tag)
+		}
 	}
 
-	g.writeScript(afterSect)
-}
-
-// writeScanLoopOpen writes the code to open the loop reading from the scanner.
-func (g *gosh) writeScanLoopOpen(tag string) {
-	g.gPrint("for _l.Scan() {", tag)
-	g.in()
-	g.gPrint("_fl++", tag)
+	if g.httpTLSSelfSigned {
+		g.gPrint("_cert, _err := _selfSignedCert()", tag)
+		g.gPrint("if _err != nil {", tag)
+		{
+			g.in()
+			g.gPrint("log.Fatal(_err)", tag)
+			g.out()
+		}
 
-	if g.splitLine {
-		g.gDecl("_lp", " = _sre.Split(_l.Text(), -1)", tag+splitSfx)
+		g.gPrint("}", tag)
+		g.gPrint("_srv.TLSConfig = &tls.Config{"+
+			"Certificates: []tls.Certificate{_cert}}", tag)
 	}
-}
 
-// writeScanLoopClose writes the code to close the loop reading from the
-// scanner.
-func (g *gosh) writeScanLoopClose(tag string) {
-	g.out()
-	g.gPrint("}", tag)
-	g.gPrint("if _err := _l.Err(); _err != nil {", tag)
-	g.in()
-	g.gPrintErr(`"Error reading %q : %v\n", _fn, _err`, tag)
-	g.out()
-	g.gPrint("}", tag)
-}
+	g.writeHandlerWrapperInit(tag)
 
-// writeFileLoopOpen writes the opening of the loop over the list of filenames.
-func (g *gosh) writeFileLoopOpen(tag string) {
-	g.gPrint("for _, _fn = range os.Args[1:] {", tag)
+	g.gPrint("_done := make(chan struct{})", tag)
+	g.gPrint("go func() {", tag)
 	{
 		g.in()
-		g.gDecl("_f", "", tag)
-		g.gDecl("_err", "", tag)
-		g.gPrint(`_f, _err = os.Open(_fn)`, tag)
-		g.gPrint(`if _err != nil {`, tag)
+		g.gPrint("_sigs := make(chan os.Signal, 1)", tag)
+		g.gPrint("signal.Notify(_sigs, os.Interrupt, syscall.SIGTERM)", tag)
+		g.gPrint("<-_sigs", tag)
+		g.gPrint("_ctx, _cancel := context.WithTimeout(context.Background(),",
+			tag)
+		g.gPrint("	"+durationExpr(g.httpShutdownGrace)+")", tag)
+		g.gPrint("defer _cancel()", tag)
+		g.gPrint("if _err := _srv.Shutdown(_ctx); _err != nil {", tag)
 		{
 			g.in()
-			g.gPrintErr(`"Error opening: %q : %v\n", _fn, _err`, tag)
-			g.gPrint(`continue`, tag)
+			g.gPrintErr(`"Error shutting down the webserver: %v\n", _err`,
+				tag)
 			g.out()
 		}
 
 		g.gPrint("}", tag)
-		g.gPrint(`_fl = 0`, tag)
-
-		g.writeInPlaceEditOpen(tag + ipeSfx)
+		g.gPrint("close(_done)", tag)
+		g.out()
 	}
-}
 
-// writeFileLoopClose writes the code to close the loop ranging over the file
-// names.
-func (g *gosh) writeFileLoopClose(tag string) {
-	g.gPrint(`_f.Close()`, tag)
+	g.gPrint("}()", tag)
 
-	g.writeInPlaceEditClose(tag + ipeSfx)
+	g.writeWebserverListen(tag)
 
-	g.out()
-	g.gPrint("}", tag)
-}
+	start := "_srv.Serve(_ln)"
 
-// writeInPlaceEditOpen writes the declaration and initialisation of the
-// writer used for in-place editing. It writes code to handle any errors
-// detected.
-func (g *gosh) writeInPlaceEditOpen(tag string) {
-	if !g.inPlaceEdit {
-		return
+	switch {
+	case g.httpTLSCert != "":
+		start = fmt.Sprintf("_srv.ServeTLS(_ln, %q, %q)",
+			g.httpTLSCert, g.httpTLSKey)
+	case g.httpTLSSelfSigned:
+		start = `_srv.ServeTLS(_ln, "", "")`
 	}
 
-	g.gDecl("_w", "", tag)
-	g.gPrint(`_w, _err = os.CreateTemp(`, tag)
+	g.gPrint("if _err := "+start+";"+
+		" !errors.Is(_err, http.ErrServerClosed) {", tag)
 	{
 		g.in()
-		g.gPrint(`filepath.Dir(_fn),`, tag)
-		g.gPrint(`filepath.Base(_fn) + ".*.new")`, tag)
+		g.gPrint("log.Fatal(_err)", tag)
 		g.out()
 	}
 
-	g.gPrint(`if _err != nil {`, tag)
+	g.gPrint("}", tag)
+	g.gPrint("<-_done", tag)
+}
+
+// writeWebserverListen writes the code to create the listener that the
+// webserver will serve requests on. This is either a TCP port or a Unix
+// domain socket. If the port is chosen by the system the address is
+// printed and, if an address file is given, the address is written to it.
+func (g *gosh) writeWebserverListen(tag string) {
+	if g.httpUnixSocket != "" {
+		g.gPrint(fmt.Sprintf("if _fi, _err := os.Lstat(%q);"+
+			" _err == nil && _fi.Mode()&fs.ModeSocket != 0 {",
+			g.httpUnixSocket), tag)
+		{
+			g.in()
+			g.gPrint(fmt.Sprintf("os.Remove(%q)", g.httpUnixSocket), tag)
+			g.out()
+		}
+
+		g.gPrint("}", tag)
+		g.gPrint(fmt.Sprintf(`_ln, _err := net.Listen("unix", %q)`,
+			g.httpUnixSocket), tag)
+	} else {
+		g.gPrint(fmt.Sprintf(`_ln, _err := net.Listen("tcp", ":%d")`,
+			g.httpPort), tag)
+	}
+
+	g.gPrint("if _err != nil {", tag)
 	{
 		g.in()
-		g.gPrintErr(`"Error creating the temp file for %q : %v\n", _fn, _err`,
-			tag)
-		g.gPrint(`_f.Close()`, tag)
-		g.gPrint(`continue`, tag)
+		g.gPrint("log.Fatal(_err)", tag)
 		g.out()
 	}
 
 	g.gPrint("}", tag)
 
-	g.gPrint("{", tag)
-	{
-		g.in()
-		g.gPrint(`_fi, _err := _f.Stat()`, tag)
-		g.gPrint(`if _err != nil {`, tag)
-		{
-			g.in()
-			g.gPrintErr(
-				`"Warning: Couldn't get status for %q: %v\n", _fn, _err`,
-				tag)
-			g.out()
-		}
+	if g.httpPort == 0 && g.httpUnixSocket == "" {
+		g.gPrint("fmt.Println(_ln.Addr())", tag)
+	}
 
-		g.gPrint("} else {", tag)
+	if g.httpAddrFile != "" {
+		g.gPrint(fmt.Sprintf("if _err := _writeAddrFile(%q, _ln.Addr());"+
+			" _err != nil {", g.httpAddrFile), tag)
 		{
 			g.in()
-			g.gPrint(`_err = _w.Chmod(_fi.Mode())`, tag)
-			g.gPrint(`if _err != nil {`, tag)
-			{
-				g.in()
-				g.gPrintErr(
-					`"Warning: Couldn't set mode for %q: %v\n", _fn, _err`,
-					tag)
-				g.out()
-			}
-
-			g.gPrint("}", tag)
+			g.gPrint("log.Fatal(_err)", tag)
 			g.out()
 		}
 
 		g.gPrint("}", tag)
-		g.out()
+	}
+}
+
+// writeAddrFileFunc writes the function which writes the address that the
+// webserver is listening on to the address file. The address is written to
+// a temporary file which is then renamed so that the file appears complete.
+func (g *gosh) writeAddrFileFunc() {
+	if g.httpAddrFile == "" {
+		return
 	}
 
+	tag := webTag
+
+	g.gPrint("", tag)
+	g.gPrint("// _writeAddrFile writes the address to the named file", tag)
+	g.gPrint("func _writeAddrFile(_name string, _addr net.Addr) error {", tag)
+	g.in()
+	g.gPrint(`_tmp := _name + ".tmp"`, tag)
+	g.gPrint("_err := os.WriteFile(_tmp, []byte(_addr.String()+\"\\n\"), 0o644)",
+		tag)
+	g.writeReturnErr(tag)
+	g.gPrint("return os.Rename(_tmp, _name)", tag)
+	g.out()
 	g.gPrint("}", tag)
 }
 
-// writeInPlaceEditClose writes the code to complete the operation of the
-// in-place edit of the given files.
-func (g *gosh) writeInPlaceEditClose(tag string) {
-	if !g.inPlaceEdit {
+// writeSelfSignedCertFunc writes the function which generates the
+// self-signed certificate used by the webserver
+func (g *gosh) writeSelfSignedCertFunc() {
+	if !g.httpTLSSelfSigned {
 		return
 	}
 
-	g.gPrint(`_w.Close()`, tag)
-	g.gPrint(`if _err := os.Rename(_fn, _fn+"`+origExt+`"); _err != nil {`, tag)
+	tag := webTag
+
+	g.gPrint("", tag)
+	g.gPrint("// _selfSignedCert generates a self-signed certificate for"+
+		" localhost", tag)
+	g.gPrint("func _selfSignedCert() (tls.Certificate, error) {", tag)
+	g.in()
+	g.gPrint("_key, _err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)",
+		tag)
+	g.gPrint("if _err != nil {", tag)
 	{
 		g.in()
-		g.gPrintErr(`"Error making copy of %q : %v\n", _fn, _err`, tag)
+		g.gPrint("return tls.Certificate{}, _err", tag)
 		g.out()
 	}
 
 	g.gPrint("}", tag)
-	g.gPrint(`if _err := os.Rename(_w.Name(), _fn); _err != nil {`, tag)
+	g.gPrint("_now := time.Now()", tag)
+	g.gPrint("_tmpl := x509.Certificate{", tag)
 	{
 		g.in()
-		g.gPrintErr(`"Error recreating %q : %v\n", _fn, _err`, tag)
+		g.gPrint("SerialNumber: big.NewInt(_now.UnixNano()),", tag)
+		g.gPrint(`Subject:      pkix.Name{Organization: []string{"gosh"}},`,
+			tag)
+		g.gPrint("NotBefore:    _now.Add(-time.Hour),", tag)
+		g.gPrint("NotAfter:     _now.Add(24 * time.Hour),", tag)
+		g.gPrint("KeyUsage:     x509.KeyUsageDigitalSignature,", tag)
+		g.gPrint("ExtKeyUsage: []x509.ExtKeyUsage{"+
+			"x509.ExtKeyUsageServerAuth},", tag)
+		g.gPrint(`DNSNames:    []string{"localhost"},`, tag)
+		g.gPrint("IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1),"+
+			" net.IPv6loopback},", tag)
 		g.out()
 	}
 
 	g.gPrint("}", tag)
-}
-
-// writeWebserverInit writes the webserver boilerplate code
-// (if any) into the Go file
-func (g *gosh) writeWebserverInit() {
-	tag := webTag
-
-	g.writeScript(beforeSect)
-	g.writeScript(beforeInnerSect)
-
-	g.gPrint(fmt.Sprintf(`http.Handle(%q, %s)`,
-		g.httpPath, g.httpHandlerInstance()),
-		tag)
-
-	g.writeScript(afterInnerSect)
-	g.writeScript(afterSect)
+	g.gPrint("_der, _err := x509.CreateCertificate(rand.Reader,"+
+		" &_tmpl, &_tmpl, &_key.PublicKey, _key)", tag)
+	g.gPrint("if _err != nil {", tag)
+	{
+		g.in()
+		g.gPrint("return tls.Certificate{}, _err", tag)
+		g.out()
+	}
 
-	g.gPrint(fmt.Sprintf(`log.Fatal(http.ListenAndServe(":%d", nil))`,
-		g.httpPort),
-		tag)
+	g.gPrint("}", tag)
+	g.gPrint("return tls.Certificate{"+
+		"Certificate: [][]byte{_der}, PrivateKey: _key}, nil", tag)
+	g.out()
+	g.gPrint("}", tag)
 }
 
 // httpHandlerInstance returns either the value of the httpHandler (or, if it
@@ -341,7 +1494,9 @@ func (g *gosh) httpHandlerInstance() string {
 // writeWebserverHandler writes the webserver handler function
 // (if any) into the Go file
 func (g *gosh) writeWebserverHandler() {
-	if g.httpHandler != dfltHTTPHandlerName {
+	g.writeRouteHandlers()
+
+	if g.httpHandler != dfltHTTPHandlerName || !g.needsDefaultHandler() {
 		return
 	}
 
@@ -376,20 +1531,31 @@ func (g *gosh) writeGoFile() {
 
 	verbose.Println(intro, " Creating the Go file: ", goshFilename)
 
-	var err error
+	f, err := os.Create(goshFilename)
+	g.reportFatalError("create the Go file", goshFilename, err)
 
-	g.w, err = os.Create(goshFilename)
+	g.w = &progWriter{f: f}
+	g.srcLocs = map[int]srcLoc{}
 
 	defer g.w.Close()
 
-	g.reportFatalError("create the Go file", goshFilename, err)
-
 	g.gPrint("package main", frameTag)
 
 	g.writeImports()
 	g.writeGoshComment()
+	g.writeEmbeds()
 	g.writeScript(globalSect)
 
+	if g.benchmark {
+		g.writeBenchFuncs()
+		return
+	}
+
+	if g.hasAsserts() {
+		g.writeAssertFuncs()
+		return
+	}
+
 	g.writeMainOpen()
 
 	if g.runAsWebserver {
@@ -407,9 +1573,20 @@ func (g *gosh) writeGoFile() {
 	}
 
 	g.writeMainClose()
+	g.writeProfileFunc()
+
+	if g.runInReadLoop {
+		g.writeWalkFilesFunc()
+		g.writeDecompressFuncs()
+		g.writeBackupFunc()
+		g.writeEditFuncs()
+	}
 
 	if g.runAsWebserver {
 		g.writeWebserverHandler()
+		g.writeSelfSignedCertFunc()
+		g.writeAddrFileFunc()
+		g.writeHandlerWrapperFuncs()
 	}
 }
 
@@ -418,6 +1595,7 @@ func (g *gosh) writeMainOpen() {
 	g.gPrint("", frameTag)
 	g.gPrint("func main() {", frameTag)
 	g.in()
+	g.writeProfileStart()
 }
 
 // writeMainClose writes the closing of the main func.
@@ -440,8 +1618,5 @@ func (g *gosh) writeGoshComment() {
 		return
 	}
 
-	g.print(`//
-// All lines of code generated by gosh (apart from these) end
-// with a comment like this: '//` + goshCommentIntro + `...'.
-// User provided code has no automatic end-of-line comment.`)
+	g.print(goshCommentExplanation)
 }
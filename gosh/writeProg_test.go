@@ -0,0 +1,1143 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nickwells/testhelper.mod/v2/testhelper"
+)
+
+// buildTestProg writes the gosh program into a new temporary directory and
+// builds it (passing any build arguments to the go command). It returns the
+// pathname of the executable. The test is skipped if the go command is not
+// available.
+func buildTestProg(t *testing.T, g *gosh, buildArgs ...string) string {
+	t.Helper()
+
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is not available")
+	}
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	g.writeGoFile()
+	g.copyDiffFile()
+	g.copyEmbedFiles()
+
+	if g.errMap.HasErrors() {
+		var errs bytes.Buffer
+
+		g.errMap.Report(&errs, "gosh")
+		t.Fatal("Cannot write the program:", errs.String())
+	}
+
+	err = os.WriteFile("go.mod", []byte("module gosh\n\ngo 1.22\n"), 0o600)
+	if err != nil {
+		t.Fatal("Cannot write the go.mod file:", err)
+	}
+
+	execPath := filepath.Join(dir, g.execName)
+
+	cmd := exec.Command(goCmd,
+		append(append([]string{"build"}, buildArgs...), "-o", execPath)...)
+	cmd.Env = append(os.Environ(), "GOFLAGS=", "GOWORK=off")
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		prog, _ := os.ReadFile(goshFilename)
+		t.Log("Program:\n" + string(prog))
+		t.Fatal("Cannot build the program:", err, "\n"+string(out))
+	}
+
+	return execPath
+}
+
+// runTestProg runs the program with the given standard input and arguments
+// and returns the standard output, standard error and exit status.
+func runTestProg(
+	t *testing.T, execPath, stdin string, args ...string,
+) (string, string, int) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(execPath, args...)
+	cmd.Stdin = bytes.NewBufferString(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	exitStatus := 0
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatal("Cannot run the program:", err)
+		}
+
+		exitStatus = exitErr.ExitCode()
+	}
+
+	return stdout.String(), stderr.String(), exitStatus
+}
+
+// mkTestFile creates the named file in the directory with the given
+// contents and returns the full pathname.
+func mkTestFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+
+	fName := filepath.Join(dir, name)
+	if err := os.WriteFile(fName, []byte(contents), 0o600); err != nil {
+		t.Fatal("Cannot create the test file:", err)
+	}
+
+	return fName
+}
+
+// checkTestFile checks that the named file has the expected contents or, if
+// the expected contents are nil, that the file does not exist.
+func checkTestFile(t *testing.T, id, fName string, expContents *string) {
+	t.Helper()
+
+	contents, err := os.ReadFile(fName) //nolint:gosec
+	if expContents == nil {
+		if !os.IsNotExist(err) {
+			t.Log(id)
+			t.Errorf("\t: %q should not exist", fName)
+		}
+
+		return
+	}
+
+	if err != nil {
+		t.Log(id)
+		t.Errorf("\t: Cannot read %q: %v", fName, err)
+
+		return
+	}
+
+	testhelper.DiffString(t, id, filepath.Base(fName),
+		string(contents), *expContents)
+}
+
+func TestWriteJSONLines(t *testing.T) {
+	const (
+		input = `{"a": 1}` + "\n" +
+			"not JSON\n" +
+			`{"a": "x"}` + "\n"
+		origFile = "data.jsonl"
+		badLine  = "data.jsonl:2: Bad JSON:" +
+			" invalid character 'o' in literal null (expecting 'u')\n"
+	)
+
+	edited := "1\nx\n"
+	unchanged := input
+
+	testCases := []struct {
+		testhelper.ID
+		setGosh   func(g *gosh)
+		useStdin  bool
+		expOut    string
+		expErr    string
+		expStatus int
+		expFile   *string
+		expOrig   *string
+	}{
+		{
+			ID:       testhelper.MkID("stdin, bad lines skipped"),
+			useStdin: true,
+			setGosh: func(g *gosh) {
+				g.AddScriptEntry(execSect, `fmt.Println(_jv["a"])`, verbatim)
+			},
+			expOut: "1\nx\n",
+			expErr: "standard input:2: Bad JSON:" +
+				" invalid character 'o' in literal null (expecting 'u')\n",
+		},
+		{
+			ID:       testhelper.MkID("stdin, bad lines fatal"),
+			useStdin: true,
+			setGosh: func(g *gosh) {
+				g.jsonErrsFatal = true
+				g.AddScriptEntry(execSect, `fmt.Println(_jv["a"])`, verbatim)
+			},
+			expOut: "1\n",
+			expErr: "standard input:2: Bad JSON:" +
+				" invalid character 'o' in literal null (expecting 'u')\n",
+			expStatus: 1,
+		},
+		{
+			ID:       testhelper.MkID("stdin, user type"),
+			useStdin: true,
+			setGosh: func(g *gosh) {
+				g.jsonType = "rec"
+				g.AddScriptEntry(globalSect,
+					"type rec struct{ A any `json:\"a\"` }", verbatim)
+				g.AddScriptEntry(execSect, `fmt.Println(_jv.A)`, verbatim)
+			},
+			expOut: "1\nx\n",
+			expErr: "standard input:2: Bad JSON:" +
+				" invalid character 'o' in literal null (expecting 'u')\n",
+		},
+		{
+			ID: testhelper.MkID("in-place edit, bad lines skipped"),
+			setGosh: func(g *gosh) {
+				g.inPlaceEdit = true
+				g.AddScriptEntry(execSect,
+					`fmt.Fprintln(_w, _jv["a"])`, verbatim)
+			},
+			expErr:  badLine,
+			expFile: &edited,
+			expOrig: &unchanged,
+		},
+		{
+			ID: testhelper.MkID("in-place edit, bad lines fatal"),
+			setGosh: func(g *gosh) {
+				g.inPlaceEdit = true
+				g.jsonErrsFatal = true
+				g.AddScriptEntry(execSect,
+					`fmt.Fprintln(_w, _jv["a"])`, verbatim)
+			},
+			expErr:    badLine,
+			expStatus: 1,
+			expFile:   &unchanged,
+		},
+	}
+
+	for _, tc := range testCases {
+		dataDir := t.TempDir()
+		fName := mkTestFile(t, dataDir, origFile, input)
+
+		g := mkTestGosh(func(g *gosh) {
+			g.runInReadLoop = true
+			g.jsonLines = true
+			g.imports = []string{"fmt", "os"}
+
+			if !tc.useStdin {
+				g.filesToRead = true
+				g.args = []string{fName}
+			}
+		}, tc.setGosh)
+
+		execPath := buildTestProg(t, g)
+
+		t.Chdir(dataDir)
+
+		args := []string{origFile}
+		if tc.useStdin {
+			args = nil
+		}
+
+		stdout, stderr, status := runTestProg(t, execPath, input, args...)
+
+		testhelper.DiffString(t, tc.IDStr(), "stdout", stdout, tc.expOut)
+		testhelper.DiffString(t, tc.IDStr(), "stderr", stderr, tc.expErr)
+		testhelper.DiffInt(t, tc.IDStr(), "exit status", status, tc.expStatus)
+
+		if tc.useStdin {
+			continue
+		}
+
+		checkTestFile(t, tc.IDStr(), fName, tc.expFile)
+		checkTestFile(t, tc.IDStr(), fName+origExt, tc.expOrig)
+
+		leftovers, _ := filepath.Glob(fName + ".*.new")
+		testhelper.DiffInt(t, tc.IDStr(), "temp files left", len(leftovers), 0)
+	}
+}
+
+func TestWriteCSVRecords(t *testing.T) {
+	const origFile = "data.csv"
+
+	editedCSV := "a,b\n1,X\n2,\"Y,Z\"\n"
+
+	testCases := []struct {
+		testhelper.ID
+		setGosh func(g *gosh)
+		input   string
+		inPlace bool
+		expOut  string
+		expErr  string
+		expFile *string
+	}{
+		{
+			ID: testhelper.MkID("header"),
+			setGosh: func(g *gosh) {
+				g.csvHeader = true
+				g.AddScriptEntry(execSect,
+					`fmt.Println(_fl, _rec[_hdr["b"]])`, verbatim)
+			},
+			input:  "a,b\n1,2\n3,4\n",
+			expOut: "2 2\n3 4\n",
+		},
+		{
+			ID: testhelper.MkID("no header"),
+			setGosh: func(g *gosh) {
+				g.AddScriptEntry(execSect, `fmt.Println(_rec[1])`, verbatim)
+			},
+			input:  "a,b\n1,2\n",
+			expOut: "b\n2\n",
+		},
+		{
+			ID: testhelper.MkID("TSV"),
+			setGosh: func(g *gosh) {
+				g.csvDelimiter = "\t"
+				g.AddScriptEntry(execSect,
+					`fmt.Println(len(_rec), _rec[1])`, verbatim)
+			},
+			input:  "a\tb,c\n\"d\te\"\tf\n",
+			expOut: "2 b,c\n2 f\n",
+		},
+		{
+			ID: testhelper.MkID("comment lines"),
+			setGosh: func(g *gosh) {
+				g.csvComment = "#"
+				g.AddScriptEntry(execSect,
+					`fmt.Println(_fl, _rec[0])`, verbatim)
+			},
+			input:  "# a comment\n1,2\n#another\n3,4\n",
+			expOut: "2 1\n4 3\n",
+		},
+		{
+			ID: testhelper.MkID("malformed record skipped"),
+			setGosh: func(g *gosh) {
+				g.AddScriptEntry(execSect, `fmt.Println(_rec[0])`, verbatim)
+			},
+			input:  "1,2\n3,\"x\"y\n5,6\n",
+			expOut: "1\n5\n",
+			expErr: `Error reading "standard input" :` +
+				` parse error on line 2, column 5:` +
+				` extraneous or missing " in quoted-field` + "\n",
+		},
+		{
+			ID: testhelper.MkID("in-place edit"),
+			setGosh: func(g *gosh) {
+				g.csvHeader = true
+				g.imports = append(g.imports, "strings")
+				g.AddScriptEntry(execSect,
+					`_rec[_hdr["b"]] = strings.ToUpper(_rec[_hdr["b"]])`,
+					verbatim)
+				g.AddScriptEntry(execSect, `_cw.Write(_rec)`, verbatim)
+			},
+			input:   "a,b\n1,x\n2,\"y,z\"\n",
+			inPlace: true,
+			expFile: &editedCSV,
+		},
+	}
+
+	for _, tc := range testCases {
+		dataDir := t.TempDir()
+		fName := mkTestFile(t, dataDir, origFile, tc.input)
+
+		g := mkTestGosh(func(g *gosh) {
+			g.runInReadLoop = true
+			g.csvRecords = true
+			g.imports = []string{"fmt", "os"}
+
+			if tc.inPlace {
+				g.filesToRead = true
+				g.inPlaceEdit = true
+				g.args = []string{fName}
+			}
+		}, tc.setGosh)
+
+		execPath := buildTestProg(t, g)
+
+		t.Chdir(dataDir)
+
+		var args []string
+		if tc.inPlace {
+			args = []string{origFile}
+		}
+
+		stdout, stderr, status := runTestProg(t, execPath, tc.input, args...)
+
+		testhelper.DiffString(t, tc.IDStr(), "stdout", stdout, tc.expOut)
+		testhelper.DiffString(t, tc.IDStr(), "stderr", stderr, tc.expErr)
+		testhelper.DiffInt(t, tc.IDStr(), "exit status", status, 0)
+
+		if !tc.inPlace {
+			continue
+		}
+
+		checkTestFile(t, tc.IDStr(), fName, tc.expFile)
+		checkTestFile(t, tc.IDStr(), fName+origExt, &tc.input)
+	}
+}
+
+func TestWriteParallelFiles(t *testing.T) {
+	files := []struct {
+		name    string
+		content string
+	}{
+		{name: "f0", content: "a\nb\n"},
+		{name: "f1", content: "c\n"},
+		{name: "f2", content: "d\ne\nf\n"},
+		{name: "f3", content: ""},
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		setGosh func(g *gosh)
+		expOut  string
+		edited  bool
+	}{
+		{
+			ID: testhelper.MkID("read files"),
+			setGosh: func(g *gosh) {
+				g.AddScriptEntry(beforeSect, `fmt.Println("start", _fn)`,
+					verbatim)
+				g.AddScriptEntry(beforeInnerSect, `fmt.Fprintln(_o, _fn)`,
+					verbatim)
+				g.AddScriptEntry(execSect,
+					`fmt.Fprintf(_o, "%d: %s\n", _fl, _l.Text())`, verbatim)
+				g.AddScriptEntry(afterInnerSect, `fmt.Fprint(_o, "---\n")`,
+					verbatim)
+				g.AddScriptEntry(afterSect, `fmt.Println("end", _fl)`,
+					verbatim)
+			},
+			expOut: "start standard input\n" +
+				"f0\n1: a\n2: b\n---\n" +
+				"f1\n1: c\n---\n" +
+				"f2\n1: d\n2: e\n3: f\n---\n" +
+				"f3\n---\n" +
+				"end 0\n",
+		},
+		{
+			ID: testhelper.MkID("in-place edit"),
+			setGosh: func(g *gosh) {
+				g.inPlaceEdit = true
+				g.imports = append(g.imports, "strings")
+				g.AddScriptEntry(execSect,
+					`fmt.Fprintln(_w, strings.ToUpper(_l.Text()))`, verbatim)
+				g.AddScriptEntry(afterInnerSect, `fmt.Fprintln(_o, _fn, _fl)`,
+					verbatim)
+			},
+			expOut: "f0 2\nf1 1\nf2 3\nf3 0\n",
+			edited: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		dataDir := t.TempDir()
+		args := []string{}
+
+		for _, f := range files {
+			mkTestFile(t, dataDir, f.name, f.content)
+			args = append(args, f.name)
+		}
+
+		g := mkTestGosh(func(g *gosh) {
+			g.runInReadLoop = true
+			g.filesToRead = true
+			g.parallelFiles = 2
+			g.args = args
+			g.imports = []string{"fmt", "os"}
+		}, tc.setGosh)
+
+		execPath := buildTestProg(t, g, "-race")
+
+		t.Chdir(dataDir)
+
+		stdout, stderr, status := runTestProg(t, execPath, "", args...)
+
+		testhelper.DiffString(t, tc.IDStr(), "stdout", stdout, tc.expOut)
+		testhelper.DiffString(t, tc.IDStr(), "stderr", stderr, "")
+		testhelper.DiffInt(t, tc.IDStr(), "exit status", status, 0)
+
+		if !tc.edited {
+			continue
+		}
+
+		for _, f := range files {
+			fName := filepath.Join(dataDir, f.name)
+			upper := strings.ToUpper(f.content)
+
+			checkTestFile(t, tc.IDStr(), fName, &upper)
+
+			if upper == f.content { // unchanged files are not copied
+				checkTestFile(t, tc.IDStr(), fName+origExt, nil)
+				continue
+			}
+
+			checkTestFile(t, tc.IDStr(), fName+origExt, &f.content)
+		}
+	}
+}
+
+// gzipString returns the gzip-compressed form of the string.
+func gzipString(t *testing.T, s string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal("Cannot compress the string:", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal("Cannot compress the string:", err)
+	}
+
+	return buf.String()
+}
+
+// gunzipFile returns the decompressed contents of the named file.
+func gunzipFile(t *testing.T, fName string) string {
+	t.Helper()
+
+	f, err := os.Open(fName) //nolint:gosec
+	if err != nil {
+		t.Fatal("Cannot open the compressed file:", err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal("Cannot read the compressed file:", err)
+	}
+
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal("Cannot read the compressed file:", err)
+	}
+
+	return string(content)
+}
+
+func TestWriteDecompress(t *testing.T) {
+	bz2Content, err := os.ReadFile(testBzip2File)
+	if err != nil {
+		t.Fatal("Cannot read the bzip2 test file:", err)
+	}
+
+	testCases := []struct {
+		testhelper.ID
+		inPlaceEdit bool
+		expOut      string
+	}{
+		{
+			ID: testhelper.MkID("read compressed files"),
+			expOut: "plain.txt: plain\n" +
+				"a.gz: gzip by name\n" +
+				"gzipped: gzip by content\n" +
+				"b.bz2: hello\n" +
+				"b.bz2: world\n",
+		},
+		{
+			ID:          testhelper.MkID("edit compressed files"),
+			inPlaceEdit: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		dataDir := t.TempDir()
+
+		mkTestFile(t, dataDir, "plain.txt", "plain\n")
+		mkTestFile(t, dataDir, "a.gz", gzipString(t, "gzip by name\n"))
+		mkTestFile(t, dataDir, "gzipped", gzipString(t, "gzip by content\n"))
+
+		args := []string{"plain.txt", "a.gz", "gzipped"}
+
+		if !tc.inPlaceEdit {
+			mkTestFile(t, dataDir, "b.bz2", string(bz2Content))
+			args = append(args, "b.bz2")
+		}
+
+		g := mkTestGosh(func(g *gosh) {
+			g.runInReadLoop = true
+			g.filesToRead = true
+			g.decompress = true
+			g.inPlaceEdit = tc.inPlaceEdit
+			g.args = args
+			g.imports = []string{"fmt", "os"}
+
+			if tc.inPlaceEdit {
+				g.imports = append(g.imports, "strings")
+				g.AddScriptEntry(execSect,
+					`fmt.Fprintln(_w, strings.ToUpper(_l.Text()))`, verbatim)
+			} else {
+				g.AddScriptEntry(execSect,
+					`fmt.Printf("%s: %s\n", _fn, _l.Text())`, verbatim)
+			}
+		})
+
+		execPath := buildTestProg(t, g)
+
+		t.Chdir(dataDir)
+
+		stdout, stderr, status := runTestProg(t, execPath, "", args...)
+
+		testhelper.DiffString(t, tc.IDStr(), "stdout", stdout, tc.expOut)
+		testhelper.DiffString(t, tc.IDStr(), "stderr", stderr, "")
+		testhelper.DiffInt(t, tc.IDStr(), "exit status", status, 0)
+
+		if !tc.inPlaceEdit {
+			continue
+		}
+
+		plain := "PLAIN\n"
+		checkTestFile(t, tc.IDStr(), filepath.Join(dataDir, "plain.txt"),
+			&plain)
+
+		testhelper.DiffString(t, tc.IDStr(), "a.gz",
+			gunzipFile(t, filepath.Join(dataDir, "a.gz")), "GZIP BY NAME\n")
+		testhelper.DiffString(t, tc.IDStr(), "a.gz"+origExt,
+			gunzipFile(t, filepath.Join(dataDir, "a.gz"+origExt)),
+			"gzip by name\n")
+		testhelper.DiffString(t, tc.IDStr(), "gzipped",
+			gunzipFile(t, filepath.Join(dataDir, "gzipped")),
+			"GZIP BY CONTENT\n")
+	}
+}
+
+func TestWriteWalkDirs(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		inPlaceEdit bool
+	}{
+		{ID: testhelper.MkID("read walked files")},
+		{ID: testhelper.MkID("edit walked files"), inPlaceEdit: true},
+	}
+
+	for _, tc := range testCases {
+		dataDir := mkTestTree(t, t.TempDir(), testTreeFiles...)
+
+		args := []string{"sub", "a.txt"}
+
+		g := mkTestGosh(func(g *gosh) {
+			g.runInReadLoop = true
+			g.filesToRead = true
+			g.walkDirs = true
+			g.walkSkipHidden = true
+			g.walkInclude = []string{"*.go"}
+			g.walkExclude = []string{"*_test.go", "vendor"}
+			g.inPlaceEdit = tc.inPlaceEdit
+			g.args = args
+			g.imports = []string{"fmt", "os"}
+
+			if tc.inPlaceEdit {
+				g.imports = append(g.imports, "strings")
+				g.AddScriptEntry(execSect,
+					`fmt.Fprintln(_w, strings.ToUpper(_l.Text()))`, verbatim)
+			} else {
+				g.AddScriptEntry(execSect,
+					`fmt.Printf("%s: %s\n", _fn, _l.Text())`, verbatim)
+			}
+		})
+
+		execPath := buildTestProg(t, g)
+
+		t.Chdir(dataDir)
+
+		stdout, stderr, status := runTestProg(t, execPath, "", args...)
+
+		testhelper.DiffString(t, tc.IDStr(), "stderr", stderr, "")
+		testhelper.DiffInt(t, tc.IDStr(), "exit status", status, 0)
+
+		if !tc.inPlaceEdit {
+			testhelper.DiffString(t, tc.IDStr(), "stdout", stdout,
+				"sub/b.go: sub/b.go\n"+
+					"a.txt: a.txt\n")
+
+			continue
+		}
+
+		testhelper.DiffString(t, tc.IDStr(), "stdout", stdout, "")
+
+		for fName, expContent := range map[string]string{
+			"sub/b.go":                "SUB/B.GO\n",
+			"sub/b.go" + origExt:      "sub/b.go\n",
+			"a.txt":                   "A.TXT\n",
+			"a.txt" + origExt:         "a.txt\n",
+			"sub/b_test.go":           "sub/b_test.go\n",
+			"sub/vendor/v.go":         "sub/vendor/v.go\n",
+			"sub/b_test.go" + origExt: "",
+		} {
+			fullName := filepath.Join(dataDir, fName)
+
+			if expContent == "" {
+				checkTestFile(t, tc.IDStr(), fullName, nil)
+				continue
+			}
+
+			checkTestFile(t, tc.IDStr(), fullName, &expContent)
+		}
+	}
+}
+
+func TestWriteWalkDirsSkipsBackups(t *testing.T) {
+	dataDir := mkTestTree(t, t.TempDir(),
+		"a.txt", "a.txt.orig.1", "a.txt.12345.new")
+
+	g := mkTestGosh(func(g *gosh) {
+		g.runInReadLoop = true
+		g.filesToRead = true
+		g.walkDirs = true
+		g.inPlaceEdit = true
+		g.backupMode = backupModeNumbered
+		g.args = []string{"."}
+		g.imports = []string{"fmt", "os", "strings"}
+		g.AddScriptEntry(execSect,
+			`fmt.Fprintln(_w, strings.ToUpper(_l.Text()))`, verbatim)
+	})
+
+	execPath := buildTestProg(t, g)
+
+	t.Chdir(dataDir)
+
+	stdout, stderr, status := runTestProg(t, execPath, "", ".")
+
+	id := "walk skips backups"
+	testhelper.DiffString(t, id, "stdout", stdout, "")
+	testhelper.DiffString(t, id, "stderr", stderr, "")
+	testhelper.DiffInt(t, id, "exit status", status, 0)
+
+	for fName, expContent := range map[string]string{
+		"a.txt":           "A.TXT\n",
+		"a.txt.orig.1":    "a.txt.orig.1\n",
+		"a.txt.orig.2":    "a.txt\n",
+		"a.txt.12345.new": "a.txt.12345.new\n",
+	} {
+		checkTestFile(t, id, filepath.Join(dataDir, fName), &expContent)
+	}
+}
+
+func TestWriteBackupModes(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		mode     string
+		suffix   string
+		expFiles func(dataDir, bakDir string) []string
+	}{
+		{
+			ID:     testhelper.MkID("suffix"),
+			mode:   backupModeSuffix,
+			suffix: ".bak",
+			expFiles: func(dataDir, _ string) []string {
+				return []string{filepath.Join(dataDir, "f.bak")}
+			},
+		},
+		{
+			ID:     testhelper.MkID("numbered"),
+			mode:   backupModeNumbered,
+			suffix: origExt,
+			expFiles: func(dataDir, _ string) []string {
+				return []string{
+					filepath.Join(dataDir, "f"+origExt+".1"),
+					filepath.Join(dataDir, "f"+origExt+".2"),
+				}
+			},
+		},
+		{
+			ID:     testhelper.MkID("dir"),
+			mode:   backupModeDir,
+			suffix: origExt,
+			expFiles: func(dataDir, bakDir string) []string {
+				return []string{
+					filepath.Join(bakDir, dataDir, "f"),
+				}
+			},
+		},
+		{
+			ID:     testhelper.MkID("none"),
+			mode:   backupModeNone,
+			suffix: origExt,
+			expFiles: func(_, _ string) []string {
+				return []string{}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		dataDir := t.TempDir()
+		bakDir := filepath.Join(t.TempDir(), "bak")
+
+		mkTestFile(t, dataDir, "f", "a\n")
+
+		g := mkTestGosh(func(g *gosh) {
+			g.runInReadLoop = true
+			g.filesToRead = true
+			g.inPlaceEdit = true
+			g.backupMode = tc.mode
+			g.backupSuffix = tc.suffix
+			g.backupDir = bakDir
+			g.args = []string{"f"}
+			g.imports = []string{"fmt", "os"}
+			g.AddScriptEntry(execSect,
+				`fmt.Fprintln(_w, _l.Text()+"a")`, verbatim)
+		})
+
+		execPath := buildTestProg(t, g)
+
+		t.Chdir(dataDir)
+
+		runs := 1
+		if tc.mode == backupModeNumbered {
+			runs = 2
+		}
+
+		expContent := "a\n"
+
+		for range runs {
+			_, stderr, status := runTestProg(t, execPath, "", "f")
+
+			testhelper.DiffString(t, tc.IDStr(), "stderr", stderr, "")
+			testhelper.DiffInt(t, tc.IDStr(), "exit status", status, 0)
+
+			expContent = strings.TrimSuffix(expContent, "\n") + "a\n"
+		}
+
+		checkTestFile(t, tc.IDStr(), filepath.Join(dataDir, "f"), &expContent)
+
+		expBackups := tc.expFiles(dataDir, bakDir)
+		for i, fName := range expBackups {
+			backupContent := strings.Repeat("a", i+1) + "\n"
+			checkTestFile(t, tc.IDStr(), fName, &backupContent)
+		}
+
+		if tc.mode == backupModeNone {
+			checkTestFile(t, tc.IDStr(),
+				filepath.Join(dataDir, "f"+origExt), nil)
+		}
+	}
+}
+
+func TestWriteBackupFails(t *testing.T) {
+	dataDir := t.TempDir()
+	fName := mkTestFile(t, dataDir, "f", "a\n")
+
+	// the backup directory cannot be created as a file is in the way
+	notADir := mkTestFile(t, t.TempDir(), "notADir", "")
+
+	g := mkTestGosh(func(g *gosh) {
+		g.runInReadLoop = true
+		g.filesToRead = true
+		g.inPlaceEdit = true
+		g.backupMode = backupModeDir
+		g.backupDir = filepath.Join(notADir, "bak")
+		g.args = []string{"f"}
+		g.imports = []string{"fmt", "os"}
+		g.AddScriptEntry(execSect,
+			`fmt.Fprintln(_w, _l.Text()+"a")`, verbatim)
+	})
+
+	execPath := buildTestProg(t, g)
+
+	t.Chdir(dataDir)
+
+	_, stderr, status := runTestProg(t, execPath, "", "f")
+
+	id := "backup fails"
+	if !strings.HasPrefix(stderr, `Error making copy of "f" : `) {
+		t.Log(id)
+		t.Errorf("\t: unexpected stderr: %q", stderr)
+	}
+
+	testhelper.DiffInt(t, id, "exit status", status, 0)
+
+	unchanged := "a\n"
+	checkTestFile(t, id, fName, &unchanged)
+
+	leftovers, _ := filepath.Glob(fName + ".*.new")
+	testhelper.DiffInt(t, id, "temp files left", len(leftovers), 0)
+}
+
+func TestWriteDryRun(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		parallel bool
+	}{
+		{ID: testhelper.MkID("sequential")},
+		{ID: testhelper.MkID("parallel"), parallel: true},
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{name: "f0", content: "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"},
+		{name: "f1", content: "x\ny\n"},
+		{name: "f2", content: "a\nb"},
+	}
+
+	expOut := "--- f0\n+++ f0\n" +
+		"@@ -1,4 +1,4 @@\n" +
+		"-a\n+A\n b\n c\n d\n" +
+		"@@ -9,4 +9,3 @@\n" +
+		" i\n j\n k\n-l\n" +
+		"--- f2\n+++ f2\n" +
+		"@@ -1,2 +1,2 @@\n" +
+		"-a\n+A\n b\n\\ No newline at end of file\n"
+
+	for _, tc := range testCases {
+		dataDir := t.TempDir()
+		args := []string{}
+
+		for _, f := range files {
+			mkTestFile(t, dataDir, f.name, f.content)
+			args = append(args, f.name)
+		}
+
+		g := mkTestGosh(func(g *gosh) {
+			g.runInReadLoop = true
+			g.filesToRead = true
+			g.inPlaceEdit = true
+			g.ipeDryRun = true
+			g.args = args
+			g.imports = []string{"fmt", "os", "strings"}
+			g.AddScriptEntry(execSect, `_t := _l.Text()`, verbatim)
+			g.AddScriptEntry(execSect, `if _t == "l" { continue }`, verbatim)
+			g.AddScriptEntry(execSect, `if _t == "a" { _t = "A" }`, verbatim)
+			g.AddScriptEntry(execSect,
+				`if strings.HasPrefix(_fn, "f2") && _t == "b" {`+
+					` fmt.Fprint(_w, _t); continue }`,
+				verbatim)
+			g.AddScriptEntry(execSect, `fmt.Fprintln(_w, _t)`, verbatim)
+
+			if tc.parallel {
+				g.parallelFiles = 2
+			}
+		})
+
+		execPath := buildTestProg(t, g)
+
+		t.Chdir(dataDir)
+
+		stdout, stderr, status := runTestProg(t, execPath, "", args...)
+
+		testhelper.DiffString(t, tc.IDStr(), "stdout", stdout, expOut)
+		testhelper.DiffString(t, tc.IDStr(), "stderr", stderr,
+			"2 files changed, 1 unchanged\n")
+		testhelper.DiffInt(t, tc.IDStr(), "exit status", status, 0)
+
+		for _, f := range files {
+			fName := filepath.Join(dataDir, f.name)
+
+			checkTestFile(t, tc.IDStr(), fName, &f.content)
+			checkTestFile(t, tc.IDStr(), fName+origExt, nil)
+		}
+
+		entries, err := os.ReadDir(dataDir)
+		if err != nil {
+			t.Fatal("Cannot read the test directory:", err)
+		}
+
+		testhelper.DiffInt(t, tc.IDStr(), "files left", len(entries),
+			len(files))
+	}
+}
+
+// freeTestPort returns a TCP port number which is not currently in use.
+func freeTestPort(t *testing.T) int64 {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot find a free port:", err)
+	}
+	defer l.Close()
+
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		t.Fatal("Unexpected address type:", l.Addr())
+	}
+
+	return int64(addr.Port)
+}
+
+func TestWriteWebserverShutdown(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		selfSigned bool
+	}{
+		{ID: testhelper.MkID("http")},
+		{ID: testhelper.MkID("https, self-signed"), selfSigned: true},
+	}
+
+	for _, tc := range testCases {
+		port := freeTestPort(t)
+
+		g := mkTestGosh(func(g *gosh) {
+			g.runAsWebserver = true
+			g.httpPort = port
+			g.httpTLSSelfSigned = tc.selfSigned
+			g.httpReadTimeout = 5 * time.Second
+			g.httpShutdownGrace = 1500 * time.Millisecond
+			g.imports = []string{"fmt"}
+			g.AddScriptEntry(execSect, `fmt.Fprintln(_rw, "hello")`, verbatim)
+			g.AddScriptEntry(afterShutdownSect,
+				`fmt.Println("shut down")`, verbatim)
+		})
+
+		execPath := buildTestProg(t, g)
+
+		var stdout, stderr bytes.Buffer
+
+		cmd := exec.Command(execPath)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		if err := cmd.Start(); err != nil {
+			t.Fatal("Cannot start the webserver:", err)
+		}
+
+		scheme := "http"
+		if tc.selfSigned {
+			scheme = "https"
+		}
+
+		client := &http.Client{
+			Timeout: time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true, //nolint:gosec
+				},
+			},
+		}
+		url := fmt.Sprintf("%s://localhost:%d/", scheme, port)
+
+		var body string
+
+		for range 100 {
+			resp, err := client.Get(url)
+			if err == nil {
+				b, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				body = string(b)
+
+				break
+			}
+
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		testhelper.DiffString(t, tc.IDStr(), "response", body, "hello\n")
+
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			t.Fatal("Cannot interrupt the webserver:", err)
+		}
+
+		if err := cmd.Wait(); err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: the webserver failed: %v\n%s", err, stderr.String())
+		}
+
+		testhelper.DiffString(t, tc.IDStr(), "stdout", stdout.String(),
+			"shut down\n")
+	}
+}
+
+func TestWriteWebserverListen(t *testing.T) {
+	testCases := []struct {
+		testhelper.ID
+		unixSocket bool
+	}{
+		{ID: testhelper.MkID("tcp, system chosen port")},
+		{ID: testhelper.MkID("unix socket"), unixSocket: true},
+	}
+
+	for _, tc := range testCases {
+		dir := t.TempDir()
+		addrFile := filepath.Join(dir, "addr")
+		sockName := filepath.Join(dir, "gosh.sock")
+
+		g := mkTestGosh(func(g *gosh) {
+			g.runAsWebserver = true
+			g.httpPort = 0
+			g.httpAddrFile = addrFile
+			g.imports = []string{"fmt"}
+			g.AddScriptEntry(execSect, `fmt.Fprintln(_rw, "hello")`, verbatim)
+
+			if tc.unixSocket {
+				g.httpUnixSocket = sockName
+			}
+		})
+
+		execPath := buildTestProg(t, g)
+
+		var stdout, stderr bytes.Buffer
+
+		cmd := exec.Command(execPath)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		if err := cmd.Start(); err != nil {
+			t.Fatal("Cannot start the webserver:", err)
+		}
+
+		var addr []byte
+
+		for range 100 {
+			var err error
+			if addr, err = os.ReadFile(addrFile); err == nil {
+				break
+			}
+
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		client := &http.Client{Timeout: time.Second}
+		url := "http://" + strings.TrimSpace(string(addr)) + "/"
+
+		if tc.unixSocket {
+			client.Transport = &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string,
+				) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", sockName)
+				},
+			}
+			url = "http://gosh/"
+
+			testhelper.DiffString(t, tc.IDStr(), "address",
+				string(addr), sockName+"\n")
+		}
+
+		var body string
+
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: the request failed: %v", err)
+		} else {
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			body = string(b)
+		}
+
+		testhelper.DiffString(t, tc.IDStr(), "response", body, "hello\n")
+
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			t.Fatal("Cannot interrupt the webserver:", err)
+		}
+
+		if err := cmd.Wait(); err != nil {
+			t.Log(tc.IDStr())
+			t.Errorf("\t: the webserver failed: %v\n%s", err, stderr.String())
+		}
+
+		expStdout := string(addr)
+		if tc.unixSocket {
+			expStdout = ""
+		}
+
+		testhelper.DiffString(t, tc.IDStr(), "stdout", stdout.String(),
+			expStdout)
+	}
+}